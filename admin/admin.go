@@ -0,0 +1,282 @@
+package admin
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alphagov/paas-compose-broker/audit"
+	"github.com/alphagov/paas-compose-broker/broker"
+	"github.com/alphagov/paas-compose-broker/catalog"
+	"github.com/alphagov/paas-compose-broker/compose"
+	"github.com/alphagov/paas-compose-broker/config"
+	composeapi "github.com/compose/gocomposeapi"
+)
+
+// Admin implements the operator commands for deployments owned by this
+// broker. Deployments are identified by the CF service instance GUID, using
+// the same naming convention as the broker itself.
+type Admin struct {
+	Compose   compose.Client
+	Config    *config.Config
+	Catalog   *catalog.Catalog
+	In        io.Reader
+	Out       io.Writer
+	JSON      bool
+	AssumeYes bool
+
+	// Prompts are written to Err, so that they do not mix with JSON on Out.
+	// Without Err there are no prompts, and nothing is confirmed.
+	Err io.Writer
+
+	// CCInstances lists the service instances Cloud Controller knows about.
+	CCInstances  func() ([]CCInstance, error)
+	PurgeOrphans bool
+
+	// BillingFrom and BillingTo are the dates given for the billing command.
+	BillingFrom string
+	BillingTo   string
+
+	in *bufio.Reader
+}
+
+type Instance struct {
+	InstanceID   string    `json:"instance_id"`
+	DeploymentID string    `json:"deployment_id"`
+	Name         string    `json:"name"`
+	Type         string    `json:"type"`
+	SpaceID      string    `json:"space_id"`
+	ClusterID    string    `json:"cluster_id,omitempty"`
+	PlanID       string    `json:"plan_id,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type InstanceDetails struct {
+	Instance
+	Service   string   `json:"service,omitempty"`
+	Plan      string   `json:"plan,omitempty"`
+	Units     int      `json:"units"`
+	Usage     Usage    `json:"usage"`
+	Version   string   `json:"version"`
+	WebUI     string   `json:"web_ui"`
+	Whitelist []string `json:"whitelist"`
+	Backups   []Backup `json:"backups"`
+	Alerts    []Alert  `json:"alerts"`
+}
+
+// Usage is how much of its allocation a deployment uses, as Compose scales
+// it.
+type Usage struct {
+	UnitType    string `json:"unit_type"`
+	UsedUnits   int    `json:"used_units"`
+	AllocatedMB int    `json:"allocated_mb"`
+	UsedMB      int    `json:"used_mb"`
+}
+
+type Alert struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+type Backup struct {
+	ID           string    `json:"id"`
+	Type         string    `json:"type"`
+	Status       string    `json:"status"`
+	IsRestorable bool      `json:"is_restorable"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func newInstance(instanceID string, deployment composeapi.Deployment) Instance {
+	return Instance{
+		InstanceID:   instanceID,
+		DeploymentID: deployment.ID,
+		Name:         deployment.Name,
+		Type:         deployment.Type,
+		SpaceID:      deployment.CustomerBillingCode,
+		ClusterID:    deployment.ClusterID,
+		PlanID:       broker.PlanIDFromNotes(deployment.Notes),
+		CreatedAt:    deployment.CreatedAt,
+	}
+}
+
+// Instances lists every deployment named with the broker's DB_PREFIX.
+func (a *Admin) Instances() ([]Instance, error) {
+	deployments, errs := a.Compose.GetDeployments()
+	if len(errs) > 0 {
+		return nil, compose.SquashErrors(errs)
+	}
+
+	instances := []Instance{}
+	for _, deployment := range *deployments {
+		instanceID, ok := broker.InstanceIDFromName(a.Config.DBPrefix, deployment.Name)
+		if !ok {
+			continue
+		}
+		instances = append(instances, newInstance(instanceID, deployment))
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].InstanceID < instances[j].InstanceID
+	})
+
+	return instances, nil
+}
+
+func (a *Admin) findDeployment(instanceID string) (*composeapi.Deployment, error) {
+	name, err := broker.MakeInstanceName(a.Config.DBPrefix, instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	deployment, err := broker.FindDeployment(a.Compose, name)
+	if err == broker.ErrDeploymentNotFound {
+		return nil, fmt.Errorf("no deployment found for instance %s", instanceID)
+	}
+	return deployment, err
+}
+
+func (a *Admin) Inspect(instanceID string) (*InstanceDetails, error) {
+	deployment, err := a.findDeployment(instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	scalings, errs := a.Compose.GetScalings(deployment.ID)
+	if len(errs) > 0 {
+		return nil, compose.SquashErrors(errs)
+	}
+
+	whitelist, errs := a.Compose.GetWhitelistForDeployment(deployment.ID)
+	if len(errs) > 0 {
+		return nil, compose.SquashErrors(errs)
+	}
+
+	backups, errs := a.Compose.GetBackupsForDeployment(deployment.ID)
+	if len(errs) > 0 {
+		return nil, compose.SquashErrors(errs)
+	}
+
+	alerts, errs := a.Compose.GetAlertsForDeployment(deployment.ID)
+	if len(errs) > 0 {
+		return nil, compose.SquashErrors(errs)
+	}
+
+	details := &InstanceDetails{
+		Instance:  newInstance(instanceID, *deployment),
+		Units:     scalings.AllocatedUnits,
+		Version:   deployment.Version,
+		WebUI:     deployment.Links.ComposeWebUILink.HREF,
+		Whitelist: []string{},
+		Backups:   []Backup{},
+		Alerts:    []Alert{},
+	}
+	details.Usage = Usage{
+		UnitType:    scalings.UnitType,
+		UsedUnits:   scalings.UsedUnits,
+		AllocatedMB: scalings.AllocatedUnits * scalings.UnitSizeInMB,
+		UsedMB:      scalings.UsedUnits * scalings.UnitSizeInMB,
+	}
+
+	service, plan, err := a.findPlan(newInstance(instanceID, *deployment), scalings.AllocatedUnits)
+	if err == nil {
+		details.Service = service.Name
+		details.Plan = plan.Name
+	}
+
+	for _, entry := range whitelist {
+		details.Whitelist = append(details.Whitelist, entry.IP)
+	}
+
+	for _, backup := range *backups {
+		details.Backups = append(details.Backups, Backup{
+			ID:           backup.ID,
+			Type:         backup.Type,
+			Status:       backup.Status,
+			IsRestorable: backup.IsRestorable,
+			CreatedAt:    backup.CreatedAt,
+		})
+	}
+	sort.Slice(details.Backups, func(i, j int) bool {
+		return details.Backups[i].CreatedAt.After(details.Backups[j].CreatedAt)
+	})
+
+	if alerts != nil {
+		for _, alert := range alerts.Embedded.Alerts {
+			details.Alerts = append(details.Alerts, Alert{Status: alert.Status, Message: alert.Message})
+		}
+	}
+
+	return details, nil
+}
+
+// Backup starts an on-demand backup and returns the Compose recipe tracking it.
+func (a *Admin) Backup(instanceID string) (*composeapi.Recipe, error) {
+	deployment, err := a.findDeployment(instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	recipe, errs := a.Compose.StartBackupForDeployment(deployment.ID)
+	if len(errs) > 0 {
+		return nil, compose.SquashErrors(errs)
+	}
+
+	return recipe, nil
+}
+
+// Deprovision deletes the deployment behind an instance. Cloud Controller is
+// not told about this, so it should only be used for instances CC has already
+// forgotten or which an operator is about to purge.
+func (a *Admin) Deprovision(instanceID string) (*composeapi.Recipe, error) {
+	deployment, err := a.findDeployment(instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !a.confirm(fmt.Sprintf("Really deprovision deployment %s (%s)?", deployment.Name, deployment.ID)) {
+		return nil, errAborted
+	}
+
+	recipe, errs := a.Compose.DeprovisionDeployment(deployment.ID)
+	if len(errs) > 0 {
+		return nil, compose.SquashErrors(errs)
+	}
+
+	return recipe, nil
+}
+
+// VerifyAuditLog checks the hash chain of an audit log file against the
+// configured key, and returns its last event.
+func (a *Admin) VerifyAuditLog(path string) (*audit.Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return audit.Verify(f, []byte(a.Config.AuditLogKey))
+}
+
+func (a *Admin) confirm(prompt string) bool {
+	if a.AssumeYes {
+		return true
+	}
+	if a.In == nil || a.Err == nil {
+		return false
+	}
+
+	if a.in == nil {
+		a.in = bufio.NewReader(a.In)
+	}
+
+	fmt.Fprintf(a.Err, "%s [y/N] ", prompt)
+	answer, err := a.in.ReadString('\n')
+	if err != nil && answer == "" {
+		return false
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,181 @@
+package admin_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+
+	composeapi "github.com/compose/gocomposeapi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/paas-compose-broker/admin"
+	"github.com/alphagov/paas-compose-broker/catalog"
+	"github.com/alphagov/paas-compose-broker/compose"
+	"github.com/alphagov/paas-compose-broker/compose/fakes"
+	"github.com/alphagov/paas-compose-broker/config"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+var _ = Describe("Admin", func() {
+
+	var (
+		fakeComposeClient *fakes.FakeClient
+		out               *bytes.Buffer
+		a                 *admin.Admin
+		createdAt         = time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	)
+
+	BeforeEach(func() {
+		fakeComposeClient = &fakes.FakeClient{}
+		fakeComposeClient.GetDeploymentsReturns(&[]composeapi.Deployment{
+			{ID: "d2", Name: "test-00000000-0000-0000-0000-000000000002", Type: "mongodb", CustomerBillingCode: "space-2", CreatedAt: createdAt},
+			{ID: "d0", Name: "someone-elses-deployment", Type: "mongodb"},
+			{ID: "d1", Name: "test-00000000-0000-0000-0000-000000000001", Type: "mongodb", CustomerBillingCode: "space-1", CreatedAt: createdAt},
+		}, []error{})
+		fakeComposeClient.GetDeploymentByNameReturns(&composeapi.Deployment{
+			ID: "d1", Name: "test-00000000-0000-0000-0000-000000000001", Type: "mongodb", CustomerBillingCode: "space-1", CreatedAt: createdAt,
+		}, []error{})
+
+		out = &bytes.Buffer{}
+		a = &admin.Admin{
+			Compose: fakeComposeClient,
+			Config:  &config.Config{DBPrefix: "test"},
+			Catalog: &catalog.Catalog{
+				Services: []*catalog.Service{{
+					Service: brokerapi.Service{Name: "mongodb"},
+					Plans: []*catalog.Plan{{
+						ServicePlan: brokerapi.ServicePlan{Name: "small"},
+						Compose:     catalog.ComposeConfig{Units: 1, DatabaseType: "mongodb"},
+					}},
+				}},
+			},
+			Out: out,
+		}
+	})
+
+	Describe("listing instances", func() {
+		It("only lists deployments with the broker's prefix, by instance GUID", func() {
+			instances, err := a.Instances()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(instances).To(HaveLen(2))
+			Expect(instances[0].InstanceID).To(Equal("00000000-0000-0000-0000-000000000001"))
+			Expect(instances[0].DeploymentID).To(Equal("d1"))
+			Expect(instances[0].SpaceID).To(Equal("space-1"))
+			Expect(instances[1].InstanceID).To(Equal("00000000-0000-0000-0000-000000000002"))
+		})
+
+		It("prints JSON", func() {
+			a.JSON = true
+			Expect(a.Run("list", nil)).To(Succeed())
+			Expect(out.String()).To(MatchJSON(`[
+				{"instance_id": "00000000-0000-0000-0000-000000000001", "deployment_id": "d1", "name": "test-00000000-0000-0000-0000-000000000001", "type": "mongodb", "space_id": "space-1", "created_at": "2017-10-01T12:00:00Z"},
+				{"instance_id": "00000000-0000-0000-0000-000000000002", "deployment_id": "d2", "name": "test-00000000-0000-0000-0000-000000000002", "type": "mongodb", "space_id": "space-2", "created_at": "2017-10-01T12:00:00Z"}
+			]`))
+		})
+
+		It("prints a table", func() {
+			Expect(a.Run("list", nil)).To(Succeed())
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			Expect(lines).To(HaveLen(3))
+			Expect(lines[1]).To(MatchRegexp(`^00000000-0000-0000-0000-000000000001\s+d1\s+mongodb\s+space-1`))
+		})
+	})
+
+	Describe("inspecting an instance", func() {
+		BeforeEach(func() {
+			fakeComposeClient.GetScalingsReturns(&composeapi.Scalings{AllocatedUnits: 1, UsedUnits: 1, UnitSizeInMB: 1024, UnitType: "storage"}, []error{})
+			fakeComposeClient.GetWhitelistForDeploymentReturns([]composeapi.DeploymentWhitelist{{IP: "1.1.1.1"}}, []error{})
+			fakeComposeClient.GetBackupsForDeploymentReturns(&[]composeapi.Backup{
+				{ID: "older", CreatedAt: createdAt},
+				{ID: "newer", CreatedAt: createdAt.Add(time.Hour), IsRestorable: true},
+			}, []error{})
+			alerts := &composeapi.Alerts{}
+			alerts.Embedded.Alerts = []composeapi.Alert{{Status: "warning", Message: "disk usage is above 90%"}}
+			fakeComposeClient.GetAlertsForDeploymentReturns(alerts, []error{})
+		})
+
+		It("looks up the deployment by instance name", func() {
+			details, err := a.Inspect("00000000-0000-0000-0000-000000000001")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeComposeClient.GetDeploymentByNameArgsForCall(0)).To(Equal("test-00000000-0000-0000-0000-000000000001"))
+			Expect(details.DeploymentID).To(Equal("d1"))
+			Expect(details.Service).To(Equal("mongodb"))
+			Expect(details.Plan).To(Equal("small"))
+			Expect(details.Usage).To(Equal(admin.Usage{UnitType: "storage", UsedUnits: 1, AllocatedMB: 1024, UsedMB: 1024}))
+			Expect(details.Whitelist).To(Equal([]string{"1.1.1.1"}))
+			Expect(details.Backups).To(HaveLen(2))
+			Expect(details.Backups[0].ID).To(Equal("newer"))
+			Expect(details.Alerts).To(Equal([]admin.Alert{{Status: "warning", Message: "disk usage is above 90%"}}))
+		})
+
+		It("reports a missing deployment by instance GUID", func() {
+			fakeComposeClient.GetDeploymentByNameReturns(nil, []error{&compose.NotFoundError{Resource: "deployment", Name: "test-missing"}})
+
+			Expect(a.Run("inspect", []string{"missing"})).To(MatchError("no deployment found for instance missing"))
+		})
+
+		It("requires an instance GUID", func() {
+			Expect(a.Run("inspect", nil)).To(MatchError("inspect takes exactly one instance GUID"))
+		})
+	})
+
+	Describe("backing up an instance", func() {
+		It("starts a backup", func() {
+			fakeComposeClient.StartBackupForDeploymentReturns(&composeapi.Recipe{ID: "backup-recipe"}, []error{})
+
+			Expect(a.Run("backup", []string{"00000000-0000-0000-0000-000000000001"})).To(Succeed())
+			Expect(fakeComposeClient.StartBackupForDeploymentArgsForCall(0)).To(Equal("d1"))
+			Expect(out.String()).To(ContainSubstring("backup-recipe"))
+		})
+	})
+
+	Describe("deprovisioning an instance", func() {
+		BeforeEach(func() {
+			fakeComposeClient.DeprovisionDeploymentReturns(&composeapi.Recipe{ID: "deprovision-recipe"}, []error{})
+		})
+
+		It("deprovisions after confirmation", func() {
+			errOut := &bytes.Buffer{}
+			a.In = strings.NewReader("yes\n")
+			a.Err = errOut
+
+			Expect(a.Run("deprovision", []string{"00000000-0000-0000-0000-000000000001"})).To(Succeed())
+			Expect(fakeComposeClient.DeprovisionDeploymentArgsForCall(0)).To(Equal("d1"))
+			Expect(out.String()).To(ContainSubstring("deprovision-recipe"))
+			Expect(errOut.String()).To(ContainSubstring("[y/N]"))
+		})
+
+		It("keeps the prompt out of JSON output", func() {
+			a.In = strings.NewReader("yes\n")
+			a.Err = &bytes.Buffer{}
+			a.JSON = true
+
+			Expect(a.Run("deprovision", []string{"00000000-0000-0000-0000-000000000001"})).To(Succeed())
+			Expect(out.String()).NotTo(ContainSubstring("[y/N]"))
+			var result interface{}
+			Expect(json.Unmarshal(out.Bytes(), &result)).To(Succeed())
+		})
+
+		It("aborts unless confirmed", func() {
+			a.In = strings.NewReader("\n")
+			a.Err = &bytes.Buffer{}
+
+			Expect(a.Run("deprovision", []string{"00000000-0000-0000-0000-000000000001"})).To(MatchError("aborted"))
+			Expect(fakeComposeClient.DeprovisionDeploymentCallCount()).To(Equal(0))
+		})
+
+		It("does not ask when told to assume yes", func() {
+			a.AssumeYes = true
+
+			Expect(a.Run("deprovision", []string{"00000000-0000-0000-0000-000000000001"})).To(Succeed())
+			Expect(fakeComposeClient.DeprovisionDeploymentCallCount()).To(Equal(1))
+		})
+	})
+
+	It("rejects unknown commands", func() {
+		Expect(a.Run("frobnicate", nil)).To(MatchError("unknown command: frobnicate"))
+	})
+})
@@ -0,0 +1,265 @@
+package admin
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alphagov/paas-compose-broker/catalog"
+	"github.com/alphagov/paas-compose-broker/compose"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	billingDateFormat = "2006-01-02"
+	hoursPerMonth     = 730
+)
+
+// BillingReport groups broker-owned deployments by the space GUID they are
+// tagged with in CustomerBillingCode. Costs are estimated from the monthly
+// costs in the catalog of the plan recorded in each deployment's notes, or
+// for older deployments of the plan with its units, prorated by the hours
+// each deployment existed during the period. Deployments deleted before the
+// report is run are not included, because Compose no longer lists them.
+//
+// Deployments whose plan cannot be found have PlanUnknown set and no cost,
+// and are listed in Warnings, so that they are not billed as free by
+// mistake.
+type BillingReport struct {
+	From     time.Time    `json:"from"`
+	To       time.Time    `json:"to"`
+	Spaces   []SpaceUsage `json:"spaces"`
+	Warnings []string     `json:"warnings,omitempty"`
+}
+
+type SpaceUsage struct {
+	SpaceID     string             `json:"space_id"`
+	Units       int                `json:"units"`
+	Cost        map[string]float64 `json:"cost"`
+	Deployments []DeploymentUsage  `json:"deployments"`
+}
+
+type DeploymentUsage struct {
+	InstanceID   string             `json:"instance_id"`
+	DeploymentID string             `json:"deployment_id"`
+	Type         string             `json:"type"`
+	Service      string             `json:"service,omitempty"`
+	Plan         string             `json:"plan,omitempty"`
+	PlanUnknown  bool               `json:"plan_unknown,omitempty"`
+	Units        int                `json:"units"`
+	CreatedAt    time.Time          `json:"created_at"`
+	MonthlyCost  map[string]float64 `json:"monthly_cost"`
+	Cost         map[string]float64 `json:"cost"`
+}
+
+// BillingPeriod parses the from and to dates of a report. If they are empty
+// the period defaults to the calendar month containing now.
+func BillingPeriod(from, to string, now time.Time) (time.Time, time.Time, error) {
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0)
+
+	var err error
+	if from != "" {
+		if start, err = time.Parse(billingDateFormat, from); err != nil {
+			return start, end, fmt.Errorf("invalid from date: %s", from)
+		}
+	}
+	if to != "" {
+		if end, err = time.Parse(billingDateFormat, to); err != nil {
+			return start, end, fmt.Errorf("invalid to date: %s", to)
+		}
+	}
+	if !end.After(start) {
+		return start, end, fmt.Errorf("billing period must end after it starts")
+	}
+
+	return start, end, nil
+}
+
+func monthlyCost(plan *catalog.Plan) map[string]float64 {
+	costs := map[string]float64{}
+	if plan == nil || plan.Metadata == nil {
+		return costs
+	}
+	for _, cost := range plan.Metadata.Costs {
+		if !strings.EqualFold(cost.Unit, "MONTHLY") {
+			continue
+		}
+		for currency, amount := range cost.Amount {
+			costs[currency] += amount
+		}
+	}
+	return costs
+}
+
+func (a *Admin) Billing(from, to time.Time) (*BillingReport, error) {
+	instances, err := a.Instances()
+	if err != nil {
+		return nil, err
+	}
+
+	spaces := map[string]*SpaceUsage{}
+	warnings := []string{}
+	for _, instance := range instances {
+		if !instance.CreatedAt.Before(to) {
+			continue
+		}
+
+		scalings, errs := a.Compose.GetScalings(instance.DeploymentID)
+		if len(errs) > 0 {
+			return nil, compose.SquashErrors(errs)
+		}
+
+		usage := DeploymentUsage{
+			InstanceID:   instance.InstanceID,
+			DeploymentID: instance.DeploymentID,
+			Type:         instance.Type,
+			Units:        scalings.AllocatedUnits,
+			CreatedAt:    instance.CreatedAt,
+			Cost:         map[string]float64{},
+		}
+		service, plan, err := a.findPlan(instance, scalings.AllocatedUnits)
+		if err == nil {
+			usage.Service = service.Name
+			usage.Plan = plan.Name
+		} else {
+			usage.PlanUnknown = true
+			warnings = append(warnings, fmt.Sprintf("instance %s is not costed: %s", instance.InstanceID, err))
+		}
+		usage.MonthlyCost = monthlyCost(plan)
+
+		start := from
+		if instance.CreatedAt.After(start) {
+			start = instance.CreatedAt
+		}
+		hours := to.Sub(start).Hours()
+		for currency, amount := range usage.MonthlyCost {
+			usage.Cost[currency] = amount * hours / hoursPerMonth
+		}
+
+		space, ok := spaces[instance.SpaceID]
+		if !ok {
+			space = &SpaceUsage{SpaceID: instance.SpaceID, Cost: map[string]float64{}}
+			spaces[instance.SpaceID] = space
+		}
+		space.Units += usage.Units
+		for currency, amount := range usage.Cost {
+			space.Cost[currency] += amount
+		}
+		space.Deployments = append(space.Deployments, usage)
+	}
+
+	report := &BillingReport{From: from, To: to, Spaces: []SpaceUsage{}}
+	if len(warnings) > 0 {
+		report.Warnings = warnings
+	}
+	for _, space := range spaces {
+		report.Spaces = append(report.Spaces, *space)
+	}
+	sort.Slice(report.Spaces, func(i, j int) bool {
+		return report.Spaces[i].SpaceID < report.Spaces[j].SpaceID
+	})
+
+	return report, nil
+}
+
+// findPlan returns the plan recorded in the instance's deployment notes.
+// Deployments provisioned before plans were recorded are matched by their
+// units, which is wrong once Compose has scaled them.
+func (a *Admin) findPlan(instance Instance, units int) (*catalog.Service, *catalog.Plan, error) {
+	if instance.PlanID != "" {
+		return a.Catalog.FindPlanByID(instance.PlanID)
+	}
+	return a.Catalog.FindPlan(instance.Type, units)
+}
+
+// WriteCSV writes one row per deployment, with a cost column per currency.
+func (r *BillingReport) WriteCSV(out io.Writer) error {
+	currencySet := map[string]bool{}
+	for _, space := range r.Spaces {
+		for _, deployment := range space.Deployments {
+			for currency := range deployment.MonthlyCost {
+				currencySet[currency] = true
+			}
+		}
+	}
+	currencies := []string{}
+	for currency := range currencySet {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+
+	w := csv.NewWriter(out)
+	header := []string{"space_guid", "instance_guid", "deployment_id", "type", "service", "plan", "plan_unknown", "units", "created_at", "period_from", "period_to"}
+	for _, currency := range currencies {
+		header = append(header, "monthly_cost_"+currency, "cost_"+currency)
+	}
+	if err := w.Write(header); err != nil {
+		return err
+	}
+
+	for _, space := range r.Spaces {
+		for _, d := range space.Deployments {
+			row := []string{
+				space.SpaceID, d.InstanceID, d.DeploymentID, d.Type, d.Service, d.Plan,
+				strconv.FormatBool(d.PlanUnknown), strconv.Itoa(d.Units), d.CreatedAt.Format(time.RFC3339),
+				r.From.Format(billingDateFormat), r.To.Format(billingDateFormat),
+			}
+			for _, currency := range currencies {
+				row = append(row,
+					strconv.FormatFloat(d.MonthlyCost[currency], 'f', 2, 64),
+					strconv.FormatFloat(d.Cost[currency], 'f', 2, 64),
+				)
+			}
+			if err := w.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+// BillingHandler serves the billing report for the `from` and `to` query
+// parameters, as JSON or as CSV with `format=csv`. It must be wrapped in the
+// same basic auth as the broker API.
+func BillingHandler(a *Admin) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		from, to, err := BillingPeriod(query.Get("from"), query.Get("to"), time.Now().UTC())
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(brokerapi.ErrorResponse{Description: err.Error()})
+			return
+		}
+
+		report, err := a.Billing(from, to)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(brokerapi.ErrorResponse{Description: err.Error()})
+			return
+		}
+
+		if query.Get("format") == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", fmt.Sprintf(
+				"attachment; filename=compose-billing-%s-%s.csv",
+				from.Format(billingDateFormat), to.Format(billingDateFormat),
+			))
+			report.WriteCSV(w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	})
+}
@@ -0,0 +1,180 @@
+package admin_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	composeapi "github.com/compose/gocomposeapi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/paas-compose-broker/admin"
+	"github.com/alphagov/paas-compose-broker/catalog"
+	"github.com/alphagov/paas-compose-broker/compose/fakes"
+	"github.com/alphagov/paas-compose-broker/config"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+var _ = Describe("Billing", func() {
+
+	var (
+		fakeComposeClient *fakes.FakeClient
+		out               *bytes.Buffer
+		a                 *admin.Admin
+		from              = time.Date(2017, 10, 1, 0, 0, 0, 0, time.UTC)
+		to                = time.Date(2017, 10, 31, 10, 0, 0, 0, time.UTC) // 730 hours later
+	)
+
+	BeforeEach(func() {
+		fakeComposeClient = &fakes.FakeClient{}
+		fakeComposeClient.GetDeploymentsReturns(&[]composeapi.Deployment{
+			{ID: "d1", Name: "test-00000000-0000-0000-0000-000000000001", Type: "mongodb", CustomerBillingCode: "space-a", CreatedAt: from.AddDate(0, -1, 0)},
+			{ID: "d2", Name: "test-00000000-0000-0000-0000-000000000002", Type: "mongodb", CustomerBillingCode: "space-a", CreatedAt: to.Add(-73 * time.Hour)},
+			{ID: "d3", Name: "test-00000000-0000-0000-0000-000000000003", Type: "mongodb", CustomerBillingCode: "space-b", CreatedAt: from},
+			{ID: "d4", Name: "test-00000000-0000-0000-0000-000000000004", Type: "mongodb", CustomerBillingCode: "space-b", CreatedAt: to},
+			{ID: "d5", Name: "test-00000000-0000-0000-0000-000000000005", Type: "mongodb", CustomerBillingCode: "space-c", CreatedAt: from, Notes: `{"plan_id":"small-plan-id"}`},
+		}, []error{})
+		fakeComposeClient.GetScalingsStub = func(id string) (*composeapi.Scalings, []error) {
+			if id == "d3" || id == "d5" {
+				return &composeapi.Scalings{AllocatedUnits: 5}, []error{}
+			}
+			return &composeapi.Scalings{AllocatedUnits: 1}, []error{}
+		}
+
+		out = &bytes.Buffer{}
+		a = &admin.Admin{
+			Compose: fakeComposeClient,
+			Config:  &config.Config{DBPrefix: "test"},
+			Catalog: &catalog.Catalog{
+				Services: []*catalog.Service{{
+					Service: brokerapi.Service{Name: "mongodb"},
+					Plans: []*catalog.Plan{{
+						ServicePlan: brokerapi.ServicePlan{
+							ID:   "small-plan-id",
+							Name: "small",
+							Metadata: &brokerapi.ServicePlanMetadata{
+								Costs: []brokerapi.ServicePlanCost{
+									{Amount: map[string]float64{"USD": 35}, Unit: "MONTHLY"},
+									{Amount: map[string]float64{"USD": 1}, Unit: "PER BINDING"},
+								},
+							},
+						},
+						Compose: catalog.ComposeConfig{Units: 1, DatabaseType: "mongodb"},
+					}},
+				}},
+			},
+			Out: out,
+		}
+	})
+
+	It("groups deployments by space and prorates their monthly cost", func() {
+		report, err := a.Billing(from, to)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(report.Spaces).To(HaveLen(3))
+
+		spaceA := report.Spaces[0]
+		Expect(spaceA.SpaceID).To(Equal("space-a"))
+		Expect(spaceA.Units).To(Equal(2))
+		Expect(spaceA.Deployments).To(HaveLen(2))
+		Expect(spaceA.Deployments[0].Plan).To(Equal("small"))
+		Expect(spaceA.Deployments[0].MonthlyCost).To(Equal(map[string]float64{"USD": 35}))
+		Expect(spaceA.Deployments[0].Cost["USD"]).To(BeNumerically("~", 35, 0.001))
+		Expect(spaceA.Deployments[1].Cost["USD"]).To(BeNumerically("~", 3.5, 0.001))
+		Expect(spaceA.Cost["USD"]).To(BeNumerically("~", 38.5, 0.001))
+
+		spaceB := report.Spaces[1]
+		Expect(spaceB.SpaceID).To(Equal("space-b"))
+		Expect(spaceB.Deployments).To(HaveLen(1), "deployments created after the period are excluded")
+		Expect(spaceB.Units).To(Equal(5))
+		Expect(spaceB.Deployments[0].Plan).To(BeEmpty(), "no plan in the catalog has 5 units")
+		Expect(spaceB.Deployments[0].PlanUnknown).To(BeTrue())
+		Expect(spaceB.Cost).To(BeEmpty())
+		Expect(report.Warnings).To(ConsistOf(
+			"instance 00000000-0000-0000-0000-000000000003 is not costed: plan for 5 units of mongodb: not found",
+		))
+	})
+
+	It("costs deployments by the plan recorded in their notes, whatever their units", func() {
+		report, err := a.Billing(from, to)
+		Expect(err).NotTo(HaveOccurred())
+
+		spaceC := report.Spaces[2]
+		Expect(spaceC.SpaceID).To(Equal("space-c"))
+		Expect(spaceC.Units).To(Equal(5))
+		Expect(spaceC.Deployments[0].Plan).To(Equal("small"))
+		Expect(spaceC.Deployments[0].PlanUnknown).To(BeFalse())
+		Expect(spaceC.Cost["USD"]).To(BeNumerically("~", 35, 0.001))
+	})
+
+	It("flags deployments whose recorded plan is no longer in the catalog", func() {
+		a.Catalog.Services[0].Plans[0].ID = "another-plan-id"
+
+		report, err := a.Billing(from, to)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(report.Spaces[2].Deployments[0].PlanUnknown).To(BeTrue())
+		Expect(report.Warnings).To(ContainElement(
+			"instance 00000000-0000-0000-0000-000000000005 is not costed: plan small-plan-id: not found",
+		))
+	})
+
+	It("writes CSV with a column per currency", func() {
+		report, err := a.Billing(from, to)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(report.WriteCSV(out)).To(Succeed())
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		Expect(lines).To(HaveLen(5))
+		Expect(lines[0]).To(Equal("space_guid,instance_guid,deployment_id,type,service,plan,plan_unknown,units,created_at,period_from,period_to,monthly_cost_USD,cost_USD"))
+		Expect(lines[1]).To(Equal("space-a,00000000-0000-0000-0000-000000000001,d1,mongodb,mongodb,small,false,1,2017-09-01T00:00:00Z,2017-10-01,2017-10-31,35.00,35.00"))
+		Expect(lines[3]).To(Equal("space-b,00000000-0000-0000-0000-000000000003,d3,mongodb,,,true,5,2017-10-01T00:00:00Z,2017-10-01,2017-10-31,0.00,0.00"))
+	})
+
+	Describe("the billing period", func() {
+		It("defaults to the current month", func() {
+			start, end, err := admin.BillingPeriod("", "", time.Date(2017, 2, 14, 9, 0, 0, 0, time.UTC))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(start).To(Equal(time.Date(2017, 2, 1, 0, 0, 0, 0, time.UTC)))
+			Expect(end).To(Equal(time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)))
+		})
+
+		It("rejects periods which end before they start", func() {
+			_, _, err := admin.BillingPeriod("2017-03-01", "2017-02-01", time.Now())
+			Expect(err).To(MatchError("billing period must end after it starts"))
+		})
+	})
+
+	Describe("the billing endpoint", func() {
+		It("serves JSON", func() {
+			resp := httptest.NewRecorder()
+			admin.BillingHandler(a).ServeHTTP(resp, httptest.NewRequest("GET", "/billing?from=2017-10-01&to=2017-11-01", nil))
+
+			Expect(resp.Code).To(Equal(http.StatusOK))
+			var report admin.BillingReport
+			Expect(json.NewDecoder(resp.Body).Decode(&report)).To(Succeed())
+			Expect(report.Spaces).To(HaveLen(3))
+		})
+
+		It("serves CSV", func() {
+			resp := httptest.NewRecorder()
+			admin.BillingHandler(a).ServeHTTP(resp, httptest.NewRequest("GET", "/billing?from=2017-10-01&to=2017-11-01&format=csv", nil))
+
+			Expect(resp.Code).To(Equal(http.StatusOK))
+			Expect(resp.Header().Get("Content-Type")).To(Equal("text/csv"))
+			Expect(resp.Body.String()).To(HavePrefix("space_guid,"))
+		})
+
+		It("rejects bad dates", func() {
+			resp := httptest.NewRecorder()
+			admin.BillingHandler(a).ServeHTTP(resp, httptest.NewRequest("GET", "/billing?from=yesterday", nil))
+
+			Expect(resp.Code).To(Equal(http.StatusBadRequest))
+			Expect(resp.Body.String()).To(MatchJSON(`{"description": "invalid from date: yesterday"}`))
+		})
+	})
+})
@@ -0,0 +1,178 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/alphagov/paas-compose-broker/broker"
+	"github.com/alphagov/paas-compose-broker/catalog"
+)
+
+// CCInstance is the part of a Cloud Controller service instance the audit
+// needs to match it with a Compose deployment.
+type CCInstance struct {
+	GUID      string `json:"guid"`
+	Name      string `json:"name,omitempty"`
+	SpaceGUID string `json:"space_guid,omitempty"`
+}
+
+type ccResource struct {
+	Metadata struct {
+		GUID string `json:"guid"`
+	} `json:"metadata"`
+	Entity struct {
+		Name            string `json:"name"`
+		SpaceGUID       string `json:"space_guid"`
+		ServicePlanGUID string `json:"service_plan_guid"`
+		UniqueID        string `json:"unique_id"`
+	} `json:"entity"`
+}
+
+type ccPage struct {
+	NextURL   string       `json:"next_url"`
+	Resources []ccResource `json:"resources"`
+}
+
+func (r ccResource) instance() CCInstance {
+	return CCInstance{
+		GUID:      r.Metadata.GUID,
+		Name:      r.Entity.Name,
+		SpaceGUID: r.Entity.SpaceGUID,
+	}
+}
+
+// ReadCCInstances parses a list of service instances saved from Cloud
+// Controller. It accepts either a JSON array of instance GUIDs or the output
+// of `cf curl /v2/service_instances`, which should be limited to the
+// instances of this broker's services. As instances missing from the list
+// are taken for orphans, a page of cf curl output with more pages after it
+// is rejected, as is anything which isn't a GUID.
+func ReadCCInstances(r io.Reader) ([]CCInstance, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	instances := []CCInstance{}
+	guids := []string{}
+	if err := json.Unmarshal(data, &guids); err == nil {
+		for _, guid := range guids {
+			instances = append(instances, CCInstance{GUID: guid})
+		}
+	} else {
+		page := ccPage{}
+		if err := json.Unmarshal(data, &page); err != nil {
+			return nil, fmt.Errorf("could not parse instance list: %s", err)
+		}
+		if page.NextURL != "" {
+			return nil, fmt.Errorf("instance list is one page of several (next_url is %s): list every instance, or use -cc-api", page.NextURL)
+		}
+		for _, resource := range page.Resources {
+			instances = append(instances, resource.instance())
+		}
+	}
+
+	if err := checkGUIDs(instances); err != nil {
+		return nil, err
+	}
+	return instances, nil
+}
+
+func checkGUIDs(instances []CCInstance) error {
+	for _, instance := range instances {
+		if !broker.IsGUID(instance.GUID) {
+			return fmt.Errorf("invalid service instance GUID in instance list: %q", instance.GUID)
+		}
+	}
+	return nil
+}
+
+// CloudController is a minimal Cloud Controller v2 API client. Token is the
+// value of the Authorization header, as printed by `cf oauth-token`.
+type CloudController struct {
+	API   string
+	Token string
+	HTTP  *http.Client
+}
+
+// ServiceInstances lists the CC service instances of plans in the catalog.
+func (cc *CloudController) ServiceInstances(cat *catalog.Catalog) ([]CCInstance, error) {
+	brokerPlanIDs := map[string]bool{}
+	for _, service := range cat.Services {
+		for _, plan := range service.Plans {
+			brokerPlanIDs[plan.ID] = true
+		}
+	}
+
+	ccPlanGUIDs := map[string]bool{}
+	err := cc.eachResource("/v2/service_plans", func(r ccResource) {
+		if brokerPlanIDs[r.Entity.UniqueID] {
+			ccPlanGUIDs[r.Metadata.GUID] = true
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	instances := []CCInstance{}
+	err = cc.eachResource("/v2/service_instances", func(r ccResource) {
+		if ccPlanGUIDs[r.Entity.ServicePlanGUID] {
+			instances = append(instances, r.instance())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkGUIDs(instances); err != nil {
+		return nil, err
+	}
+	return instances, nil
+}
+
+func (cc *CloudController) eachResource(path string, fn func(ccResource)) error {
+	httpClient := cc.HTTP
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	api := strings.TrimSuffix(cc.API, "/")
+
+	next := path + "?results-per-page=100"
+	for next != "" {
+		req, err := http.NewRequest("GET", api+next, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", cc.Token)
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		page := ccPage{}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("cloud controller responded %d to GET %s", resp.StatusCode, path)
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, resource := range page.Resources {
+			fn(resource)
+		}
+
+		next = page.NextURL
+		if u, err := url.Parse(next); err == nil && u.IsAbs() {
+			next = u.RequestURI()
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package admin_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/paas-compose-broker/admin"
+	"github.com/alphagov/paas-compose-broker/catalog"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+var _ = Describe("Cloud Controller instance lists", func() {
+
+	Describe("reading a saved instance list", func() {
+		It("reads an array of GUIDs", func() {
+			instances, err := admin.ReadCCInstances(strings.NewReader(`["00000000-0000-0000-0000-000000000001", "00000000-0000-0000-0000-000000000002"]`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(instances).To(Equal([]admin.CCInstance{{GUID: "00000000-0000-0000-0000-000000000001"}, {GUID: "00000000-0000-0000-0000-000000000002"}}))
+		})
+
+		It("reads the output of cf curl", func() {
+			instances, err := admin.ReadCCInstances(strings.NewReader(`{
+				"resources": [
+					{"metadata": {"guid": "00000000-0000-0000-0000-000000000001"}, "entity": {"name": "db", "space_guid": "space"}}
+				]
+			}`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(instances).To(Equal([]admin.CCInstance{{GUID: "00000000-0000-0000-0000-000000000001", Name: "db", SpaceGUID: "space"}}))
+		})
+
+		It("rejects a page of cf curl output with more pages after it", func() {
+			_, err := admin.ReadCCInstances(strings.NewReader(`{
+				"total_results": 2,
+				"total_pages": 2,
+				"next_url": "/v2/service_instances?order-direction=asc&page=2&results-per-page=1",
+				"resources": [
+					{"metadata": {"guid": "00000000-0000-0000-0000-000000000001"}, "entity": {"name": "db", "space_guid": "space"}}
+				]
+			}`))
+			Expect(err).To(MatchError(ContainSubstring("instance list is one page of several")))
+		})
+
+		It("rejects instances which are not GUIDs", func() {
+			_, err := admin.ReadCCInstances(strings.NewReader(`["00000000-0000-0000-0000-000000000001", ""]`))
+			Expect(err).To(MatchError(`invalid service instance GUID in instance list: ""`))
+		})
+
+		It("rejects anything else", func() {
+			_, err := admin.ReadCCInstances(strings.NewReader(`"one"`))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("listing instances from the API", func() {
+		var (
+			server *httptest.Server
+			cat    *catalog.Catalog
+		)
+
+		BeforeEach(func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "bearer token" {
+					w.WriteHeader(http.StatusUnauthorized)
+					fmt.Fprint(w, `{}`)
+					return
+				}
+				switch r.URL.Path + "?" + r.URL.RawQuery {
+				case "/v2/service_plans?results-per-page=100":
+					fmt.Fprint(w, `{"resources": [
+						{"metadata": {"guid": "cc-plan-ours"}, "entity": {"unique_id": "broker-plan"}},
+						{"metadata": {"guid": "cc-plan-theirs"}, "entity": {"unique_id": "other-plan"}}
+					]}`)
+				case "/v2/service_instances?results-per-page=100":
+					fmt.Fprintf(w, `{
+						"next_url": "%s/v2/service_instances?page=2",
+						"resources": [
+							{"metadata": {"guid": "00000000-0000-0000-0000-000000000001"}, "entity": {"name": "db", "space_guid": "s", "service_plan_guid": "cc-plan-ours"}},
+							{"metadata": {"guid": "00000000-0000-0000-0000-000000000002"}, "entity": {"name": "other", "space_guid": "s", "service_plan_guid": "cc-plan-theirs"}}
+						]}`, "https://api.example.com")
+				case "/v2/service_instances?page=2":
+					fmt.Fprint(w, `{"resources": [
+						{"metadata": {"guid": "00000000-0000-0000-0000-000000000003"}, "entity": {"name": "db2", "space_guid": "s", "service_plan_guid": "cc-plan-ours"}}
+					]}`)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+
+			cat = &catalog.Catalog{Services: []*catalog.Service{{
+				Plans: []*catalog.Plan{{ServicePlan: brokerapi.ServicePlan{ID: "broker-plan"}}},
+			}}}
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("follows pages and only returns instances of the broker's plans", func() {
+			cc := &admin.CloudController{API: server.URL, Token: "bearer token"}
+
+			instances, err := cc.ServiceInstances(cat)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(instances).To(Equal([]admin.CCInstance{
+				{GUID: "00000000-0000-0000-0000-000000000001", Name: "db", SpaceGUID: "s"},
+				{GUID: "00000000-0000-0000-0000-000000000003", Name: "db2", SpaceGUID: "s"},
+			}))
+		})
+
+		It("returns an error when CC refuses", func() {
+			cc := &admin.CloudController{API: server.URL, Token: "bearer wrong"}
+
+			_, err := cc.ServiceInstances(cat)
+			Expect(err).To(MatchError("cloud controller responded 401 to GET /v2/service_plans"))
+		})
+	})
+})
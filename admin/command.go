@@ -0,0 +1,298 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/alphagov/paas-compose-broker/catalog"
+	"github.com/alphagov/paas-compose-broker/compose"
+	"github.com/alphagov/paas-compose-broker/config"
+)
+
+const usage = `Usage: compose-broker admin [options] <command> [arguments]
+
+Commands:
+  list                        list deployments owned by this broker
+  inspect <instance-guid>     show a deployment, its whitelist, backups and
+                              alerts
+  backup <instance-guid>      start an on-demand backup
+  deprovision <instance-guid> delete the deployment behind an instance
+  orphans                     find deployments CC doesn't know about, and CC
+                              instances with no deployment. Needs either
+                              -cc-instances or -cc-api and -cc-token
+  billing                     estimate costs by space for the period given by
+                              -from and -to, as CSV or with -json as JSON
+  verify-audit-log <file>     check that an audit log has not been changed
+
+Options:
+`
+
+var errAborted = errors.New("aborted")
+
+// Main runs an admin command using the same environment variables and
+// catalog as the broker, and returns the process exit code.
+func Main(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("admin", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		flags.PrintDefaults()
+	}
+	catalogFilePath := flags.String("catalog", "./catalog.json", "Location of the catalog file")
+	jsonOutput := flags.Bool("json", false, "Print results as JSON")
+	assumeYes := flags.Bool("yes", false, "Do not ask for confirmation before destructive actions")
+	ccInstancesFile := flags.String("cc-instances", "", "JSON file listing the CC service instances, for orphans")
+	ccAPI := flags.String("cc-api", "", "Cloud Controller API URL to list service instances from, for orphans")
+	ccToken := flags.String("cc-token", "", "Cloud Controller token, as printed by `cf oauth-token`")
+	deprovisionOrphans := flags.Bool("deprovision", false, "Deprovision orphaned deployments after confirmation")
+	billingFrom := flags.String("from", "", "Start of the billing period, as YYYY-MM-DD. Defaults to the start of this month")
+	billingTo := flags.String("to", "", "End of the billing period, as YYYY-MM-DD. Defaults to the start of next month")
+
+	if err := parseInterspersed(flags, args); err != nil {
+		return 2
+	}
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return 2
+	}
+
+	cfg, err := config.New()
+	if err != nil {
+		fmt.Fprintf(stderr, "Error loading config: %v\n", err)
+		return 1
+	}
+
+	catalogFile, err := os.Open(*catalogFilePath)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error opening catalog file: %v\n", err)
+		return 1
+	}
+	defer catalogFile.Close()
+	cat, err := catalog.Load(catalogFile)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error loading catalog: %v\n", err)
+		return 1
+	}
+
+	composeClient, err := compose.NewClient(cfg.APIToken)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error creating compose client: %v\n", err)
+		return 1
+	}
+
+	composeClient = compose.NewRetryingClient(
+		composeClient,
+		compose.DefaultRetryPolicy.WithOverrides(cfg.ComposeRetryAttempts, cfg.ComposeRetryBaseDelay, cfg.ComposeRetryMaxDelay),
+		lager.NewLogger("compose-broker-admin"),
+	)
+
+	a := &Admin{
+		Compose:      composeClient,
+		Config:       cfg,
+		Catalog:      cat,
+		In:           stdin,
+		Out:          stdout,
+		Err:          stderr,
+		JSON:         *jsonOutput,
+		AssumeYes:    *assumeYes,
+		PurgeOrphans: *deprovisionOrphans,
+		BillingFrom:  *billingFrom,
+		BillingTo:    *billingTo,
+	}
+	if *ccInstancesFile != "" {
+		a.CCInstances = func() ([]CCInstance, error) {
+			f, err := os.Open(*ccInstancesFile)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			return ReadCCInstances(f)
+		}
+	} else if *ccAPI != "" {
+		cc := &CloudController{API: *ccAPI, Token: *ccToken}
+		a.CCInstances = func() ([]CCInstance, error) {
+			return cc.ServiceInstances(cat)
+		}
+	}
+
+	if err := a.Run(flags.Arg(0), flags.Args()[1:]); err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// parseInterspersed allows options to follow the command, as in
+// `admin deprovision <guid> -yes`, which the flag package does not support.
+func parseInterspersed(flags *flag.FlagSet, args []string) error {
+	positional := []string{}
+	for {
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+	return flags.Parse(append([]string{"--"}, positional...))
+}
+
+func (a *Admin) Run(command string, args []string) error {
+	switch command {
+	case "list":
+		instances, err := a.Instances()
+		if err != nil {
+			return err
+		}
+		return a.print(instances, func(w io.Writer) {
+			fmt.Fprintln(w, "INSTANCE\tDEPLOYMENT\tTYPE\tSPACE\tCREATED")
+			for _, i := range instances {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", i.InstanceID, i.DeploymentID, i.Type, i.SpaceID, i.CreatedAt.Format(time.RFC3339))
+			}
+		})
+	case "inspect":
+		instanceID, err := singleArg(command, args)
+		if err != nil {
+			return err
+		}
+		details, err := a.Inspect(instanceID)
+		if err != nil {
+			return err
+		}
+		return a.print(details, func(w io.Writer) {
+			fmt.Fprintf(w, "instance:\t%s\n", details.InstanceID)
+			fmt.Fprintf(w, "deployment:\t%s (%s)\n", details.Name, details.DeploymentID)
+			fmt.Fprintf(w, "type:\t%s %s\n", details.Type, details.Version)
+			fmt.Fprintf(w, "plan:\t%s/%s (%d units)\n", details.Service, details.Plan, details.Units)
+			fmt.Fprintf(w, "usage:\t%d of %d MB %s (%d units)\n", details.Usage.UsedMB, details.Usage.AllocatedMB, details.Usage.UnitType, details.Usage.UsedUnits)
+			fmt.Fprintf(w, "space:\t%s\n", details.SpaceID)
+			fmt.Fprintf(w, "created:\t%s\n", details.CreatedAt.Format(time.RFC3339))
+			fmt.Fprintf(w, "web ui:\t%s\n", details.WebUI)
+			for _, ip := range details.Whitelist {
+				fmt.Fprintf(w, "whitelist:\t%s\n", ip)
+			}
+			for _, b := range details.Backups {
+				fmt.Fprintf(w, "backup:\t%s %s %s %s\n", b.ID, b.Type, b.Status, b.CreatedAt.Format(time.RFC3339))
+			}
+			for _, alert := range details.Alerts {
+				fmt.Fprintf(w, "alert:\t%s %s\n", alert.Status, alert.Message)
+			}
+		})
+	case "backup":
+		instanceID, err := singleArg(command, args)
+		if err != nil {
+			return err
+		}
+		recipe, err := a.Backup(instanceID)
+		if err != nil {
+			return err
+		}
+		return a.print(recipe, func(w io.Writer) {
+			fmt.Fprintf(w, "backup started:\t%s\n", recipe.ID)
+		})
+	case "deprovision":
+		instanceID, err := singleArg(command, args)
+		if err != nil {
+			return err
+		}
+		recipe, err := a.Deprovision(instanceID)
+		if err != nil {
+			return err
+		}
+		return a.print(recipe, func(w io.Writer) {
+			fmt.Fprintf(w, "deprovision started:\t%s\n", recipe.ID)
+		})
+	case "orphans":
+		if a.CCInstances == nil {
+			return errors.New("orphans needs -cc-instances or -cc-api to list the CC service instances")
+		}
+		ccInstances, err := a.CCInstances()
+		if err != nil {
+			return err
+		}
+		report, err := a.FindOrphans(ccInstances)
+		if err != nil {
+			return err
+		}
+		if a.PurgeOrphans {
+			if err := a.DeprovisionOrphans(report); err != nil {
+				return err
+			}
+		}
+		return a.print(report, func(w io.Writer) {
+			for _, o := range report.Orphans {
+				fmt.Fprintf(w, "orphaned deployment:\t%s\t%s\t%s\n", o.InstanceID, o.DeploymentID, o.SpaceID)
+			}
+			for _, m := range report.MissingDeployments {
+				fmt.Fprintf(w, "missing deployment:\t%s\t%s\t%s\n", m.GUID, m.Name, m.SpaceGUID)
+			}
+			for _, d := range report.Deprovisioned {
+				fmt.Fprintf(w, "deprovisioned:\t%s\n", d)
+			}
+		})
+	case "billing":
+		from, to, err := BillingPeriod(a.BillingFrom, a.BillingTo, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		report, err := a.Billing(from, to)
+		if err != nil {
+			return err
+		}
+		if a.Err != nil {
+			for _, warning := range report.Warnings {
+				fmt.Fprintln(a.Err, "warning:", warning)
+			}
+		}
+		if a.JSON {
+			return a.print(report, nil)
+		}
+		return report.WriteCSV(a.Out)
+	case "verify-audit-log":
+		if len(args) != 1 {
+			return fmt.Errorf("%s takes exactly one file", command)
+		}
+		last, err := a.VerifyAuditLog(args[0])
+		if err != nil {
+			return err
+		}
+		return a.print(last, func(w io.Writer) {
+			if last == nil {
+				fmt.Fprintln(w, "no events")
+				return
+			}
+			fmt.Fprintf(w, "verified up to event:\t%d\t%s\t%s\n", last.Sequence, last.Time.Format(time.RFC3339), last.Hash)
+		})
+	default:
+		return fmt.Errorf("unknown command: %s", command)
+	}
+}
+
+func singleArg(command string, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("%s takes exactly one instance GUID", command)
+	}
+	return args[0], nil
+}
+
+func (a *Admin) print(v interface{}, text func(io.Writer)) error {
+	if a.JSON {
+		encoder := json.NewEncoder(a.Out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+
+	w := tabwriter.NewWriter(a.Out, 0, 4, 2, ' ', 0)
+	text(w)
+	return w.Flush()
+}
@@ -0,0 +1,122 @@
+package admin
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alphagov/paas-compose-broker/compose"
+)
+
+// OrphanReport cross-references the broker's Compose deployments with the
+// service instances Cloud Controller knows about.
+type OrphanReport struct {
+	// Orphans are deployments which no CC service instance refers to.
+	Orphans []Instance `json:"orphans"`
+	// MissingDeployments are CC service instances with no deployment.
+	MissingDeployments []CCInstance `json:"missing_deployments"`
+	// Deprovisioned lists the orphans deleted by DeprovisionOrphans.
+	Deprovisioned []string `json:"deprovisioned,omitempty"`
+
+	// CCInstances and Deployments count the instances and deployments
+	// compared.
+	CCInstances int `json:"cc_instances"`
+	Deployments int `json:"deployments"`
+}
+
+// maxOrphanShare is the share of the broker's deployments which can be
+// deprovisioned as orphans without confirming how many are to go. Many
+// orphans more likely means an incomplete instance list than many leaks.
+const maxOrphanShare = 0.1
+
+func (a *Admin) FindOrphans(ccInstances []CCInstance) (*OrphanReport, error) {
+	instances, err := a.Instances()
+	if err != nil {
+		return nil, err
+	}
+
+	known := map[string]bool{}
+	for _, ccInstance := range ccInstances {
+		known[ccInstance.GUID] = true
+	}
+
+	deployed := map[string]bool{}
+	report := &OrphanReport{
+		Orphans:            []Instance{},
+		MissingDeployments: []CCInstance{},
+		CCInstances:        len(ccInstances),
+		Deployments:        len(instances),
+	}
+	for _, instance := range instances {
+		deployed[instance.InstanceID] = true
+		if !known[instance.InstanceID] {
+			report.Orphans = append(report.Orphans, instance)
+		}
+	}
+	for _, ccInstance := range ccInstances {
+		if !deployed[ccInstance.GUID] {
+			report.MissingDeployments = append(report.MissingDeployments, ccInstance)
+		}
+	}
+	sort.Slice(report.MissingDeployments, func(i, j int) bool {
+		return report.MissingDeployments[i].GUID < report.MissingDeployments[j].GUID
+	})
+
+	return report, nil
+}
+
+// DeprovisionOrphans deletes each orphan the operator confirms. It stops at
+// the first Compose error so that a misbehaving API doesn't get hammered.
+// It refuses if Cloud Controller listed no instances, and asks the operator
+// to type the number of orphans, even with -yes, if they are more than
+// maxOrphanShare of the deployments.
+func (a *Admin) DeprovisionOrphans(report *OrphanReport) error {
+	if len(report.Orphans) == 0 {
+		return nil
+	}
+	if report.CCInstances == 0 {
+		return errors.New("refusing to deprovision orphans: the instance list from Cloud Controller is empty")
+	}
+	if float64(len(report.Orphans)) > maxOrphanShare*float64(report.Deployments) {
+		prompt := fmt.Sprintf("%d of the broker's %d deployments are orphaned. Check the instance list is complete, then type %d to continue:", len(report.Orphans), report.Deployments, len(report.Orphans))
+		if !a.confirmCount(prompt, len(report.Orphans)) {
+			return fmt.Errorf("refusing to deprovision %d of %d deployments without confirmation of the count", len(report.Orphans), report.Deployments)
+		}
+	}
+
+	for _, orphan := range report.Orphans {
+		prompt := fmt.Sprintf("Deprovision orphaned deployment %s (%s) in space %s?", orphan.Name, orphan.DeploymentID, orphan.SpaceID)
+		if !a.confirm(prompt) {
+			continue
+		}
+
+		_, errs := a.Compose.DeprovisionDeployment(orphan.DeploymentID)
+		if len(errs) > 0 {
+			return compose.SquashErrors(errs)
+		}
+		report.Deprovisioned = append(report.Deprovisioned, orphan.InstanceID)
+	}
+
+	return nil
+}
+
+// confirmCount asks the operator to type count. Unlike confirm, it cannot be
+// assumed.
+func (a *Admin) confirmCount(prompt string, count int) bool {
+	if a.In == nil || a.Err == nil {
+		return false
+	}
+	if a.in == nil {
+		a.in = bufio.NewReader(a.In)
+	}
+
+	fmt.Fprintf(a.Err, "%s ", prompt)
+	answer, err := a.in.ReadString('\n')
+	if err != nil && answer == "" {
+		return false
+	}
+	return strings.TrimSpace(answer) == strconv.Itoa(count)
+}
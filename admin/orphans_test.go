@@ -0,0 +1,141 @@
+package admin_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	composeapi "github.com/compose/gocomposeapi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/paas-compose-broker/admin"
+	"github.com/alphagov/paas-compose-broker/catalog"
+	"github.com/alphagov/paas-compose-broker/compose/fakes"
+	"github.com/alphagov/paas-compose-broker/config"
+)
+
+var _ = Describe("Orphan detection", func() {
+
+	var (
+		fakeComposeClient *fakes.FakeClient
+		out               *bytes.Buffer
+		a                 *admin.Admin
+		ccInstances       []admin.CCInstance
+	)
+
+	BeforeEach(func() {
+		fakeComposeClient = &fakes.FakeClient{}
+		fakeComposeClient.GetDeploymentsReturns(&[]composeapi.Deployment{
+			{ID: "d1", Name: "test-00000000-0000-0000-0000-000000000001"},
+			{ID: "d2", Name: "test-00000000-0000-0000-0000-000000000002"},
+			{ID: "d3", Name: "test-00000000-0000-0000-0000-000000000003"},
+			{ID: "d4", Name: "not-ours"},
+		}, []error{})
+		fakeComposeClient.DeprovisionDeploymentReturns(&composeapi.Recipe{ID: "recipe"}, []error{})
+
+		ccInstances = []admin.CCInstance{
+			{GUID: "00000000-0000-0000-0000-000000000001"},
+			{GUID: "00000000-0000-0000-0000-000000000004", Name: "my-db", SpaceGUID: "space"},
+		}
+
+		out = &bytes.Buffer{}
+		a = &admin.Admin{
+			Compose: fakeComposeClient,
+			Config:  &config.Config{DBPrefix: "test"},
+			Catalog: &catalog.Catalog{},
+			Out:     out,
+			CCInstances: func() ([]admin.CCInstance, error) {
+				return ccInstances, nil
+			},
+		}
+	})
+
+	It("reports orphans and instances with no deployment", func() {
+		report, err := a.FindOrphans(ccInstances)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(report.Orphans).To(HaveLen(2))
+		Expect(report.Orphans[0].InstanceID).To(Equal("00000000-0000-0000-0000-000000000002"))
+		Expect(report.Orphans[1].InstanceID).To(Equal("00000000-0000-0000-0000-000000000003"))
+		Expect(report.MissingDeployments).To(Equal([]admin.CCInstance{
+			{GUID: "00000000-0000-0000-0000-000000000004", Name: "my-db", SpaceGUID: "space"},
+		}))
+	})
+
+	It("does not deprovision anything unless asked to", func() {
+		a.AssumeYes = true
+
+		Expect(a.Run("orphans", nil)).To(Succeed())
+		Expect(fakeComposeClient.DeprovisionDeploymentCallCount()).To(Equal(0))
+		Expect(out.String()).To(MatchRegexp(`orphaned deployment:\s+00000000-0000-0000-0000-000000000002`))
+		Expect(out.String()).To(MatchRegexp(`missing deployment:\s+00000000-0000-0000-0000-000000000004`))
+	})
+
+	It("deprovisions the orphans the operator confirms", func() {
+		a.PurgeOrphans = true
+		a.In = strings.NewReader("2\nn\ny\n")
+		a.Err = &bytes.Buffer{}
+
+		Expect(a.Run("orphans", nil)).To(Succeed())
+		Expect(fakeComposeClient.DeprovisionDeploymentCallCount()).To(Equal(1))
+		Expect(fakeComposeClient.DeprovisionDeploymentArgsForCall(0)).To(Equal("d3"))
+		Expect(out.String()).To(MatchRegexp(`deprovisioned:\s+00000000-0000-0000-0000-000000000003`))
+	})
+
+	It("stops at the first failure to deprovision", func() {
+		a.PurgeOrphans = true
+		a.AssumeYes = true
+		a.In = strings.NewReader("2\n")
+		a.Err = &bytes.Buffer{}
+		fakeComposeClient.DeprovisionDeploymentReturns(nil, []error{errors.New("computer says no")})
+
+		Expect(a.Run("orphans", nil)).To(MatchError("computer says no"))
+		Expect(fakeComposeClient.DeprovisionDeploymentCallCount()).To(Equal(1))
+	})
+
+	It("asks for the number of orphans when many deployments are orphaned, even when told to assume yes", func() {
+		errOut := &bytes.Buffer{}
+		a.PurgeOrphans = true
+		a.AssumeYes = true
+		a.In = strings.NewReader("y\n")
+		a.Err = errOut
+
+		Expect(a.Run("orphans", nil)).To(MatchError("refusing to deprovision 2 of 3 deployments without confirmation of the count"))
+		Expect(errOut.String()).To(ContainSubstring("2 of the broker's 3 deployments are orphaned"))
+		Expect(fakeComposeClient.DeprovisionDeploymentCallCount()).To(Equal(0))
+	})
+
+	It("does not ask for the number of orphans when few deployments are orphaned", func() {
+		deployments := []composeapi.Deployment{{ID: "orphan", Name: "test-00000000-0000-0000-0000-000000000000"}}
+		ccInstances = []admin.CCInstance{}
+		for i := 1; i <= 10; i++ {
+			guid := fmt.Sprintf("00000000-0000-0000-0000-%012d", i)
+			deployments = append(deployments, composeapi.Deployment{ID: guid, Name: "test-" + guid})
+			ccInstances = append(ccInstances, admin.CCInstance{GUID: guid})
+		}
+		fakeComposeClient.GetDeploymentsReturns(&deployments, []error{})
+		a.PurgeOrphans = true
+		a.AssumeYes = true
+
+		Expect(a.Run("orphans", nil)).To(Succeed())
+		Expect(fakeComposeClient.DeprovisionDeploymentCallCount()).To(Equal(1))
+		Expect(fakeComposeClient.DeprovisionDeploymentArgsForCall(0)).To(Equal("orphan"))
+	})
+
+	It("refuses to deprovision when Cloud Controller lists no instances", func() {
+		ccInstances = []admin.CCInstance{}
+		a.PurgeOrphans = true
+		a.AssumeYes = true
+
+		Expect(a.Run("orphans", nil)).To(MatchError(ContainSubstring("the instance list from Cloud Controller is empty")))
+		Expect(fakeComposeClient.DeprovisionDeploymentCallCount()).To(Equal(0))
+	})
+
+	It("needs a list of CC instances", func() {
+		a.CCInstances = nil
+
+		Expect(a.Run("orphans", nil)).To(MatchError(ContainSubstring("orphans needs -cc-instances or -cc-api")))
+	})
+})
@@ -0,0 +1,128 @@
+package audit
+
+import (
+	"context"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/alphagov/paas-compose-broker/broker"
+)
+
+type serviceBroker struct {
+	broker brokerapi.ServiceBroker
+	log    *Log
+	logger lager.Logger
+}
+
+// NewServiceBroker wraps a brokerapi.ServiceBroker so that every call is
+// recorded in the audit log, with the CF user who made it. A call is not
+// failed when its event cannot be written; the error is logged instead.
+func NewServiceBroker(broker brokerapi.ServiceBroker, log *Log, logger lager.Logger) brokerapi.ServiceBroker {
+	return &serviceBroker{
+		broker: broker,
+		log:    log,
+		logger: logger.Session("audit"),
+	}
+}
+
+func (b *serviceBroker) record(ctx context.Context, event Event, async bool, err error) {
+	event.RequestID = broker.RequestID(ctx)
+	event.User = broker.OriginatingUser(ctx)
+	switch {
+	case err != nil:
+		event.Outcome = OutcomeFailed
+		event.Error = redactString(err.Error())
+	case async:
+		event.Outcome = OutcomeAccepted
+	default:
+		event.Outcome = OutcomeSucceeded
+	}
+	if recordErr := b.log.Record(event); recordErr != nil {
+		b.logger.Error("record-event", recordErr, lager.Data{
+			"action":      event.Action,
+			"instance-id": event.InstanceID,
+		})
+	}
+}
+
+func (b *serviceBroker) Services(ctx context.Context) []brokerapi.Service {
+	services := b.broker.Services(ctx)
+	b.record(ctx, Event{Action: "catalog"}, false, nil)
+	return services
+}
+
+func (b *serviceBroker) Provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, error) {
+	spec, err := b.broker.Provision(ctx, instanceID, details, asyncAllowed)
+	b.record(ctx, Event{
+		Action:           "provision",
+		InstanceID:       instanceID,
+		ServiceID:        details.ServiceID,
+		PlanID:           details.PlanID,
+		OrganizationGUID: details.OrganizationGUID,
+		SpaceGUID:        details.SpaceGUID,
+		Parameters:       RedactParameters(details.RawParameters),
+	}, spec.IsAsync, err)
+	return spec, err
+}
+
+func (b *serviceBroker) Deprovision(ctx context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (brokerapi.DeprovisionServiceSpec, error) {
+	spec, err := b.broker.Deprovision(ctx, instanceID, details, asyncAllowed)
+	b.record(ctx, Event{
+		Action:     "deprovision",
+		InstanceID: instanceID,
+		ServiceID:  details.ServiceID,
+		PlanID:     details.PlanID,
+	}, spec.IsAsync, err)
+	return spec, err
+}
+
+func (b *serviceBroker) Bind(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
+	binding, err := b.broker.Bind(ctx, instanceID, bindingID, details)
+	b.record(ctx, Event{
+		Action:     "bind",
+		InstanceID: instanceID,
+		BindingID:  bindingID,
+		AppGUID:    details.AppGUID,
+		ServiceID:  details.ServiceID,
+		PlanID:     details.PlanID,
+		Parameters: RedactParameters(details.RawParameters),
+	}, false, err)
+	return binding, err
+}
+
+func (b *serviceBroker) Unbind(ctx context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) error {
+	err := b.broker.Unbind(ctx, instanceID, bindingID, details)
+	b.record(ctx, Event{
+		Action:     "unbind",
+		InstanceID: instanceID,
+		BindingID:  bindingID,
+		ServiceID:  details.ServiceID,
+		PlanID:     details.PlanID,
+	}, false, err)
+	return err
+}
+
+func (b *serviceBroker) Update(ctx context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
+	spec, err := b.broker.Update(ctx, instanceID, details, asyncAllowed)
+	b.record(ctx, Event{
+		Action:           "update",
+		InstanceID:       instanceID,
+		ServiceID:        details.ServiceID,
+		PlanID:           details.PlanID,
+		OrganizationGUID: details.PreviousValues.OrgID,
+		SpaceGUID:        details.PreviousValues.SpaceID,
+		Parameters:       RedactParameters(details.RawParameters),
+	}, spec.IsAsync, err)
+	return spec, err
+}
+
+func (b *serviceBroker) LastOperation(ctx context.Context, instanceID, operationData string) (brokerapi.LastOperation, error) {
+	lastOperation, err := b.broker.LastOperation(ctx, instanceID, operationData)
+	event := Event{Action: "last_operation", InstanceID: instanceID}
+	if err == nil {
+		event.State = string(lastOperation.State)
+	}
+	b.record(ctx, event, false, err)
+	return lastOperation, err
+}
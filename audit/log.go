@@ -0,0 +1,150 @@
+// Package audit keeps a tamper-evident record of the service broker API
+// calls made to the broker: who asked for what, on which instance, and how
+// it turned out.
+package audit
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Outcomes of calls.
+const (
+	OutcomeSucceeded = "succeeded"
+	OutcomeAccepted  = "accepted"
+	OutcomeFailed    = "failed"
+)
+
+// ActionRestart is the action of the event a log records when the broker
+// starts.
+const ActionRestart = "restart"
+
+// Event records one call. Events are chained: each holds the hash of the
+// one before it in the same log, so that removing or changing an event
+// breaks the chain from there on. Hashes are HMACs, so that only holders of
+// the key can write events which verify.
+type Event struct {
+	Sequence         uint64          `json:"sequence"`
+	Time             time.Time       `json:"time"`
+	Action           string          `json:"action"`
+	RequestID        string          `json:"request_id,omitempty"`
+	User             string          `json:"user,omitempty"`
+	InstanceID       string          `json:"instance_id,omitempty"`
+	BindingID        string          `json:"binding_id,omitempty"`
+	AppGUID          string          `json:"app_guid,omitempty"`
+	ServiceID        string          `json:"service_id,omitempty"`
+	PlanID           string          `json:"plan_id,omitempty"`
+	OrganizationGUID string          `json:"organization_guid,omitempty"`
+	SpaceGUID        string          `json:"space_guid,omitempty"`
+	Parameters       json.RawMessage `json:"parameters,omitempty"`
+	Outcome          string          `json:"outcome"`
+	Error            string          `json:"error,omitempty"`
+	// State is the state reported by last_operation.
+	State    string `json:"state,omitempty"`
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// hash is the HMAC-SHA256 under key of the event without its own hash.
+func (e Event) hash(key []byte) (string, error) {
+	e.Hash = ""
+	encoded, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(encoded)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Log chains events and writes them to a sink.
+type Log struct {
+	sink Sink
+	key  []byte
+
+	mu       sync.Mutex
+	sequence uint64
+	prevHash string
+}
+
+// NewLog starts a log which continues the chain after last, or a new chain
+// if last is nil, hashing events with key.
+func NewLog(sink Sink, key []byte, last *Event) *Log {
+	l := &Log{sink: sink, key: key}
+	if last != nil {
+		l.sequence = last.Sequence
+		l.prevHash = last.Hash
+	}
+	return l
+}
+
+// Restart records that the broker has started, carrying on the chain if
+// the log continues one.
+func (l *Log) Restart() error {
+	return l.Record(Event{Action: ActionRestart, Outcome: OutcomeSucceeded})
+}
+
+// Record adds the event to the chain and writes it.
+func (l *Log) Record(event Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	event.Sequence = l.sequence + 1
+	event.PrevHash = l.prevHash
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	hash, err := event.hash(l.key)
+	if err != nil {
+		return err
+	}
+	event.Hash = hash
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if err := l.sink.Write(line); err != nil {
+		return err
+	}
+	l.sequence = event.Sequence
+	l.prevHash = event.Hash
+	return nil
+}
+
+// Verify checks the chain of events read from r, one JSON event per line,
+// against key and returns the last. Lines which are not events, such as
+// other output sharing the log, are skipped. A new chain may only start
+// with a restart event, where a broker was restarted without being able to
+// continue the chain.
+func Verify(r io.Reader, key []byte) (*Event, error) {
+	var last *Event
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || event.Hash == "" {
+			continue
+		}
+		hash, err := event.hash(key)
+		if err != nil {
+			return last, err
+		}
+		if !hmac.Equal([]byte(hash), []byte(event.Hash)) {
+			return last, fmt.Errorf("line %d: event %d has been changed, or was not written with this key", line, event.Sequence)
+		}
+		restart := event.Sequence == 1 && event.PrevHash == "" && event.Action == ActionRestart
+		if last != nil && !restart && (event.Sequence != last.Sequence+1 || event.PrevHash != last.Hash) {
+			return last, fmt.Errorf("line %d: event %d does not follow event %d", line, event.Sequence, last.Sequence)
+		}
+		last = &event
+	}
+	return last, scanner.Err()
+}
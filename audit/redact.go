@@ -0,0 +1,63 @@
+package audit
+
+import (
+	"encoding/json"
+	"net/url"
+
+	"github.com/alphagov/paas-compose-broker/logging"
+)
+
+const redacted = "[REDACTED]"
+
+// RedactParameters returns raw parameters with the values of keys which are
+// not logged and the credentials in URLs masked. Parameters which are not
+// JSON are dropped, as there is no telling what is in them.
+func RedactParameters(raw json.RawMessage) json.RawMessage {
+	if len(raw) == 0 {
+		return nil
+	}
+	var params interface{}
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return json.RawMessage(`"[INVALID]"`)
+	}
+	encoded, err := json.Marshal(redact(params))
+	if err != nil {
+		return nil
+	}
+	return encoded
+}
+
+func redact(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, inner := range v {
+			if logging.IsSensitiveKey(key) {
+				v[key] = redacted
+			} else {
+				v[key] = redact(inner)
+			}
+		}
+		return v
+	case []interface{}:
+		for i, inner := range v {
+			v[i] = redact(inner)
+		}
+		return v
+	case string:
+		if u, err := url.Parse(v); err == nil && u.User != nil && u.Scheme != "" {
+			u.User = url.User(redacted)
+			return u.String()
+		}
+		return redactString(v)
+	}
+	return value
+}
+
+// redactString masks the whole of a string with a sensitive value in it,
+// such as an error message quoting a connection string, as the logs do.
+func redactString(s string) string {
+	if logging.IsSensitiveValue(s) {
+		return redacted
+	}
+	return s
+}
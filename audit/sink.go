@@ -0,0 +1,97 @@
+package audit
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Sink writes encoded events, one per call.
+type Sink interface {
+	Write(event []byte) error
+}
+
+type writerSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSink writes events to w as JSON lines.
+func NewWriterSink(w io.Writer) Sink {
+	return &writerSink{w: w}
+}
+
+func (s *writerSink) Write(event []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.Write(append(append([]byte{}, event...), '\n'))
+	return err
+}
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+// NewSyslogSink writes events to the local syslog daemon.
+func NewSyslogSink(tag string) (Sink, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) Write(event []byte) error {
+	return s.w.Info(string(event))
+}
+
+// OpenFile opens a file for appending events, and returns the last event
+// already in it so that a log can continue its chain. It fails if the file
+// does not verify with key.
+func OpenFile(path string, key []byte) (Sink, *Event, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	last, err := Verify(f, key)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("audit log %s: %s", path, err)
+	}
+	return NewWriterSink(f), last, nil
+}
+
+// NewLogFromConfig returns a log writing to the sink described by config:
+// "stdout", "syslog" or "file:<path>", hashing events with key. It records
+// the restart of the broker. It returns nil for "none".
+func NewLogFromConfig(config string, key []byte) (*Log, error) {
+	var log *Log
+	switch {
+	case config == "none":
+		return nil, nil
+	case config == "stdout":
+		log = NewLog(NewWriterSink(os.Stdout), key, nil)
+	case config == "syslog":
+		sink, err := NewSyslogSink("compose-broker-audit")
+		if err != nil {
+			return nil, err
+		}
+		log = NewLog(sink, key, nil)
+	case strings.HasPrefix(config, "file:"):
+		sink, last, err := OpenFile(strings.TrimPrefix(config, "file:"), key)
+		if err != nil {
+			return nil, err
+		}
+		log = NewLog(sink, key, last)
+	default:
+		return nil, fmt.Errorf("unknown audit log sink: %s", config)
+	}
+
+	if err := log.Restart(); err != nil {
+		return nil, err
+	}
+	return log, nil
+}
@@ -0,0 +1,13 @@
+package auditevents_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestAuditEvents(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Audit Events Suite")
+}
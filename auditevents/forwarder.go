@@ -0,0 +1,349 @@
+// Package auditevents forwards Compose audit events about the broker's
+// deployments, such as logins, scaling and whitelist changes, to a SIEM as
+// JSON lines.
+package auditevents
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	composeapi "github.com/compose/gocomposeapi"
+
+	"github.com/alphagov/paas-compose-broker/broker"
+	"github.com/alphagov/paas-compose-broker/compose"
+	"github.com/alphagov/paas-compose-broker/leader"
+)
+
+const (
+	// checkpointKey is where the checkpoint is kept in the state store.
+	checkpointKey = "audit_events"
+	// instancesKey is where the instances of deployments seen are kept.
+	instancesKey = "audit_event_instances"
+	// forgetAfter is how long after the checkpoint passes the deletion of a
+	// deployment its instance is forgotten.
+	forgetAfter = 24 * time.Hour
+
+	DefaultInterval = time.Minute
+	pageSize        = 100
+	batchSize       = 100
+)
+
+// Event is a line sent to the SIEM: a Compose audit event tagged with the
+// service instance and space of its deployment.
+type Event struct {
+	ID           string            `json:"id"`
+	Event        string            `json:"event"`
+	CreatedAt    time.Time         `json:"created_at"`
+	DeploymentID string            `json:"deployment_id"`
+	InstanceID   string            `json:"instance_id"`
+	SpaceGUID    string            `json:"space_guid"`
+	UserID       string            `json:"user_id,omitempty"`
+	Email        string            `json:"email,omitempty"`
+	IP           string            `json:"ip,omitempty"`
+	UserAgent    string            `json:"user_agent,omitempty"`
+	Data         map[string]string `json:"data,omitempty"`
+}
+
+// checkpoint is the newest event handled. Compose times events to the
+// second, so the IDs of the events handled at that time are kept too.
+type checkpoint struct {
+	CreatedAt time.Time `json:"created_at"`
+	IDs       []string  `json:"ids,omitempty"`
+}
+
+func (c checkpoint) handled(event composeapi.AuditEvent) bool {
+	if event.CreatedAt.Before(c.CreatedAt) {
+		return true
+	}
+	if event.CreatedAt.After(c.CreatedAt) {
+		return false
+	}
+	for _, id := range c.IDs {
+		if id == event.ID {
+			return true
+		}
+	}
+	return false
+}
+
+func (c checkpoint) advance(event composeapi.AuditEvent) checkpoint {
+	if event.CreatedAt.Equal(c.CreatedAt) {
+		return checkpoint{CreatedAt: c.CreatedAt, IDs: append(append([]string{}, c.IDs...), event.ID)}
+	}
+	return checkpoint{CreatedAt: event.CreatedAt, IDs: []string{event.ID}}
+}
+
+// instance is the service instance of a deployment, remembered so that the
+// events of a deployment are still tagged after it is deleted.
+type instance struct {
+	ID        string `json:"instance_id"`
+	SpaceGUID string `json:"space_guid"`
+	// GoneAt is when the deployment was first found to be deleted.
+	GoneAt *time.Time `json:"gone_at,omitempty"`
+}
+
+// Forwarder posts new audit events to URL as newline-delimited JSON. It
+// saves a checkpoint before posting each batch and restores the previous
+// one if the post fails, so that no event is sent twice; a broker instance
+// stopping between the two loses that batch instead. The instances of
+// deployments seen are saved too, so that whichever broker instance leads
+// next can still tag the events of deleted deployments.
+type Forwarder struct {
+	Compose    compose.Client
+	Store      *compose.NotesStore
+	Leader     leader.Leader
+	DBPrefix   string
+	URL        string
+	HTTPClient *http.Client
+	Logger     lager.Logger
+
+	// instances are the instances of deployments seen, by deployment ID, as
+	// last saved.
+	instances map[string]instance
+}
+
+// Run forwards new events every interval until stop is closed.
+func (f *Forwarder) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			if err := f.RunOnce(ctx); err != nil {
+				f.Logger.Error("forward-audit-events", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// RunOnce forwards the events since the checkpoint, if this broker instance
+// is the leader. With no checkpoint it starts from now.
+func (f *Forwarder) RunOnce(ctx context.Context) error {
+	if !f.Leader.IsLeader() {
+		return nil
+	}
+
+	var cp checkpoint
+	found, err := f.Store.Get(ctx, checkpointKey, &cp)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return f.Store.Put(ctx, checkpointKey, checkpoint{CreatedAt: time.Now().UTC().Truncate(time.Second)})
+	}
+
+	events, err := f.eventsSince(ctx, cp)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	if err := f.refreshInstances(ctx, cp); err != nil {
+		return err
+	}
+
+	for len(events) > 0 {
+		// Another instance may have taken over, and be writing checkpoints
+		// of its own.
+		if !f.Leader.IsLeader() {
+			return nil
+		}
+		n := batchSize
+		if n > len(events) {
+			n = len(events)
+		}
+		cp, err = f.deliver(ctx, cp, events[:n])
+		if err != nil {
+			return err
+		}
+		events = events[n:]
+	}
+	return nil
+}
+
+// eventsSince returns the events not yet handled, oldest first. Compose
+// returns the newest events first, so pages are fetched going back in time.
+func (f *Forwarder) eventsSince(ctx context.Context, cp checkpoint) ([]composeapi.AuditEvent, error) {
+	client := compose.WithContext(ctx, f.Compose)
+	// Fetch a second before the checkpoint in case Compose compares times
+	// exclusively.
+	newerThan := cp.CreatedAt.Add(-time.Second)
+	params := composeapi.AuditEventsParams{NewerThan: &newerThan, Limit: pageSize}
+
+	seen := map[string]bool{}
+	events := []composeapi.AuditEvent{}
+	for {
+		page, errs := client.GetAuditEvents(params)
+		if len(errs) > 0 {
+			return nil, compose.SquashErrors(errs)
+		}
+		newEvents := 0
+		var oldest time.Time
+		for _, event := range *page {
+			if oldest.IsZero() || event.CreatedAt.Before(oldest) {
+				oldest = event.CreatedAt
+			}
+			if seen[event.ID] {
+				continue
+			}
+			seen[event.ID] = true
+			newEvents++
+			if !cp.handled(event) {
+				events = append(events, event)
+			}
+		}
+		if len(*page) < pageSize || newEvents == 0 {
+			break
+		}
+		// Overlap the pages by a second, as events share times.
+		olderThan := oldest.Add(time.Second)
+		params.OlderThan = &olderThan
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].CreatedAt.Equal(events[j].CreatedAt) {
+			return events[i].CreatedAt.Before(events[j].CreatedAt)
+		}
+		return events[i].ID < events[j].ID
+	})
+	return events, nil
+}
+
+// refreshInstances adds the instances of the broker's deployments to those
+// saved, marks those of deleted deployments as gone and forgets them once
+// the checkpoint is well past, saving any change.
+func (f *Forwarder) refreshInstances(ctx context.Context, cp checkpoint) error {
+	deployments, errs := compose.WithContext(ctx, f.Compose).GetDeployments()
+	if len(errs) > 0 {
+		return compose.SquashErrors(errs)
+	}
+	instances := map[string]instance{}
+	if _, err := f.Store.Get(ctx, instancesKey, &instances); err != nil {
+		return err
+	}
+
+	changed := false
+	current := map[string]bool{}
+	for _, deployment := range *deployments {
+		instanceID, ok := broker.InstanceIDFromName(f.DBPrefix, deployment.Name)
+		if !ok {
+			continue
+		}
+		current[deployment.ID] = true
+		if saved, ok := instances[deployment.ID]; ok && saved.ID == instanceID && saved.SpaceGUID == deployment.CustomerBillingCode && saved.GoneAt == nil {
+			continue
+		}
+		instances[deployment.ID] = instance{ID: instanceID, SpaceGUID: deployment.CustomerBillingCode}
+		changed = true
+	}
+	now := time.Now().UTC()
+	for deploymentID, saved := range instances {
+		switch {
+		case current[deploymentID]:
+		case saved.GoneAt == nil:
+			saved.GoneAt = &now
+			instances[deploymentID] = saved
+			changed = true
+		case saved.GoneAt.Before(cp.CreatedAt.Add(-forgetAfter)):
+			delete(instances, deploymentID)
+			changed = true
+		}
+	}
+
+	if changed {
+		if err := f.Store.Put(ctx, instancesKey, instances); err != nil {
+			return err
+		}
+	}
+	f.instances = instances
+	return nil
+}
+
+// deliver posts the events of the broker's deployments in a batch, and
+// returns the checkpoint after it.
+func (f *Forwarder) deliver(ctx context.Context, cp checkpoint, events []composeapi.AuditEvent) (checkpoint, error) {
+	var lines bytes.Buffer
+	next := cp
+	encoder := json.NewEncoder(&lines)
+	for _, event := range events {
+		next = next.advance(event)
+		owner, ok := f.instances[event.DeploymentID]
+		if !ok {
+			continue
+		}
+		err := encoder.Encode(Event{
+			ID:           event.ID,
+			Event:        event.Event,
+			CreatedAt:    event.CreatedAt,
+			DeploymentID: event.DeploymentID,
+			InstanceID:   owner.ID,
+			SpaceGUID:    owner.SpaceGUID,
+			UserID:       event.UserID,
+			Email:        event.Email,
+			IP:           event.IP,
+			UserAgent:    event.UserAgent,
+			Data:         event.Data,
+		})
+		if err != nil {
+			return cp, err
+		}
+	}
+
+	if err := f.Store.Put(ctx, checkpointKey, next); err != nil {
+		return cp, err
+	}
+	if lines.Len() == 0 {
+		return next, nil
+	}
+
+	if err := f.post(ctx, lines.Bytes()); err != nil {
+		if restoreErr := f.Store.Put(context.Background(), checkpointKey, cp); restoreErr != nil {
+			f.Logger.Error("audit-events-lost", restoreErr, lager.Data{
+				"from": cp.CreatedAt,
+				"to":   next.CreatedAt,
+			})
+		}
+		return cp, err
+	}
+	f.Logger.Info("forwarded-audit-events", lager.Data{"up-to": next.CreatedAt})
+	return next, nil
+}
+
+func (f *Forwarder) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest("POST", f.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	httpClient := f.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if urlErr, ok := err.(*url.Error); ok {
+		// The URL may have credentials in it.
+		err = urlErr.Err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to post audit events: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("failed to post audit events: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package auditevents_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	composeapi "github.com/compose/gocomposeapi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/paas-compose-broker/auditevents"
+	"github.com/alphagov/paas-compose-broker/compose"
+	"github.com/alphagov/paas-compose-broker/compose/fakes"
+	"github.com/alphagov/paas-compose-broker/leader"
+)
+
+var _ = Describe("Forwarder", func() {
+	var (
+		fakeComposeClient *fakes.FakeClient
+		siem              *httptest.Server
+		siemStatus        int
+		mu                sync.Mutex
+		received          []auditevents.Event
+		notes             string
+		events            []composeapi.AuditEvent
+		forwarder         *auditevents.Forwarder
+		base              time.Time
+	)
+
+	event := func(id, deploymentID string, offset time.Duration) composeapi.AuditEvent {
+		return composeapi.AuditEvent{
+			ID:           id,
+			DeploymentID: deploymentID,
+			Event:        "deployment.scale",
+			CreatedAt:    base.Add(offset),
+			UserID:       "compose-user",
+			Data:         map[string]string{"units": "2"},
+		}
+	}
+
+	receivedIDs := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		ids := []string{}
+		for _, event := range received {
+			ids = append(ids, event.ID)
+		}
+		return ids
+	}
+
+	BeforeEach(func() {
+		base = time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+		received = nil
+		siemStatus = http.StatusOK
+		notes = fmt.Sprintf(`{"audit_events":{"created_at":"%s"}}`, base.Format(time.RFC3339))
+		events = []composeapi.AuditEvent{}
+
+		siem = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.Header.Get("Content-Type")).To(Equal("application/x-ndjson"))
+			if siemStatus != http.StatusOK {
+				w.WriteHeader(siemStatus)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			scanner := bufio.NewScanner(r.Body)
+			for scanner.Scan() {
+				var event auditevents.Event
+				Expect(json.Unmarshal(scanner.Bytes(), &event)).To(Succeed())
+				received = append(received, event)
+			}
+		}))
+
+		fakeComposeClient = &fakes.FakeClient{}
+		fakeComposeClient.GetDeploymentByNameReturns(&composeapi.Deployment{ID: "lock"}, nil)
+		fakeComposeClient.GetDeploymentStub = func(id string) (*composeapi.Deployment, []error) {
+			return &composeapi.Deployment{ID: id, Notes: notes}, nil
+		}
+		fakeComposeClient.PatchDeploymentStub = func(params composeapi.PatchDeploymentParams) (*composeapi.Deployment, []error) {
+			notes = params.Notes
+			return &composeapi.Deployment{ID: params.DeploymentID, Notes: notes}, nil
+		}
+		fakeComposeClient.GetDeploymentsReturns(&[]composeapi.Deployment{
+			{ID: "d1", Name: "test-00000000-0000-0000-0000-000000000001", CustomerBillingCode: "space-1"},
+			{ID: "d2", Name: "someone-else"},
+		}, nil)
+		// Like Compose, return the newest events first.
+		fakeComposeClient.GetAuditEventsStub = func(params composeapi.AuditEventsParams) (*[]composeapi.AuditEvent, []error) {
+			page := []composeapi.AuditEvent{}
+			for i := len(events) - 1; i >= 0; i-- {
+				event := events[i]
+				if params.NewerThan != nil && !event.CreatedAt.After(*params.NewerThan) {
+					continue
+				}
+				if params.OlderThan != nil && !event.CreatedAt.Before(*params.OlderThan) {
+					continue
+				}
+				if len(page) == params.Limit {
+					break
+				}
+				page = append(page, event)
+			}
+			return &page, nil
+		}
+
+		forwarder = &auditevents.Forwarder{
+			Compose:  fakeComposeClient,
+			Store:    compose.NewNotesStore(fakeComposeClient, "broker-lock"),
+			Leader:   leader.Static(true),
+			DBPrefix: "test",
+			URL:      siem.URL,
+			Logger:   lager.NewLogger("test"),
+		}
+	})
+
+	AfterEach(func() {
+		siem.Close()
+	})
+
+	It("forwards the events of the broker's deployments, oldest first", func() {
+		events = []composeapi.AuditEvent{
+			event("e1", "d1", time.Second),
+			event("e2", "d2", 2*time.Second),
+			event("e3", "d1", 3*time.Second),
+		}
+
+		Expect(forwarder.RunOnce(context.Background())).To(Succeed())
+
+		Expect(receivedIDs()).To(Equal([]string{"e1", "e3"}))
+		Expect(received[0]).To(Equal(auditevents.Event{
+			ID:           "e1",
+			Event:        "deployment.scale",
+			CreatedAt:    base.Add(time.Second),
+			DeploymentID: "d1",
+			InstanceID:   "00000000-0000-0000-0000-000000000001",
+			SpaceGUID:    "space-1",
+			UserID:       "compose-user",
+			Data:         map[string]string{"units": "2"},
+		}))
+	})
+
+	It("does not send an event twice", func() {
+		events = []composeapi.AuditEvent{
+			event("e1", "d1", time.Second),
+			event("e2", "d1", time.Second),
+		}
+		Expect(forwarder.RunOnce(context.Background())).To(Succeed())
+
+		events = append(events, event("e3", "d1", time.Second), event("e4", "d1", 2*time.Second))
+		Expect(forwarder.RunOnce(context.Background())).To(Succeed())
+		Expect(forwarder.RunOnce(context.Background())).To(Succeed())
+
+		Expect(receivedIDs()).To(Equal([]string{"e1", "e2", "e3", "e4"}))
+	})
+
+	It("pages through the events since the checkpoint", func() {
+		for i := 0; i < 250; i++ {
+			events = append(events, event(fmt.Sprintf("e%03d", i), "d1", time.Duration(i)*time.Second))
+		}
+
+		Expect(forwarder.RunOnce(context.Background())).To(Succeed())
+
+		ids := receivedIDs()
+		Expect(ids).To(HaveLen(250))
+		Expect(ids[0]).To(Equal("e000"))
+		Expect(ids[249]).To(Equal("e249"))
+	})
+
+	It("sends the events again later if the SIEM does not accept them", func() {
+		events = []composeapi.AuditEvent{event("e1", "d1", time.Second)}
+		siemStatus = http.StatusServiceUnavailable
+
+		Expect(forwarder.RunOnce(context.Background())).To(MatchError("failed to post audit events: 503 Service Unavailable"))
+		var saved map[string]json.RawMessage
+		Expect(json.Unmarshal([]byte(notes), &saved)).To(Succeed())
+		Expect(saved["audit_events"]).To(MatchJSON(fmt.Sprintf(`{"created_at":"%s"}`, base.Format(time.RFC3339))))
+
+		siemStatus = http.StatusOK
+		Expect(forwarder.RunOnce(context.Background())).To(Succeed())
+		Expect(receivedIDs()).To(Equal([]string{"e1"}))
+	})
+
+	It("starts from now when there is no checkpoint", func() {
+		notes = `{"leader":{"holder":"someone"}}`
+		events = []composeapi.AuditEvent{event("e1", "d1", time.Second)}
+
+		Expect(forwarder.RunOnce(context.Background())).To(Succeed())
+
+		Expect(receivedIDs()).To(BeEmpty())
+		var saved struct {
+			Leader      map[string]string `json:"leader"`
+			AuditEvents struct {
+				CreatedAt time.Time `json:"created_at"`
+			} `json:"audit_events"`
+		}
+		Expect(json.Unmarshal([]byte(notes), &saved)).To(Succeed())
+		Expect(saved.Leader).To(Equal(map[string]string{"holder": "someone"}))
+		Expect(saved.AuditEvents.CreatedAt).To(BeTemporally("~", time.Now(), 2*time.Second))
+	})
+
+	It("tags the events of a deployment deleted before another broker instance took over", func() {
+		events = []composeapi.AuditEvent{event("e1", "d1", time.Second)}
+		Expect(forwarder.RunOnce(context.Background())).To(Succeed())
+
+		fakeComposeClient.GetDeploymentsReturns(&[]composeapi.Deployment{}, nil)
+		events = append(events, event("e2", "d1", 2*time.Second))
+		next := &auditevents.Forwarder{
+			Compose:  fakeComposeClient,
+			Store:    compose.NewNotesStore(fakeComposeClient, "broker-lock"),
+			Leader:   leader.Static(true),
+			DBPrefix: "test",
+			URL:      siem.URL,
+			Logger:   lager.NewLogger("test"),
+		}
+		Expect(next.RunOnce(context.Background())).To(Succeed())
+
+		Expect(receivedIDs()).To(Equal([]string{"e1", "e2"}))
+		Expect(received[1].InstanceID).To(Equal("00000000-0000-0000-0000-000000000001"))
+	})
+
+	It("forgets the instances of deployments deleted a day before the checkpoint", func() {
+		goneAt := base.Add(-25 * time.Hour)
+		notes = fmt.Sprintf(`{
+			"audit_events": {"created_at": "%s"},
+			"audit_event_instances": {
+				"d1": {"instance_id": "00000000-0000-0000-0000-000000000001", "space_guid": "space-1"},
+				"d3": {"instance_id": "00000000-0000-0000-0000-000000000003", "space_guid": "space-1", "gone_at": "%s"}
+			}
+		}`, base.Format(time.RFC3339), goneAt.Format(time.RFC3339))
+		events = []composeapi.AuditEvent{event("e1", "d1", time.Second)}
+
+		Expect(forwarder.RunOnce(context.Background())).To(Succeed())
+
+		var saved struct {
+			Instances map[string]json.RawMessage `json:"audit_event_instances"`
+		}
+		Expect(json.Unmarshal([]byte(notes), &saved)).To(Succeed())
+		Expect(saved.Instances).To(HaveLen(1))
+		Expect(saved.Instances).To(HaveKey("d1"))
+	})
+
+	It("does nothing unless it is the leader", func() {
+		forwarder.Leader = leader.Static(false)
+		events = []composeapi.AuditEvent{event("e1", "d1", time.Second)}
+
+		Expect(forwarder.RunOnce(context.Background())).To(Succeed())
+
+		Expect(fakeComposeClient.GetAuditEventsCallCount()).To(Equal(0))
+		Expect(receivedIDs()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,287 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	composeapi "github.com/compose/gocomposeapi"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/alphagov/paas-compose-broker/leader"
+)
+
+// Alert is a Compose alert on one of a deployment's capsules, such as a disk
+// filling up.
+type Alert struct {
+	CapsuleID string `json:"capsule_id"`
+	Status    string `json:"status"`
+	Message   string `json:"message"`
+}
+
+// InstanceAlerts are the alerts Compose has raised on an instance's
+// deployment. They are not returned when an instance is fetched, as the
+// vendored brokerapi has no GetInstance.
+type InstanceAlerts struct {
+	InstanceID   string  `json:"instance_id"`
+	DeploymentID string  `json:"deployment_id"`
+	SpaceGUID    string  `json:"space_guid"`
+	Summary      string  `json:"summary,omitempty"`
+	Alerts       []Alert `json:"alerts"`
+}
+
+// Describe summarises the alerts for a tenant, or returns "" if there are
+// none.
+func (a *InstanceAlerts) Describe() string {
+	if len(a.Alerts) == 0 {
+		return ""
+	}
+	messages := []string{}
+	for _, alert := range a.Alerts {
+		messages = append(messages, fmt.Sprintf("%s: %s", alert.Status, alert.Message))
+	}
+	noun := "alerts"
+	if len(a.Alerts) == 1 {
+		noun = "alert"
+	}
+	return fmt.Sprintf("Compose reports %d %s: %s", len(a.Alerts), noun, strings.Join(messages, "; "))
+}
+
+func (b *Broker) deploymentAlerts(ctx context.Context, instanceID string, deployment *composeapi.Deployment) (*InstanceAlerts, error) {
+	alerts, errs := b.composeClient(ctx).GetAlertsForDeployment(deployment.ID)
+	if len(errs) > 0 {
+		return nil, composeError(errs)
+	}
+	result := &InstanceAlerts{
+		InstanceID:   instanceID,
+		DeploymentID: deployment.ID,
+		SpaceGUID:    deployment.CustomerBillingCode,
+		Alerts:       []Alert{},
+	}
+	if alerts == nil {
+		return result, nil
+	}
+	result.Summary = alerts.Summary
+	for _, alert := range alerts.Embedded.Alerts {
+		result.Alerts = append(result.Alerts, Alert{
+			CapsuleID: alert.CapsuleID,
+			Status:    alert.Status,
+			Message:   alert.Message,
+		})
+	}
+	return result, nil
+}
+
+// InstanceAlerts returns the alerts on an instance's deployment.
+func (b *Broker) InstanceAlerts(ctx context.Context, instanceID string) (*InstanceAlerts, error) {
+	instanceName, err := MakeInstanceName(b.Config.DBPrefix, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	deployment, err := b.findDeployment(ctx, instanceName)
+	if err == ErrDeploymentNotFound {
+		return nil, brokerapi.ErrInstanceDoesNotExist
+	} else if err != nil {
+		return nil, err
+	}
+	return b.deploymentAlerts(ctx, instanceID, deployment)
+}
+
+// AllAlerts returns the alerts on every broker-owned deployment which has
+// any, ordered by instance.
+func (b *Broker) AllAlerts(ctx context.Context) ([]InstanceAlerts, error) {
+	deployments, errs := b.composeClient(ctx).GetDeployments()
+	if len(errs) > 0 {
+		return nil, composeError(errs)
+	}
+
+	result := []InstanceAlerts{}
+	for i := range *deployments {
+		deployment := &(*deployments)[i]
+		instanceID, ok := InstanceIDFromName(b.Config.DBPrefix, deployment.Name)
+		if !ok {
+			continue
+		}
+		alerts, err := b.deploymentAlerts(ctx, instanceID, deployment)
+		if err != nil {
+			return nil, err
+		}
+		if len(alerts.Alerts) > 0 {
+			result = append(result, *alerts)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].InstanceID < result[j].InstanceID
+	})
+	return result, nil
+}
+
+// withAlerts appends the alerts on a deployment to the description of an
+// operation which has finished. Alerts are only informational, so failing
+// to fetch them is logged rather than failing the operation.
+func (b *Broker) withAlerts(ctx context.Context, deploymentID string, lastOperation brokerapi.LastOperation) brokerapi.LastOperation {
+	alerts, err := b.deploymentAlerts(ctx, "", &composeapi.Deployment{ID: deploymentID})
+	if err != nil {
+		b.logger(ctx).Error("get-alerts", err, lager.Data{"deployment-id": deploymentID})
+		return lastOperation
+	}
+	if description := alerts.Describe(); description != "" {
+		if lastOperation.Description != "" {
+			description = lastOperation.Description + ". " + description
+		}
+		lastOperation.Description = description
+	}
+	return lastOperation
+}
+
+// AlertsHandler lists the alerts on broker-owned deployments to operators,
+// or those on one instance with ?instance_id=. It must be wrapped in the
+// same basic auth as the broker API.
+func AlertsHandler(b *Broker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		var result interface{}
+		var err error
+		if instanceID := req.URL.Query().Get("instance_id"); instanceID != "" {
+			result, err = b.InstanceAlerts(req.Context(), instanceID)
+		} else {
+			result, err = b.AllAlerts(req.Context())
+		}
+		if err == brokerapi.ErrInstanceDoesNotExist {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(brokerapi.ErrorResponse{Description: err.Error()})
+			return
+		} else if err != nil {
+			b.logger(req.Context()).Error("alerts", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(brokerapi.ErrorResponse{Description: err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+// DefaultAlertCheckInterval is how often the AlertNotifier checks for alerts.
+const DefaultAlertCheckInterval = 5 * time.Minute
+
+// AlertNotifier posts alerts on broker-owned deployments to a webhook as
+// they are raised. Every broker instance runs one, but only the leader's
+// posts. Alerts already posted are remembered in memory, so they are posted
+// again when the leader changes.
+type AlertNotifier struct {
+	Broker        *Broker
+	Leader        leader.Leader
+	URL           string
+	HTTPClient    *http.Client
+	CheckInterval time.Duration
+
+	posted map[postedAlert]bool
+}
+
+// postedAlert identifies an alert across deployments.
+type postedAlert struct {
+	deploymentID string
+	alert        Alert
+}
+
+// Run checks for new alerts every CheckInterval until stop is closed.
+func (n *AlertNotifier) Run(stop <-chan struct{}) {
+	interval := n.CheckInterval
+	if interval <= 0 {
+		interval = DefaultAlertCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			if err := n.RunOnce(ctx); err != nil {
+				n.Broker.Logger.Session("alert-notifier").Error("notify", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// RunOnce posts the instances with alerts not yet posted, with all of their
+// alerts, if this broker instance is the leader. Alerts which have cleared
+// are forgotten, so they are posted again if they are raised again.
+func (n *AlertNotifier) RunOnce(ctx context.Context) error {
+	if !n.Leader.IsLeader() {
+		n.posted = nil
+		return nil
+	}
+
+	all, err := n.Broker.AllAlerts(ctx)
+	if err != nil {
+		return err
+	}
+
+	current := map[postedAlert]bool{}
+	raised := []InstanceAlerts{}
+	for _, instance := range all {
+		isNew := false
+		for _, alert := range instance.Alerts {
+			key := postedAlert{deploymentID: instance.DeploymentID, alert: alert}
+			current[key] = true
+			if !n.posted[key] {
+				isNew = true
+			}
+		}
+		if isNew {
+			raised = append(raised, instance)
+		}
+	}
+
+	if len(raised) > 0 {
+		if err := n.post(ctx, raised); err != nil {
+			return err
+		}
+		n.Broker.Logger.Info("alerts-posted", lager.Data{"instances": len(raised)})
+	}
+	n.posted = current
+	return nil
+}
+
+func (n *AlertNotifier) post(ctx context.Context, alerts []InstanceAlerts) error {
+	body, err := json.Marshal(map[string]interface{}{"alerts": alerts})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	httpClient := n.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if urlErr, ok := err.(*url.Error); ok {
+		// The URL may have credentials in it.
+		err = urlErr.Err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to post alerts: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("failed to post alerts: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package broker_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"code.cloudfoundry.org/lager"
+	composeapi "github.com/compose/gocomposeapi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/alphagov/paas-compose-broker/broker"
+	"github.com/alphagov/paas-compose-broker/catalog"
+	"github.com/alphagov/paas-compose-broker/compose/fakes"
+	"github.com/alphagov/paas-compose-broker/config"
+	enginefakes "github.com/alphagov/paas-compose-broker/dbengine/fakes"
+	"github.com/alphagov/paas-compose-broker/leader"
+)
+
+var _ = Describe("Alerts", func() {
+	var (
+		fakeComposeClient *fakes.FakeClient
+		b                 *broker.Broker
+		alerts            map[string][]composeapi.Alert
+	)
+
+	BeforeEach(func() {
+		alerts = map[string][]composeapi.Alert{
+			"d1": {{CapsuleID: "c1", Status: "warning", Message: "disk usage is above 90%"}},
+			"d3": {},
+		}
+		fakeComposeClient = &fakes.FakeClient{}
+		fakeComposeClient.GetAccountReturns(&composeapi.Account{ID: "1"}, []error{})
+		fakeComposeClient.GetDeploymentsReturns(&[]composeapi.Deployment{
+			{ID: "d1", Name: "test-00000000-0000-0000-0000-000000000001", CustomerBillingCode: "space-1"},
+			{ID: "d2", Name: "someone-else"},
+			{ID: "d3", Name: "test-00000000-0000-0000-0000-000000000003"},
+		}, []error{})
+		fakeComposeClient.GetDeploymentByNameStub = func(name string) (*composeapi.Deployment, []error) {
+			return &composeapi.Deployment{ID: "d1", Name: name, CustomerBillingCode: "space-1"}, nil
+		}
+		fakeComposeClient.GetAlertsForDeploymentStub = func(deploymentID string) (*composeapi.Alerts, []error) {
+			result := &composeapi.Alerts{}
+			result.Embedded.Alerts = alerts[deploymentID]
+			return result, nil
+		}
+
+		var err error
+		b, err = broker.New(fakeComposeClient, enginefakes.FakeProvider{}, &config.Config{DBPrefix: "test"}, &catalog.Catalog{}, lager.NewLogger("test"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("lists the broker's deployments which have alerts", func() {
+		all, err := b.AllAlerts(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(all).To(Equal([]broker.InstanceAlerts{{
+			InstanceID:   "00000000-0000-0000-0000-000000000001",
+			DeploymentID: "d1",
+			SpaceGUID:    "space-1",
+			Alerts:       []broker.Alert{{CapsuleID: "c1", Status: "warning", Message: "disk usage is above 90%"}},
+		}}))
+		Expect(fakeComposeClient.GetAlertsForDeploymentCallCount()).To(Equal(2))
+	})
+
+	It("serves the alerts of an instance to operators", func() {
+		resp := httptest.NewRecorder()
+		broker.AlertsHandler(b).ServeHTTP(resp, httptest.NewRequest("GET", "/alerts?instance_id=00000000-0000-0000-0000-000000000001", nil))
+
+		Expect(resp.Code).To(Equal(http.StatusOK))
+		Expect(resp.Body.String()).To(MatchJSON(`{
+			"instance_id": "00000000-0000-0000-0000-000000000001",
+			"deployment_id": "d1",
+			"space_guid": "space-1",
+			"alerts": [{"capsule_id": "c1", "status": "warning", "message": "disk usage is above 90%"}]
+		}`))
+		Expect(fakeComposeClient.GetDeploymentByNameArgsForCall(0)).To(Equal("test-00000000-0000-0000-0000-000000000001"))
+	})
+
+	It("summarises the alerts after an update", func() {
+		fakeComposeClient.GetRecipeReturns(&composeapi.Recipe{Status: "complete", DeploymentID: "d1"}, nil)
+
+		lastOperation, err := b.LastOperation(context.Background(), "00000000-0000-0000-0000-000000000001", `{"type":"update","recipe_id":"r1"}`)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(lastOperation).To(Equal(brokerapi.LastOperation{
+			State:       brokerapi.Succeeded,
+			Description: "Compose reports 1 alert: warning: disk usage is above 90%",
+		}))
+	})
+
+	It("does not fail an update when the alerts cannot be fetched", func() {
+		fakeComposeClient.GetRecipeReturns(&composeapi.Recipe{Status: "complete", StatusDetail: "Scaled", DeploymentID: "d1"}, nil)
+		fakeComposeClient.GetAlertsForDeploymentReturns(nil, []error{http.ErrHandlerTimeout})
+		fakeComposeClient.GetAlertsForDeploymentStub = nil
+
+		lastOperation, err := b.LastOperation(context.Background(), "00000000-0000-0000-0000-000000000001", `{"type":"update","recipe_id":"r1"}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lastOperation.Description).To(Equal("Scaled"))
+	})
+
+	Describe("AlertNotifier", func() {
+		var (
+			webhook  *httptest.Server
+			mu       sync.Mutex
+			posts    []map[string][]broker.InstanceAlerts
+			notifier *broker.AlertNotifier
+		)
+
+		posted := func() []map[string][]broker.InstanceAlerts {
+			mu.Lock()
+			defer mu.Unlock()
+			return posts
+		}
+
+		BeforeEach(func() {
+			posts = nil
+			webhook = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var body map[string][]broker.InstanceAlerts
+				Expect(json.NewDecoder(r.Body).Decode(&body)).To(Succeed())
+				mu.Lock()
+				defer mu.Unlock()
+				posts = append(posts, body)
+			}))
+			notifier = &broker.AlertNotifier{
+				Broker: b,
+				Leader: leader.Static(true),
+				URL:    webhook.URL,
+			}
+		})
+
+		AfterEach(func() {
+			webhook.Close()
+		})
+
+		It("posts alerts once, and again if they are raised again", func() {
+			Expect(notifier.RunOnce(context.Background())).To(Succeed())
+			Expect(notifier.RunOnce(context.Background())).To(Succeed())
+			Expect(posted()).To(HaveLen(1))
+			Expect(posted()[0]["alerts"][0].InstanceID).To(Equal("00000000-0000-0000-0000-000000000001"))
+
+			alerts["d3"] = []composeapi.Alert{{CapsuleID: "c3", Status: "critical", Message: "disk full"}}
+			Expect(notifier.RunOnce(context.Background())).To(Succeed())
+			Expect(posted()).To(HaveLen(2))
+			Expect(posted()[1]["alerts"]).To(HaveLen(1))
+			Expect(posted()[1]["alerts"][0].InstanceID).To(Equal("00000000-0000-0000-0000-000000000003"))
+
+			delete(alerts, "d1")
+			Expect(notifier.RunOnce(context.Background())).To(Succeed())
+			alerts["d1"] = []composeapi.Alert{{CapsuleID: "c1", Status: "warning", Message: "disk usage is above 90%"}}
+			Expect(notifier.RunOnce(context.Background())).To(Succeed())
+			Expect(posted()).To(HaveLen(3))
+		})
+
+		It("does nothing unless it is the leader", func() {
+			notifier.Leader = leader.Static(false)
+
+			Expect(notifier.RunOnce(context.Background())).To(Succeed())
+
+			Expect(posted()).To(BeEmpty())
+			Expect(fakeComposeClient.GetDeploymentsCallCount()).To(Equal(0))
+		})
+	})
+})
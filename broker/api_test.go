@@ -1,6 +1,7 @@
 package broker_test
 
 import (
+	"context"
 	"errors"
 	"strings"
 
@@ -10,19 +11,24 @@ import (
 	. "github.com/onsi/gomega"
 
 	"bytes"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"time"
 
 	"github.com/alphagov/paas-compose-broker/broker"
 	"github.com/alphagov/paas-compose-broker/catalog"
+	"github.com/alphagov/paas-compose-broker/compose"
 	"github.com/alphagov/paas-compose-broker/compose/fakes"
 	"github.com/alphagov/paas-compose-broker/config"
 	enginefakes "github.com/alphagov/paas-compose-broker/dbengine/fakes"
+	"github.com/alphagov/paas-compose-broker/s3/s3test"
 	"github.com/pivotal-cf/brokerapi"
 	uuid "github.com/satori/go.uuid"
 )
@@ -62,7 +68,10 @@ var _ = Describe("Broker API", func() {
 
 	var (
 		fakeComposeClient *fakes.FakeClient
+		dbEngineProvider  enginefakes.FakeProvider
+		minBackupInterval string
 		cfg               *config.Config
+		exportHTTPClient  *http.Client
 		brokerAPI         http.Handler
 		service           = brokerapi.Service{
 			ID:            uuid.NewV4().String(),
@@ -114,7 +123,7 @@ var _ = Describe("Broker API", func() {
 			logger := lager.NewLogger("compose-broker")
 			logger.RegisterSink(lager.NewWriterSink(GinkgoWriter, cfg.LogLevel))
 
-			broker, err := broker.New(fakeComposeClient, enginefakes.FakeProvider{}, cfg, &catalog.Catalog{
+			serviceBroker, err := broker.New(fakeComposeClient, dbEngineProvider, cfg, &catalog.Catalog{
 				Services: []*catalog.Service{
 					{
 						Plans: []*catalog.Plan{
@@ -123,8 +132,9 @@ var _ = Describe("Broker API", func() {
 									ID: service.Plans[0].ID,
 								},
 								Compose: catalog.ComposeConfig{
-									Units:        1,
-									DatabaseType: "fakedb",
+									Units:             1,
+									DatabaseType:      "fakedb",
+									MinBackupInterval: minBackupInterval,
 								},
 							},
 						},
@@ -133,19 +143,23 @@ var _ = Describe("Broker API", func() {
 				},
 			}, logger)
 			Expect(err).NotTo(HaveOccurred())
+			serviceBroker.ExportHTTPClient = exportHTTPClient
 
-			return brokerapi.New(
-				broker,
+			return broker.WithOriginatingIdentity(brokerapi.New(
+				serviceBroker,
 				logger,
 				brokerapi.BrokerCredentials{
 					Username: cfg.Username,
 					Password: cfg.Password,
 				},
-			)
+			))
 		}
 	)
 
 	BeforeEach(func() {
+		dbEngineProvider = enginefakes.FakeProvider{}
+		minBackupInterval = "1h"
+		exportHTTPClient = nil
 		cfg = &config.Config{
 			Username: "jeff",
 			Password: "j3ffers0n",
@@ -217,9 +231,6 @@ var _ = Describe("Broker API", func() {
 		It("provisions an instance", func() {
 			instanceID := uuid.NewV4().String()
 			fakeComposeClient.CreateDeploymentReturns(&composeapi.Deployment{ID: "1", ProvisionRecipeID: "provision-recipe-id"}, []error{})
-			fakeComposeClient.CreateDeploymentWhitelistReturnsOnCall(0, &composeapi.Recipe{ID: "id-for-1.1.1.1", Status: "complete"}, []error{})
-			fakeComposeClient.CreateDeploymentWhitelistReturnsOnCall(1, &composeapi.Recipe{ID: "id-for-2.2.2.2", Status: "complete"}, []error{})
-			fakeComposeClient.CreateDeploymentWhitelistReturnsOnCall(2, &composeapi.Recipe{ID: "id-for-3.3.3.3", Status: "complete"}, []error{})
 
 			resp := DoRequest(brokerAPI, NewRequest(
 				"PUT",
@@ -241,7 +252,8 @@ var _ = Describe("Broker API", func() {
 			{
 			  "recipe_id":"provision-recipe-id",
 			  "type":"provision",
-			  "whitelist_recipe_ids":["id-for-1.1.1.1","id-for-2.2.2.2","id-for-3.3.3.3"]
+			  "deployment_id":"1",
+			  "whitelist_recipe_ids":[]
 			}
 			`))
 
@@ -255,46 +267,24 @@ var _ = Describe("Broker API", func() {
 				SSL:                 true,
 				ClusterID:           "",
 				CustomerBillingCode: "space-id",
+				Notes:               `{"organization_guid":"test-organization-id","plan_id":"` + service.Plans[0].ID + `","provision":{"step":"whitelist"}}`,
 			}
 			Expect(fakeComposeClient.CreateDeploymentArgsForCall(0)).To(Equal(expectedDeploymentParams))
 
-			By("adding all whitelist entries")
-			var args composeapi.DeploymentWhitelistParams
-			_, args = fakeComposeClient.CreateDeploymentWhitelistArgsForCall(0)
-			Expect(args).To(Equal(composeapi.DeploymentWhitelistParams{
-				IP:          "1.1.1.1",
-				Description: "Allow 1.1.1.1 to access deployment",
-			}))
-			_, args = fakeComposeClient.CreateDeploymentWhitelistArgsForCall(1)
-			Expect(args).To(Equal(composeapi.DeploymentWhitelistParams{
-				IP:          "2.2.2.2",
-				Description: "Allow 2.2.2.2 to access deployment",
-			}))
-			_, args = fakeComposeClient.CreateDeploymentWhitelistArgsForCall(2)
-			Expect(args).To(Equal(composeapi.DeploymentWhitelistParams{
-				IP:          "3.3.3.3",
-				Description: "Allow 3.3.3.3 to access deployment",
-			}))
+			By("leaving the whitelist to last_operation")
+			Expect(fakeComposeClient.CreateDeploymentWhitelistCallCount()).To(Equal(0))
 
 			By("not deprovisioning, as would happen in an error situation")
 			Expect(fakeComposeClient.DeprovisionDeploymentCallCount()).
 				To(Equal(0))
 		})
 
-		It("500s and deprovisions if any of the whitelist entry requests fail", func() {
-			instanceID := uuid.NewV4().String()
-			fakeComposeClient.CreateDeploymentReturns(&composeapi.Deployment{ID: "1", ProvisionRecipeID: "provision-recipe-id"}, []error{})
-
-			fakeComposeClient.CreateDeploymentWhitelistReturnsOnCall(
-				0, nil, []error{},
-			)
-			fakeComposeClient.CreateDeploymentWhitelistReturnsOnCall(
-				1, &composeapi.Recipe{}, []error{errors.New("won't get here")},
-			)
+		It("responds 422 when Compose refuses the deployment", func() {
+			fakeComposeClient.CreateDeploymentReturns(nil, []error{errors.New("map[name:[has already been taken]]")})
 
 			resp := DoRequest(brokerAPI, NewRequest(
 				"PUT",
-				"/v2/service_instances/"+instanceID,
+				"/v2/service_instances/"+uuid.NewV4().String(),
 				strings.NewReader(fmt.Sprintf(`{
 					"service_id": "%s",
 					"plan_id": "%s",
@@ -306,40 +296,52 @@ var _ = Describe("Broker API", func() {
 				cfg.Password,
 				UriParam{Key: "accepts_incomplete", Value: "true"},
 			))
-			body := ReadResponseBody(resp.Body)
 
-			Expect(resp.Code).To(Equal(500))
-			Expect(string(body)).
-				To(MatchJSON(`{"description":"malformed response from Compose: no pending whitelist recipe received"}`))
-			Expect(fakeComposeClient.DeprovisionDeploymentArgsForCall(0)).
-				To(Equal("1"))
+			Expect(resp.Code).To(Equal(422))
+			Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{"description":"map[name:[has already been taken]]"}`))
 		})
 
-		It("500s if any of the whitelist recipes are nil", func() {
+		It("keeps a backup schedule in the deployment's notes", func() {
 			fakeComposeClient.CreateDeploymentReturns(&composeapi.Deployment{ID: "1", ProvisionRecipeID: "provision-recipe-id"}, []error{})
-			fakeComposeClient.CreateDeploymentWhitelistReturns(nil, []error{})
-
-			instanceID := uuid.NewV4().String()
 
 			resp := DoRequest(brokerAPI, NewRequest(
 				"PUT",
-				"/v2/service_instances/"+instanceID,
+				"/v2/service_instances/"+uuid.NewV4().String(),
 				strings.NewReader(fmt.Sprintf(`{
 					"service_id": "%s",
 					"plan_id": "%s",
 					"organization_guid": "test-organization-id",
 					"space_guid": "space-id",
-					"parameters": {}
+					"parameters": {"backup_schedule": {"interval": "6h"}}
 				}`, service.ID, service.Plans[0].ID)),
 				cfg.Username,
 				cfg.Password,
 				UriParam{Key: "accepts_incomplete", Value: "true"},
 			))
-			body := ReadResponseBody(resp.Body)
+			Expect(resp.Code).To(Equal(202))
+			Expect(fakeComposeClient.CreateDeploymentArgsForCall(0).Notes).To(MatchJSON(
+				`{"organization_guid":"test-organization-id","plan_id":"` + service.Plans[0].ID + `","provision":{"step":"whitelist"},"backup_schedule":{"interval":"6h"}}`,
+			))
+		})
 
-			Expect(resp.Code).To(Equal(500))
-			Expect(string(body)).
-				To(MatchJSON(`{"description":"malformed response from Compose: no pending whitelist recipe received"}`))
+		It("refuses a backup schedule more frequent than the plan allows", func() {
+			resp := DoRequest(brokerAPI, NewRequest(
+				"PUT",
+				"/v2/service_instances/"+uuid.NewV4().String(),
+				strings.NewReader(fmt.Sprintf(`{
+					"service_id": "%s",
+					"plan_id": "%s",
+					"organization_guid": "test-organization-id",
+					"space_guid": "space-id",
+					"parameters": {"backup_schedule": {"interval": "30m"}}
+				}`, service.ID, service.Plans[0].ID)),
+				cfg.Username,
+				cfg.Password,
+				UriParam{Key: "accepts_incomplete", Value: "true"},
+			))
+			Expect(resp.Code).To(Equal(422))
+			Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{"description":"backup_schedule: interval must be at least 1h0m0s on this plan"}`))
+			Expect(fakeComposeClient.CreateDeploymentCallCount()).To(Equal(0))
 		})
 
 		Context("paramaters contain an unknown key", func() {
@@ -361,7 +363,7 @@ var _ = Describe("Broker API", func() {
 					cfg.Password,
 					UriParam{Key: "accepts_incomplete", Value: "true"},
 				))
-				Expect(resp.Code).To(Equal(500))
+				Expect(resp.Code).To(Equal(422))
 				body := ReadResponseBody(resp.Body)
 				Expect(body).To(MatchJSON(`
 				{
@@ -398,9 +400,6 @@ var _ = Describe("Broker API", func() {
 			}, nil)
 			fakeComposeClient.RestoreBackupReturns(&composeapi.Deployment{ID: "2", ProvisionRecipeID: "provision-recipe-id"}, []error{})
 			fakeComposeClient.PatchDeploymentReturns(&composeapi.Deployment{ID: "2", ProvisionRecipeID: "provision-recipe-id", CustomerBillingCode: "space-id"}, []error{})
-			fakeComposeClient.CreateDeploymentWhitelistReturnsOnCall(0, &composeapi.Recipe{ID: "id-for-1.1.1.1", Status: "complete"}, []error{})
-			fakeComposeClient.CreateDeploymentWhitelistReturnsOnCall(1, &composeapi.Recipe{ID: "id-for-2.2.2.2", Status: "complete"}, []error{})
-			fakeComposeClient.CreateDeploymentWhitelistReturnsOnCall(2, &composeapi.Recipe{ID: "id-for-3.3.3.3", Status: "complete"}, []error{})
 
 			resp := DoRequest(brokerAPI, NewRequest(
 				"PUT",
@@ -424,7 +423,8 @@ var _ = Describe("Broker API", func() {
 			{
 			  "recipe_id":"provision-recipe-id",
 			  "type":"provision",
-			  "whitelist_recipe_ids":["id-for-1.1.1.1","id-for-2.2.2.2","id-for-3.3.3.3"]
+			  "deployment_id":"2",
+			  "whitelist_recipe_ids":[]
 			}
 			`))
 
@@ -444,14 +444,89 @@ var _ = Describe("Broker API", func() {
 			}
 			Expect(fakeComposeClient.RestoreBackupArgsForCall(0)).To(Equal(expectedRestoreBackupParams))
 
-			By("setting CustomerBillingCode on the new deployment")
+			By("setting CustomerBillingCode and the provision state on the new deployment")
 			expectedPatchDeploymentParams := composeapi.PatchDeploymentParams{
 				DeploymentID:        "2",
 				CustomerBillingCode: "space-id",
+				Notes:               `{"organization_guid":"test-organization-id","plan_id":"` + service.Plans[0].ID + `","provision":{"step":"whitelist","recipe_id":"provision-recipe-id"}}`,
 			}
 			Expect(fakeComposeClient.PatchDeploymentArgsForCall(0)).To(Equal(expectedPatchDeploymentParams))
 		})
 
+		It("saves the notes of the restored deployment even if the request is cancelled", func() {
+			fakeComposeClient.GetDeploymentByNameReturns(&composeapi.Deployment{
+				ID:                  "123467",
+				CustomerBillingCode: "space-id",
+				Type:                "fakedb",
+			}, nil)
+			fakeComposeClient.GetBackupsForDeploymentReturns(&[]composeapi.Backup{
+				{ID: "xyz", IsRestorable: true, CreatedAt: time.Now()},
+			}, nil)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			fakeComposeClient.RestoreBackupStub = func(composeapi.RestoreBackupParams) (*composeapi.Deployment, []error) {
+				cancel()
+				return &composeapi.Deployment{ID: "2", ProvisionRecipeID: "provision-recipe-id"}, nil
+			}
+			fakeComposeClient.PatchDeploymentReturns(&composeapi.Deployment{ID: "2"}, []error{})
+
+			req := NewRequest(
+				"PUT",
+				"/v2/service_instances/"+uuid.NewV4().String(),
+				strings.NewReader(fmt.Sprintf(`{
+					"service_id": "%s",
+					"plan_id": "%s",
+					"organization_guid": "test-organization-id",
+					"space_guid": "space-id",
+					"parameters": {
+						"restore_from_latest_snapshot_of": "123467"
+					}
+				}`, service.ID, service.Plans[0].ID)),
+				cfg.Username,
+				cfg.Password,
+				UriParam{Key: "accepts_incomplete", Value: "true"},
+			)
+			resp := DoRequest(brokerAPI, req.WithContext(ctx))
+
+			Expect(resp.Code).To(Equal(202))
+			Expect(fakeComposeClient.PatchDeploymentCallCount()).To(Equal(1))
+			Expect(fakeComposeClient.DeprovisionDeploymentCallCount()).To(Equal(0))
+		})
+
+		It("deprovisions the restored deployment if it cannot be updated", func() {
+			fakeComposeClient.GetDeploymentByNameReturns(&composeapi.Deployment{
+				ID:                  "123467",
+				CustomerBillingCode: "space-id",
+				Type:                "fakedb",
+			}, nil)
+			fakeComposeClient.GetBackupsForDeploymentReturns(&[]composeapi.Backup{
+				{ID: "xyz", IsRestorable: true, CreatedAt: time.Now()},
+			}, nil)
+			fakeComposeClient.RestoreBackupReturns(&composeapi.Deployment{ID: "2", ProvisionRecipeID: "provision-recipe-id"}, []error{})
+			fakeComposeClient.PatchDeploymentReturns(nil, []error{errors.New("map[notes:[is invalid]]")})
+
+			resp := DoRequest(brokerAPI, NewRequest(
+				"PUT",
+				"/v2/service_instances/"+uuid.NewV4().String(),
+				strings.NewReader(fmt.Sprintf(`{
+					"service_id": "%s",
+					"plan_id": "%s",
+					"organization_guid": "test-organization-id",
+					"space_guid": "space-id",
+					"parameters": {
+						"restore_from_latest_snapshot_of": "123467"
+					}
+				}`, service.ID, service.Plans[0].ID)),
+				cfg.Username,
+				cfg.Password,
+				UriParam{Key: "accepts_incomplete", Value: "true"},
+			))
+
+			Expect(resp.Code).To(Equal(422))
+			Expect(fakeComposeClient.DeprovisionDeploymentCallCount()).To(Equal(1))
+			Expect(fakeComposeClient.DeprovisionDeploymentArgsForCall(0)).To(Equal("2"))
+		})
+
 		It("prevents provisioning an instance from a backup owned by someone else", func() {
 			oldInstanceID := "123467"
 			oldInstanceName, err := broker.MakeInstanceName(cfg.DBPrefix, oldInstanceID)
@@ -493,7 +568,7 @@ var _ = Describe("Broker API", func() {
 				cfg.Password,
 				UriParam{Key: "accepts_incomplete", Value: "true"},
 			))
-			Expect(resp.Code).To(Equal(500))
+			Expect(resp.Code).To(Equal(422))
 			body := ReadResponseBody(resp.Body)
 			Expect(body).To(MatchJSON(`
 			{
@@ -539,7 +614,7 @@ var _ = Describe("Broker API", func() {
 				cfg.Password,
 				UriParam{Key: "accepts_incomplete", Value: "true"},
 			))
-			Expect(resp.Code).To(Equal(500))
+			Expect(resp.Code).To(Equal(422))
 			body := ReadResponseBody(resp.Body)
 			Expect(body).To(MatchJSON(`
 			{
@@ -548,6 +623,305 @@ var _ = Describe("Broker API", func() {
 			`))
 		})
 
+		Context("with the org restore policy", func() {
+			var (
+				source   *composeapi.Deployment
+				identity string
+			)
+
+			restore := func() *httptest.ResponseRecorder {
+				req := NewRequest(
+					"PUT",
+					"/v2/service_instances/"+uuid.NewV4().String(),
+					strings.NewReader(fmt.Sprintf(`{
+						"service_id": "%s",
+						"plan_id": "%s",
+						"organization_guid": "test-organization-id",
+						"space_guid": "space-id",
+						"parameters": {
+							"restore_from_latest_snapshot_of": "123467"
+						}
+					}`, service.ID, service.Plans[0].ID)),
+					cfg.Username,
+					cfg.Password,
+					UriParam{Key: "accepts_incomplete", Value: "true"},
+				)
+				if identity != "" {
+					req.Header.Set("X-Broker-API-Originating-Identity", identity)
+				}
+				return DoRequest(brokerAPI, req)
+			}
+
+			BeforeEach(func() {
+				cfg.RestorePolicy = config.RestorePolicyOrg
+				cfg.RestoreUsers = []string{"user-id"}
+				identity = "cloudfoundry " + base64.StdEncoding.EncodeToString([]byte(`{"user_id":"user-id"}`))
+				source = &composeapi.Deployment{
+					ID:                  "123467",
+					CustomerBillingCode: "production-space-id",
+					Type:                "fakedb",
+					Notes:               `{"organization_guid":"test-organization-id","provision":{"step":"done"}}`,
+				}
+			})
+
+			JustBeforeEach(func() {
+				fakeComposeClient.GetDeploymentByNameReturns(source, nil)
+				fakeComposeClient.GetBackupsForDeploymentReturns(&[]composeapi.Backup{
+					{ID: "xyz", IsRestorable: true, CreatedAt: time.Now()},
+				}, nil)
+				fakeComposeClient.RestoreBackupReturns(&composeapi.Deployment{ID: "2", ProvisionRecipeID: "provision-recipe-id"}, nil)
+				fakeComposeClient.PatchDeploymentReturns(&composeapi.Deployment{ID: "2"}, nil)
+			})
+
+			It("restores from another space in the same organization", func() {
+				resp := restore()
+				Expect(resp.Code).To(Equal(202))
+
+				Expect(fakeComposeClient.RestoreBackupArgsForCall(0).DeploymentID).To(Equal("123467"))
+				Expect(fakeComposeClient.PatchDeploymentArgsForCall(0).CustomerBillingCode).To(Equal("space-id"))
+			})
+
+			It("refuses to restore from another organization", func() {
+				source.Notes = `{"organization_guid":"other-organization-id"}`
+
+				resp := restore()
+				Expect(resp.Code).To(Equal(422))
+				Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{
+					"description": "you are only allowed to restore from backup to a space in the same organization"
+				}`))
+				Expect(fakeComposeClient.RestoreBackupCallCount()).To(Equal(0))
+			})
+
+			It("refuses to restore from a deployment whose organization is unknown", func() {
+				source.Notes = ""
+
+				resp := restore()
+				Expect(resp.Code).To(Equal(422))
+				Expect(fakeComposeClient.RestoreBackupCallCount()).To(Equal(0))
+			})
+
+			It("refuses to restore when Cloud Controller does not say who asked", func() {
+				identity = ""
+
+				resp := restore()
+				Expect(resp.Code).To(Equal(422))
+				Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{
+					"description": "restoring from backup to another space requires the originating identity of the request"
+				}`))
+			})
+
+			It("only lets the configured users restore", func() {
+				cfg.RestoreUsers = []string{"someone-else"}
+
+				resp := restore()
+				Expect(resp.Code).To(Equal(422))
+				Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{
+					"description": "you are not allowed to restore from backup to another space"
+				}`))
+			})
+
+			It("lets nobody restore when no users are configured", func() {
+				cfg.RestoreUsers = nil
+
+				resp := restore()
+				Expect(resp.Code).To(Equal(422))
+				Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{
+					"description": "you are not allowed to restore from backup to another space"
+				}`))
+				Expect(fakeComposeClient.RestoreBackupCallCount()).To(Equal(0))
+			})
+		})
+
+	})
+
+	Describe("Cloning an instance", func() {
+		var (
+			instanceID   string
+			instanceName string
+			cloneOp      string
+		)
+
+		lastOperation := func() *httptest.ResponseRecorder {
+			return DoRequest(brokerAPI, NewRequest(
+				"GET",
+				fmt.Sprintf("/v2/service_instances/%s/last_operation", instanceID),
+				nil,
+				cfg.Username,
+				cfg.Password,
+				UriParam{Key: "operation", Value: cloneOp},
+			))
+		}
+
+		BeforeEach(func() {
+			instanceID = uuid.NewV4().String()
+			instanceName = fmt.Sprintf("%s-%s", cfg.DBPrefix, instanceID)
+			cloneOp = `{
+				"type": "provision",
+				"recipe_id": "",
+				"whitelist_recipe_ids": [],
+				"clone": {
+					"source_deployment_id": "123467",
+					"backup_recipe_id": "backup-recipe-id",
+					"space_guid": "space-id",
+					"organization_guid": "test-organization-id",
+					"plan_id": "` + service.Plans[0].ID + `"
+				}
+			}`
+		})
+
+		It("starts backing up the source instance", func() {
+			fakeComposeClient.GetDeploymentByNameReturns(&composeapi.Deployment{
+				ID:                  "123467",
+				CustomerBillingCode: "space-id",
+				Type:                "fakedb",
+			}, nil)
+			fakeComposeClient.StartBackupForDeploymentReturns(&composeapi.Recipe{ID: "backup-recipe-id"}, nil)
+
+			resp := DoRequest(brokerAPI, NewRequest(
+				"PUT",
+				"/v2/service_instances/"+instanceID,
+				strings.NewReader(fmt.Sprintf(`{
+					"service_id": "%s",
+					"plan_id": "%s",
+					"organization_guid": "test-organization-id",
+					"space_guid": "space-id",
+					"parameters": {
+						"clone_of": "123467"
+					}
+				}`, service.ID, service.Plans[0].ID)),
+				cfg.Username,
+				cfg.Password,
+				UriParam{Key: "accepts_incomplete", Value: "true"},
+			))
+			Expect(resp.Code).To(Equal(202))
+			Expect(ReadResponseBody(resp.Body)).To(MatchOperationJSON(cloneOp))
+
+			Expect(fakeComposeClient.GetDeploymentByNameArgsForCall(0)).To(Equal(cfg.DBPrefix + "-123467"))
+			Expect(fakeComposeClient.StartBackupForDeploymentArgsForCall(0)).To(Equal("123467"))
+			Expect(fakeComposeClient.CreateDeploymentCallCount()).To(Equal(0))
+			Expect(fakeComposeClient.RestoreBackupCallCount()).To(Equal(0))
+		})
+
+		It("refuses to clone and restore at once", func() {
+			resp := DoRequest(brokerAPI, NewRequest(
+				"PUT",
+				"/v2/service_instances/"+instanceID,
+				strings.NewReader(fmt.Sprintf(`{
+					"service_id": "%s",
+					"plan_id": "%s",
+					"organization_guid": "test-organization-id",
+					"space_guid": "space-id",
+					"parameters": {
+						"clone_of": "123467",
+						"restore_from_latest_snapshot_of": "123467"
+					}
+				}`, service.ID, service.Plans[0].ID)),
+				cfg.Username,
+				cfg.Password,
+				UriParam{Key: "accepts_incomplete", Value: "true"},
+			))
+			Expect(resp.Code).To(Equal(422))
+			Expect(fakeComposeClient.StartBackupForDeploymentCallCount()).To(Equal(0))
+		})
+
+		It("waits for the backup", func() {
+			fakeComposeClient.GetRecipeReturns(&composeapi.Recipe{Status: "running", StatusDetail: "dumping"}, nil)
+
+			resp := lastOperation()
+			Expect(resp.Code).To(Equal(200))
+			Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{
+				"state": "in progress",
+				"description": "backing up the instance to clone: dumping"
+			}`))
+			Expect(fakeComposeClient.GetDeploymentByNameArgsForCall(0)).To(Equal(instanceName))
+			Expect(fakeComposeClient.GetRecipeArgsForCall(0)).To(Equal("backup-recipe-id"))
+			Expect(fakeComposeClient.RestoreBackupCallCount()).To(Equal(0))
+		})
+
+		It("fails when the backup fails", func() {
+			fakeComposeClient.GetRecipeReturns(&composeapi.Recipe{Status: "failed", StatusDetail: "disk full"}, nil)
+
+			resp := lastOperation()
+			Expect(resp.Code).To(Equal(200))
+			Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{"state":"failed","description":"backup failed: disk full"}`))
+		})
+
+		It("restores the backup once it is complete", func() {
+			backupStarted := time.Now()
+			fakeComposeClient.GetRecipeReturns(&composeapi.Recipe{Status: "complete", CreatedAt: backupStarted}, nil)
+			fakeComposeClient.GetBackupsForDeploymentReturns(&[]composeapi.Backup{
+				{ID: "older", IsRestorable: true, CreatedAt: backupStarted.Add(-time.Hour)},
+				{ID: "clone-backup", IsRestorable: true, CreatedAt: backupStarted.Add(time.Minute)},
+			}, nil)
+			fakeComposeClient.RestoreBackupReturns(&composeapi.Deployment{ID: "2", ProvisionRecipeID: "restore-recipe-id"}, nil)
+			fakeComposeClient.PatchDeploymentReturns(&composeapi.Deployment{ID: "2"}, nil)
+
+			resp := lastOperation()
+			Expect(resp.Code).To(Equal(200))
+			Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{"state":"in progress","description":"restoring the backup"}`))
+
+			Expect(fakeComposeClient.GetBackupsForDeploymentArgsForCall(0)).To(Equal("123467"))
+			Expect(fakeComposeClient.RestoreBackupArgsForCall(0)).To(Equal(composeapi.RestoreBackupParams{
+				DeploymentID: "123467",
+				BackupID:     "clone-backup",
+				Name:         instanceName,
+				Datacenter:   broker.ComposeDatacenter,
+				SSL:          true,
+			}))
+			Expect(fakeComposeClient.PatchDeploymentArgsForCall(0)).To(Equal(composeapi.PatchDeploymentParams{
+				DeploymentID:        "2",
+				CustomerBillingCode: "space-id",
+				Notes:               `{"organization_guid":"test-organization-id","plan_id":"` + service.Plans[0].ID + `","provision":{"step":"whitelist","recipe_id":"restore-recipe-id"}}`,
+			}))
+		})
+
+		It("fails when the backup cannot be restored", func() {
+			backupStarted := time.Now()
+			fakeComposeClient.GetRecipeReturns(&composeapi.Recipe{Status: "complete", CreatedAt: backupStarted}, nil)
+			fakeComposeClient.GetBackupsForDeploymentReturns(&[]composeapi.Backup{
+				{ID: "older", IsRestorable: true, CreatedAt: backupStarted.Add(-time.Hour)},
+			}, nil)
+
+			resp := lastOperation()
+			Expect(resp.Code).To(Equal(200))
+			Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{
+				"state": "failed",
+				"description": "the backup of the instance to clone is not restorable"
+			}`))
+			Expect(fakeComposeClient.RestoreBackupCallCount()).To(Equal(0))
+		})
+
+		It("provisions the restored deployment", func() {
+			restored := &composeapi.Deployment{
+				ID:    "2",
+				Name:  instanceName,
+				Type:  "fakedb",
+				Notes: `{"provision":{"step":"wait","recipe_id":"restore-recipe-id"}}`,
+			}
+			fakeComposeClient.GetDeploymentByNameReturns(restored, nil)
+			fakeComposeClient.GetDeploymentReturns(restored, nil)
+			fakeComposeClient.GetRecipeReturns(&composeapi.Recipe{Status: "running"}, nil)
+
+			resp := lastOperation()
+			Expect(resp.Code).To(Equal(200))
+			Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{"state":"in progress"}`))
+
+			Expect(fakeComposeClient.GetDeploymentArgsForCall(0)).To(Equal("2"))
+			Expect(fakeComposeClient.GetRecipeArgsForCall(0)).To(Equal("restore-recipe-id"))
+			Expect(fakeComposeClient.RestoreBackupCallCount()).To(Equal(0))
+		})
+
+		It("fails and deprovisions a restored deployment which was never set up", func() {
+			fakeComposeClient.GetDeploymentByNameReturns(&composeapi.Deployment{ID: "2", Name: instanceName}, nil)
+
+			resp := lastOperation()
+			Expect(resp.Code).To(Equal(200))
+			Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{
+				"state": "failed",
+				"description": "the restored deployment could not be set up"
+			}`))
+			Expect(fakeComposeClient.DeprovisionDeploymentArgsForCall(0)).To(Equal("2"))
+		})
 	})
 
 	Describe("Provisioning an instance into cluster", func() {
@@ -559,9 +933,6 @@ var _ = Describe("Broker API", func() {
 		It("provisions into cluster when configured with a cluster name", func() {
 			instanceID := uuid.NewV4().String()
 			fakeComposeClient.CreateDeploymentReturns(&composeapi.Deployment{ID: "1", ProvisionRecipeID: "provision-recipe-id"}, []error{})
-			fakeComposeClient.CreateDeploymentWhitelistReturnsOnCall(0, &composeapi.Recipe{ID: "id-for-1.1.1.1", Status: "complete"}, []error{})
-			fakeComposeClient.CreateDeploymentWhitelistReturnsOnCall(1, &composeapi.Recipe{ID: "id-for-2.2.2.2", Status: "complete"}, []error{})
-			fakeComposeClient.CreateDeploymentWhitelistReturnsOnCall(2, &composeapi.Recipe{ID: "id-for-3.3.3.3", Status: "complete"}, []error{})
 
 			resp := DoRequest(brokerAPI, NewRequest(
 				"PUT",
@@ -584,7 +955,8 @@ var _ = Describe("Broker API", func() {
 			{
 			  "recipe_id":"provision-recipe-id",
 			  "type":"provision",
-			  "whitelist_recipe_ids":["id-for-1.1.1.1","id-for-2.2.2.2","id-for-3.3.3.3"]
+			  "deployment_id":"1",
+			  "whitelist_recipe_ids":[]
 			}
 			`))
 
@@ -597,48 +969,110 @@ var _ = Describe("Broker API", func() {
 				SSL:                 true,
 				ClusterID:           "1234",
 				CustomerBillingCode: "space-id",
+				Notes:               `{"organization_guid":"test-organization-id","plan_id":"` + service.Plans[0].ID + `","provision":{"step":"whitelist"}}`,
 			}
 			Expect(fakeComposeClient.CreateDeploymentArgsForCall(0)).To(Equal(expectedDeploymentParams))
 		})
 
-		It("responds with 500 when a whitelist recipe ID is invalid", func() {
-			instanceID := uuid.NewV4().String()
-			invalid := ""
-			fakeComposeClient.CreateDeploymentReturns(&composeapi.Deployment{ID: "1", ProvisionRecipeID: "provision-recipe-id"}, []error{})
-			fakeComposeClient.CreateDeploymentWhitelistReturnsOnCall(
-				0, &composeapi.Recipe{ID: "id-for-1.1.1.1", Status: "complete"}, []error{},
-			)
-			fakeComposeClient.CreateDeploymentWhitelistReturnsOnCall(
-				1, &composeapi.Recipe{ID: invalid, Status: "complete"}, []error{},
-			)
-			fakeComposeClient.CreateDeploymentWhitelistReturnsOnCall(
-				2, &composeapi.Recipe{ID: "id-for-3.3.3.3", Status: "complete"}, []error{},
-			)
-
-			resp := DoRequest(brokerAPI, NewRequest(
-				"PUT",
-				"/v2/service_instances/"+instanceID,
-				strings.NewReader(fmt.Sprintf(`{
-					"service_id": "%s",
-					"plan_id": "%s",
-					"organization_guid": "test-organization-id",
-					"space_guid": "space-id",
-					"parameters": %s
-				}`, service.ID, service.Plans[0].ID, "{}")),
-				cfg.Username,
-				cfg.Password,
-				UriParam{Key: "accepts_incomplete", Value: "true"},
-			))
+		Context("with a cluster capacity configured", func() {
+			BeforeEach(func() {
+				cfg.ClusterCapacityUnits = 4
+			})
 
-			Expect(resp.Code).To(Equal(500))
-			body := ReadResponseBody(resp.Body)
-			Expect(body).To(MatchJSON(`{"description":"malformed response from Compose: invalid whitelist recipe ID"}`))
-		})
-	})
+			JustBeforeEach(func() {
+				fakeComposeClient.GetClusterReturns(&composeapi.Cluster{ID: "1234", Name: cfg.ClusterName}, []error{})
+				fakeComposeClient.GetDeploymentsReturns(&[]composeapi.Deployment{
+					{ID: "1111", ClusterID: "1234"},
+					{ID: "2222", ClusterID: "1234"},
+				}, []error{})
+				fakeComposeClient.GetScalingsReturns(&composeapi.Scalings{AllocatedUnits: 2}, []error{})
+			})
 
-	Describe("deprovisioning an instance", func() {
+			It("refuses to provision when the plan's units won't fit", func() {
+				instanceID := uuid.NewV4().String()
 
-		It("deprovisions the correct instance", func() {
+				resp := DoRequest(brokerAPI, NewRequest(
+					"PUT",
+					"/v2/service_instances/"+instanceID,
+					strings.NewReader(fmt.Sprintf(`{
+						"service_id": "%s",
+						"plan_id": "%s",
+						"organization_guid": "test-organization-id",
+						"space_guid": "space-id",
+						"parameters": {}
+					}`, service.ID, service.Plans[0].ID)),
+					cfg.Username,
+					cfg.Password,
+					UriParam{Key: "accepts_incomplete", Value: "true"},
+				))
+
+				Expect(resp.Code).To(Equal(422))
+				Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{
+					"error": "ClusterCapacityExceeded",
+					"description": "cluster test-cluster does not have capacity for 1 more units (0 available)"
+				}`))
+				Expect(fakeComposeClient.CreateDeploymentCallCount()).To(Equal(0))
+			})
+
+			It("counts earlier provisions against the cached capacity", func() {
+				cfg.ClusterCapacityUnits = 5
+				fakeComposeClient.CreateDeploymentReturns(&composeapi.Deployment{ID: "1", ProvisionRecipeID: "provision-recipe-id"}, []error{})
+				provision := func() int {
+					return DoRequest(brokerAPI, NewRequest(
+						"PUT",
+						"/v2/service_instances/"+uuid.NewV4().String(),
+						strings.NewReader(fmt.Sprintf(`{
+							"service_id": "%s",
+							"plan_id": "%s",
+							"organization_guid": "test-organization-id",
+							"space_guid": "space-id",
+							"parameters": {}
+						}`, service.ID, service.Plans[0].ID)),
+						cfg.Username,
+						cfg.Password,
+						UriParam{Key: "accepts_incomplete", Value: "true"},
+					)).Code
+				}
+
+				Expect(provision()).To(Equal(http.StatusAccepted))
+				Expect(provision()).To(Equal(422))
+				Expect(fakeComposeClient.CreateDeploymentCallCount()).To(Equal(1))
+				Expect(fakeComposeClient.GetScalingsCallCount()).To(Equal(2))
+			})
+
+			It("gives back the units of a provision which fails", func() {
+				cfg.ClusterCapacityUnits = 5
+				fakeComposeClient.CreateDeploymentReturnsOnCall(0, nil, []error{errors.New("computer says no")})
+				fakeComposeClient.CreateDeploymentReturnsOnCall(1, &composeapi.Deployment{ID: "1", ProvisionRecipeID: "provision-recipe-id"}, []error{})
+				provision := func() int {
+					return DoRequest(brokerAPI, NewRequest(
+						"PUT",
+						"/v2/service_instances/"+uuid.NewV4().String(),
+						strings.NewReader(fmt.Sprintf(`{
+							"service_id": "%s",
+							"plan_id": "%s",
+							"organization_guid": "test-organization-id",
+							"space_guid": "space-id",
+							"parameters": {}
+						}`, service.ID, service.Plans[0].ID)),
+						cfg.Username,
+						cfg.Password,
+						UriParam{Key: "accepts_incomplete", Value: "true"},
+					)).Code
+				}
+
+				Expect(provision()).To(Equal(http.StatusInternalServerError))
+				Expect(provision()).To(Equal(http.StatusAccepted))
+				Expect(fakeComposeClient.CreateDeploymentCallCount()).To(Equal(2))
+				Expect(fakeComposeClient.GetScalingsCallCount()).To(Equal(2))
+			})
+		})
+
+	})
+
+	Describe("deprovisioning an instance", func() {
+
+		It("deprovisions the correct instance", func() {
 			instanceID := uuid.NewV4().String()
 			fakeComposeClient.GetDeploymentByNameReturns(&composeapi.Deployment{
 				ID: "1", ProvisionRecipeID: "provision-recipe-id",
@@ -657,6 +1091,51 @@ var _ = Describe("Broker API", func() {
 			Expect(ReadResponseBody(resp.Body)).To(MatchOperationJSON(`{"type":"deprovision","recipe_id":"deprovision-recipe-id", "whitelist_recipe_ids": []}`))
 		})
 
+		It("responds 410 Gone when the deployment does not exist", func() {
+			fakeComposeClient.GetDeploymentByNameReturns(nil, []error{&compose.NotFoundError{Resource: "deployment", Name: "test-gone"}})
+			resp := DoRequest(brokerAPI, NewRequest(
+				"DELETE",
+				"/v2/service_instances/gone",
+				nil,
+				cfg.Username,
+				cfg.Password,
+				UriParam{Key: "accepts_incomplete", Value: "true"},
+			))
+			Expect(resp.Code).To(Equal(410))
+			Expect(fakeComposeClient.DeprovisionDeploymentCallCount()).To(Equal(0))
+		})
+
+		It("responds 410 Gone when the deployment disappears before it is deprovisioned", func() {
+			fakeComposeClient.GetDeploymentByNameReturns(&composeapi.Deployment{ID: "1"}, []error{})
+			fakeComposeClient.DeprovisionDeploymentReturns(nil, []error{&compose.Error{StatusCode: 404, Body: "Not Found"}})
+			resp := DoRequest(brokerAPI, NewRequest(
+				"DELETE",
+				"/v2/service_instances/gone",
+				nil,
+				cfg.Username,
+				cfg.Password,
+				UriParam{Key: "accepts_incomplete", Value: "true"},
+			))
+			Expect(resp.Code).To(Equal(410))
+		})
+
+		It("responds 503 when Compose fails transiently", func() {
+			fakeComposeClient.GetDeploymentByNameReturns(&composeapi.Deployment{ID: "1"}, []error{})
+			fakeComposeClient.DeprovisionDeploymentReturns(nil, []error{
+				errors.New("Unable to parse error - status code 502 - body Bad Gateway"),
+			})
+			resp := DoRequest(brokerAPI, NewRequest(
+				"DELETE",
+				"/v2/service_instances/some-instance",
+				nil,
+				cfg.Username,
+				cfg.Password,
+				UriParam{Key: "accepts_incomplete", Value: "true"},
+			))
+			Expect(resp.Code).To(Equal(503))
+			Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{"description":"Bad Gateway"}`))
+		})
+
 	})
 
 	Describe("updating a service", func() {
@@ -685,6 +1164,349 @@ var _ = Describe("Broker API", func() {
 			Expect(body).To(MatchJSON(`{"description":"changing plans is not currently supported"}`))
 		})
 
+		It("records the plan in the deployment's notes before scaling it", func() {
+			fakeComposeClient.GetDeploymentByNameReturns(&composeapi.Deployment{ID: "1"}, []error{})
+			fakeComposeClient.GetDeploymentReturns(&composeapi.Deployment{
+				ID:    "1",
+				Notes: `{"organization_guid":"test-organization-id","provision":{"step":"done"}}`,
+			}, []error{})
+			fakeComposeClient.SetScalingsReturns(&composeapi.Recipe{ID: "scale-recipe-id"}, []error{})
+
+			resp := DoRequest(brokerAPI, NewRequest(
+				"PATCH",
+				"/v2/service_instances/update-me",
+				strings.NewReader(fmt.Sprintf(`{
+					"service_id": "%s",
+					"plan_id": "%s",
+					"previous_values": {
+						"plan_id": "%s"
+					}
+				}`, service.ID, service.Plans[0].ID, service.Plans[0].ID)),
+				cfg.Username,
+				cfg.Password,
+				UriParam{Key: "accepts_incomplete", Value: "true"},
+			))
+			Expect(resp.Code).To(Equal(202))
+
+			Expect(fakeComposeClient.PatchDeploymentCallCount()).To(Equal(1))
+			Expect(fakeComposeClient.PatchDeploymentArgsForCall(0).Notes).To(MatchJSON(
+				`{"organization_guid":"test-organization-id","plan_id":"` + service.Plans[0].ID + `","provision":{"step":"done"}}`,
+			))
+			Expect(fakeComposeClient.SetScalingsArgsForCall(0)).To(Equal(composeapi.ScalingsParams{
+				DeploymentID: "1",
+				Units:        1,
+			}))
+		})
+
+		Context("scheduling backups", func() {
+			var notes string
+
+			update := func(parameters string) *httptest.ResponseRecorder {
+				return DoRequest(brokerAPI, NewRequest(
+					"PATCH",
+					"/v2/service_instances/schedule-me",
+					strings.NewReader(fmt.Sprintf(`{
+						"service_id": "%s",
+						"plan_id": "%s",
+						"previous_values": {
+							"plan_id": "%s"
+						},
+						"parameters": %s
+					}`, service.ID, service.Plans[0].ID, service.Plans[0].ID, parameters)),
+					cfg.Username,
+					cfg.Password,
+					UriParam{Key: "accepts_incomplete", Value: "true"},
+				))
+			}
+
+			BeforeEach(func() {
+				notes = `{"organization_guid":"test-organization-id","provision":{"step":"done"}}`
+			})
+
+			JustBeforeEach(func() {
+				fakeComposeClient.GetDeploymentByNameReturns(&composeapi.Deployment{ID: "1"}, nil)
+				fakeComposeClient.GetDeploymentStub = func(id string) (*composeapi.Deployment, []error) {
+					return &composeapi.Deployment{ID: id, Notes: notes}, nil
+				}
+			})
+
+			It("saves the schedule without rescaling the deployment", func() {
+				resp := update(`{"backup_schedule": {"interval": "2h"}}`)
+				Expect(resp.Code).To(Equal(200))
+
+				Expect(fakeComposeClient.SetScalingsCallCount()).To(Equal(0))
+				Expect(fakeComposeClient.PatchDeploymentCallCount()).To(Equal(1))
+				params := fakeComposeClient.PatchDeploymentArgsForCall(0)
+				Expect(params.DeploymentID).To(Equal("1"))
+				Expect(params.Notes).To(MatchJSON(
+					`{"organization_guid":"test-organization-id","provision":{"step":"done"},"backup_schedule":{"interval":"2h"}}`,
+				))
+			})
+
+			It("keeps the time of the last backup when the interval changes", func() {
+				notes = `{"backup_schedule":{"interval":"2h","last_backup_at":"2018-01-01T00:00:00Z"}}`
+
+				resp := update(`{"backup_schedule": {"interval": "4h"}}`)
+				Expect(resp.Code).To(Equal(200))
+				Expect(fakeComposeClient.PatchDeploymentArgsForCall(0).Notes).To(MatchJSON(
+					`{"backup_schedule":{"interval":"4h","last_backup_at":"2018-01-01T00:00:00Z"}}`,
+				))
+			})
+
+			It("removes the schedule when the interval is empty", func() {
+				notes = `{"backup_schedule":{"interval":"2h","last_backup_at":"2018-01-01T00:00:00Z"}}`
+
+				resp := update(`{"backup_schedule": {"interval": ""}}`)
+				Expect(resp.Code).To(Equal(200))
+				Expect(fakeComposeClient.PatchDeploymentArgsForCall(0).Notes).To(MatchJSON(`{}`))
+			})
+
+			It("refuses an interval which is not a duration", func() {
+				resp := update(`{"backup_schedule": {"interval": "daily"}}`)
+				Expect(resp.Code).To(Equal(422))
+				Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{"description":"backup_schedule: invalid interval: daily"}`))
+				Expect(fakeComposeClient.PatchDeploymentCallCount()).To(Equal(0))
+			})
+
+			Context("on a plan without scheduled backups", func() {
+				BeforeEach(func() {
+					minBackupInterval = ""
+				})
+
+				It("refuses a schedule", func() {
+					resp := update(`{"backup_schedule": {"interval": "24h"}}`)
+					Expect(resp.Code).To(Equal(422))
+					Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{"description":"this plan does not offer scheduled backups"}`))
+					Expect(fakeComposeClient.PatchDeploymentCallCount()).To(Equal(0))
+				})
+			})
+		})
+
+		Context("exporting a backup", func() {
+			var (
+				s3Server       *s3test.Server
+				downloadServer *httptest.Server
+				notesMutex     sync.Mutex
+				notes          string
+				exportParams   string
+				release        chan struct{}
+			)
+
+			update := func(parameters string) *httptest.ResponseRecorder {
+				return DoRequest(brokerAPI, NewRequest(
+					"PATCH",
+					"/v2/service_instances/export-me",
+					strings.NewReader(fmt.Sprintf(`{
+						"service_id": "%s",
+						"plan_id": "%s",
+						"previous_values": {
+							"plan_id": "%s"
+						},
+						"parameters": %s
+					}`, service.ID, service.Plans[0].ID, service.Plans[0].ID, parameters)),
+					cfg.Username,
+					cfg.Password,
+					UriParam{Key: "accepts_incomplete", Value: "true"},
+				))
+			}
+
+			lastOperation := func(operation string) brokerapi.LastOperation {
+				resp := DoRequest(brokerAPI, NewRequest(
+					"GET",
+					"/v2/service_instances/export-me/last_operation",
+					nil,
+					cfg.Username,
+					cfg.Password,
+					UriParam{Key: "operation", Value: operation},
+				))
+				Expect(resp.Code).To(Equal(200))
+				var lastOperation brokerapi.LastOperation
+				Expect(json.Unmarshal(ReadResponseBody(resp.Body), &lastOperation)).To(Succeed())
+				return lastOperation
+			}
+
+			startExport := func() string {
+				resp := update(exportParams)
+				Expect(resp.Code).To(Equal(202))
+				var body struct {
+					Operation string `json:"operation"`
+				}
+				Expect(json.Unmarshal(ReadResponseBody(resp.Body), &body)).To(Succeed())
+				return body.Operation
+			}
+
+			BeforeEach(func() {
+				s3Server = s3test.NewTLSServer("access-key-id")
+				cfg.ExportEndpoints = []string{s3Server.URL}
+				exportHTTPClient = &http.Client{Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+				}}
+				release = nil
+				downloadServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Path != "/backup-1.tar.gz" {
+						http.NotFound(w, r)
+						return
+					}
+					if release != nil {
+						<-release
+					}
+					w.Write([]byte("backup data"))
+				}))
+				notes = `{"organization_guid":"test-organization-id","provision":{"step":"done"}}`
+				exportParams = fmt.Sprintf(`{
+					"export_backup": {
+						"backup_id": "backup-1",
+						"endpoint": "%s",
+						"region": "eu-west-2",
+						"bucket": "retention",
+						"key": "db/backup-1.tar.gz",
+						"access_key_id": "access-key-id",
+						"secret_access_key": "secret"
+					}
+				}`, s3Server.URL)
+			})
+
+			AfterEach(func() {
+				s3Server.Close()
+				downloadServer.Close()
+			})
+
+			JustBeforeEach(func() {
+				fakeComposeClient.GetDeploymentByNameReturns(&composeapi.Deployment{ID: "1"}, nil)
+				fakeComposeClient.GetBackupDetailsForDeploymentReturns(&composeapi.Backup{
+					ID:             "backup-1",
+					IsDownloadable: true,
+					DownloadLink:   downloadServer.URL + "/backup-1.tar.gz",
+				}, nil)
+				fakeComposeClient.GetDeploymentStub = func(id string) (*composeapi.Deployment, []error) {
+					notesMutex.Lock()
+					defer notesMutex.Unlock()
+					return &composeapi.Deployment{ID: id, Notes: notes}, nil
+				}
+				fakeComposeClient.PatchDeploymentStub = func(params composeapi.PatchDeploymentParams) (*composeapi.Deployment, []error) {
+					notesMutex.Lock()
+					defer notesMutex.Unlock()
+					notes = params.Notes
+					return &composeapi.Deployment{ID: params.DeploymentID, Notes: notes}, nil
+				}
+			})
+
+			It("copies the backup to the bucket and reports when it is done", func() {
+				operation := startExport()
+				Expect(operation).To(ContainSubstring(`"type":"export"`))
+
+				Eventually(func() brokerapi.LastOperationState {
+					return lastOperation(operation).State
+				}).Should(Equal(brokerapi.Succeeded))
+				Expect(lastOperation(operation).Description).To(Equal("exported backup backup-1 to retention/db/backup-1.tar.gz"))
+
+				object, ok := s3Server.Object("retention", "db/backup-1.tar.gz")
+				Expect(ok).To(BeTrue())
+				Expect(string(object)).To(Equal("backup data"))
+
+				deploymentID, backupID := fakeComposeClient.GetBackupDetailsForDeploymentArgsForCall(0)
+				Expect(deploymentID).To(Equal("1"))
+				Expect(backupID).To(Equal("backup-1"))
+
+				notesMutex.Lock()
+				defer notesMutex.Unlock()
+				Expect(notes).To(ContainSubstring(`"organization_guid":"test-organization-id","provision":{"step":"done"}`))
+				Expect(notes).NotTo(ContainSubstring("secret"))
+			})
+
+			It("keeps changes made to the notes while the export runs", func() {
+				release = make(chan struct{})
+				operation := startExport()
+
+				notesMutex.Lock()
+				notes = strings.Replace(notes, `"provision"`, `"backup_schedule":{"interval":"6h"},"provision"`, 1)
+				notesMutex.Unlock()
+				close(release)
+
+				Eventually(func() brokerapi.LastOperationState {
+					return lastOperation(operation).State
+				}).Should(Equal(brokerapi.Succeeded))
+				notesMutex.Lock()
+				defer notesMutex.Unlock()
+				Expect(notes).To(ContainSubstring(`"backup_schedule":{"interval":"6h"}`))
+			})
+
+			It("refuses to export to an endpoint the operator has not allowed", func() {
+				for _, endpoint := range []string{"https://169.254.169.254", strings.Replace(s3Server.URL, "https:", "http:", 1)} {
+					exportParams = fmt.Sprintf(`{"export_backup": {"endpoint": "%s", "region": "eu-west-2", "bucket": "retention", "access_key_id": "a", "secret_access_key": "s"}}`, endpoint)
+
+					resp := update(exportParams)
+					Expect(resp.Code).To(Equal(422))
+					Expect(ReadResponseBody(resp.Body)).To(MatchJSON(fmt.Sprintf(`{"description":"exports to %s are not allowed"}`, endpoint)))
+				}
+				Expect(fakeComposeClient.PatchDeploymentCallCount()).To(Equal(0))
+			})
+
+			It("refuses a region which is not a region's name", func() {
+				resp := update(`{"export_backup": {"region": "evil.example.com/", "bucket": "retention", "access_key_id": "a", "secret_access_key": "s"}}`)
+				Expect(resp.Code).To(Equal(422))
+				Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{"description":"export_backup: invalid region: evil.example.com/"}`))
+			})
+
+			It("exports the newest downloadable backup by default", func() {
+				exportParams = strings.Replace(exportParams, `"backup_id": "backup-1",`, "", 1)
+				fakeComposeClient.GetBackupsForDeploymentReturns(&[]composeapi.Backup{
+					{ID: "backup-0", IsDownloadable: true, CreatedAt: time.Now().Add(-time.Hour)},
+					{ID: "backup-1", IsDownloadable: true, CreatedAt: time.Now()},
+					{ID: "backup-2", IsDownloadable: false, CreatedAt: time.Now().Add(time.Hour)},
+				}, nil)
+
+				operation := startExport()
+				_, backupID := fakeComposeClient.GetBackupDetailsForDeploymentArgsForCall(0)
+				Expect(backupID).To(Equal("backup-1"))
+				Eventually(func() brokerapi.LastOperationState {
+					return lastOperation(operation).State
+				}).Should(Equal(brokerapi.Succeeded))
+			})
+
+			It("refuses to export a backup which cannot be downloaded", func() {
+				fakeComposeClient.GetBackupDetailsForDeploymentReturns(&composeapi.Backup{ID: "backup-1"}, nil)
+
+				resp := update(exportParams)
+				Expect(resp.Code).To(Equal(422))
+				Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{"description":"backup 'backup-1' cannot be downloaded"}`))
+			})
+
+			It("refuses an export without credentials", func() {
+				resp := update(`{"export_backup": {"bucket": "retention", "region": "eu-west-2"}}`)
+				Expect(resp.Code).To(Equal(422))
+				Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{"description":"export_backup: missing access_key_id"}`))
+			})
+
+			It("reports an export which the object store refuses as failed", func() {
+				exportParams = strings.Replace(exportParams, `"access_key_id": "access-key-id"`, `"access_key_id": "wrong"`, 1)
+
+				operation := startExport()
+				Eventually(func() brokerapi.LastOperationState {
+					return lastOperation(operation).State
+				}).Should(Equal(brokerapi.Failed))
+				Expect(lastOperation(operation).Description).To(ContainSubstring("InvalidAccessKeyId"))
+			})
+
+			It("reports an export which stopped making progress as failed", func() {
+				notes = fmt.Sprintf(`{"export":{"id":"export-1","state":"in progress","bytes":10,"updated_at":"%s"}}`,
+					time.Now().Add(-time.Hour).Format(time.RFC3339))
+
+				lastOp := lastOperation(`{"type":"export","recipe_id":"","whitelist_recipe_ids":[],"deployment_id":"1","export_id":"export-1"}`)
+				Expect(lastOp.State).To(Equal(brokerapi.Failed))
+				Expect(lastOp.Description).To(Equal("the export stopped making progress"))
+			})
+
+			It("reports the progress of an export", func() {
+				notes = fmt.Sprintf(`{"export":{"id":"export-1","state":"in progress","bytes":10,"total_bytes":40,"updated_at":"%s"}}`,
+					time.Now().Format(time.RFC3339))
+
+				lastOp := lastOperation(`{"type":"export","recipe_id":"","whitelist_recipe_ids":[],"deployment_id":"1","export_id":"export-1"}`)
+				Expect(lastOp.State).To(Equal(brokerapi.InProgress))
+				Expect(lastOp.Description).To(Equal("exported 10 of 40 bytes"))
+			})
+		})
+
 	})
 
 	Describe("binding to a service", func() {
@@ -880,6 +1702,307 @@ var _ = Describe("Broker API", func() {
 				body := ReadResponseBody(resp.Body)
 				Expect(body).To(MatchJSON(`{"description":"some-error"}`))
 			})
+
+			It("responds with 410 when the recipe of a deprovision is gone", func() {
+				deprovisionReq := NewRequest(
+					"GET",
+					"/v2/service_instances/gone/last_operation",
+					nil,
+					cfg.Username,
+					cfg.Password,
+					UriParam{Key: "operation", Value: `{"recipe_id":"recipe-id","type":"deprovision"}`},
+				)
+				fakeComposeClient.GetRecipeReturns(nil, []error{&compose.NotFoundError{Resource: "recipe", Name: "recipe-id"}})
+				resp := DoRequest(brokerAPI, deprovisionReq)
+				Expect(resp.Code).To(Equal(410))
+			})
+
+			It("responds with 503 when the Compose API circuit is open", func() {
+				fakeComposeClient.GetRecipeReturns(nil, []error{compose.ErrCircuitOpen})
+				resp := DoRequest(brokerAPI, req)
+				Expect(resp.Code).To(Equal(503))
+				body := ReadResponseBody(resp.Body)
+				Expect(body).To(MatchJSON(`{"error":"ComposeUnavailable","description":"Compose API unavailable"}`))
+			})
+		})
+
+		Context("resuming a provision", func() {
+			var (
+				req        *http.Request
+				deployment *composeapi.Deployment
+			)
+
+			savedNotes := func() []string {
+				notes := []string{}
+				for i := 0; i < fakeComposeClient.PatchDeploymentCallCount(); i++ {
+					params := fakeComposeClient.PatchDeploymentArgsForCall(i)
+					Expect(params.DeploymentID).To(Equal("1"))
+					notes = append(notes, params.Notes)
+				}
+				return notes
+			}
+
+			BeforeEach(func() {
+				req = NewRequest(
+					"GET",
+					fmt.Sprintf("/v2/service_instances/%s/last_operation", uuid.NewV4().String()),
+					nil,
+					cfg.Username,
+					cfg.Password,
+					UriParam{Key: "operation", Value: `{"type":"provision","recipe_id":"provision-recipe-id","deployment_id":"1"}`},
+				)
+				deployment = &composeapi.Deployment{
+					ID:    "1",
+					Name:  "test-instance",
+					Type:  "fakedb",
+					Notes: `{"provision":{"step":"whitelist"}}`,
+				}
+			})
+
+			JustBeforeEach(func() {
+				fakeComposeClient.GetDeploymentReturns(deployment, nil)
+				fakeComposeClient.PatchDeploymentReturns(deployment, nil)
+				fakeComposeClient.CreateDeploymentWhitelistReturnsOnCall(0, &composeapi.Recipe{ID: "id-for-1.1.1.1"}, nil)
+				fakeComposeClient.CreateDeploymentWhitelistReturnsOnCall(1, &composeapi.Recipe{ID: "id-for-2.2.2.2"}, nil)
+				fakeComposeClient.CreateDeploymentWhitelistReturnsOnCall(2, &composeapi.Recipe{ID: "id-for-3.3.3.3"}, nil)
+				fakeComposeClient.GetRecipeReturns(&composeapi.Recipe{Status: "running"}, nil)
+			})
+
+			It("whitelists the deployment, saving progress, and then waits for the recipes", func() {
+				resp := DoRequest(brokerAPI, req)
+				Expect(resp.Code).To(Equal(200))
+				Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{"state":"in progress"}`))
+
+				Expect(fakeComposeClient.GetDeploymentArgsForCall(0)).To(Equal("1"))
+				Expect(fakeComposeClient.CreateDeploymentWhitelistCallCount()).To(Equal(3))
+				_, args := fakeComposeClient.CreateDeploymentWhitelistArgsForCall(1)
+				Expect(args).To(Equal(composeapi.DeploymentWhitelistParams{
+					IP:          "2.2.2.2",
+					Description: "Allow 2.2.2.2 to access deployment",
+				}))
+				Expect(savedNotes()).To(Equal([]string{
+					`{"provision":{"step":"whitelist","pending_whitelist_ip":"1.1.1.1"}}`,
+					`{"provision":{"step":"whitelist","whitelist_recipe_ids":["id-for-1.1.1.1"]}}`,
+					`{"provision":{"step":"whitelist","whitelist_recipe_ids":["id-for-1.1.1.1"],"pending_whitelist_ip":"2.2.2.2"}}`,
+					`{"provision":{"step":"whitelist","whitelist_recipe_ids":["id-for-1.1.1.1","id-for-2.2.2.2"]}}`,
+					`{"provision":{"step":"whitelist","whitelist_recipe_ids":["id-for-1.1.1.1","id-for-2.2.2.2"],"pending_whitelist_ip":"3.3.3.3"}}`,
+					`{"provision":{"step":"whitelist","whitelist_recipe_ids":["id-for-1.1.1.1","id-for-2.2.2.2","id-for-3.3.3.3"]}}`,
+					`{"provision":{"step":"wait","whitelist_recipe_ids":["id-for-1.1.1.1","id-for-2.2.2.2","id-for-3.3.3.3"]}}`,
+				}))
+				Expect(fakeComposeClient.GetRecipeArgsForCall(0)).To(Equal("provision-recipe-id"))
+			})
+
+			It("does not whitelist an IP twice after a restart", func() {
+				fakeComposeClient.GetWhitelistForDeploymentReturns([]composeapi.DeploymentWhitelist{
+					{IP: "1.1.1.1/32"},
+				}, nil)
+
+				resp := DoRequest(brokerAPI, req)
+				Expect(resp.Code).To(Equal(200))
+
+				Expect(fakeComposeClient.CreateDeploymentWhitelistCallCount()).To(Equal(2))
+				_, args := fakeComposeClient.CreateDeploymentWhitelistArgsForCall(0)
+				Expect(args.IP).To(Equal("2.2.2.2"))
+			})
+
+			It("does not whitelist an IP again whose recipe was lost in a restart", func() {
+				deployment.Notes = `{"provision":{"step":"whitelist","pending_whitelist_ip":"1.1.1.1"}}`
+				fakeComposeClient.GetWhitelistForDeploymentReturns([]composeapi.DeploymentWhitelist{
+					{IP: "1.1.1.1"},
+					{IP: "2.2.2.0/24"},
+					{IP: "3.3.3.3/32"},
+				}, nil)
+
+				resp := DoRequest(brokerAPI, req)
+				Expect(resp.Code).To(Equal(200))
+
+				Expect(fakeComposeClient.CreateDeploymentWhitelistCallCount()).To(Equal(1))
+				_, args := fakeComposeClient.CreateDeploymentWhitelistArgsForCall(0)
+				Expect(args.IP).To(Equal("2.2.2.2"))
+				Expect(savedNotes()[0]).To(Equal(
+					`{"provision":{"step":"whitelist","pending_whitelist_ip":"2.2.2.2"}}`,
+				))
+			})
+
+			It("carries on from the step saved in the deployment's notes", func() {
+				deployment.Notes = `{"provision":{"step":"wait","whitelist_recipe_ids":["id-for-1.1.1.1"]}}`
+				fakeComposeClient.GetRecipeReturns(&composeapi.Recipe{Status: "complete"}, nil)
+
+				resp := DoRequest(brokerAPI, req)
+				Expect(resp.Code).To(Equal(200))
+				Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{"state":"succeeded"}`))
+
+				Expect(fakeComposeClient.CreateDeploymentWhitelistCallCount()).To(Equal(0))
+				Expect(fakeComposeClient.GetRecipeCallCount()).To(Equal(2))
+				Expect(fakeComposeClient.GetRecipeArgsForCall(1)).To(Equal("id-for-1.1.1.1"))
+				Expect(savedNotes()).To(Equal([]string{
+					`{"provision":{"step":"setup","whitelist_recipe_ids":["id-for-1.1.1.1"]}}`,
+					`{"provision":{"step":"done","whitelist_recipe_ids":["id-for-1.1.1.1"]}}`,
+				}))
+			})
+
+			Context("when the engine has a ready hook", func() {
+				var engine *enginefakes.FakeReadyDBEngine
+
+				BeforeEach(func() {
+					engine = &enginefakes.FakeReadyDBEngine{}
+					dbEngineProvider.DBEngine = engine
+					deployment.Notes = `{"provision":{"step":"wait"}}`
+				})
+
+				JustBeforeEach(func() {
+					fakeComposeClient.GetRecipeReturns(&composeapi.Recipe{Status: "complete"}, nil)
+				})
+
+				It("runs the hook once the recipes are complete", func() {
+					resp := DoRequest(brokerAPI, req)
+					Expect(resp.Code).To(Equal(200))
+					Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{"state":"succeeded"}`))
+
+					Expect(engine.OnReadyCallCount()).To(Equal(1))
+					Expect(savedNotes()).To(Equal([]string{
+						`{"provision":{"step":"setup"}}`,
+						`{"provision":{"step":"done"}}`,
+					}))
+				})
+
+				It("does not run the hook again once done", func() {
+					deployment.Notes = `{"provision":{"step":"done"}}`
+
+					resp := DoRequest(brokerAPI, req)
+					Expect(resp.Code).To(Equal(200))
+					Expect(engine.OnReadyCallCount()).To(Equal(0))
+				})
+
+				It("reports a failed hook and retries it on the next poll", func() {
+					engine.OnReadyError = errors.New("cluster unreachable")
+
+					resp := DoRequest(brokerAPI, req)
+					Expect(resp.Code).To(Equal(200))
+					Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{
+						"state": "in progress",
+						"description": "will retry: setup failed: cluster unreachable"
+					}`))
+					Expect(savedNotes()).To(Equal([]string{
+						`{"provision":{"step":"setup"}}`,
+						`{"provision":{"step":"setup","setup_attempts":1}}`,
+					}))
+					Expect(fakeComposeClient.DeprovisionDeploymentCallCount()).To(Equal(0))
+				})
+
+				It("fails but keeps the deployment when the hook keeps failing", func() {
+					engine.OnReadyError = errors.New("cluster unreachable")
+					deployment.Notes = `{"provision":{"step":"setup","setup_attempts":4}}`
+
+					resp := DoRequest(brokerAPI, req)
+					Expect(resp.Code).To(Equal(200))
+					Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{
+						"state": "failed",
+						"description": "setup failed: cluster unreachable"
+					}`))
+					Expect(savedNotes()).To(Equal([]string{
+						`{"provision":{"step":"failed","setup_attempts":5,"error":"setup failed: cluster unreachable"}}`,
+					}))
+					Expect(fakeComposeClient.DeprovisionDeploymentCallCount()).To(Equal(0))
+				})
+			})
+
+			It("keeps the rest of the deployment's notes when saving progress", func() {
+				deployment.Notes = `{"organization_guid":"test-organization-id","provision":{"step":"setup"}}`
+
+				resp := DoRequest(brokerAPI, req)
+				Expect(resp.Code).To(Equal(200))
+				Expect(savedNotes()).To(Equal([]string{
+					`{"organization_guid":"test-organization-id","provision":{"step":"done"}}`,
+				}))
+			})
+
+			It("reports success without calling Compose again once done", func() {
+				deployment.Notes = `{"provision":{"step":"done"}}`
+
+				resp := DoRequest(brokerAPI, req)
+				Expect(resp.Code).To(Equal(200))
+				Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{"state":"succeeded"}`))
+				Expect(fakeComposeClient.GetRecipeCallCount()).To(Equal(0))
+				Expect(fakeComposeClient.PatchDeploymentCallCount()).To(Equal(0))
+			})
+
+			It("retries a failed recipe until it has failed too often", func() {
+				deployment.Notes = `{"provision":{"step":"wait"}}`
+				fakeComposeClient.GetRecipeReturns(&composeapi.Recipe{Status: "failed", StatusDetail: "out of disk"}, nil)
+
+				resp := DoRequest(brokerAPI, req)
+				Expect(resp.Code).To(Equal(200))
+				Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{
+					"state": "in progress",
+					"description": "will retry: recipe failed: out of disk"
+				}`))
+				Expect(savedNotes()).To(Equal([]string{
+					`{"provision":{"step":"wait","setup_attempts":1}}`,
+				}))
+				Expect(fakeComposeClient.DeprovisionDeploymentCallCount()).To(Equal(0))
+			})
+
+			It("fails and deprovisions the deployment when a recipe keeps failing", func() {
+				deployment.Notes = `{"provision":{"step":"wait","setup_attempts":4}}`
+				fakeComposeClient.GetRecipeReturns(&composeapi.Recipe{Status: "failed", StatusDetail: "out of disk"}, nil)
+
+				resp := DoRequest(brokerAPI, req)
+				Expect(resp.Code).To(Equal(200))
+				Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{"state":"failed","description":"recipe failed: out of disk"}`))
+
+				Expect(savedNotes()).To(Equal([]string{
+					`{"provision":{"step":"failed","setup_attempts":5,"error":"recipe failed: out of disk"}}`,
+				}))
+				Expect(fakeComposeClient.DeprovisionDeploymentCallCount()).To(Equal(1))
+				Expect(fakeComposeClient.DeprovisionDeploymentArgsForCall(0)).To(Equal("1"))
+			})
+
+			It("fails and deprovisions the deployment when Compose keeps returning a malformed whitelist recipe", func() {
+				deployment.Notes = `{"provision":{"step":"whitelist","setup_attempts":4}}`
+				fakeComposeClient.CreateDeploymentWhitelistReturnsOnCall(1, &composeapi.Recipe{ID: ""}, nil)
+
+				resp := DoRequest(brokerAPI, req)
+				Expect(resp.Code).To(Equal(200))
+				Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{
+					"state": "failed",
+					"description": "malformed response from Compose: invalid whitelist recipe ID"
+				}`))
+				Expect(fakeComposeClient.DeprovisionDeploymentArgsForCall(0)).To(Equal("1"))
+			})
+
+			It("keeps the deployment when Compose fails transiently", func() {
+				deployment.Notes = `{"provision":{"step":"whitelist","setup_attempts":4}}`
+				fakeComposeClient.CreateDeploymentWhitelistReturnsOnCall(0, nil, []error{
+					errors.New("Unable to parse error - status code 503 - body Service Unavailable"),
+				})
+
+				resp := DoRequest(brokerAPI, req)
+				Expect(resp.Code).To(Equal(503))
+				Expect(fakeComposeClient.DeprovisionDeploymentCallCount()).To(Equal(0))
+				Expect(savedNotes()).To(Equal([]string{
+					`{"provision":{"step":"whitelist","pending_whitelist_ip":"1.1.1.1","setup_attempts":4}}`,
+				}))
+			})
+
+			It("keeps the deployment when Compose cannot be reached", func() {
+				deployment.Notes = `{"provision":{"step":"whitelist","setup_attempts":4}}`
+				fakeComposeClient.CreateDeploymentWhitelistReturnsOnCall(0, nil, []error{
+					errors.New("dial tcp: lookup api.compose.io: no such host"),
+				})
+
+				resp := DoRequest(brokerAPI, req)
+				Expect(resp.Code).To(Equal(500))
+				Expect(fakeComposeClient.DeprovisionDeploymentCallCount()).To(Equal(0))
+			})
+
+			It("reports a failure when the deployment has gone", func() {
+				fakeComposeClient.GetDeploymentReturns(nil, []error{&compose.NotFoundError{Resource: "deployment", Name: "1"}})
+
+				resp := DoRequest(brokerAPI, req)
+				Expect(resp.Code).To(Equal(200))
+				Expect(ReadResponseBody(resp.Body)).To(MatchJSON(`{"state":"failed","description":"the deployment no longer exists"}`))
+			})
 		})
 
 		Context("with whitelist", func() {
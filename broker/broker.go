@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
+	"time"
 
 	"code.cloudfoundry.org/lager"
 
@@ -24,12 +26,25 @@ const (
 	asyncAllowedLogKey          = "acceptsIncomplete"
 	operationDataLogKey         = "operation-data-recipe-id"
 	restoreFromLatestSnapshotOf = "restoreFromLatestSnapshotOf"
+	cloneOfLogKey               = "cloneOf"
 )
 
 type OperationData struct {
 	Type               string   `json:"type"`
 	RecipeID           string   `json:"recipe_id"`
 	WhitelistRecipeIDs []string `json:"whitelist_recipe_ids"`
+	// DeploymentID is set for provisions whose progress is kept in the
+	// deployment's notes. Older provisions list their whitelist recipes.
+	DeploymentID string `json:"deployment_id,omitempty"`
+	// Clone is set for provisions which back up another instance before
+	// restoring the backup into the new deployment.
+	Clone *CloneOperation `json:"clone,omitempty"`
+	// ExportID is set for exports, which record their progress in the
+	// deployment's notes.
+	ExportID string `json:"export_id,omitempty"`
+	// RequestID is the correlation ID of the request which started the
+	// operation.
+	RequestID string `json:"request_id,omitempty"`
 }
 
 func lookupBrokerAPIState(composeStatus string) brokerapi.LastOperationState {
@@ -55,6 +70,12 @@ type Broker struct {
 	AccountID        string
 	ClusterID        string
 	DBEngineProvider dbengine.Provider
+	// ExportHTTPClient uploads exported backups. http.DefaultClient is
+	// used when nil.
+	ExportHTTPClient *http.Client
+
+	deployments *deploymentCache
+	capacity    *capacityCache
 }
 
 func New(composeClient compose.Client, dbEngineProvider dbengine.Provider, config *config.Config, catalog *catalog.Catalog, logger lager.Logger) (*Broker, error) {
@@ -71,6 +92,8 @@ func New(composeClient compose.Client, dbEngineProvider dbengine.Provider, confi
 		Logger:           logger,
 		AccountID:        account.ID,
 		DBEngineProvider: dbEngineProvider,
+		deployments:      newDeploymentCache(config.DeploymentCacheTTL),
+		capacity:         &capacityCache{now: time.Now},
 	}
 
 	if config.ClusterName != "" {
@@ -84,7 +107,25 @@ func New(composeClient compose.Client, dbEngineProvider dbengine.Provider, confi
 	return &broker, nil
 }
 
-func (b *Broker) Services(context context.Context) []brokerapi.Service {
+// composeClient returns the Compose client bound to the context of a
+// request, so that calls are abandoned when it is cancelled.
+func (b *Broker) composeClient(ctx context.Context) compose.Client {
+	return compose.WithContext(ctx, b.Compose)
+}
+
+// uninterrupted is a context without the cancellation and deadline of its
+// parent, keeping its values, such as the request's logger and span. It is
+// for the one call which must follow a change that has been made, when
+// abandoning it would leave the change half done.
+type uninterrupted struct {
+	context.Context
+}
+
+func (uninterrupted) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (uninterrupted) Done() <-chan struct{}       { return nil }
+func (uninterrupted) Err() error                  { return nil }
+
+func (b *Broker) Services(ctx context.Context) []brokerapi.Service {
 	services := []brokerapi.Service{}
 	for _, s := range b.Catalog.Services {
 		services = append(services, s.Service)
@@ -92,8 +133,8 @@ func (b *Broker) Services(context context.Context) []brokerapi.Service {
 	return services
 }
 
-func (b *Broker) Provision(context context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, error) {
-	b.Logger.Debug("provision", lager.Data{
+func (b *Broker) Provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, error) {
+	b.logger(ctx).Debug("provision", lager.Data{
 		instanceIDLogKey:   instanceID,
 		detailsLogKey:      details,
 		asyncAllowedLogKey: asyncAllowed,
@@ -112,7 +153,7 @@ func (b *Broker) Provision(context context.Context, instanceID string, details b
 		var err error
 		provisionParameters, err = ParseProvisionParameters(details.RawParameters)
 		if err != nil {
-			return brokerapi.ProvisionedServiceSpec{}, err
+			return brokerapi.ProvisionedServiceSpec{}, invalidParameters(err)
 		}
 	}
 
@@ -120,29 +161,50 @@ func (b *Broker) Provision(context context.Context, instanceID string, details b
 	if err != nil {
 		return spec, err
 	}
+	b.deployments.invalidate(newInstanceName)
+
+	notes := deploymentNotes{OrganizationGUID: details.OrganizationGUID, PlanID: details.PlanID}
+	if provisionParameters.BackupSchedule != nil {
+		notes.BackupSchedule, err = b.newBackupSchedule(details.ServiceID, details.PlanID, provisionParameters.BackupSchedule)
+		if err != nil {
+			return spec, err
+		}
+	}
+
+	if provisionParameters.CloneOf != nil {
+		b.logger(ctx).Debug("provision.clone", lager.Data{
+			instanceIDLogKey: instanceID,
+			detailsLogKey:    details,
+			cloneOfLogKey:    *provisionParameters.CloneOf,
+		})
+
+		spec.OperationData, err = b.startClone(ctx, *provisionParameters.CloneOf, details, notes.BackupSchedule)
+		return spec, err
+	}
 
 	var deployment *composeapi.Deployment
 	if provisionParameters.RestoreFromLatestSnapshotOf != nil {
-		b.Logger.Debug("provision.restore", lager.Data{
+		b.logger(ctx).Debug("provision.restore", lager.Data{
 			instanceIDLogKey:            instanceID,
 			detailsLogKey:               details,
 			restoreFromLatestSnapshotOf: provisionParameters.RestoreFromLatestSnapshotOf,
 		})
 
 		deployment, err = b.createDeploymentFromLatestSnapshot(
+			ctx,
 			*provisionParameters.RestoreFromLatestSnapshotOf,
-			newInstanceName, details.ServiceID, details.PlanID, details.SpaceGUID,
+			newInstanceName, details, notes,
 		)
 		if err != nil {
 			return spec, err
 		}
 	} else {
-		b.Logger.Debug("provision.blank", lager.Data{
+		b.logger(ctx).Debug("provision.blank", lager.Data{
 			instanceIDLogKey: instanceID,
 			detailsLogKey:    details,
 		})
 
-		deployment, err = b.createDeployment(newInstanceName, details.ServiceID, details.PlanID, details.SpaceGUID)
+		deployment, err = b.createDeployment(ctx, newInstanceName, details, notes)
 		if err != nil {
 			return spec, err
 		}
@@ -152,52 +214,26 @@ func (b *Broker) Provision(context context.Context, instanceID string, details b
 		return spec, fmt.Errorf("unexpected nil deployment")
 	}
 
-	ok := false
-	defer func() {
-		if !ok {
-			_, errs := b.Compose.DeprovisionDeployment(deployment.ID)
-			for _, err := range errs {
-				b.Logger.Error("failed-deprovision", err, lager.Data{
-					instanceIDLogKey:   instanceID,
-					detailsLogKey:      details,
-					asyncAllowedLogKey: asyncAllowed,
-				})
-			}
-		}
-	}()
-
-	whitelistRecipeIDs := []string{}
-	for _, ip := range b.Config.IPWhitelist {
-		whitelistParams := composeapi.DeploymentWhitelistParams{
-			IP:          ip,
-			Description: fmt.Sprintf("Allow %s to access deployment", ip),
-		}
-		whitelistRecipe, whitelistErrs := b.Compose.CreateDeploymentWhitelist(deployment.ID, whitelistParams)
-		if len(whitelistErrs) > 0 {
-			return spec, compose.SquashErrors(whitelistErrs)
-		}
-		if whitelistRecipe == nil {
-			return spec, errors.New("malformed response from Compose: no pending whitelist recipe received")
-		}
-		if whitelistRecipe.ID == "" {
-			return spec, errors.New("malformed response from Compose: invalid whitelist recipe ID")
-		}
-		whitelistRecipeIDs = append(whitelistRecipeIDs, whitelistRecipe.ID)
-	}
-
-	operationData, err := makeOperationData("provision", deployment.ProvisionRecipeID, whitelistRecipeIDs)
+	// LastOperation whitelists the deployment and sees it through the rest
+	// of provisioning.
+	operationData, err := b.startOperation(ctx, OperationData{
+		Type:               "provision",
+		RecipeID:           deployment.ProvisionRecipeID,
+		DeploymentID:       deployment.ID,
+		WhitelistRecipeIDs: []string{},
+	})
 	if err != nil {
+		b.deprovisionAbandoned(deployment.ID)
 		return spec, err
 	}
 
 	spec.OperationData = operationData
-	ok = true
 
 	return spec, nil
 }
 
-func (b *Broker) Deprovision(context context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (brokerapi.DeprovisionServiceSpec, error) {
-	b.Logger.Debug("deprovision", lager.Data{
+func (b *Broker) Deprovision(ctx context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (brokerapi.DeprovisionServiceSpec, error) {
+	b.logger(ctx).Debug("deprovision", lager.Data{
 		instanceIDLogKey:   instanceID,
 		detailsLogKey:      details,
 		asyncAllowedLogKey: asyncAllowed,
@@ -216,19 +252,26 @@ func (b *Broker) Deprovision(context context.Context, instanceID string, details
 		return spec, err
 	}
 
-	deployment, err := findDeployment(b.Compose, instanceName)
-	if err == errDeploymentNotFound {
+	deployment, err := b.findDeployment(ctx, instanceName)
+	if err == ErrDeploymentNotFound {
 		return spec, brokerapi.ErrInstanceDoesNotExist
 	} else if err != nil {
 		return spec, err
 	}
 
-	recipe, errs := b.Compose.DeprovisionDeployment(deployment.ID)
-	if len(errs) > 0 {
-		return spec, compose.SquashErrors(errs)
+	b.deployments.invalidate(instanceName)
+	recipe, errs := b.composeClient(ctx).DeprovisionDeployment(deployment.ID)
+	if len(errs) > 0 && compose.IsNotFound(errs[0]) {
+		return spec, brokerapi.ErrInstanceDoesNotExist
+	} else if len(errs) > 0 {
+		return spec, composeError(errs)
 	}
 
-	operationData, err := makeOperationData("deprovision", recipe.ID, []string{})
+	operationData, err := b.startOperation(ctx, OperationData{
+		Type:               "deprovision",
+		RecipeID:           recipe.ID,
+		WhitelistRecipeIDs: []string{},
+	})
 	if err != nil {
 		return spec, err
 	}
@@ -238,8 +281,8 @@ func (b *Broker) Deprovision(context context.Context, instanceID string, details
 	return spec, nil
 }
 
-func (b *Broker) Bind(context context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
-	b.Logger.Debug("bind", lager.Data{
+func (b *Broker) Bind(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
+	b.logger(ctx).Debug("bind", lager.Data{
 		instanceIDLogKey: instanceID,
 		bindingIDLogKey:  bindingID,
 		detailsLogKey:    details,
@@ -252,8 +295,8 @@ func (b *Broker) Bind(context context.Context, instanceID, bindingID string, det
 		return binding, err
 	}
 
-	deployment, err := findDeployment(b.Compose, instanceName)
-	if err == errDeploymentNotFound {
+	deployment, err := b.findDeployment(ctx, instanceName)
+	if err == ErrDeploymentNotFound {
 		return binding, brokerapi.ErrInstanceDoesNotExist
 	} else if err != nil {
 		return binding, err
@@ -268,12 +311,12 @@ func (b *Broker) Bind(context context.Context, instanceID, bindingID string, det
 		return binding, err
 	}
 
-	binding.Credentials, err = dbEngine.GenerateCredentials(instanceID, bindingID)
+	binding.Credentials, err = dbEngine.GenerateCredentials(ctx, instanceID, bindingID)
 	return binding, err
 }
 
-func (b *Broker) Unbind(context context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) error {
-	b.Logger.Debug("unbind", lager.Data{
+func (b *Broker) Unbind(ctx context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) error {
+	b.logger(ctx).Debug("unbind", lager.Data{
 		instanceIDLogKey: instanceID,
 		bindingIDLogKey:  bindingID,
 		detailsLogKey:    details,
@@ -284,8 +327,8 @@ func (b *Broker) Unbind(context context.Context, instanceID, bindingID string, d
 		return err
 	}
 
-	deployment, err := findDeployment(b.Compose, instanceName)
-	if err == errDeploymentNotFound {
+	deployment, err := b.findDeployment(ctx, instanceName)
+	if err == ErrDeploymentNotFound {
 		return brokerapi.ErrInstanceDoesNotExist
 	} else if err != nil {
 		return err
@@ -296,13 +339,16 @@ func (b *Broker) Unbind(context context.Context, instanceID, bindingID string, d
 		return err
 	}
 
-	return dbEngine.RevokeCredentials(instanceID, bindingID)
+	return dbEngine.RevokeCredentials(ctx, instanceID, bindingID)
 }
 
-func (b *Broker) Update(context context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
-	b.Logger.Debug("update", lager.Data{
+func (b *Broker) Update(ctx context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
+	// The parameters may hold credentials, so they are not logged.
+	loggedDetails := details
+	loggedDetails.RawParameters = nil
+	b.logger(ctx).Debug("update", lager.Data{
 		instanceIDLogKey:   instanceID,
-		detailsLogKey:      details,
+		detailsLogKey:      loggedDetails,
 		asyncAllowedLogKey: asyncAllowed,
 	})
 
@@ -324,8 +370,8 @@ func (b *Broker) Update(context context.Context, instanceID string, details brok
 		return spec, err
 	}
 
-	deployment, err := findDeployment(b.Compose, instanceName)
-	if err == errDeploymentNotFound {
+	deployment, err := b.findDeployment(ctx, instanceName)
+	if err == ErrDeploymentNotFound {
 		return spec, brokerapi.ErrInstanceDoesNotExist
 	} else if err != nil {
 		return spec, err
@@ -335,6 +381,30 @@ func (b *Broker) Update(context context.Context, instanceID string, details brok
 		return spec, fmt.Errorf("changing plans is not currently supported")
 	}
 
+	updateParameters := &UpdateParameters{}
+	if len(details.RawParameters) > 0 {
+		updateParameters, err = ParseUpdateParameters(details.RawParameters)
+		if err != nil {
+			return spec, invalidParameters(err)
+		}
+	}
+	if updateParameters.BackupSchedule != nil {
+		schedule, err := b.newBackupSchedule(details.ServiceID, details.PlanID, updateParameters.BackupSchedule)
+		if err != nil {
+			return spec, err
+		}
+		if err := b.updateBackupSchedule(ctx, deployment.ID, schedule); err != nil {
+			return spec, err
+		}
+		if updateParameters.ExportBackup == nil {
+			return brokerapi.UpdateServiceSpec{IsAsync: false}, nil
+		}
+	}
+	if updateParameters.ExportBackup != nil {
+		spec.OperationData, err = b.startExport(ctx, deployment, updateParameters.ExportBackup)
+		return spec, err
+	}
+
 	plan, err := service.GetPlan(details.PlanID)
 	if err != nil {
 		return spec, err
@@ -345,12 +415,22 @@ func (b *Broker) Update(context context.Context, instanceID string, details brok
 		Units:        plan.Compose.Units,
 	}
 
-	recipe, errs := b.Compose.SetScalings(params)
+	// Recorded first, so that billing does not miss a scaling which has
+	// started.
+	if err := b.recordPlan(ctx, deployment.ID, details.PlanID); err != nil {
+		return spec, err
+	}
+
+	recipe, errs := b.composeClient(ctx).SetScalings(params)
 	if len(errs) > 0 {
-		return spec, compose.SquashErrors(errs)
+		return spec, composeError(errs)
 	}
 
-	operationData, err := makeOperationData("update", recipe.ID, []string{})
+	operationData, err := b.startOperation(ctx, OperationData{
+		Type:               "update",
+		RecipeID:           recipe.ID,
+		WhitelistRecipeIDs: []string{},
+	})
 	if err != nil {
 		return spec, err
 	}
@@ -360,22 +440,35 @@ func (b *Broker) Update(context context.Context, instanceID string, details brok
 	return spec, nil
 }
 
-func (b *Broker) LastOperation(context context.Context, instanceID, operationDataJson string) (brokerapi.LastOperation, error) {
+func (b *Broker) LastOperation(ctx context.Context, instanceID, operationDataJson string) (brokerapi.LastOperation, error) {
 	lastOperation := brokerapi.LastOperation{}
 	operationData := OperationData{}
 	err := json.Unmarshal([]byte(operationDataJson), &operationData)
 	if err != nil {
 		return lastOperation, err
 	}
+	ctx = withOperationRequestID(ctx, operationData.RequestID)
 
-	b.Logger.Debug("last-operation", lager.Data{
+	b.logger(ctx).Debug("last-operation", lager.Data{
 		instanceIDLogKey:    instanceID,
 		operationDataLogKey: operationData.RecipeID,
 	})
 
-	deploymentRecipe, errs := b.Compose.GetRecipe(operationData.RecipeID)
-	if len(errs) > 0 {
-		return lastOperation, compose.SquashErrors(errs)
+	if operationData.Type == "export" {
+		return b.exportLastOperation(ctx, operationData)
+	}
+	if operationData.Type == "provision" && operationData.Clone != nil {
+		return b.resumeClone(ctx, instanceID, operationData)
+	}
+	if operationData.Type == "provision" && operationData.DeploymentID != "" {
+		return b.resumeProvision(ctx, operationData)
+	}
+
+	deploymentRecipe, errs := b.composeClient(ctx).GetRecipe(operationData.RecipeID)
+	if len(errs) > 0 && operationData.Type == "deprovision" && compose.AsError(errs[0]).StatusCode == http.StatusNotFound {
+		return lastOperation, brokerapi.ErrInstanceDoesNotExist
+	} else if len(errs) > 0 {
+		return lastOperation, composeError(errs)
 	}
 	deploymentState := lookupBrokerAPIState(deploymentRecipe.Status)
 	if deploymentState != brokerapi.Succeeded {
@@ -386,9 +479,9 @@ func (b *Broker) LastOperation(context context.Context, instanceID, operationDat
 	}
 
 	for _, recipeID := range operationData.WhitelistRecipeIDs {
-		whitelistRecipe, errs := b.Compose.GetRecipe(recipeID)
+		whitelistRecipe, errs := b.composeClient(ctx).GetRecipe(recipeID)
 		if len(errs) > 0 {
-			return lastOperation, compose.SquashErrors(errs)
+			return lastOperation, composeError(errs)
 		}
 		state := lookupBrokerAPIState(whitelistRecipe.Status)
 
@@ -400,20 +493,36 @@ func (b *Broker) LastOperation(context context.Context, instanceID, operationDat
 		}
 	}
 
-	return brokerapi.LastOperation{
+	lastOperation = brokerapi.LastOperation{
 		State:       deploymentState,
 		Description: deploymentRecipe.StatusDetail,
-	}, nil
+	}
+	if operationData.Type == "update" {
+		lastOperation = b.withAlerts(ctx, deploymentRecipe.DeploymentID, lastOperation)
+	}
+	return lastOperation, nil
 }
 
-func (b *Broker) createDeployment(newInstanceName, serviceID, planID, spaceID string) (*composeapi.Deployment, error) {
-	service, err := b.Catalog.GetService(serviceID)
+func (b *Broker) createDeployment(ctx context.Context, newInstanceName string, details brokerapi.ProvisionDetails, notes deploymentNotes) (*composeapi.Deployment, error) {
+	service, err := b.Catalog.GetService(details.ServiceID)
+	if err != nil {
+		return nil, err
+	}
+
+	plan, err := service.GetPlan(details.PlanID)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := b.checkClusterCapacity(ctx, plan.Compose.Units)
 	if err != nil {
 		return nil, err
 	}
 
-	plan, err := service.GetPlan(planID)
+	notes.Provision = &provisionState{Step: provisionStepWhitelist}
+	encodedNotes, err := encodeNotes(notes)
 	if err != nil {
+		release()
 		return nil, err
 	}
 
@@ -425,76 +534,123 @@ func (b *Broker) createDeployment(newInstanceName, serviceID, planID, spaceID st
 		Units:               plan.Compose.Units,
 		SSL:                 true,
 		ClusterID:           b.ClusterID,
-		CustomerBillingCode: spaceID,
+		CustomerBillingCode: details.SpaceGUID,
+		Notes:               encodedNotes,
 	}
 
-	deployment, errs := b.Compose.CreateDeployment(params)
+	deployment, errs := b.composeClient(ctx).CreateDeployment(params)
 	if len(errs) > 0 {
-		return nil, compose.SquashErrors(errs)
+		release()
+		return nil, composeError(errs)
 	}
 	return deployment, nil
 }
 
-func (b *Broker) createDeploymentFromLatestSnapshot(restoreFrom, newInstanceName, serviceID, planID, spaceID string) (*composeapi.Deployment, error) {
-	oldInstanceName, err := MakeInstanceName(b.Config.DBPrefix, restoreFrom)
+func (b *Broker) createDeploymentFromLatestSnapshot(ctx context.Context, restoreFrom, newInstanceName string, details brokerapi.ProvisionDetails, notes deploymentNotes) (*composeapi.Deployment, error) {
+	oldDeployment, plan, err := b.findRestoreSource(ctx, restoreFrom, details)
 	if err != nil {
 		return nil, err
 	}
 
-	service, err := b.Catalog.GetService(serviceID)
+	oldDeploymentBackups, errs := b.composeClient(ctx).GetBackupsForDeployment(oldDeployment.ID)
+	if len(errs) > 0 {
+		return nil, composeError(errs)
+	}
+
+	chosenOldDeploymentBackup := newestRestorableBackup(*oldDeploymentBackups)
+	if chosenOldDeploymentBackup == nil {
+		return nil, invalidParameters(errors.New("that instance has no restorable snapshots"))
+	}
+
+	release, err := b.checkClusterCapacity(ctx, plan.Compose.Units)
 	if err != nil {
 		return nil, err
 	}
 
-	plan, err := service.GetPlan(planID)
+	deployment, err := b.restoreBackup(ctx, oldDeployment.ID, chosenOldDeploymentBackup.ID, newInstanceName, details.SpaceGUID, notes)
 	if err != nil {
+		release()
 		return nil, err
 	}
+	return deployment, nil
+}
 
-	oldDeployment, err := findDeployment(b.Compose, oldInstanceName)
+// findRestoreSource finds the deployment of the instance restoreFrom and
+// checks that its backups may be restored into the instance described by
+// details.
+func (b *Broker) findRestoreSource(ctx context.Context, restoreFrom string, details brokerapi.ProvisionDetails) (*composeapi.Deployment, *catalog.Plan, error) {
+	oldInstanceName, err := MakeInstanceName(b.Config.DBPrefix, restoreFrom)
 	if err != nil {
-		return nil, fmt.Errorf("service '%s' does not exist", restoreFrom)
+		return nil, nil, err
 	}
 
-	if oldDeployment.CustomerBillingCode != spaceID {
-		return nil, errors.New("you are only allowed to restore from backup to the same space")
+	service, err := b.Catalog.GetService(details.ServiceID)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if oldDeployment.Type != plan.Compose.DatabaseType {
-		return nil, errors.New("you are only allowed to restore a backup from the same service type")
+	plan, err := service.GetPlan(details.PlanID)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	oldDeploymentBackups, errs := b.Compose.GetBackupsForDeployment(oldDeployment.ID)
-	if len(errs) > 0 {
-		return nil, compose.SquashErrors(errs)
+	oldDeployment, err := b.findDeployment(ctx, oldInstanceName)
+	if err == ErrDeploymentNotFound {
+		return nil, nil, invalidParameters(fmt.Errorf("service '%s' does not exist", restoreFrom))
+	} else if err != nil {
+		return nil, nil, err
 	}
 
-	chosenOldDeploymentBackup := newestRestorableBackup(*oldDeploymentBackups)
-	if chosenOldDeploymentBackup == nil {
-		return nil, errors.New("that instance has no restorable snapshots")
+	if err := b.checkRestoreAllowed(ctx, restoreFrom, oldDeployment, details); err != nil {
+		return nil, nil, err
+	}
+
+	if oldDeployment.Type != plan.Compose.DatabaseType {
+		return nil, nil, invalidParameters(errors.New("you are only allowed to restore a backup from the same service type"))
 	}
 
+	return oldDeployment, plan, nil
+}
+
+// restoreBackup creates a deployment for an instance from a backup of
+// another deployment, and gets it ready for LastOperation to whitelist. The
+// deployment is given notes, with the provision state added.
+func (b *Broker) restoreBackup(ctx context.Context, sourceDeploymentID, backupID, newInstanceName, spaceGUID string, notes deploymentNotes) (*composeapi.Deployment, error) {
 	restoreBackupParams := composeapi.RestoreBackupParams{
-		DeploymentID: oldDeployment.ID,
-		BackupID:     chosenOldDeploymentBackup.ID,
+		DeploymentID: sourceDeploymentID,
+		BackupID:     backupID,
 		Name:         newInstanceName,
 		Datacenter:   ComposeDatacenter,
 		SSL:          true,
 		ClusterID:    b.ClusterID,
 	}
-	deployment, errs := b.Compose.RestoreBackup(restoreBackupParams)
+	deployment, errs := b.composeClient(ctx).RestoreBackup(restoreBackupParams)
 	if len(errs) > 0 {
-		return nil, compose.SquashErrors(errs)
+		return nil, composeError(errs)
 	}
+	restoredDeploymentID := deployment.ID
 	provisionRecipeID := deployment.ProvisionRecipeID
 
+	notes.Provision = &provisionState{
+		Step:     provisionStepWhitelist,
+		RecipeID: provisionRecipeID,
+	}
+	encodedNotes, err := encodeNotes(notes)
+	if err != nil {
+		b.deprovisionAbandoned(restoredDeploymentID)
+		return nil, err
+	}
 	patchDeploymentParams := composeapi.PatchDeploymentParams{
 		DeploymentID:        deployment.ID,
-		CustomerBillingCode: spaceID,
+		CustomerBillingCode: spaceGUID,
+		Notes:               encodedNotes,
 	}
-	deployment, errs = b.Compose.PatchDeployment(patchDeploymentParams)
+	// The deployment exists now, so the request being cancelled must not
+	// leave it without its notes.
+	deployment, errs = b.composeClient(uninterrupted{ctx}).PatchDeployment(patchDeploymentParams)
 	if len(errs) > 0 {
-		return nil, compose.SquashErrors(errs)
+		b.deprovisionAbandoned(restoredDeploymentID)
+		return nil, composeError(errs)
 	}
 	deployment.ProvisionRecipeID = provisionRecipeID
 
@@ -1,11 +1,15 @@
 package broker_test
 
 import (
+	"context"
 	"errors"
 
+	"code.cloudfoundry.org/lager"
+
 	composeapi "github.com/compose/gocomposeapi"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/brokerapi"
 
 	"github.com/alphagov/paas-compose-broker/broker"
 	"github.com/alphagov/paas-compose-broker/catalog"
@@ -90,4 +94,25 @@ var _ = Describe("Broker", func() {
 		})
 	})
 
+	Describe("cancelled requests", func() {
+
+		It("does not call Compose once the request context is done", func() {
+			fakeComposeClient := &fakes.FakeClient{}
+			fakeComposeClient.GetAccountReturns(&composeapi.Account{ID: "1234"}, []error{})
+			b, err := broker.New(fakeComposeClient, &enginefakes.FakeProvider{}, &config.Config{DBPrefix: "test"}, &catalog.Catalog{}, lager.NewLogger("test"))
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			_, err = b.LastOperation(ctx, "instance", `{"recipe_id":"recipe-id","type":"provision"}`)
+			Expect(err).To(MatchError(context.Canceled.Error()))
+			_, err = b.Bind(ctx, "instance", "binding", brokerapi.BindDetails{})
+			Expect(err).To(MatchError(context.Canceled.Error()))
+
+			Expect(fakeComposeClient.GetRecipeCallCount()).To(Equal(0))
+			Expect(fakeComposeClient.GetDeploymentByNameCallCount()).To(Equal(0))
+		})
+	})
+
 })
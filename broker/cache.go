@@ -0,0 +1,84 @@
+package broker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	composeapi "github.com/compose/gocomposeapi"
+)
+
+// deploymentCache remembers deployments found by instance name, so that
+// binds, unbinds and updates do not each look the deployment up in Compose.
+// Only deployments which exist are cached. Entries are dropped when the
+// broker provisions or deprovisions the instance, and expire after ttl in
+// case another broker instance has done so.
+type deploymentCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]deploymentCacheEntry
+}
+
+type deploymentCacheEntry struct {
+	deployment composeapi.Deployment
+	expires    time.Time
+}
+
+func newDeploymentCache(ttl time.Duration) *deploymentCache {
+	return &deploymentCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: map[string]deploymentCacheEntry{},
+	}
+}
+
+func (c *deploymentCache) get(name string) (*composeapi.Deployment, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[name]
+	if !ok {
+		return nil, false
+	}
+	if !c.now().Before(entry.expires) {
+		delete(c.entries, name)
+		return nil, false
+	}
+	deployment := entry.deployment
+	return &deployment, true
+}
+
+func (c *deploymentCache) put(name string, deployment *composeapi.Deployment) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[name] = deploymentCacheEntry{
+		deployment: *deployment,
+		expires:    c.now().Add(c.ttl),
+	}
+}
+
+func (c *deploymentCache) invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, name)
+}
+
+// findDeployment is FindDeployment through the broker's cache.
+func (b *Broker) findDeployment(ctx context.Context, name string) (*composeapi.Deployment, error) {
+	if deployment, ok := b.deployments.get(name); ok {
+		return deployment, nil
+	}
+
+	deployment, err := FindDeployment(b.composeClient(ctx), name)
+	if err != nil {
+		return nil, err
+	}
+	b.deployments.put(name, deployment)
+	return deployment, nil
+}
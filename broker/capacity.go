@@ -0,0 +1,195 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	clusterCapacityExceededKey = "cluster-capacity-exceeded"
+
+	// capacityCacheTTL is how long provisions use a computed cluster
+	// capacity for, as computing it scales-checks every deployment.
+	capacityCacheTTL = time.Minute
+)
+
+var errNoCluster = errors.New("no enterprise cluster configured")
+
+// ClusterCapacity describes how many Compose units are allocated to the
+// deployments in the configured enterprise cluster and how many are left.
+// TotalUnits and HeadroomUnits are only meaningful when the operator has set
+// CLUSTER_CAPACITY_UNITS, as the Compose API does not report cluster size.
+type ClusterCapacity struct {
+	ClusterID      string `json:"cluster_id"`
+	ClusterName    string `json:"cluster_name"`
+	Deployments    int    `json:"deployments"`
+	AllocatedUnits int    `json:"allocated_units"`
+	TotalUnits     int    `json:"total_units"`
+	HeadroomUnits  int    `json:"headroom_units"`
+}
+
+func (b *Broker) ClusterCapacity(ctx context.Context) (*ClusterCapacity, error) {
+	if b.ClusterID == "" {
+		return nil, errNoCluster
+	}
+	client := b.composeClient(ctx)
+
+	cluster, errs := client.GetCluster(b.ClusterID)
+	if len(errs) > 0 {
+		return nil, composeError(errs)
+	}
+
+	deployments, errs := client.GetDeployments()
+	if len(errs) > 0 {
+		return nil, composeError(errs)
+	}
+
+	capacity := &ClusterCapacity{
+		ClusterID:   cluster.ID,
+		ClusterName: cluster.Name,
+		TotalUnits:  b.Config.ClusterCapacityUnits,
+	}
+	for _, deployment := range *deployments {
+		if deployment.ClusterID != cluster.ID {
+			continue
+		}
+		scalings, errs := client.GetScalings(deployment.ID)
+		if len(errs) > 0 {
+			return nil, composeError(errs)
+		}
+		capacity.Deployments++
+		capacity.AllocatedUnits += scalings.AllocatedUnits
+	}
+	if capacity.TotalUnits > 0 {
+		capacity.HeadroomUnits = capacity.TotalUnits - capacity.AllocatedUnits
+	}
+
+	return capacity, nil
+}
+
+// capacityCache holds the cluster capacity between provisions. The units of
+// each provision it allows are added to it, so that provisions within
+// capacityCacheTTL of each other are not all allowed the same headroom, and
+// taken off again if the provision fails.
+type capacityCache struct {
+	now func() time.Time
+
+	mu       sync.Mutex
+	capacity *ClusterCapacity
+	expires  time.Time
+}
+
+// reserve returns the capacity before units are allocated, computing it with
+// compute if the cached one has expired, and allocates units in the cache if
+// they fit. release gives the units back, unless the capacity has been
+// computed again since, when it no longer counts them.
+//
+// compute is called without the lock held, so provisions are not queued
+// behind the scalings check of every deployment in the cluster.
+func (c *capacityCache) reserve(units int, compute func() (*ClusterCapacity, error)) (before ClusterCapacity, release func(), err error) {
+	c.mu.Lock()
+	expired := c.capacity == nil || !c.now().Before(c.expires)
+	c.mu.Unlock()
+
+	var computed *ClusterCapacity
+	if expired {
+		computed, err = compute()
+		if err != nil {
+			return ClusterCapacity{}, func() {}, err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Another provision may have computed the capacity meanwhile, and
+	// allocated units in it which the one computed here may not count.
+	if computed != nil && (c.capacity == nil || !c.now().Before(c.expires)) {
+		c.capacity = computed
+		c.expires = c.now().Add(capacityCacheTTL)
+	}
+	before = *c.capacity
+	if units > c.capacity.HeadroomUnits {
+		return before, func() {}, nil
+	}
+	reserved := c.capacity
+	reserved.AllocatedUnits += units
+	reserved.HeadroomUnits -= units
+	return before, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.capacity == reserved {
+			reserved.AllocatedUnits -= units
+			reserved.HeadroomUnits += units
+		}
+	}, nil
+}
+
+// checkClusterCapacity fails if the cluster does not have room for units
+// more, and otherwise reserves them. The caller must call release if the
+// deployment is not created after all.
+func (b *Broker) checkClusterCapacity(ctx context.Context, units int) (release func(), err error) {
+	if b.ClusterID == "" || b.Config.ClusterCapacityUnits == 0 {
+		return func() {}, nil
+	}
+
+	capacity, release, err := b.capacity.reserve(units, func() (*ClusterCapacity, error) {
+		return b.ClusterCapacity(ctx)
+	})
+	if err == ErrComposeUnavailable {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("could not check cluster capacity: %s", err)
+	}
+
+	b.logger(ctx).Info("cluster-capacity", lager.Data{
+		"cluster-id":      capacity.ClusterID,
+		"allocated-units": capacity.AllocatedUnits,
+		"total-units":     capacity.TotalUnits,
+		"headroom-units":  capacity.HeadroomUnits,
+		"requested-units": units,
+	})
+
+	if units > capacity.HeadroomUnits {
+		return nil, brokerapi.NewFailureResponseBuilder(
+			fmt.Errorf(
+				"cluster %s does not have capacity for %d more units (%d available)",
+				capacity.ClusterName, units, capacity.HeadroomUnits,
+			),
+			http.StatusUnprocessableEntity,
+			clusterCapacityExceededKey,
+		).WithErrorKey("ClusterCapacityExceeded").Build()
+	}
+
+	return release, nil
+}
+
+// CapacityHandler reports the headroom of the configured enterprise cluster
+// to operators. It must be wrapped in the same basic auth as the broker API.
+func CapacityHandler(b *Broker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		capacity, err := b.ClusterCapacity(req.Context())
+		if err == errNoCluster {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(brokerapi.ErrorResponse{Description: err.Error()})
+			return
+		} else if err != nil {
+			b.logger(req.Context()).Error("cluster-capacity", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(brokerapi.ErrorResponse{Description: err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(capacity)
+	})
+}
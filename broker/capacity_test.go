@@ -0,0 +1,114 @@
+package broker_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	"code.cloudfoundry.org/lager"
+	composeapi "github.com/compose/gocomposeapi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/paas-compose-broker/broker"
+	"github.com/alphagov/paas-compose-broker/catalog"
+	"github.com/alphagov/paas-compose-broker/compose/fakes"
+	"github.com/alphagov/paas-compose-broker/config"
+	enginefakes "github.com/alphagov/paas-compose-broker/dbengine/fakes"
+)
+
+var _ = Describe("Cluster capacity", func() {
+
+	var (
+		fakeComposeClient *fakes.FakeClient
+		cfg               *config.Config
+		b                 *broker.Broker
+	)
+
+	BeforeEach(func() {
+		fakeComposeClient = &fakes.FakeClient{}
+		fakeComposeClient.GetAccountReturns(&composeapi.Account{ID: "1"}, []error{})
+		fakeComposeClient.GetClusterByNameReturns(&composeapi.Cluster{ID: "c1", Name: "cluster-one"}, []error{})
+		fakeComposeClient.GetClusterReturns(&composeapi.Cluster{ID: "c1", Name: "cluster-one"}, []error{})
+		fakeComposeClient.GetDeploymentsReturns(&[]composeapi.Deployment{
+			{ID: "d1", ClusterID: "c1"},
+			{ID: "d2", ClusterID: "elsewhere"},
+			{ID: "d3", ClusterID: "c1"},
+		}, []error{})
+		fakeComposeClient.GetScalingsStub = func(deploymentID string) (*composeapi.Scalings, []error) {
+			switch deploymentID {
+			case "d1":
+				return &composeapi.Scalings{AllocatedUnits: 3}, []error{}
+			case "d3":
+				return &composeapi.Scalings{AllocatedUnits: 4}, []error{}
+			}
+			return nil, []error{errors.New("unexpected deployment")}
+		}
+
+		cfg = &config.Config{
+			ClusterName:          "cluster-one",
+			ClusterCapacityUnits: 10,
+		}
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		b, err = broker.New(fakeComposeClient, enginefakes.FakeProvider{}, cfg, &catalog.Catalog{}, lager.NewLogger("test"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("adds up the units allocated to deployments in the cluster", func() {
+		capacity, err := b.ClusterCapacity(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(fakeComposeClient.GetClusterArgsForCall(0)).To(Equal("c1"))
+		Expect(fakeComposeClient.GetScalingsCallCount()).To(Equal(2))
+		Expect(capacity).To(Equal(&broker.ClusterCapacity{
+			ClusterID:      "c1",
+			ClusterName:    "cluster-one",
+			Deployments:    2,
+			AllocatedUnits: 7,
+			TotalUnits:     10,
+			HeadroomUnits:  3,
+		}))
+	})
+
+	It("returns an error if the scalings can't be looked up", func() {
+		fakeComposeClient.GetScalingsStub = nil
+		fakeComposeClient.GetScalingsReturns(nil, []error{errors.New("computer says no")})
+
+		_, err := b.ClusterCapacity(context.Background())
+		Expect(err).To(MatchError("computer says no"))
+	})
+
+	Context("when no cluster is configured", func() {
+		BeforeEach(func() {
+			cfg.ClusterName = ""
+		})
+
+		It("returns an error", func() {
+			_, err := b.ClusterCapacity(context.Background())
+			Expect(err).To(MatchError("no enterprise cluster configured"))
+		})
+
+		It("responds 404 from the capacity endpoint", func() {
+			resp := httptest.NewRecorder()
+			broker.CapacityHandler(b).ServeHTTP(resp, httptest.NewRequest("GET", "/capacity", nil))
+
+			Expect(resp.Code).To(Equal(http.StatusNotFound))
+			Expect(resp.Body.String()).To(MatchJSON(`{"description":"no enterprise cluster configured"}`))
+		})
+	})
+
+	It("serves the headroom from the capacity endpoint", func() {
+		resp := httptest.NewRecorder()
+		broker.CapacityHandler(b).ServeHTTP(resp, httptest.NewRequest("GET", "/capacity", nil))
+
+		Expect(resp.Code).To(Equal(http.StatusOK))
+		var capacity broker.ClusterCapacity
+		Expect(json.NewDecoder(resp.Body).Decode(&capacity)).To(Succeed())
+		Expect(capacity.HeadroomUnits).To(Equal(3))
+	})
+})
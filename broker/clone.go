@@ -0,0 +1,144 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	composeapi "github.com/compose/gocomposeapi"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// CloneOperation tracks a clone, which backs up the source deployment and
+// then restores that backup as the new instance's deployment. The details
+// of the provision are kept for the restore, which happens in LastOperation.
+type CloneOperation struct {
+	SourceDeploymentID string `json:"source_deployment_id"`
+	BackupRecipeID     string `json:"backup_recipe_id"`
+	SpaceGUID          string `json:"space_guid"`
+	OrganizationGUID   string `json:"organization_guid"`
+	PlanID             string `json:"plan_id"`
+	// BackupSchedule is the schedule requested for the new instance.
+	BackupSchedule *backupSchedule `json:"backup_schedule,omitempty"`
+}
+
+// startClone starts backing up the deployment of the instance cloneOf and
+// returns the operation data for LastOperation to carry on with.
+func (b *Broker) startClone(ctx context.Context, cloneOf string, details brokerapi.ProvisionDetails, schedule *backupSchedule) (string, error) {
+	source, plan, err := b.findRestoreSource(ctx, cloneOf, details)
+	if err != nil {
+		return "", err
+	}
+
+	release, err := b.checkClusterCapacity(ctx, plan.Compose.Units)
+	if err != nil {
+		return "", err
+	}
+
+	backupRecipe, errs := b.composeClient(ctx).StartBackupForDeployment(source.ID)
+	if len(errs) > 0 {
+		release()
+		return "", composeError(errs)
+	}
+	if backupRecipe == nil || backupRecipe.ID == "" {
+		release()
+		return "", errors.New("malformed response from Compose: invalid backup recipe")
+	}
+
+	return b.startOperation(ctx, OperationData{
+		Type:               "provision",
+		WhitelistRecipeIDs: []string{},
+		Clone: &CloneOperation{
+			SourceDeploymentID: source.ID,
+			BackupRecipeID:     backupRecipe.ID,
+			SpaceGUID:          details.SpaceGUID,
+			OrganizationGUID:   details.OrganizationGUID,
+			PlanID:             details.PlanID,
+			BackupSchedule:     schedule,
+		},
+	})
+}
+
+// resumeClone waits for the backup of a clone's source and restores it.
+// Once the instance has a deployment, it is provisioned like any other.
+func (b *Broker) resumeClone(ctx context.Context, instanceID string, operationData OperationData) (brokerapi.LastOperation, error) {
+	instanceName, err := MakeInstanceName(b.Config.DBPrefix, instanceID)
+	if err != nil {
+		return brokerapi.LastOperation{}, err
+	}
+
+	b.deployments.invalidate(instanceName)
+	deployment, err := b.findDeployment(ctx, instanceName)
+	if err == nil {
+		if decodeNotes(deployment.Notes).Provision == nil {
+			// The restore was not recorded, so the broker cannot tell
+			// how far it got.
+			b.deprovisionAbandoned(deployment.ID)
+			return brokerapi.LastOperation{
+				State:       brokerapi.Failed,
+				Description: "the restored deployment could not be set up",
+			}, nil
+		}
+		return b.resumeProvision(ctx, OperationData{
+			Type:         "provision",
+			DeploymentID: deployment.ID,
+		})
+	} else if err != ErrDeploymentNotFound {
+		return brokerapi.LastOperation{}, err
+	}
+
+	clone := operationData.Clone
+	backupRecipe, errs := b.composeClient(ctx).GetRecipe(clone.BackupRecipeID)
+	if len(errs) > 0 {
+		return brokerapi.LastOperation{}, composeError(errs)
+	}
+	switch lookupBrokerAPIState(backupRecipe.Status) {
+	case brokerapi.InProgress:
+		return brokerapi.LastOperation{
+			State:       brokerapi.InProgress,
+			Description: fmt.Sprintf("backing up the instance to clone: %s", backupRecipe.StatusDetail),
+		}, nil
+	case brokerapi.Failed:
+		return brokerapi.LastOperation{
+			State:       brokerapi.Failed,
+			Description: fmt.Sprintf("backup failed: %s", backupRecipe.StatusDetail),
+		}, nil
+	}
+
+	backups, errs := b.composeClient(ctx).GetBackupsForDeployment(clone.SourceDeploymentID)
+	if len(errs) > 0 {
+		return brokerapi.LastOperation{}, composeError(errs)
+	}
+	backup := newestRestorableBackup(backupsSince(*backups, backupRecipe.CreatedAt))
+	if backup == nil {
+		return brokerapi.LastOperation{
+			State:       brokerapi.Failed,
+			Description: "the backup of the instance to clone is not restorable",
+		}, nil
+	}
+
+	_, err = b.restoreBackup(ctx, clone.SourceDeploymentID, backup.ID, instanceName, clone.SpaceGUID, deploymentNotes{
+		OrganizationGUID: clone.OrganizationGUID,
+		PlanID:           clone.PlanID,
+		BackupSchedule:   clone.BackupSchedule,
+	})
+	if err != nil {
+		return brokerapi.LastOperation{}, err
+	}
+	return brokerapi.LastOperation{
+		State:       brokerapi.InProgress,
+		Description: "restoring the backup",
+	}, nil
+}
+
+// backupsSince returns the backups taken at or after t.
+func backupsSince(backups []composeapi.Backup, t time.Time) []composeapi.Backup {
+	since := []composeapi.Backup{}
+	for _, backup := range backups {
+		if !backup.CreatedAt.Before(t) {
+			since = append(since, backup)
+		}
+	}
+	return since
+}
@@ -0,0 +1,47 @@
+package broker
+
+import (
+	"net/http"
+
+	"github.com/alphagov/paas-compose-broker/compose"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	composeUnavailableKey = "compose-unavailable"
+	invalidRequestKey     = "invalid-request"
+)
+
+// ErrComposeUnavailable is returned to Cloud Controller while the circuit
+// breaker around the Compose API is open, so that it can retry later.
+var ErrComposeUnavailable = brokerapi.NewFailureResponseBuilder(
+	compose.ErrCircuitOpen, http.StatusServiceUnavailable, composeUnavailableKey,
+).WithErrorKey("ComposeUnavailable").Build()
+
+// composeError converts the errors from a failed Compose API call into the
+// error returned by the broker: 422 for requests Compose refused to process
+// and 503 for failures worth retrying later. Anything else is returned as a
+// *compose.Error, which the API responds to with a 500, so that callers can
+// still check for compose.IsNotFound.
+func composeError(errs []error) error {
+	for _, err := range errs {
+		if err == compose.ErrCircuitOpen {
+			return ErrComposeUnavailable
+		}
+	}
+
+	err := compose.NewError(errs)
+	switch {
+	case err.StatusCode == http.StatusBadRequest || err.StatusCode == http.StatusUnprocessableEntity:
+		return brokerapi.NewFailureResponse(err, http.StatusUnprocessableEntity, invalidRequestKey)
+	case err.Retryable:
+		return brokerapi.NewFailureResponseBuilder(err, http.StatusServiceUnavailable, composeUnavailableKey).Build()
+	}
+	return err
+}
+
+// invalidParameters wraps an error caused by the parameters of an OSB
+// request, so that it is returned as a 422 rather than a 500.
+func invalidParameters(err error) error {
+	return brokerapi.NewFailureResponse(err, http.StatusUnprocessableEntity, invalidRequestKey)
+}
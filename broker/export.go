@@ -0,0 +1,256 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	composeapi "github.com/compose/gocomposeapi"
+	"github.com/pivotal-cf/brokerapi"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/alphagov/paas-compose-broker/compose"
+	"github.com/alphagov/paas-compose-broker/s3"
+)
+
+// Exports copy a backup to the tenant's object storage. The copy runs in the
+// background of the broker instance which started it, recording progress in
+// the deployment's notes so that LastOperation can report it from any
+// instance. An export which stops recording progress, e.g. because its
+// broker instance was stopped, is reported as failed.
+const (
+	exportProgressInterval = 30 * time.Second
+	exportStalledAfter     = 10 * time.Minute
+	exportTimeout          = 6 * time.Hour
+)
+
+type exportState struct {
+	ID         string                       `json:"id"`
+	BackupID   string                       `json:"backup_id"`
+	Bucket     string                       `json:"bucket"`
+	Key        string                       `json:"key"`
+	State      brokerapi.LastOperationState `json:"state"`
+	Bytes      int64                        `json:"bytes"`
+	TotalBytes int64                        `json:"total_bytes,omitempty"`
+	UpdatedAt  time.Time                    `json:"updated_at"`
+	Error      string                       `json:"error,omitempty"`
+}
+
+// startExport starts copying a backup of the deployment to the bucket in
+// params, and returns the operation data for LastOperation to report on it.
+func (b *Broker) startExport(ctx context.Context, deployment *composeapi.Deployment, params *ExportBackupParameters) (string, error) {
+	if params.Endpoint != "" && !b.exportEndpointAllowed(params.Endpoint) {
+		return "", invalidParameters(fmt.Errorf("exports to %s are not allowed", params.Endpoint))
+	}
+
+	client := b.composeClient(ctx)
+
+	backupID := params.BackupID
+	if backupID == "" {
+		backups, errs := client.GetBackupsForDeployment(deployment.ID)
+		if len(errs) > 0 {
+			return "", composeError(errs)
+		}
+		newest := newestDownloadableBackup(*backups)
+		if newest == nil {
+			return "", invalidParameters(fmt.Errorf("that instance has no downloadable backups"))
+		}
+		backupID = newest.ID
+	}
+
+	backup, errs := client.GetBackupDetailsForDeployment(deployment.ID, backupID)
+	if len(errs) > 0 && compose.AsError(errs[0]).StatusCode == http.StatusNotFound {
+		return "", invalidParameters(fmt.Errorf("backup '%s' does not exist", backupID))
+	} else if len(errs) > 0 {
+		return "", composeError(errs)
+	}
+	if !backup.IsDownloadable || backup.DownloadLink == "" {
+		return "", invalidParameters(fmt.Errorf("backup '%s' cannot be downloaded", backupID))
+	}
+
+	key := params.Key
+	if key == "" {
+		key = backup.ID
+	}
+	endpoint := params.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", params.Region)
+	}
+	uploader := &s3.Client{
+		Endpoint:        endpoint,
+		Region:          params.Region,
+		AccessKeyID:     params.AccessKeyID,
+		SecretAccessKey: params.SecretAccessKey,
+		HTTPClient:      b.ExportHTTPClient,
+	}
+
+	// The cached deployment's notes may be out of date.
+	current, errs := client.GetDeployment(deployment.ID)
+	if len(errs) > 0 {
+		return "", composeError(errs)
+	}
+	notes := decodeNotes(current.Notes)
+	notes.Export = &exportState{
+		ID:        uuid.NewV4().String(),
+		BackupID:  backup.ID,
+		Bucket:    params.Bucket,
+		Key:       key,
+		State:     brokerapi.InProgress,
+		UpdatedAt: time.Now(),
+	}
+	if err := b.saveNotes(ctx, deployment.ID, notes); err != nil {
+		return "", err
+	}
+
+	go b.runExport(RequestID(ctx), deployment.ID, notes.Export, backup.DownloadLink, uploader)
+
+	return b.startOperation(ctx, OperationData{
+		Type:               "export",
+		DeploymentID:       deployment.ID,
+		ExportID:           notes.Export.ID,
+		WhitelistRecipeIDs: []string{},
+	})
+}
+
+// exportEndpointAllowed reports whether the operator allows exports to the
+// object store at endpoint. Tenants could otherwise have the broker send
+// requests to anything it can reach.
+func (b *Broker) exportEndpointAllowed(endpoint string) bool {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	for _, allowed := range b.Config.ExportEndpoints {
+		if endpoint == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Broker) runExport(requestID, deploymentID string, state *exportState, downloadLink string, uploader *s3.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	logger := b.Logger.Session("export", lager.Data{
+		operationRequestIDLogKey: requestID,
+		"deployment-id":          deploymentID,
+		"export-id":              state.ID,
+		"backup-id":              state.BackupID,
+	})
+	logger.Info("start")
+
+	lastSaved := time.Now()
+	save := func() {
+		state.UpdatedAt = time.Now()
+		lastSaved = state.UpdatedAt
+		saveCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := b.saveExportState(saveCtx, deploymentID, state); err != nil {
+			logger.Error("failed-to-save-progress", err)
+		}
+	}
+
+	err := b.export(ctx, downloadLink, uploader, state, func() {
+		if time.Since(lastSaved) >= exportProgressInterval {
+			save()
+		}
+	})
+	if err != nil {
+		logger.Error("failed", err)
+		state.State = brokerapi.Failed
+		state.Error = err.Error()
+	} else {
+		logger.Info("done", lager.Data{"bytes": state.Bytes})
+		state.State = brokerapi.Succeeded
+	}
+	save()
+}
+
+// saveExportState replaces the export state in the deployment's notes. The
+// notes are read afresh each time, as the rest of them may have changed
+// since the export started. It does nothing if another export has since
+// been started.
+func (b *Broker) saveExportState(ctx context.Context, deploymentID string, state *exportState) error {
+	deployment, errs := b.composeClient(ctx).GetDeployment(deploymentID)
+	if len(errs) > 0 {
+		return composeError(errs)
+	}
+	notes := decodeNotes(deployment.Notes)
+	if notes.Export == nil || notes.Export.ID != state.ID {
+		return fmt.Errorf("export %s has been replaced", state.ID)
+	}
+	saved := *state
+	notes.Export = &saved
+	return b.saveNotes(ctx, deploymentID, notes)
+}
+
+// export streams the backup at downloadLink to the bucket, keeping state up
+// to date and calling progress as it goes.
+func (b *Broker) export(ctx context.Context, downloadLink string, uploader *s3.Client, state *exportState, progress func()) error {
+	req, err := http.NewRequest("GET", downloadLink, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to download backup: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download backup: %s", resp.Status)
+	}
+	if resp.ContentLength > 0 {
+		state.TotalBytes = resp.ContentLength
+	}
+
+	return uploader.Upload(ctx, state.Bucket, state.Key, resp.Body, func(uploaded int64) {
+		state.Bytes = uploaded
+		progress()
+	})
+}
+
+// exportLastOperation reports on the export of operationData from the
+// deployment's notes.
+func (b *Broker) exportLastOperation(ctx context.Context, operationData OperationData) (brokerapi.LastOperation, error) {
+	deployment, errs := b.composeClient(ctx).GetDeployment(operationData.DeploymentID)
+	if len(errs) > 0 && compose.AsError(errs[0]).StatusCode == http.StatusNotFound {
+		return brokerapi.LastOperation{
+			State:       brokerapi.Failed,
+			Description: "the deployment no longer exists",
+		}, nil
+	} else if len(errs) > 0 {
+		return brokerapi.LastOperation{}, composeError(errs)
+	}
+
+	state := decodeNotes(deployment.Notes).Export
+	if state == nil || state.ID != operationData.ExportID {
+		return brokerapi.LastOperation{
+			State:       brokerapi.Failed,
+			Description: "the export has been lost",
+		}, nil
+	}
+
+	switch state.State {
+	case brokerapi.Succeeded:
+		return brokerapi.LastOperation{
+			State:       brokerapi.Succeeded,
+			Description: fmt.Sprintf("exported backup %s to %s/%s", state.BackupID, state.Bucket, state.Key),
+		}, nil
+	case brokerapi.Failed:
+		return brokerapi.LastOperation{State: brokerapi.Failed, Description: state.Error}, nil
+	}
+
+	if time.Since(state.UpdatedAt) > exportStalledAfter {
+		return brokerapi.LastOperation{
+			State:       brokerapi.Failed,
+			Description: "the export stopped making progress",
+		}, nil
+	}
+
+	description := fmt.Sprintf("exported %d bytes", state.Bytes)
+	if state.TotalBytes > 0 {
+		description = fmt.Sprintf("exported %d of %d bytes", state.Bytes, state.TotalBytes)
+	}
+	return brokerapi.LastOperation{State: brokerapi.InProgress, Description: description}, nil
+}
@@ -0,0 +1,50 @@
+package broker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+type originatingUserKey struct{}
+
+// WithOriginatingIdentity makes the CF user on whose behalf Cloud Controller
+// sent a request available to the broker, from the request's
+// X-Broker-API-Originating-Identity header.
+func WithOriginatingIdentity(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if userID := parseOriginatingIdentity(req.Header.Get("X-Broker-API-Originating-Identity")); userID != "" {
+			req = req.WithContext(context.WithValue(req.Context(), originatingUserKey{}, userID))
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// parseOriginatingIdentity returns the user ID from a Cloud Foundry
+// originating identity, which looks like `cloudfoundry <base64 JSON>`.
+func parseOriginatingIdentity(header string) string {
+	fields := strings.Fields(header)
+	if len(fields) != 2 || fields[0] != "cloudfoundry" {
+		return ""
+	}
+	value, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return ""
+	}
+	var identity struct {
+		UserID string `json:"user_id"`
+	}
+	if err := json.Unmarshal(value, &identity); err != nil {
+		return ""
+	}
+	return identity.UserID
+}
+
+// OriginatingUser returns the CF user ID of the request, or "" if Cloud
+// Controller did not say.
+func OriginatingUser(ctx context.Context) string {
+	userID, _ := ctx.Value(originatingUserKey{}).(string)
+	return userID
+}
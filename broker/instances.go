@@ -0,0 +1,55 @@
+package broker
+
+import (
+	"sort"
+)
+
+// PlanInstances is the number of broker-owned deployments on a catalog plan.
+// Deployments whose type and units match no plan are counted under an empty
+// plan name for their database type.
+type PlanInstances struct {
+	Service   string
+	Plan      string
+	Instances int
+}
+
+func (b *Broker) PlanInstanceCounts() ([]PlanInstances, error) {
+	deployments, errs := b.Compose.GetDeployments()
+	if len(errs) > 0 {
+		return nil, composeError(errs)
+	}
+
+	counts := map[PlanInstances]int{}
+	for _, deployment := range *deployments {
+		if _, ok := InstanceIDFromName(b.Config.DBPrefix, deployment.Name); !ok {
+			continue
+		}
+
+		scalings, errs := b.Compose.GetScalings(deployment.ID)
+		if len(errs) > 0 {
+			return nil, composeError(errs)
+		}
+
+		key := PlanInstances{Service: deployment.Type}
+		service, plan, err := b.deploymentPlan(&deployment, scalings.AllocatedUnits)
+		if err == nil {
+			key.Service = service.Name
+			key.Plan = plan.Name
+		}
+		counts[key]++
+	}
+
+	result := []PlanInstances{}
+	for key, count := range counts {
+		key.Instances = count
+		result = append(result, key)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Service != result[j].Service {
+			return result[i].Service < result[j].Service
+		}
+		return result[i].Plan < result[j].Plan
+	})
+
+	return result, nil
+}
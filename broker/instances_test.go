@@ -0,0 +1,54 @@
+package broker_test
+
+import (
+	"code.cloudfoundry.org/lager"
+	composeapi "github.com/compose/gocomposeapi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/alphagov/paas-compose-broker/broker"
+	"github.com/alphagov/paas-compose-broker/catalog"
+	"github.com/alphagov/paas-compose-broker/compose/fakes"
+	"github.com/alphagov/paas-compose-broker/config"
+	enginefakes "github.com/alphagov/paas-compose-broker/dbengine/fakes"
+)
+
+var _ = Describe("Plan instance counts", func() {
+
+	It("counts the broker's deployments by catalog plan", func() {
+		fakeComposeClient := &fakes.FakeClient{}
+		fakeComposeClient.GetAccountReturns(&composeapi.Account{ID: "1"}, []error{})
+		fakeComposeClient.GetDeploymentsReturns(&[]composeapi.Deployment{
+			{ID: "d1", Name: "test-00000000-0000-0000-0000-000000000001", Type: "mongodb"},
+			{ID: "d2", Name: "test-00000000-0000-0000-0000-000000000002", Type: "mongodb"},
+			{ID: "d3", Name: "test-00000000-0000-0000-0000-000000000003", Type: "mongodb"},
+			{ID: "d4", Name: "someone-else", Type: "mongodb"},
+		}, []error{})
+		fakeComposeClient.GetScalingsStub = func(deploymentID string) (*composeapi.Scalings, []error) {
+			if deploymentID == "d3" {
+				return &composeapi.Scalings{AllocatedUnits: 7}, []error{}
+			}
+			return &composeapi.Scalings{AllocatedUnits: 1}, []error{}
+		}
+
+		cat := &catalog.Catalog{Services: []*catalog.Service{{
+			Service: brokerapi.Service{Name: "mongodb"},
+			Plans: []*catalog.Plan{{
+				ServicePlan: brokerapi.ServicePlan{Name: "small"},
+				Compose:     catalog.ComposeConfig{Units: 1, DatabaseType: "mongodb"},
+			}},
+		}}}
+
+		b, err := broker.New(fakeComposeClient, enginefakes.FakeProvider{}, &config.Config{DBPrefix: "test"}, cat, lager.NewLogger("test"))
+		Expect(err).NotTo(HaveOccurred())
+
+		counts, err := b.PlanInstanceCounts()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fakeComposeClient.GetScalingsCallCount()).To(Equal(3))
+		Expect(counts).To(Equal([]broker.PlanInstances{
+			{Service: "mongodb", Plan: "", Instances: 1},
+			{Service: "mongodb", Plan: "small", Instances: 2},
+		}))
+	})
+})
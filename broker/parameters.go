@@ -3,15 +3,111 @@ package broker
 import (
 	"encoding/json"
 	"fmt"
+	"regexp"
+	"time"
 )
 
 func ParseProvisionParameters(data []byte) (*ProvisionParameters, error) {
+	if err := checkParameterKeys(data, "restore_from_latest_snapshot_of", "clone_of", "backup_schedule"); err != nil {
+		return nil, err
+	}
+	provisionParameters := &ProvisionParameters{}
+	if err := json.Unmarshal(data, provisionParameters); err != nil {
+		return nil, err
+	}
+	if provisionParameters.RestoreFromLatestSnapshotOf != nil && provisionParameters.CloneOf != nil {
+		return nil, fmt.Errorf("restore_from_latest_snapshot_of and clone_of cannot be used together")
+	}
+	if err := provisionParameters.BackupSchedule.check(); err != nil {
+		return nil, err
+	}
+	return provisionParameters, nil
+}
+
+type ProvisionParameters struct {
+	RestoreFromLatestSnapshotOf *string                   `json:"restore_from_latest_snapshot_of"`
+	CloneOf                     *string                   `json:"clone_of"`
+	BackupSchedule              *BackupScheduleParameters `json:"backup_schedule"`
+}
+
+func ParseUpdateParameters(data []byte) (*UpdateParameters, error) {
+	if err := checkParameterKeys(data, "export_backup", "backup_schedule"); err != nil {
+		return nil, err
+	}
+	updateParameters := &UpdateParameters{}
+	if err := json.Unmarshal(data, updateParameters); err != nil {
+		return nil, err
+	}
+	if export := updateParameters.ExportBackup; export != nil {
+		required := []struct{ name, value string }{
+			{"bucket", export.Bucket},
+			{"region", export.Region},
+			{"access_key_id", export.AccessKeyID},
+			{"secret_access_key", export.SecretAccessKey},
+		}
+		for _, parameter := range required {
+			if parameter.value == "" {
+				return nil, fmt.Errorf("export_backup: missing %s", parameter.name)
+			}
+		}
+		if !regionPattern.MatchString(export.Region) {
+			return nil, fmt.Errorf("export_backup: invalid region: %s", export.Region)
+		}
+	}
+	if err := updateParameters.BackupSchedule.check(); err != nil {
+		return nil, err
+	}
+	return updateParameters, nil
+}
+
+type UpdateParameters struct {
+	ExportBackup   *ExportBackupParameters   `json:"export_backup"`
+	BackupSchedule *BackupScheduleParameters `json:"backup_schedule"`
+}
+
+// BackupScheduleParameters set how often the broker backs an instance up,
+// as a Go duration such as "6h". An empty interval stops scheduled backups.
+type BackupScheduleParameters struct {
+	Interval string `json:"interval"`
+}
+
+func (p *BackupScheduleParameters) check() error {
+	if p == nil || p.Interval == "" {
+		return nil
+	}
+	interval, err := time.ParseDuration(p.Interval)
+	if err != nil || interval <= 0 {
+		return fmt.Errorf("backup_schedule: invalid interval: %s", p.Interval)
+	}
+	return nil
+}
+
+// regionPattern matches AWS region names, such as eu-west-2. The region is
+// part of the default endpoint's host name, so must not be able to change it.
+var regionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d+$`)
+
+// ExportBackupParameters say which backup to copy to which bucket. The
+// newest downloadable backup is exported if BackupID is empty, to a key
+// named after the backup if Key is empty. Endpoint must be one the operator
+// allows, see config.ExportEndpoints.
+type ExportBackupParameters struct {
+	BackupID        string `json:"backup_id"`
+	Endpoint        string `json:"endpoint"`
+	Region          string `json:"region"`
+	Bucket          string `json:"bucket"`
+	Key             string `json:"key"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+}
+
+// checkParameterKeys fails if the JSON object data has keys other than
+// validKeys.
+func checkParameterKeys(data []byte, validKeys ...string) error {
 	mapParams := map[string]interface{}{}
 	err := json.Unmarshal(data, &mapParams)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	validKeys := []string{"restore_from_latest_snapshot_of"}
 	for key := range mapParams {
 		valid := false
 		for _, validKey := range validKeys {
@@ -21,16 +117,8 @@ func ParseProvisionParameters(data []byte) (*ProvisionParameters, error) {
 			}
 		}
 		if !valid {
-			return nil, fmt.Errorf("unknown parameter: %s", key)
+			return fmt.Errorf("unknown parameter: %s", key)
 		}
 	}
-	provisionParameters := &ProvisionParameters{}
-	if err := json.Unmarshal(data, provisionParameters); err != nil {
-		return nil, err
-	}
-	return provisionParameters, nil
-}
-
-type ProvisionParameters struct {
-	RestoreFromLatestSnapshotOf *string `json:"restore_from_latest_snapshot_of"`
+	return nil
 }
@@ -0,0 +1,433 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+	composeapi "github.com/compose/gocomposeapi"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/alphagov/paas-compose-broker/catalog"
+	"github.com/alphagov/paas-compose-broker/compose"
+	"github.com/alphagov/paas-compose-broker/dbengine"
+)
+
+// Provisioning steps. Provision creates the deployment at
+// provisionStepWhitelist and LastOperation drives it through the rest,
+// saving the step reached in the deployment's notes so that it carries on
+// where it left off after the broker restarts.
+const (
+	provisionStepWhitelist = "whitelist"
+	provisionStepWait      = "wait"
+	provisionStepSetup     = "setup"
+	provisionStepDone      = "done"
+	provisionStepFailed    = "failed"
+)
+
+// maxSetupAttempts is how many polls may fail a step before the provision
+// is failed. A deployment whose engine's ready hook keeps failing is healthy
+// by then, so it is kept; one which could not be whitelisted or whose
+// recipes failed is deprovisioned.
+const maxSetupAttempts = 5
+
+type provisionState struct {
+	Step string `json:"step"`
+	// RecipeID is the recipe creating the deployment, when the operation
+	// does not say.
+	RecipeID           string   `json:"recipe_id,omitempty"`
+	WhitelistRecipeIDs []string `json:"whitelist_recipe_ids,omitempty"`
+	// PendingWhitelistIP is the IP being whitelisted, saved before asking
+	// Compose so that a restart knows a recipe may exist for it.
+	PendingWhitelistIP string `json:"pending_whitelist_ip,omitempty"`
+	SetupAttempts      int    `json:"setup_attempts,omitempty"`
+	Error              string `json:"error,omitempty"`
+}
+
+// deploymentNotes is the JSON the broker keeps in a deployment's notes.
+type deploymentNotes struct {
+	OrganizationGUID string `json:"organization_guid,omitempty"`
+	// PlanID is the catalog plan the instance was provisioned with or last
+	// updated to. Compose does not record it, and a deployment's units may
+	// not match its plan's once Compose has scaled it.
+	PlanID         string          `json:"plan_id,omitempty"`
+	Provision      *provisionState `json:"provision,omitempty"`
+	Export         *exportState    `json:"export,omitempty"`
+	BackupSchedule *backupSchedule `json:"backup_schedule,omitempty"`
+}
+
+// PlanIDFromNotes returns the ID of the plan recorded in a deployment's
+// notes, or "" for deployments provisioned before plans were recorded.
+func PlanIDFromNotes(notes string) string {
+	return decodeNotes(notes).PlanID
+}
+
+// deploymentPlan returns the plan recorded in the deployment's notes or, for
+// deployments provisioned before plans were recorded, the plan with its
+// units.
+func (b *Broker) deploymentPlan(deployment *composeapi.Deployment, units int) (*catalog.Service, *catalog.Plan, error) {
+	if planID := PlanIDFromNotes(deployment.Notes); planID != "" {
+		return b.Catalog.FindPlanByID(planID)
+	}
+	return b.Catalog.FindPlan(deployment.Type, units)
+}
+
+func encodeNotes(notes deploymentNotes) (string, error) {
+	encoded, err := json.Marshal(notes)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// decodeNotes returns empty notes for deployments whose notes were not
+// written by the broker.
+func decodeNotes(notes string) deploymentNotes {
+	var decoded deploymentNotes
+	if err := json.Unmarshal([]byte(notes), &decoded); err != nil {
+		return deploymentNotes{}
+	}
+	return decoded
+}
+
+// saveProvisionState replaces the provision state in the deployment's notes,
+// keeping the rest.
+func (b *Broker) saveProvisionState(ctx context.Context, deployment *composeapi.Deployment, state *provisionState) error {
+	notes := decodeNotes(deployment.Notes)
+	notes.Provision = state
+	return b.saveNotes(ctx, deployment.ID, notes)
+}
+
+func (b *Broker) saveNotes(ctx context.Context, deploymentID string, notes deploymentNotes) error {
+	encoded, err := encodeNotes(notes)
+	if err != nil {
+		return err
+	}
+	_, errs := b.composeClient(ctx).PatchDeployment(composeapi.PatchDeploymentParams{
+		DeploymentID: deploymentID,
+		Notes:        encoded,
+	})
+	if len(errs) > 0 {
+		return composeError(errs)
+	}
+	return nil
+}
+
+// recordPlan records the plan of an instance in its deployment's notes,
+// unless they already say it.
+func (b *Broker) recordPlan(ctx context.Context, deploymentID, planID string) error {
+	// The cached deployment's notes may be out of date.
+	deployment, errs := b.composeClient(ctx).GetDeployment(deploymentID)
+	if len(errs) > 0 {
+		return composeError(errs)
+	}
+	notes := decodeNotes(deployment.Notes)
+	if notes.PlanID == planID {
+		return nil
+	}
+	notes.PlanID = planID
+	return b.saveNotes(ctx, deploymentID, notes)
+}
+
+// resumeProvision runs the provisioning steps left for the deployment of
+// operationData and reports how far it has got.
+func (b *Broker) resumeProvision(ctx context.Context, operationData OperationData) (brokerapi.LastOperation, error) {
+	deployment, errs := b.composeClient(ctx).GetDeployment(operationData.DeploymentID)
+	if len(errs) > 0 && compose.AsError(errs[0]).StatusCode == http.StatusNotFound {
+		return brokerapi.LastOperation{
+			State:       brokerapi.Failed,
+			Description: "the deployment no longer exists",
+		}, nil
+	} else if len(errs) > 0 {
+		return brokerapi.LastOperation{}, composeError(errs)
+	}
+
+	state := decodeNotes(deployment.Notes).Provision
+	if state == nil {
+		state = &provisionState{Step: provisionStepWhitelist}
+	}
+
+	for {
+		b.logger(ctx).Debug("provision-step", lager.Data{
+			"deployment-id": deployment.ID,
+			"step":          state.Step,
+		})
+
+		switch state.Step {
+		case provisionStepWhitelist:
+			err := b.createWhitelists(ctx, deployment, state)
+			if err != nil && (!isTerminal(err) || ctx.Err() != nil) {
+				return brokerapi.LastOperation{}, err
+			} else if err != nil {
+				return b.failProvision(ctx, deployment, state, err)
+			}
+			state.Step = provisionStepWait
+			state.SetupAttempts = 0
+
+		case provisionStepWait:
+			recipeID := operationData.RecipeID
+			if recipeID == "" {
+				recipeID = state.RecipeID
+			}
+			recipeIDs := append([]string{recipeID}, state.WhitelistRecipeIDs...)
+			lastOperation, err := b.recipesState(ctx, recipeIDs)
+			if err != nil {
+				return lastOperation, err
+			}
+			switch lastOperation.State {
+			case brokerapi.InProgress:
+				return lastOperation, nil
+			case brokerapi.Failed:
+				return b.failProvision(ctx, deployment, state, fmt.Errorf("recipe failed: %s", lastOperation.Description))
+			}
+			state.Step = provisionStepSetup
+			state.SetupAttempts = 0
+
+		case provisionStepSetup:
+			err := b.runReadyHook(ctx, deployment)
+			if err != nil && ctx.Err() != nil {
+				return brokerapi.LastOperation{}, err
+			} else if err != nil {
+				cause := fmt.Errorf("setup failed: %s", err)
+				state.SetupAttempts++
+				if state.SetupAttempts >= maxSetupAttempts {
+					return b.markProvisionFailed(ctx, deployment, state, cause)
+				}
+				return b.retryProvisionStep(ctx, deployment, state, cause)
+			}
+			state.Step = provisionStepDone
+
+		case provisionStepDone:
+			return brokerapi.LastOperation{State: brokerapi.Succeeded}, nil
+
+		case provisionStepFailed:
+			return brokerapi.LastOperation{State: brokerapi.Failed, Description: state.Error}, nil
+
+		default:
+			return brokerapi.LastOperation{}, fmt.Errorf("unknown provision step: %s", state.Step)
+		}
+
+		if err := b.saveProvisionState(ctx, deployment, state); err != nil {
+			return brokerapi.LastOperation{}, err
+		}
+	}
+}
+
+// createWhitelists adds the configured IPs to the deployment's whitelist,
+// saving progress around each so that none is added twice. An IP which was
+// being whitelisted when the broker stopped is not added again if it is in
+// the whitelist, though its recipe is then not waited for.
+func (b *Broker) createWhitelists(ctx context.Context, deployment *composeapi.Deployment, state *provisionState) error {
+	client := b.composeClient(ctx)
+	existing, errs := client.GetWhitelistForDeployment(deployment.ID)
+	if len(errs) > 0 {
+		return composeError(errs)
+	}
+
+	for _, ip := range b.Config.IPWhitelist {
+		if isWhitelisted(existing, ip) {
+			if state.PendingWhitelistIP == ip {
+				b.logger(ctx).Info("whitelist-recipe-unknown", lager.Data{
+					"deployment-id": deployment.ID,
+					"ip":            ip,
+				})
+				state.PendingWhitelistIP = ""
+			}
+			continue
+		}
+
+		state.PendingWhitelistIP = ip
+		if err := b.saveProvisionState(ctx, deployment, state); err != nil {
+			return err
+		}
+
+		whitelistParams := composeapi.DeploymentWhitelistParams{
+			IP:          ip,
+			Description: fmt.Sprintf("Allow %s to access deployment", ip),
+		}
+		whitelistRecipe, errs := client.CreateDeploymentWhitelist(deployment.ID, whitelistParams)
+		if len(errs) > 0 {
+			return composeError(errs)
+		}
+		if whitelistRecipe == nil {
+			return errors.New("malformed response from Compose: no pending whitelist recipe received")
+		}
+		if whitelistRecipe.ID == "" {
+			return errors.New("malformed response from Compose: invalid whitelist recipe ID")
+		}
+
+		state.WhitelistRecipeIDs = append(state.WhitelistRecipeIDs, whitelistRecipe.ID)
+		state.PendingWhitelistIP = ""
+		if err := b.saveProvisionState(ctx, deployment, state); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isWhitelisted reports whether the whitelist has an entry for the same
+// network as ip, however either is written: Compose may store "1.2.3.4" as
+// "1.2.3.4/32", and a range by another address within it.
+func isWhitelisted(whitelist []composeapi.DeploymentWhitelist, ip string) bool {
+	network := normaliseNetwork(ip)
+	for _, entry := range whitelist {
+		if normaliseNetwork(entry.IP) == network {
+			return true
+		}
+	}
+	return false
+}
+
+// normaliseNetwork returns an IP or CIDR range in CIDR notation, with the
+// address masked to the start of the range. Anything unparseable is returned
+// as it is, to be compared literally.
+func normaliseNetwork(ip string) string {
+	ip = strings.TrimSpace(ip)
+	if !strings.Contains(ip, "/") {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return ip
+		}
+		if parsed.To4() != nil {
+			return parsed.String() + "/32"
+		}
+		return parsed.String() + "/128"
+	}
+	_, network, err := net.ParseCIDR(ip)
+	if err != nil {
+		return ip
+	}
+	return network.String()
+}
+
+// runReadyHook runs the deployment's engine's ready hook, if it has one.
+func (b *Broker) runReadyHook(ctx context.Context, deployment *composeapi.Deployment) error {
+	engine, err := b.DBEngineProvider.GetDBEngine(deployment)
+	if err != nil {
+		return err
+	}
+	hook, ok := engine.(dbengine.ReadyHook)
+	if !ok {
+		return nil
+	}
+	return hook.OnReady(ctx)
+}
+
+// recipesState combines the states of recipes: failed if any failed, in
+// progress if any are still running, otherwise succeeded.
+func (b *Broker) recipesState(ctx context.Context, recipeIDs []string) (brokerapi.LastOperation, error) {
+	result := brokerapi.LastOperation{State: brokerapi.Succeeded}
+	for _, recipeID := range recipeIDs {
+		recipe, errs := b.composeClient(ctx).GetRecipe(recipeID)
+		if len(errs) > 0 {
+			return brokerapi.LastOperation{}, composeError(errs)
+		}
+
+		switch lookupBrokerAPIState(recipe.Status) {
+		case brokerapi.Failed:
+			return brokerapi.LastOperation{State: brokerapi.Failed, Description: recipe.StatusDetail}, nil
+		case brokerapi.InProgress:
+			result = brokerapi.LastOperation{State: brokerapi.InProgress, Description: recipe.StatusDetail}
+		}
+	}
+	return result, nil
+}
+
+// failProvision is the compensating action for a provision which cannot
+// complete: once the step has failed maxSetupAttempts times it records why
+// in the deployment's notes and then deprovisions it, so that nothing
+// half-configured is left behind. Until then the step is retried.
+func (b *Broker) failProvision(ctx context.Context, deployment *composeapi.Deployment, state *provisionState, cause error) (brokerapi.LastOperation, error) {
+	state.SetupAttempts++
+	if state.SetupAttempts < maxSetupAttempts {
+		return b.retryProvisionStep(ctx, deployment, state, cause)
+	}
+	lastOperation, err := b.markProvisionFailed(ctx, deployment, state, cause)
+	if err != nil {
+		return lastOperation, err
+	}
+	b.deprovisionAbandoned(deployment.ID)
+	return lastOperation, nil
+}
+
+// retryProvisionStep saves the failed attempt at the current step, which is
+// run again on the next poll.
+func (b *Broker) retryProvisionStep(ctx context.Context, deployment *composeapi.Deployment, state *provisionState, cause error) (brokerapi.LastOperation, error) {
+	b.logger(ctx).Error("provision-step-failed", cause, lager.Data{
+		"deployment-id": deployment.ID,
+		"step":          state.Step,
+		"attempt":       state.SetupAttempts,
+	})
+	if err := b.saveProvisionState(ctx, deployment, state); err != nil {
+		return brokerapi.LastOperation{}, err
+	}
+	return brokerapi.LastOperation{
+		State:       brokerapi.InProgress,
+		Description: fmt.Sprintf("will retry: %s", cause),
+	}, nil
+}
+
+// markProvisionFailed records why a provision failed in the deployment's
+// notes, keeping the deployment. It is deleted when the instance is
+// deprovisioned.
+func (b *Broker) markProvisionFailed(ctx context.Context, deployment *composeapi.Deployment, state *provisionState, cause error) (brokerapi.LastOperation, error) {
+	b.logger(ctx).Error("provision-failed", cause, lager.Data{
+		"deployment-id": deployment.ID,
+		"step":          state.Step,
+	})
+
+	state.Step = provisionStepFailed
+	state.Error = cause.Error()
+	if err := b.saveProvisionState(ctx, deployment, state); err != nil {
+		return brokerapi.LastOperation{}, err
+	}
+	b.deployments.invalidate(deployment.Name)
+
+	return brokerapi.LastOperation{State: brokerapi.Failed, Description: state.Error}, nil
+}
+
+// deprovisionAbandoned deletes a deployment which the broker will not
+// finish provisioning. It is not bound to the request's context, so that it
+// happens even if the request was cancelled. Failures are only logged: the
+// deployment is deleted when the instance is.
+func (b *Broker) deprovisionAbandoned(deploymentID string) {
+	_, errs := b.Compose.DeprovisionDeployment(deploymentID)
+	for _, err := range errs {
+		b.Logger.Error("failed-deprovision", err, lager.Data{"deployment-id": deploymentID})
+	}
+}
+
+// isTerminal reports whether err will recur however often the step is
+// retried: Compose rejected the request, or answered in a way the broker
+// cannot use. Failing to reach Compose at all is not terminal.
+func isTerminal(err error) bool {
+	if isTransient(err) {
+		return false
+	}
+	switch err := err.(type) {
+	case *brokerapi.FailureResponse:
+		code := err.ValidatedStatusCode(nil)
+		return code >= 400 && code < 500
+	case *compose.Error:
+		return err.StatusCode >= 400 && err.StatusCode < 500 && !err.Retryable
+	}
+	return true
+}
+
+// isTransient reports whether err is worth retrying on the next poll rather
+// than failing the operation.
+func isTransient(err error) bool {
+	if err == ErrComposeUnavailable {
+		return true
+	}
+	if failure, ok := err.(*brokerapi.FailureResponse); ok {
+		return failure.ValidatedStatusCode(nil) == 503
+	}
+	return false
+}
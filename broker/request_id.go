@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagerctx"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/alphagov/paas-compose-broker/tracing"
+)
+
+const (
+	requestIDLogKey          = "request-id"
+	operationRequestIDLogKey = "operation-request-id"
+)
+
+type requestIDKey struct{}
+
+type operationRequestIDKey struct{}
+
+// WithRequestID gives each request a correlation ID, from its X-Request-Id
+// or X-Vcap-Request-Id header or else a new one, and returns it in the
+// response's X-Request-Id header. The ID is added to everything the broker
+// logs about the request, including its Compose calls, and to its span.
+func WithRequestID(handler http.Handler, logger lager.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requestID := req.Header.Get("X-Request-Id")
+		if requestID == "" {
+			requestID = req.Header.Get("X-Vcap-Request-Id")
+		}
+		if requestID == "" {
+			requestID = uuid.NewV4().String()
+		}
+		w.Header().Set("X-Request-Id", requestID)
+		tracing.FromContext(req.Context()).SetTag("request_id", requestID)
+
+		ctx := context.WithValue(req.Context(), requestIDKey{}, requestID)
+		ctx = lagerctx.NewContext(ctx, logger.WithData(lager.Data{requestIDLogKey: requestID}))
+		handler.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// RequestID returns the correlation ID of the request, or "" outside one.
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// withOperationRequestID adds the correlation ID of the request which
+// started an operation to what is logged while polling it.
+func withOperationRequestID(ctx context.Context, requestID string) context.Context {
+	if requestID == "" {
+		return ctx
+	}
+	ctx = context.WithValue(ctx, operationRequestIDKey{}, requestID)
+	return lagerctx.NewContext(ctx, lagerctx.WithData(ctx, lager.Data{operationRequestIDLogKey: requestID}))
+}
+
+// logger returns the broker's logger, with the correlation IDs of the
+// request and of the operation it polls if there are any.
+func (b *Broker) logger(ctx context.Context) lager.Logger {
+	data := lager.Data{}
+	if requestID := RequestID(ctx); requestID != "" {
+		data[requestIDLogKey] = requestID
+	}
+	if requestID, ok := ctx.Value(operationRequestIDKey{}).(string); ok {
+		data[operationRequestIDLogKey] = requestID
+	}
+	if len(data) == 0 {
+		return b.Logger
+	}
+	return b.Logger.WithData(data)
+}
+
+// startOperation returns the operation data of an asynchronous operation
+// which the request has started, recording the request's correlation ID in
+// it so that last_operation polls can be tied back to the request.
+func (b *Broker) startOperation(ctx context.Context, operationData OperationData) (string, error) {
+	operationData.RequestID = RequestID(ctx)
+	b.logger(ctx).Info("operation-started", lager.Data{
+		"type":                 operationData.Type,
+		"recipe-id":            operationData.RecipeID,
+		"deployment-id":        operationData.DeploymentID,
+		"whitelist-recipe-ids": operationData.WhitelistRecipeIDs,
+		"export-id":            operationData.ExportID,
+	})
+	return encodeOperationData(operationData)
+}
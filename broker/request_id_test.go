@@ -0,0 +1,126 @@
+package broker_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"code.cloudfoundry.org/lager"
+	composeapi "github.com/compose/gocomposeapi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/alphagov/paas-compose-broker/broker"
+	"github.com/alphagov/paas-compose-broker/catalog"
+	"github.com/alphagov/paas-compose-broker/compose/fakes"
+	"github.com/alphagov/paas-compose-broker/config"
+	enginefakes "github.com/alphagov/paas-compose-broker/dbengine/fakes"
+)
+
+var _ = Describe("Request IDs", func() {
+	var (
+		out               *bytes.Buffer
+		logger            lager.Logger
+		fakeComposeClient *fakes.FakeClient
+		b                 *broker.Broker
+	)
+
+	// requestContext returns the context a request with headers is handled
+	// with, and the ID given back in the response.
+	requestContext := func(headers map[string]string) (context.Context, string) {
+		var ctx context.Context
+		req := httptest.NewRequest("DELETE", "/v2/service_instances/instance-1", nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp := httptest.NewRecorder()
+		broker.WithRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx = r.Context()
+		}), logger).ServeHTTP(resp, req)
+		return ctx, resp.Header().Get("X-Request-Id")
+	}
+
+	logged := func(message string) []lager.Data {
+		data := []lager.Data{}
+		scanner := bufio.NewScanner(bytes.NewReader(out.Bytes()))
+		for scanner.Scan() {
+			var line lager.LogFormat
+			Expect(json.Unmarshal(scanner.Bytes(), &line)).To(Succeed())
+			if line.Message == message {
+				data = append(data, line.Data)
+			}
+		}
+		return data
+	}
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		logger = lager.NewLogger("test")
+		logger.RegisterSink(lager.NewWriterSink(out, lager.DEBUG))
+
+		fakeComposeClient = &fakes.FakeClient{}
+		fakeComposeClient.GetAccountReturns(&composeapi.Account{ID: "1"}, []error{})
+		fakeComposeClient.GetDeploymentByNameReturns(&composeapi.Deployment{ID: "d1"}, nil)
+		fakeComposeClient.DeprovisionDeploymentReturns(&composeapi.Recipe{ID: "r1"}, nil)
+		fakeComposeClient.GetRecipeReturns(&composeapi.Recipe{ID: "r1", Status: "running"}, nil)
+
+		var err error
+		b, err = broker.New(fakeComposeClient, enginefakes.FakeProvider{}, &config.Config{DBPrefix: "test"}, &catalog.Catalog{}, logger)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("takes the ID from X-Request-Id, then X-Vcap-Request-Id, or makes one", func() {
+		ctx, responseID := requestContext(map[string]string{"X-Request-Id": "req-1", "X-Vcap-Request-Id": "vcap-1"})
+		Expect(broker.RequestID(ctx)).To(Equal("req-1"))
+		Expect(responseID).To(Equal("req-1"))
+
+		ctx, _ = requestContext(map[string]string{"X-Vcap-Request-Id": "vcap-1"})
+		Expect(broker.RequestID(ctx)).To(Equal("vcap-1"))
+
+		ctx, responseID = requestContext(nil)
+		Expect(broker.RequestID(ctx)).To(HaveLen(36))
+		Expect(responseID).To(Equal(broker.RequestID(ctx)))
+	})
+
+	It("logs the ID with the request's Compose calls and keeps it in the operation data", func() {
+		ctx, _ := requestContext(map[string]string{"X-Vcap-Request-Id": "vcap-1"})
+
+		spec, err := b.Deprovision(ctx, "instance-1", brokerapi.DeprovisionDetails{}, true)
+		Expect(err).NotTo(HaveOccurred())
+
+		var operationData broker.OperationData
+		Expect(json.Unmarshal([]byte(spec.OperationData), &operationData)).To(Succeed())
+		Expect(operationData.RequestID).To(Equal("vcap-1"))
+		Expect(operationData.RecipeID).To(Equal("r1"))
+
+		Expect(logged("test.deprovision")[0]).To(HaveKeyWithValue("request-id", "vcap-1"))
+		Expect(logged("test.operation-started")[0]).To(SatisfyAll(
+			HaveKeyWithValue("request-id", "vcap-1"),
+			HaveKeyWithValue("recipe-id", "r1"),
+		))
+		Expect(logged("test.compose-call")).To(ContainElement(SatisfyAll(
+			HaveKeyWithValue("request-id", "vcap-1"),
+			HaveKeyWithValue("method", "DeprovisionDeployment"),
+		)))
+	})
+
+	It("logs the ID of the request which started an operation when it is polled", func() {
+		ctx, _ := requestContext(map[string]string{"X-Request-Id": "poll-1"})
+
+		_, err := b.LastOperation(ctx, "instance-1", `{"type":"deprovision","recipe_id":"r1","request_id":"vcap-1"}`)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(logged("test.last-operation")[0]).To(SatisfyAll(
+			HaveKeyWithValue("request-id", "poll-1"),
+			HaveKeyWithValue("operation-request-id", "vcap-1"),
+		))
+		Expect(logged("test.compose-call")).To(ContainElement(SatisfyAll(
+			HaveKeyWithValue("operation-request-id", "vcap-1"),
+			HaveKeyWithValue("method", "GetRecipe"),
+		)))
+	})
+})
@@ -0,0 +1,59 @@
+package broker
+
+import (
+	"context"
+	"errors"
+
+	"code.cloudfoundry.org/lager"
+	composeapi "github.com/compose/gocomposeapi"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/alphagov/paas-compose-broker/config"
+)
+
+// checkRestoreAllowed applies the restore policy to restoring the backups of
+// the instance restoreFrom, whose deployment is source, into the instance
+// being provisioned. Restores across spaces are logged whether or not they
+// are allowed.
+func (b *Broker) checkRestoreAllowed(ctx context.Context, restoreFrom string, source *composeapi.Deployment, details brokerapi.ProvisionDetails) error {
+	if source.CustomerBillingCode == details.SpaceGUID {
+		return nil
+	}
+
+	data := lager.Data{
+		"source-instance-id": restoreFrom,
+		"source-space-guid":  source.CustomerBillingCode,
+		"space-guid":         details.SpaceGUID,
+		"organization-guid":  details.OrganizationGUID,
+		"user-id":            OriginatingUser(ctx),
+	}
+	if err := b.crossSpaceRestoreError(ctx, source, details); err != nil {
+		data["reason"] = err.Error()
+		b.logger(ctx).Info("cross-space-restore-refused", data)
+		return invalidParameters(err)
+	}
+	b.logger(ctx).Info("cross-space-restore", data)
+	return nil
+}
+
+func (b *Broker) crossSpaceRestoreError(ctx context.Context, source *composeapi.Deployment, details brokerapi.ProvisionDetails) error {
+	if b.Config.RestorePolicy != config.RestorePolicyOrg {
+		return errors.New("you are only allowed to restore from backup to the same space")
+	}
+
+	sourceOrganizationGUID := decodeNotes(source.Notes).OrganizationGUID
+	if sourceOrganizationGUID == "" || sourceOrganizationGUID != details.OrganizationGUID {
+		return errors.New("you are only allowed to restore from backup to a space in the same organization")
+	}
+
+	userID := OriginatingUser(ctx)
+	if userID == "" {
+		return errors.New("restoring from backup to another space requires the originating identity of the request")
+	}
+	for _, allowed := range b.Config.RestoreUsers {
+		if userID == allowed {
+			return nil
+		}
+	}
+	return errors.New("you are not allowed to restore from backup to another space")
+}
@@ -0,0 +1,167 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/alphagov/paas-compose-broker/leader"
+)
+
+// DefaultBackupCheckInterval is how often the scheduler looks for backups
+// that are due.
+const DefaultBackupCheckInterval = time.Minute
+
+// backupSchedule is an instance's backup schedule, kept in its deployment's
+// notes. Compose's own daily backups carry on regardless. How long backups
+// are kept is up to Compose, whose API cannot delete them.
+type backupSchedule struct {
+	Interval     string     `json:"interval"`
+	LastBackupAt *time.Time `json:"last_backup_at,omitempty"`
+}
+
+func (s *backupSchedule) due(now time.Time) bool {
+	interval, err := time.ParseDuration(s.Interval)
+	if err != nil {
+		return false
+	}
+	return s.LastBackupAt == nil || now.Sub(*s.LastBackupAt) >= interval
+}
+
+// newBackupSchedule checks a requested schedule against the plan's limits.
+// It returns nil for a request to stop scheduled backups.
+func (b *Broker) newBackupSchedule(serviceID, planID string, params *BackupScheduleParameters) (*backupSchedule, error) {
+	if params.Interval == "" {
+		return nil, nil
+	}
+
+	service, err := b.Catalog.GetService(serviceID)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := service.GetPlan(planID)
+	if err != nil {
+		return nil, err
+	}
+
+	limit, ok := plan.Compose.BackupIntervalLimit()
+	if !ok {
+		return nil, invalidParameters(fmt.Errorf("this plan does not offer scheduled backups"))
+	}
+	interval, err := time.ParseDuration(params.Interval)
+	if err != nil {
+		return nil, invalidParameters(err)
+	}
+	if interval < limit {
+		return nil, invalidParameters(fmt.Errorf("backup_schedule: interval must be at least %s on this plan", limit))
+	}
+	return &backupSchedule{Interval: params.Interval}, nil
+}
+
+// updateBackupSchedule replaces the backup schedule in the deployment's
+// notes. The time of the last backup is kept, so changing the interval does
+// not start a backup straight away.
+func (b *Broker) updateBackupSchedule(ctx context.Context, deploymentID string, schedule *backupSchedule) error {
+	// The cached deployment's notes may be out of date.
+	deployment, errs := b.composeClient(ctx).GetDeployment(deploymentID)
+	if len(errs) > 0 {
+		return composeError(errs)
+	}
+	notes := decodeNotes(deployment.Notes)
+	if schedule != nil && notes.BackupSchedule != nil {
+		schedule.LastBackupAt = notes.BackupSchedule.LastBackupAt
+	}
+	notes.BackupSchedule = schedule
+	return b.saveNotes(ctx, deploymentID, notes)
+}
+
+// BackupScheduler starts the backups that instances have scheduled. Every
+// broker instance runs one, but only the leader's starts backups.
+type BackupScheduler struct {
+	Broker        *Broker
+	Leader        leader.Leader
+	CheckInterval time.Duration
+}
+
+// Run checks for due backups every CheckInterval until stop is closed.
+func (s *BackupScheduler) Run(stop <-chan struct{}) {
+	interval := s.CheckInterval
+	if interval <= 0 {
+		interval = DefaultBackupCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			s.RunOnce(ctx)
+			cancel()
+		}
+	}
+}
+
+// RunOnce starts a backup of every provisioned instance whose schedule is
+// due, if this broker instance is the leader.
+func (s *BackupScheduler) RunOnce(ctx context.Context) {
+	if !s.Leader.IsLeader() {
+		return
+	}
+	b := s.Broker
+	logger := b.Logger.Session("backup-scheduler")
+
+	deployments, errs := b.composeClient(ctx).GetDeployments()
+	if len(errs) > 0 {
+		logger.Error("list-deployments", composeError(errs))
+		return
+	}
+
+	now := time.Now()
+	for _, deployment := range *deployments {
+		if _, ok := InstanceIDFromName(b.Config.DBPrefix, deployment.Name); !ok {
+			continue
+		}
+		notes := decodeNotes(deployment.Notes)
+		if notes.BackupSchedule == nil || !notes.BackupSchedule.due(now) {
+			continue
+		}
+		if notes.Provision != nil && notes.Provision.Step != provisionStepDone {
+			continue
+		}
+
+		if err := s.backup(ctx, deployment.ID, now); err != nil {
+			logger.Error("backup", err, lager.Data{"deployment-id": deployment.ID})
+			continue
+		}
+		logger.Info("backup-started", lager.Data{"deployment-id": deployment.ID})
+	}
+}
+
+func (s *BackupScheduler) backup(ctx context.Context, deploymentID string, now time.Time) error {
+	client := s.Broker.composeClient(ctx)
+
+	recipe, errs := client.StartBackupForDeployment(deploymentID)
+	if len(errs) > 0 {
+		return composeError(errs)
+	}
+	if recipe == nil || recipe.ID == "" {
+		return fmt.Errorf("malformed response from Compose: invalid backup recipe")
+	}
+
+	// The listed deployment's notes may be out of date.
+	deployment, errs := client.GetDeployment(deploymentID)
+	if len(errs) > 0 {
+		return composeError(errs)
+	}
+	notes := decodeNotes(deployment.Notes)
+	if notes.BackupSchedule == nil {
+		return nil
+	}
+	notes.BackupSchedule.LastBackupAt = &now
+	return s.Broker.saveNotes(ctx, deploymentID, notes)
+}
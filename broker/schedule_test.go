@@ -0,0 +1,134 @@
+package broker_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	composeapi "github.com/compose/gocomposeapi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/paas-compose-broker/broker"
+	"github.com/alphagov/paas-compose-broker/catalog"
+	"github.com/alphagov/paas-compose-broker/compose/fakes"
+	"github.com/alphagov/paas-compose-broker/config"
+	enginefakes "github.com/alphagov/paas-compose-broker/dbengine/fakes"
+	"github.com/alphagov/paas-compose-broker/leader"
+)
+
+var _ = Describe("Backup scheduler", func() {
+	var (
+		fakeComposeClient *fakes.FakeClient
+		scheduler         *broker.BackupScheduler
+		deployments       []composeapi.Deployment
+	)
+
+	scheduleNotes := func(lastBackupAt *time.Time) string {
+		schedule := map[string]interface{}{"interval": "1h"}
+		if lastBackupAt != nil {
+			schedule["last_backup_at"] = lastBackupAt
+		}
+		notes, err := json.Marshal(map[string]interface{}{
+			"provision":       map[string]string{"step": "done"},
+			"backup_schedule": schedule,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return string(notes)
+	}
+
+	backedUp := func() []string {
+		ids := []string{}
+		for i := 0; i < fakeComposeClient.StartBackupForDeploymentCallCount(); i++ {
+			ids = append(ids, fakeComposeClient.StartBackupForDeploymentArgsForCall(i))
+		}
+		return ids
+	}
+
+	BeforeEach(func() {
+		recent := time.Now().Add(-10 * time.Minute)
+		old := time.Now().Add(-2 * time.Hour)
+		deployments = []composeapi.Deployment{
+			{ID: "never", Name: "test-00000000-0000-0000-0000-000000000001", Notes: scheduleNotes(nil)},
+			{ID: "old", Name: "test-00000000-0000-0000-0000-000000000002", Notes: scheduleNotes(&old)},
+			{ID: "recent", Name: "test-00000000-0000-0000-0000-000000000003", Notes: scheduleNotes(&recent)},
+			{ID: "unscheduled", Name: "test-00000000-0000-0000-0000-000000000004", Notes: `{"provision":{"step":"done"}}`},
+			{ID: "provisioning", Name: "test-00000000-0000-0000-0000-000000000005", Notes: `{"provision":{"step":"wait"},"backup_schedule":{"interval":"1h"}}`},
+			{ID: "foreign", Name: "someone-else", Notes: scheduleNotes(nil)},
+		}
+
+		fakeComposeClient = &fakes.FakeClient{}
+		fakeComposeClient.GetAccountReturns(&composeapi.Account{ID: "1"}, []error{})
+		fakeComposeClient.GetDeploymentsStub = func() (*[]composeapi.Deployment, []error) {
+			return &deployments, nil
+		}
+		fakeComposeClient.GetDeploymentStub = func(id string) (*composeapi.Deployment, []error) {
+			for _, deployment := range deployments {
+				if deployment.ID == id {
+					return &deployment, nil
+				}
+			}
+			return nil, []error{errors.New("not found")}
+		}
+		fakeComposeClient.StartBackupForDeploymentStub = func(id string) (*composeapi.Recipe, []error) {
+			return &composeapi.Recipe{ID: "backup-" + id}, nil
+		}
+
+		b, err := broker.New(fakeComposeClient, enginefakes.FakeProvider{}, &config.Config{DBPrefix: "test"}, &catalog.Catalog{}, lager.NewLogger("test"))
+		Expect(err).NotTo(HaveOccurred())
+		scheduler = &broker.BackupScheduler{Broker: b, Leader: leader.Static(true)}
+	})
+
+	It("backs up the broker's provisioned instances which are due", func() {
+		scheduler.RunOnce(context.Background())
+
+		Expect(backedUp()).To(Equal([]string{"never", "old"}))
+	})
+
+	It("records when it backed each instance up", func() {
+		before := time.Now()
+		scheduler.RunOnce(context.Background())
+
+		Expect(fakeComposeClient.PatchDeploymentCallCount()).To(Equal(2))
+		params := fakeComposeClient.PatchDeploymentArgsForCall(0)
+		Expect(params.DeploymentID).To(Equal("never"))
+		var notes struct {
+			Provision      map[string]string `json:"provision"`
+			BackupSchedule struct {
+				Interval     string    `json:"interval"`
+				LastBackupAt time.Time `json:"last_backup_at"`
+			} `json:"backup_schedule"`
+		}
+		Expect(json.Unmarshal([]byte(params.Notes), &notes)).To(Succeed())
+		Expect(notes.Provision).To(Equal(map[string]string{"step": "done"}))
+		Expect(notes.BackupSchedule.Interval).To(Equal("1h"))
+		Expect(notes.BackupSchedule.LastBackupAt).To(BeTemporally(">=", before.Truncate(time.Second)))
+	})
+
+	It("carries on after failing to back an instance up", func() {
+		fakeComposeClient.StartBackupForDeploymentStub = func(id string) (*composeapi.Recipe, []error) {
+			if id == "never" {
+				return nil, []error{fmt.Errorf("backup already in progress")}
+			}
+			return &composeapi.Recipe{ID: "backup-" + id}, nil
+		}
+
+		scheduler.RunOnce(context.Background())
+
+		Expect(backedUp()).To(Equal([]string{"never", "old"}))
+		Expect(fakeComposeClient.PatchDeploymentCallCount()).To(Equal(1))
+		Expect(fakeComposeClient.PatchDeploymentArgsForCall(0).DeploymentID).To(Equal("old"))
+	})
+
+	It("does nothing unless it is the leader", func() {
+		scheduler.Leader = leader.Static(false)
+
+		scheduler.RunOnce(context.Background())
+
+		Expect(fakeComposeClient.GetDeploymentsCallCount()).To(Equal(0))
+		Expect(backedUp()).To(BeEmpty())
+	})
+})
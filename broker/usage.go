@@ -0,0 +1,236 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	composeapi "github.com/compose/gocomposeapi"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/alphagov/paas-compose-broker/dbengine"
+)
+
+// InstanceUsage is how much of its plan an instance uses: the Compose units
+// allocated to its deployment and in use, and the statistics its database
+// engine reports, such as its data size.
+type InstanceUsage struct {
+	InstanceID     string             `json:"instance_id"`
+	DeploymentID   string             `json:"deployment_id"`
+	SpaceGUID      string             `json:"space_guid"`
+	Service        string             `json:"service,omitempty"`
+	Plan           string             `json:"plan,omitempty"`
+	UnitType       string             `json:"unit_type"`
+	UnitSizeMB     int                `json:"unit_size_mb"`
+	AllocatedUnits int                `json:"allocated_units"`
+	UsedUnits      int                `json:"used_units"`
+	AllocatedMB    int                `json:"allocated_mb"`
+	UsedMB         int                `json:"used_mb"`
+	Database       map[string]float64 `json:"database,omitempty"`
+	DatabaseError  string             `json:"database_error,omitempty"`
+}
+
+// deploymentUsage gets a deployment's usage. Database statistics are
+// informational, and unavailable while a deployment is being provisioned,
+// so failing to get them is recorded in DatabaseError rather than failing.
+func (b *Broker) deploymentUsage(ctx context.Context, instanceID string, deployment *composeapi.Deployment) (*InstanceUsage, error) {
+	scalings, errs := b.composeClient(ctx).GetScalings(deployment.ID)
+	if len(errs) > 0 {
+		return nil, composeError(errs)
+	}
+
+	usage := &InstanceUsage{
+		InstanceID:     instanceID,
+		DeploymentID:   deployment.ID,
+		SpaceGUID:      deployment.CustomerBillingCode,
+		UnitType:       scalings.UnitType,
+		UnitSizeMB:     scalings.UnitSizeInMB,
+		AllocatedUnits: scalings.AllocatedUnits,
+		UsedUnits:      scalings.UsedUnits,
+		AllocatedMB:    scalings.AllocatedUnits * scalings.UnitSizeInMB,
+		UsedMB:         scalings.UsedUnits * scalings.UnitSizeInMB,
+	}
+	service, plan, err := b.deploymentPlan(deployment, scalings.AllocatedUnits)
+	if err == nil {
+		usage.Service = service.Name
+		usage.Plan = plan.Name
+	}
+
+	stats, err := b.databaseStats(ctx, deployment)
+	if err != nil {
+		b.logger(ctx).Error("get-database-stats", err, lager.Data{"deployment-id": deployment.ID})
+		usage.DatabaseError = err.Error()
+	} else {
+		usage.Database = stats
+	}
+	return usage, nil
+}
+
+// databaseStats returns the statistics of the deployment's engine, or nil if
+// it reports none.
+func (b *Broker) databaseStats(ctx context.Context, deployment *composeapi.Deployment) (map[string]float64, error) {
+	engine, err := b.DBEngineProvider.GetDBEngine(deployment)
+	if err != nil {
+		return nil, err
+	}
+	reporter, ok := engine.(dbengine.StatsReporter)
+	if !ok {
+		return nil, nil
+	}
+	return reporter.Stats(ctx)
+}
+
+// InstanceUsage returns the usage of an instance.
+func (b *Broker) InstanceUsage(ctx context.Context, instanceID string) (*InstanceUsage, error) {
+	instanceName, err := MakeInstanceName(b.Config.DBPrefix, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	deployment, err := b.findDeployment(ctx, instanceName)
+	if err == ErrDeploymentNotFound {
+		return nil, brokerapi.ErrInstanceDoesNotExist
+	} else if err != nil {
+		return nil, err
+	}
+	return b.deploymentUsage(ctx, instanceID, deployment)
+}
+
+// usageConcurrency is how many deployments AllUsage gets the usage of at
+// once.
+const usageConcurrency = 4
+
+// AllUsage returns the usage of every broker-owned deployment, ordered by
+// instance. Deployments whose usage cannot be got are logged and left out,
+// so one broken deployment does not hide the others.
+func (b *Broker) AllUsage(ctx context.Context) ([]InstanceUsage, error) {
+	deployments, errs := b.composeClient(ctx).GetDeployments()
+	if len(errs) > 0 {
+		return nil, composeError(errs)
+	}
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		result = []InstanceUsage{}
+		slots  = make(chan struct{}, usageConcurrency)
+	)
+	for i := range *deployments {
+		deployment := &(*deployments)[i]
+		instanceID, ok := InstanceIDFromName(b.Config.DBPrefix, deployment.Name)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			usage, err := b.deploymentUsage(ctx, instanceID, deployment)
+			if err != nil {
+				b.logger(ctx).Error("get-usage", err, lager.Data{"instance-id": instanceID, "deployment-id": deployment.ID})
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			result = append(result, *usage)
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].InstanceID < result[j].InstanceID
+	})
+	return result, nil
+}
+
+// DefaultUsageInterval is how often the UsageCollector collects usage.
+const DefaultUsageInterval = 5 * time.Minute
+
+// UsageCollector collects the usage of broker-owned deployments in the
+// background, so that serving it never waits on the Compose API.
+type UsageCollector struct {
+	Broker   *Broker
+	Interval time.Duration
+
+	mu        sync.Mutex
+	usages    []InstanceUsage
+	collected bool
+}
+
+// Run collects usage now and every Interval until stop is closed.
+func (c *UsageCollector) Run(stop <-chan struct{}) {
+	interval := c.Interval
+	if interval <= 0 {
+		interval = DefaultUsageInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		if err := c.Collect(ctx); err != nil {
+			c.Broker.Logger.Session("usage-collector").Error("collect", err)
+		}
+		cancel()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Collect gets the usage of every broker-owned deployment, replacing what
+// was last collected if it succeeds.
+func (c *UsageCollector) Collect(ctx context.Context) error {
+	usages, err := c.Broker.AllUsage(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.usages = usages
+	c.collected = true
+	return nil
+}
+
+// Usage returns the usage last collected, and false if none has been yet.
+func (c *UsageCollector) Usage() ([]InstanceUsage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.usages, c.collected
+}
+
+// UsageHandler lists the usage of broker-owned deployments to operators, or
+// that of one instance with ?instance_id=. It must be wrapped in the same
+// basic auth as the broker API.
+func UsageHandler(b *Broker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		var result interface{}
+		var err error
+		if instanceID := req.URL.Query().Get("instance_id"); instanceID != "" {
+			result, err = b.InstanceUsage(req.Context(), instanceID)
+		} else {
+			result, err = b.AllUsage(req.Context())
+		}
+		if err == brokerapi.ErrInstanceDoesNotExist {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(brokerapi.ErrorResponse{Description: err.Error()})
+			return
+		} else if err != nil {
+			b.logger(req.Context()).Error("usage", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(brokerapi.ErrorResponse{Description: err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(result)
+	})
+}
@@ -0,0 +1,175 @@
+package broker_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	"code.cloudfoundry.org/lager"
+	composeapi "github.com/compose/gocomposeapi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/alphagov/paas-compose-broker/broker"
+	"github.com/alphagov/paas-compose-broker/catalog"
+	"github.com/alphagov/paas-compose-broker/compose/fakes"
+	"github.com/alphagov/paas-compose-broker/config"
+	enginefakes "github.com/alphagov/paas-compose-broker/dbengine/fakes"
+)
+
+var _ = Describe("Usage", func() {
+	var (
+		fakeComposeClient *fakes.FakeClient
+		engine            *enginefakes.FakeStatsDBEngine
+		b                 *broker.Broker
+	)
+
+	BeforeEach(func() {
+		fakeComposeClient = &fakes.FakeClient{}
+		fakeComposeClient.GetAccountReturns(&composeapi.Account{ID: "1"}, []error{})
+		fakeComposeClient.GetDeploymentsReturns(&[]composeapi.Deployment{
+			{ID: "d3", Name: "test-00000000-0000-0000-0000-000000000003", Type: "mongodb", CustomerBillingCode: "space-3"},
+			{ID: "d2", Name: "someone-else", Type: "mongodb"},
+			{ID: "d1", Name: "test-00000000-0000-0000-0000-000000000001", Type: "mongodb", CustomerBillingCode: "space-1"},
+		}, []error{})
+		fakeComposeClient.GetDeploymentByNameStub = func(name string) (*composeapi.Deployment, []error) {
+			if name != "test-00000000-0000-0000-0000-000000000001" {
+				return nil, nil
+			}
+			return &composeapi.Deployment{ID: "d1", Name: name, Type: "mongodb", CustomerBillingCode: "space-1"}, nil
+		}
+		fakeComposeClient.GetScalingsStub = func(deploymentID string) (*composeapi.Scalings, []error) {
+			return &composeapi.Scalings{AllocatedUnits: 2, UsedUnits: 1, UnitSizeInMB: 1024, UnitType: "storage"}, nil
+		}
+		engine = &enginefakes.FakeStatsDBEngine{StatsResult: map[string]float64{"data_size_bytes": 2048}}
+
+		cat := &catalog.Catalog{}
+		Expect(json.Unmarshal([]byte(`{"services":[{"name":"mongodb","plans":[{"name":"small","compose":{"databaseType":"mongodb","units":2}}]}]}`), cat)).To(Succeed())
+
+		var err error
+		b, err = broker.New(fakeComposeClient, enginefakes.FakeProvider{DBEngine: engine}, &config.Config{DBPrefix: "test"}, cat, lager.NewLogger("test"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("reports an instance's scaling and database usage against its plan", func() {
+		usage, err := b.InstanceUsage(context.Background(), "00000000-0000-0000-0000-000000000001")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*usage).To(Equal(broker.InstanceUsage{
+			InstanceID:     "00000000-0000-0000-0000-000000000001",
+			DeploymentID:   "d1",
+			SpaceGUID:      "space-1",
+			Service:        "mongodb",
+			Plan:           "small",
+			UnitType:       "storage",
+			UnitSizeMB:     1024,
+			AllocatedUnits: 2,
+			UsedUnits:      1,
+			AllocatedMB:    2048,
+			UsedMB:         1024,
+			Database:       map[string]float64{"data_size_bytes": 2048},
+		}))
+		Expect(fakeComposeClient.GetScalingsArgsForCall(0)).To(Equal("d1"))
+	})
+
+	It("reports usage without database stats when the engine cannot give them", func() {
+		engine.StatsError = errors.New("failed to connect to MongoDB: no reachable servers")
+
+		usage, err := b.InstanceUsage(context.Background(), "00000000-0000-0000-0000-000000000001")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(usage.UsedMB).To(Equal(1024))
+		Expect(usage.Database).To(BeNil())
+		Expect(usage.DatabaseError).To(Equal("failed to connect to MongoDB: no reachable servers"))
+	})
+
+	It("fails when Compose cannot give the scalings", func() {
+		fakeComposeClient.GetScalingsStub = nil
+		fakeComposeClient.GetScalingsReturns(nil, []error{errors.New("boom")})
+
+		_, err := b.InstanceUsage(context.Background(), "00000000-0000-0000-0000-000000000001")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("lists the usage of the broker's deployments by instance", func() {
+		all, err := b.AllUsage(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(all).To(HaveLen(2))
+		Expect(all[0].InstanceID).To(Equal("00000000-0000-0000-0000-000000000001"))
+		Expect(all[1].InstanceID).To(Equal("00000000-0000-0000-0000-000000000003"))
+		Expect(all[1].SpaceGUID).To(Equal("space-3"))
+	})
+
+	It("leaves out deployments whose usage cannot be got", func() {
+		fakeComposeClient.GetScalingsStub = func(deploymentID string) (*composeapi.Scalings, []error) {
+			if deploymentID == "d1" {
+				return nil, []error{errors.New("boom")}
+			}
+			return &composeapi.Scalings{AllocatedUnits: 2, UsedUnits: 1, UnitSizeInMB: 1024, UnitType: "storage"}, nil
+		}
+
+		all, err := b.AllUsage(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(all).To(HaveLen(1))
+		Expect(all[0].InstanceID).To(Equal("00000000-0000-0000-0000-000000000003"))
+	})
+
+	It("fails to list usage when Compose cannot list the deployments", func() {
+		fakeComposeClient.GetDeploymentsReturns(nil, []error{errors.New("boom")})
+
+		_, err := b.AllUsage(context.Background())
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("collects usage in the background, keeping the last collected", func() {
+		collector := &broker.UsageCollector{Broker: b}
+		_, ok := collector.Usage()
+		Expect(ok).To(BeFalse())
+
+		Expect(collector.Collect(context.Background())).To(Succeed())
+		usages, ok := collector.Usage()
+		Expect(ok).To(BeTrue())
+		Expect(usages).To(HaveLen(2))
+
+		fakeComposeClient.GetDeploymentsReturns(nil, []error{errors.New("boom")})
+		Expect(collector.Collect(context.Background())).NotTo(Succeed())
+		usages, ok = collector.Usage()
+		Expect(ok).To(BeTrue())
+		Expect(usages).To(HaveLen(2))
+	})
+
+	It("serves usage to operators, for one instance or all", func() {
+		resp := httptest.NewRecorder()
+		broker.UsageHandler(b).ServeHTTP(resp, httptest.NewRequest("GET", "/usage?instance_id=00000000-0000-0000-0000-000000000001", nil))
+		Expect(resp.Code).To(Equal(http.StatusOK))
+		Expect(resp.Body.String()).To(MatchJSON(`{
+			"instance_id": "00000000-0000-0000-0000-000000000001",
+			"deployment_id": "d1",
+			"space_guid": "space-1",
+			"service": "mongodb",
+			"plan": "small",
+			"unit_type": "storage",
+			"unit_size_mb": 1024,
+			"allocated_units": 2,
+			"used_units": 1,
+			"allocated_mb": 2048,
+			"used_mb": 1024,
+			"database": {"data_size_bytes": 2048}
+		}`))
+
+		resp = httptest.NewRecorder()
+		broker.UsageHandler(b).ServeHTTP(resp, httptest.NewRequest("GET", "/usage", nil))
+		Expect(resp.Code).To(Equal(http.StatusOK))
+		var all []broker.InstanceUsage
+		Expect(json.Unmarshal(resp.Body.Bytes(), &all)).To(Succeed())
+		Expect(all).To(HaveLen(2))
+
+		resp = httptest.NewRecorder()
+		broker.UsageHandler(b).ServeHTTP(resp, httptest.NewRequest("GET", "/usage?instance_id=00000000-0000-0000-0000-000000000002", nil))
+		Expect(resp.Code).To(Equal(http.StatusNotFound))
+		var errorResponse brokerapi.ErrorResponse
+		Expect(json.Unmarshal(resp.Body.Bytes(), &errorResponse)).To(Succeed())
+		Expect(errorResponse.Description).To(Equal(brokerapi.ErrInstanceDoesNotExist.Error()))
+	})
+})
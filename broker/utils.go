@@ -4,36 +4,30 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"regexp"
 	"strings"
 
 	"github.com/alphagov/paas-compose-broker/compose"
 	composeapi "github.com/compose/gocomposeapi"
 )
 
-var errDeploymentNotFound = errors.New("Deployment not found")
+var ErrDeploymentNotFound = errors.New("Deployment not found")
 
-func findDeployment(c compose.Client, name string) (*composeapi.Deployment, error) {
+func FindDeployment(c compose.Client, name string) (*composeapi.Deployment, error) {
 	deployment, errs := c.GetDeploymentByName(name)
 	if len(errs) > 0 {
-		if strings.Contains(errs[0].Error(), "deployment not found") {
-			return nil, errDeploymentNotFound
+		if compose.IsNotFound(errs[0]) {
+			return nil, ErrDeploymentNotFound
 		}
-		return nil, compose.SquashErrors(errs)
+		return nil, composeError(errs)
 	}
 	if deployment == nil {
-		return nil, errDeploymentNotFound
+		return nil, ErrDeploymentNotFound
 	}
 	return deployment, nil
 }
 
-func makeOperationData(operationType, recipeID string, whitelistRecipeIDs []string) (string, error) {
-
-	operationData := OperationData{
-		Type:               operationType,
-		RecipeID:           recipeID,
-		WhitelistRecipeIDs: whitelistRecipeIDs,
-	}
-
+func encodeOperationData(operationData OperationData) (string, error) {
 	data, err := json.Marshal(operationData)
 	if err != nil {
 		return "", err
@@ -52,6 +46,29 @@ func MakeInstanceName(dbPrefix, instanceID string) (string, error) {
 	return fmt.Sprintf("%s-%s", strings.TrimSpace(dbPrefix), instanceID), nil
 }
 
+var guidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// IsGUID reports whether id is shaped like a Cloud Foundry GUID.
+func IsGUID(id string) bool {
+	return guidPattern.MatchString(id)
+}
+
+// InstanceIDFromName is the inverse of MakeInstanceName. It reports false for
+// deployments which were not named by a broker using dbPrefix: the name must
+// be exactly the prefix, a hyphen and an instance GUID, so that another
+// broker's prefix which starts with this one's is not mistaken for it.
+func InstanceIDFromName(dbPrefix, name string) (string, bool) {
+	prefix := strings.TrimSpace(dbPrefix) + "-"
+	if dbPrefix == "" || !strings.HasPrefix(name, prefix) {
+		return "", false
+	}
+	instanceID := strings.TrimPrefix(name, prefix)
+	if !IsGUID(instanceID) {
+		return "", false
+	}
+	return instanceID, true
+}
+
 func newestRestorableBackup(backups []composeapi.Backup) *composeapi.Backup {
 	var newest *composeapi.Backup
 	for i, backup := range backups {
@@ -64,3 +81,16 @@ func newestRestorableBackup(backups []composeapi.Backup) *composeapi.Backup {
 	}
 	return newest
 }
+
+func newestDownloadableBackup(backups []composeapi.Backup) *composeapi.Backup {
+	var newest *composeapi.Backup
+	for i, backup := range backups {
+		if !backup.IsDownloadable {
+			continue
+		}
+		if newest == nil || backup.CreatedAt.After(newest.CreatedAt) {
+			newest = &backups[i]
+		}
+	}
+	return newest
+}
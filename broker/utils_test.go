@@ -8,42 +8,57 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"github.com/alphagov/paas-compose-broker/compose"
 	"github.com/alphagov/paas-compose-broker/compose/fakes"
 )
 
 var _ = Describe("Broker utility functions", func() {
 
-	Describe("findDeployment", func() {
+	Describe("FindDeployment", func() {
 		It("returns the deployment if present", func() {
 			fakeComposeClient := &fakes.FakeClient{}
 			deployment := &composeapi.Deployment{ID: "2345", Name: "two"}
 			fakeComposeClient.GetDeploymentByNameReturns(deployment, []error{})
 
-			Expect(findDeployment(fakeComposeClient, "two")).To(Equal(deployment))
+			Expect(FindDeployment(fakeComposeClient, "two")).To(Equal(deployment))
 		})
 
-		It("returns a errDeploymentNotFound if the deployment doesn't exist", func() {
+		It("returns a ErrDeploymentNotFound if the deployment doesn't exist", func() {
+			fakeComposeClient := &fakes.FakeClient{}
+			fakeComposeClient.GetDeploymentByNameReturns(nil, []error{&compose.NotFoundError{Resource: "deployment", Name: "non-existent"}})
+
+			_, err := FindDeployment(fakeComposeClient, "non-existent")
+
+			Expect(err).To(Equal(ErrDeploymentNotFound))
+		})
+
+		It("does not mistake other errors mentioning a missing deployment", func() {
 			fakeComposeClient := &fakes.FakeClient{}
 			fakeComposeClient.GetDeploymentByNameReturns(nil, []error{errors.New("deployment not found")})
 
-			_, err := findDeployment(fakeComposeClient, "non-existent")
+			_, err := FindDeployment(fakeComposeClient, "non-existent")
 
-			Expect(err).To(Equal(errDeploymentNotFound))
+			Expect(err).To(MatchError("deployment not found"))
+			Expect(err).NotTo(Equal(ErrDeploymentNotFound))
 		})
 
 		It("returns all other errors", func() {
 			fakeComposeClient := &fakes.FakeClient{}
 			fakeComposeClient.GetDeploymentByNameReturns(nil, []error{errors.New("computer says no")})
 
-			_, err := findDeployment(fakeComposeClient, "one")
+			_, err := FindDeployment(fakeComposeClient, "one")
 
 			Expect(err).To(MatchError("computer says no"))
 		})
 	})
 
-	Describe("makeOperationData", func() {
+	Describe("encodeOperationData", func() {
 		It("can make operation data JSON", func() {
-			operationData, err := makeOperationData("expected_type", "123", []string{"1.1.1.1"})
+			operationData, err := encodeOperationData(OperationData{
+				Type:               "expected_type",
+				RecipeID:           "123",
+				WhitelistRecipeIDs: []string{"1.1.1.1"},
+			})
 			Expect(err).ToNot(HaveOccurred())
 			Expect(operationData).To(Equal(`{"type":"expected_type","recipe_id":"123","whitelist_recipe_ids":["1.1.1.1"]}`))
 		})
@@ -63,6 +78,40 @@ var _ = Describe("Broker utility functions", func() {
 		})
 	})
 
+	Describe("InstanceIDFromName", func() {
+		It("can recover the instance ID from an instance name", func() {
+			instanceID, ok := InstanceIDFromName("test", "test-15e332e8-4afa-4c41-82a3-f44b18eba448")
+			Expect(ok).To(BeTrue())
+			Expect(instanceID).To(Equal("15e332e8-4afa-4c41-82a3-f44b18eba448"))
+		})
+
+		It("can trim spaces from dbprefix", func() {
+			instanceID, ok := InstanceIDFromName(" trim-spaces ", "trim-spaces-0f38f9c2-085c-41ec-87bf-e38b72f7fdaa")
+			Expect(ok).To(BeTrue())
+			Expect(instanceID).To(Equal("0f38f9c2-085c-41ec-87bf-e38b72f7fdaa"))
+		})
+
+		It("rejects names made with another prefix", func() {
+			_, ok := InstanceIDFromName("test", "other-15e332e8-4afa-4c41-82a3-f44b18eba448")
+			Expect(ok).To(BeFalse())
+		})
+
+		It("rejects names made with a longer prefix starting with this one", func() {
+			_, ok := InstanceIDFromName("compose-broker", "compose-broker-staging-15e332e8-4afa-4c41-82a3-f44b18eba448")
+			Expect(ok).To(BeFalse())
+		})
+
+		It("rejects names whose suffix is not a GUID", func() {
+			_, ok := InstanceIDFromName("test", "test-instance-1")
+			Expect(ok).To(BeFalse())
+		})
+
+		It("rejects names without an instance ID", func() {
+			_, ok := InstanceIDFromName("test", "test-")
+			Expect(ok).To(BeFalse())
+		})
+	})
+
 	Describe("newestRestorableBackup", func() {
 		It("returns nil if provided with no backups", func() {
 			nrb := newestRestorableBackup([]composeapi.Backup{})
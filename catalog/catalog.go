@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/pivotal-cf/brokerapi"
 )
@@ -21,6 +22,23 @@ type Plan struct {
 type ComposeConfig struct {
 	Units        int    `json:"units"`
 	DatabaseType string `json:"databaseType"`
+	// MinBackupInterval is the shortest interval tenants may schedule
+	// backups at, e.g. "1h". Plans without one do not offer scheduled
+	// backups.
+	MinBackupInterval string `json:"minBackupInterval,omitempty"`
+}
+
+// BackupIntervalLimit returns the plan's minimum backup interval, and false
+// if it does not offer scheduled backups.
+func (c ComposeConfig) BackupIntervalLimit() (time.Duration, bool) {
+	if c.MinBackupInterval == "" {
+		return 0, false
+	}
+	interval, err := time.ParseDuration(c.MinBackupInterval)
+	if err != nil {
+		return 0, false
+	}
+	return interval, true
 }
 
 type Catalog struct {
@@ -47,6 +65,33 @@ func (s *Service) GetPlan(id string) (*Plan, error) {
 	return nil, fmt.Errorf("plan %v: not found", id)
 }
 
+// FindPlanByID returns the plan with the given ID, and its service.
+func (c *Catalog) FindPlanByID(id string) (*Service, *Plan, error) {
+	for _, service := range c.Services {
+		if plan, err := service.GetPlan(id); err == nil {
+			return service, plan, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("plan %v: not found", id)
+}
+
+// FindPlan returns the plan which provisions deployments of databaseType with
+// the given number of units. Compose does not record which plan a deployment
+// was created from, so this is the best mapping available for deployments
+// whose notes do not say.
+func (c *Catalog) FindPlan(databaseType string, units int) (*Service, *Plan, error) {
+	for _, service := range c.Services {
+		for _, plan := range service.Plans {
+			if plan.Compose.DatabaseType == databaseType && plan.Compose.Units == units {
+				return service, plan, nil
+			}
+		}
+	}
+
+	return nil, nil, fmt.Errorf("plan for %d units of %v: not found", units, databaseType)
+}
+
 func Load(input io.Reader) (*Catalog, error) {
 	var c Catalog
 	if err := json.NewDecoder(input).Decode(&c); err != nil {
@@ -54,6 +99,12 @@ func Load(input io.Reader) (*Catalog, error) {
 	}
 	for _, s := range c.Services {
 		for _, p := range s.Plans {
+			if p.Compose.MinBackupInterval != "" {
+				interval, err := time.ParseDuration(p.Compose.MinBackupInterval)
+				if err != nil || interval <= 0 {
+					return nil, fmt.Errorf("plan %v: invalid minBackupInterval: %s", p.ID, p.Compose.MinBackupInterval)
+				}
+			}
 			s.Service.Plans = append(s.Service.Plans, p.ServicePlan)
 		}
 	}
@@ -3,6 +3,7 @@ package catalog
 import (
 	"strings"
 	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -63,6 +64,46 @@ var _ = Describe("catalog", func() {
 		Expect(catalog.Services[0].Plans[0].Compose.DatabaseType).To(Equal("DATABASE_TYPE"), "expected a databaseType set")
 	})
 
+	It("should find a plan by database type and units", func() {
+		service, plan, err := catalog.FindPlan("DATABASE_TYPE", 1)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(service.ID).To(Equal("XXXX-XXXX-XXXX-XXXX"))
+		Expect(plan.ID).To(Equal("YYYY-YYYY-YYYY-YYYY"))
+
+		_, _, err = catalog.FindPlan("DATABASE_TYPE", 2)
+		Expect(err).To(MatchError("plan for 2 units of DATABASE_TYPE: not found"))
+	})
+
+	It("should find a plan by ID", func() {
+		service, plan, err := catalog.FindPlanByID("YYYY-YYYY-YYYY-YYYY")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(service.ID).To(Equal("XXXX-XXXX-XXXX-XXXX"))
+		Expect(plan.Name).To(Equal("PLAN_NAME"))
+
+		_, _, err = catalog.FindPlanByID("ZZZZ")
+		Expect(err).To(MatchError("plan ZZZZ: not found"))
+	})
+
+	It("should only offer scheduled backups on plans with a minimum interval", func() {
+		_, ok := catalog.Services[0].Plans[0].Compose.BackupIntervalLimit()
+		Expect(ok).To(BeFalse())
+
+		withLimit, err := Load(strings.NewReader(strings.Replace(catalogJson,
+			`"databaseType": "DATABASE_TYPE"`,
+			`"databaseType": "DATABASE_TYPE", "minBackupInterval": "1h"`, 1)))
+		Expect(err).ToNot(HaveOccurred())
+		limit, ok := withLimit.Services[0].Plans[0].Compose.BackupIntervalLimit()
+		Expect(ok).To(BeTrue())
+		Expect(limit).To(Equal(time.Hour))
+	})
+
+	It("should reject an invalid minimum backup interval", func() {
+		_, err := Load(strings.NewReader(strings.Replace(catalogJson,
+			`"databaseType": "DATABASE_TYPE"`,
+			`"databaseType": "DATABASE_TYPE", "minBackupInterval": "hourly"`, 1)))
+		Expect(err).To(MatchError("plan YYYY-YYYY-YYYY-YYYY: invalid minBackupInterval: hourly"))
+	})
+
 	It("should expose the embedded brokerapi.Service type", func() {
 		service := catalog.Services[0]
 		brokerService := service.Service
@@ -1,11 +1,13 @@
 package elastic
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
 )
 
 type Client struct {
@@ -22,6 +24,20 @@ type composeResponse struct {
 	Version composeResponseVersion `json:"version,omitempty"`
 }
 
+// ClusterStats is the part of the response to GET /_cluster/stats
+// describing the cluster's indices.
+type ClusterStats struct {
+	Indices struct {
+		Count int `json:"count"`
+		Docs  struct {
+			Count int64 `json:"count"`
+		} `json:"docs"`
+		Store struct {
+			SizeInBytes int64 `json:"size_in_bytes"`
+		} `json:"store"`
+	} `json:"indices"`
+}
+
 func New(uri string, httpClient *http.Client) (*Client, error) {
 	if httpClient == nil {
 		httpClient = &http.Client{}
@@ -84,3 +100,30 @@ func (c *Client) Do(req *http.Request) (*http.Response, error) {
 func (c *Client) Get(uri string) (*http.Response, error) {
 	return c.http.Get(uri)
 }
+
+// ClusterStats returns the cluster's index statistics.
+func (c *Client) ClusterStats(ctx context.Context) (*ClusterStats, error) {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(c.URI, "/")+"/_cluster/stats", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 || resp.StatusCode < 200 {
+		r, err := c.readBody(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("request error: %s", resp.Status)
+		}
+		return nil, fmt.Errorf("request error: %s", r.Error)
+	}
+
+	stats := &ClusterStats{}
+	if err := json.NewDecoder(resp.Body).Decode(stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
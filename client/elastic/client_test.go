@@ -2,6 +2,7 @@ package elastic
 
 import (
 	"bytes"
+	"context"
 	"io"
 
 	httpmock "gopkg.in/jarcoal/httpmock.v1"
@@ -100,5 +101,25 @@ var _ = Describe("Elastic Client", func() {
 			Expect(err).To(HaveOccurred())
 			Expect(version).NotTo(Equal("5.0.0"))
 		})
+
+		It("should get ClusterStats() from ElasticSearch", func() {
+			httpmock.RegisterResponder("GET", "http://localhost:9200/_cluster/stats",
+				httpmock.NewStringResponder(200, `{"indices":{"count":3,"docs":{"count":1200},"store":{"size_in_bytes":524288}}}`))
+
+			stats, err := client.ClusterStats(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stats.Indices.Count).To(Equal(3))
+			Expect(stats.Indices.Docs.Count).To(Equal(int64(1200)))
+			Expect(stats.Indices.Store.SizeInBytes).To(Equal(int64(524288)))
+		})
+
+		It("should fail to get ClusterStats() due to 403", func() {
+			httpmock.RegisterResponder("GET", "http://localhost:9200/_cluster/stats",
+				httpmock.NewStringResponder(403, `{"error":"forbidden"}`))
+
+			stats, err := client.ClusterStats(context.Background())
+			Expect(err).To(MatchError("request error: forbidden"))
+			Expect(stats).To(BeNil())
+		})
 	})
 })
@@ -0,0 +1,305 @@
+package compose
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	composeapi "github.com/compose/gocomposeapi"
+)
+
+// ErrCircuitOpen is returned without calling the Compose API while the
+// circuit breaker is open.
+var ErrCircuitOpen = errors.New("Compose API unavailable")
+
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"
+	CircuitOpen     CircuitState = "open"
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+// CircuitBreakerClient decorates a Client so that, after FailureThreshold
+// consecutive transient failures, calls fail fast with ErrCircuitOpen for
+// Cooldown. A single call is then let through to probe the API: if it
+// succeeds the circuit closes, otherwise it opens again.
+type CircuitBreakerClient struct {
+	client           Client
+	failureThreshold int
+	cooldown         time.Duration
+	logger           lager.Logger
+
+	// Now returns the current time. It is replaced in tests.
+	Now func() time.Time
+
+	*circuit
+}
+
+// circuit is the state of a CircuitBreakerClient, shared with the copies of
+// it bound to a context.
+type circuit struct {
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+}
+
+func NewCircuitBreakerClient(client Client, failureThreshold int, cooldown time.Duration, logger lager.Logger) *CircuitBreakerClient {
+	return &CircuitBreakerClient{
+		client:           client,
+		failureThreshold: failureThreshold,
+		cooldown:         cooldown,
+		logger:           logger.Session("compose-circuit-breaker"),
+		Now:              time.Now,
+		circuit:          &circuit{state: CircuitClosed},
+	}
+}
+
+func (c *CircuitBreakerClient) bind(ctx context.Context) Client {
+	bound := *c
+	bound.client = bind(ctx, c.client)
+	return &bound
+}
+
+func (c *CircuitBreakerClient) State() CircuitState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+func (c *CircuitBreakerClient) allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case CircuitOpen:
+		if c.Now().Sub(c.openedAt) < c.cooldown {
+			return false
+		}
+		c.state = CircuitHalfOpen
+		c.logger.Info("half-open")
+		return true
+	case CircuitHalfOpen:
+		// Only the probe is let through until it completes.
+		return false
+	}
+	return true
+}
+
+func (c *CircuitBreakerClient) record(errs []error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	failed := len(errs) > 0
+	for _, err := range errs {
+		if !isTransient(err) {
+			// The API answered, even if it did not like the request.
+			failed = false
+		}
+	}
+
+	if !failed {
+		if c.state != CircuitClosed {
+			c.logger.Info("closed")
+		}
+		c.state = CircuitClosed
+		c.failures = 0
+		return
+	}
+
+	c.failures++
+	if c.state == CircuitHalfOpen || c.failures >= c.failureThreshold {
+		if c.state != CircuitOpen {
+			c.logger.Error("open", SquashErrors(errs), lager.Data{"failures": c.failures})
+		}
+		c.state = CircuitOpen
+		c.openedAt = c.Now()
+	}
+}
+
+func (c *CircuitBreakerClient) do(call func() []error) []error {
+	if !c.allow() {
+		return []error{ErrCircuitOpen}
+	}
+	errs := call()
+	c.record(errs)
+	return errs
+}
+
+func (c *CircuitBreakerClient) GetAccount() (account *composeapi.Account, errs []error) {
+	errs = c.do(func() []error {
+		account, errs = c.client.GetAccount()
+		return errs
+	})
+	return account, errs
+}
+
+func (c *CircuitBreakerClient) GetClusters() (clusters *[]composeapi.Cluster, errs []error) {
+	errs = c.do(func() []error {
+		clusters, errs = c.client.GetClusters()
+		return errs
+	})
+	return clusters, errs
+}
+
+func (c *CircuitBreakerClient) GetCluster(clusterID string) (cluster *composeapi.Cluster, errs []error) {
+	errs = c.do(func() []error {
+		cluster, errs = c.client.GetCluster(clusterID)
+		return errs
+	})
+	return cluster, errs
+}
+
+func (c *CircuitBreakerClient) GetClusterByName(name string) (cluster *composeapi.Cluster, errs []error) {
+	errs = c.do(func() []error {
+		cluster, errs = c.client.GetClusterByName(name)
+		return errs
+	})
+	return cluster, errs
+}
+
+func (c *CircuitBreakerClient) CreateDeployment(params composeapi.DeploymentParams) (deployment *composeapi.Deployment, errs []error) {
+	errs = c.do(func() []error {
+		deployment, errs = c.client.CreateDeployment(params)
+		return errs
+	})
+	return deployment, errs
+}
+
+func (c *CircuitBreakerClient) DeprovisionDeployment(deploymentID string) (recipe *composeapi.Recipe, errs []error) {
+	errs = c.do(func() []error {
+		recipe, errs = c.client.DeprovisionDeployment(deploymentID)
+		return errs
+	})
+	return recipe, errs
+}
+
+func (c *CircuitBreakerClient) GetDeployment(deploymentID string) (deployment *composeapi.Deployment, errs []error) {
+	errs = c.do(func() []error {
+		deployment, errs = c.client.GetDeployment(deploymentID)
+		return errs
+	})
+	return deployment, errs
+}
+
+func (c *CircuitBreakerClient) GetDeploymentByName(name string) (deployment *composeapi.Deployment, errs []error) {
+	errs = c.do(func() []error {
+		deployment, errs = c.client.GetDeploymentByName(name)
+		return errs
+	})
+	return deployment, errs
+}
+
+func (c *CircuitBreakerClient) GetDeployments() (deployments *[]composeapi.Deployment, errs []error) {
+	errs = c.do(func() []error {
+		deployments, errs = c.client.GetDeployments()
+		return errs
+	})
+	return deployments, errs
+}
+
+func (c *CircuitBreakerClient) CreateDeploymentWhitelist(deploymentID string, params composeapi.DeploymentWhitelistParams) (recipe *composeapi.Recipe, errs []error) {
+	errs = c.do(func() []error {
+		recipe, errs = c.client.CreateDeploymentWhitelist(deploymentID, params)
+		return errs
+	})
+	return recipe, errs
+}
+
+func (c *CircuitBreakerClient) GetWhitelistForDeployment(deploymentID string) (whitelist []composeapi.DeploymentWhitelist, errs []error) {
+	errs = c.do(func() []error {
+		whitelist, errs = c.client.GetWhitelistForDeployment(deploymentID)
+		return errs
+	})
+	return whitelist, errs
+}
+
+func (c *CircuitBreakerClient) GetRecipe(recipeID string) (recipe *composeapi.Recipe, errs []error) {
+	errs = c.do(func() []error {
+		recipe, errs = c.client.GetRecipe(recipeID)
+		return errs
+	})
+	return recipe, errs
+}
+
+func (c *CircuitBreakerClient) GetScalings(deploymentID string) (scalings *composeapi.Scalings, errs []error) {
+	errs = c.do(func() []error {
+		scalings, errs = c.client.GetScalings(deploymentID)
+		return errs
+	})
+	return scalings, errs
+}
+
+func (c *CircuitBreakerClient) SetScalings(params composeapi.ScalingsParams) (recipe *composeapi.Recipe, errs []error) {
+	errs = c.do(func() []error {
+		recipe, errs = c.client.SetScalings(params)
+		return errs
+	})
+	return recipe, errs
+}
+
+func (c *CircuitBreakerClient) GetBackupsForDeployment(deploymentID string) (backups *[]composeapi.Backup, errs []error) {
+	errs = c.do(func() []error {
+		backups, errs = c.client.GetBackupsForDeployment(deploymentID)
+		return errs
+	})
+	return backups, errs
+}
+
+func (c *CircuitBreakerClient) GetBackupDetailsForDeployment(deploymentID, backupID string) (backup *composeapi.Backup, errs []error) {
+	errs = c.do(func() []error {
+		backup, errs = c.client.GetBackupDetailsForDeployment(deploymentID, backupID)
+		return errs
+	})
+	return backup, errs
+}
+
+func (c *CircuitBreakerClient) RestoreBackup(params composeapi.RestoreBackupParams) (deployment *composeapi.Deployment, errs []error) {
+	errs = c.do(func() []error {
+		deployment, errs = c.client.RestoreBackup(params)
+		return errs
+	})
+	return deployment, errs
+}
+
+func (c *CircuitBreakerClient) PatchDeployment(params composeapi.PatchDeploymentParams) (deployment *composeapi.Deployment, errs []error) {
+	errs = c.do(func() []error {
+		deployment, errs = c.client.PatchDeployment(params)
+		return errs
+	})
+	return deployment, errs
+}
+
+func (c *CircuitBreakerClient) StartBackupForDeployment(deploymentID string) (recipe *composeapi.Recipe, errs []error) {
+	errs = c.do(func() []error {
+		recipe, errs = c.client.StartBackupForDeployment(deploymentID)
+		return errs
+	})
+	return recipe, errs
+}
+
+func (c *CircuitBreakerClient) GetAuditEvents(params composeapi.AuditEventsParams) (events *[]composeapi.AuditEvent, errs []error) {
+	errs = c.do(func() []error {
+		events, errs = c.client.GetAuditEvents(params)
+		return errs
+	})
+	return events, errs
+}
+
+func (c *CircuitBreakerClient) GetAuditEvent(id string) (event *composeapi.AuditEvent, errs []error) {
+	errs = c.do(func() []error {
+		event, errs = c.client.GetAuditEvent(id)
+		return errs
+	})
+	return event, errs
+}
+
+func (c *CircuitBreakerClient) GetAlertsForDeployment(deploymentID string) (alerts *composeapi.Alerts, errs []error) {
+	errs = c.do(func() []error {
+		alerts, errs = c.client.GetAlertsForDeployment(deploymentID)
+		return errs
+	})
+	return alerts, errs
+}
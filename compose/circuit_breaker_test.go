@@ -0,0 +1,88 @@
+package compose_test
+
+import (
+	"errors"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	composeapi "github.com/compose/gocomposeapi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/paas-compose-broker/compose"
+	"github.com/alphagov/paas-compose-broker/compose/fakes"
+)
+
+var _ = Describe("CircuitBreakerClient", func() {
+
+	var (
+		fakeComposeClient *fakes.FakeClient
+		client            *compose.CircuitBreakerClient
+		now               time.Time
+		unavailable       = errors.New("Unable to parse error - status code 503 - body <html>Service Unavailable</html>")
+	)
+
+	BeforeEach(func() {
+		fakeComposeClient = &fakes.FakeClient{}
+		fakeComposeClient.GetRecipeReturns(nil, []error{unavailable})
+		client = compose.NewCircuitBreakerClient(fakeComposeClient, 2, time.Minute, lager.NewLogger("test"))
+		now = time.Now()
+		client.Now = func() time.Time { return now }
+	})
+
+	It("opens after consecutive transient failures and then fails fast", func() {
+		client.GetRecipe("recipe")
+		Expect(client.State()).To(Equal(compose.CircuitClosed))
+		client.GetRecipe("recipe")
+		Expect(client.State()).To(Equal(compose.CircuitOpen))
+
+		_, errs := client.GetRecipe("recipe")
+		Expect(errs).To(Equal([]error{compose.ErrCircuitOpen}))
+		Expect(errs[0]).To(MatchError("Compose API unavailable"))
+		Expect(fakeComposeClient.GetRecipeCallCount()).To(Equal(2))
+	})
+
+	It("does not count errors which the API answered with", func() {
+		fakeComposeClient.GetDeploymentByNameReturns(nil, []error{errors.New("deployment not found: test")})
+
+		for i := 0; i < 3; i++ {
+			client.GetDeploymentByName("test")
+		}
+		Expect(client.State()).To(Equal(compose.CircuitClosed))
+	})
+
+	It("resets the count after a success", func() {
+		client.GetRecipe("recipe")
+		fakeComposeClient.GetAccountReturns(&composeapi.Account{}, []error{})
+		client.GetAccount()
+		client.GetRecipe("recipe")
+
+		Expect(client.State()).To(Equal(compose.CircuitClosed))
+	})
+
+	Context("once the cooldown has passed", func() {
+		BeforeEach(func() {
+			client.GetRecipe("recipe")
+			client.GetRecipe("recipe")
+			now = now.Add(time.Minute)
+		})
+
+		It("closes if the probe succeeds", func() {
+			fakeComposeClient.GetRecipeReturns(&composeapi.Recipe{ID: "recipe"}, []error{})
+
+			recipe, errs := client.GetRecipe("recipe")
+			Expect(errs).To(BeEmpty())
+			Expect(recipe.ID).To(Equal("recipe"))
+			Expect(client.State()).To(Equal(compose.CircuitClosed))
+		})
+
+		It("opens again if the probe fails", func() {
+			_, errs := client.GetRecipe("recipe")
+			Expect(errs).To(Equal([]error{unavailable}))
+			Expect(client.State()).To(Equal(compose.CircuitOpen))
+
+			_, errs = client.GetRecipe("recipe")
+			Expect(errs).To(Equal([]error{compose.ErrCircuitOpen}))
+		})
+	})
+})
@@ -1,8 +1,13 @@
 package compose
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	composeapi "github.com/compose/gocomposeapi"
 )
@@ -11,6 +16,7 @@ import (
 type Client interface {
 	GetAccount() (*composeapi.Account, []error)
 	GetClusters() (*[]composeapi.Cluster, []error)
+	GetCluster(string) (*composeapi.Cluster, []error)
 	GetClusterByName(string) (*composeapi.Cluster, []error)
 	CreateDeployment(composeapi.DeploymentParams) (*composeapi.Deployment, []error)
 	DeprovisionDeployment(string) (*composeapi.Recipe, []error)
@@ -20,15 +26,165 @@ type Client interface {
 	CreateDeploymentWhitelist(string, composeapi.DeploymentWhitelistParams) (*composeapi.Recipe, []error)
 	GetWhitelistForDeployment(string) ([]composeapi.DeploymentWhitelist, []error)
 	GetRecipe(string) (*composeapi.Recipe, []error)
+	GetScalings(string) (*composeapi.Scalings, []error)
 	SetScalings(composeapi.ScalingsParams) (*composeapi.Recipe, []error)
 	GetBackupsForDeployment(string) (*[]composeapi.Backup, []error)
+	GetBackupDetailsForDeployment(deploymentid string, backupid string) (*composeapi.Backup, []error)
 	RestoreBackup(composeapi.RestoreBackupParams) (*composeapi.Deployment, []error)
 	PatchDeployment(composeapi.PatchDeploymentParams) (*composeapi.Deployment, []error)
 	StartBackupForDeployment(deploymentid string) (*composeapi.Recipe, []error)
+	GetAuditEvents(composeapi.AuditEventsParams) (*[]composeapi.AuditEvent, []error)
+	GetAuditEvent(string) (*composeapi.AuditEvent, []error)
+	GetAlertsForDeployment(string) (*composeapi.Alerts, []error)
 }
 
+// apiBase is the Compose API that NewClient calls.
+const apiBase = "https://api.compose.io/2016-07/"
+
+// client adapts gocomposeapi to return typed errors. gocomposeapi drops the
+// status code of failed calls, so lookups are made here instead, and a 404
+// is returned as a NotFoundError.
+type client struct {
+	*composeapi.Client
+	apiToken   string
+	apiBase    string
+	httpClient *http.Client
+}
+
+// NewClient returns a client for the Compose API. gocomposeapi's own retries,
+// at a fixed interval and including requests which may have been acted on,
+// are turned off: wrap the client in a RetryingClient instead.
 func NewClient(apiToken string) (Client, error) {
-	return composeapi.NewClient(apiToken)
+	c, err := composeapi.NewClient(apiToken)
+	if err != nil {
+		return nil, err
+	}
+	c.Retries = 0
+	return &client{Client: c, apiToken: apiToken, apiBase: apiBase, httpClient: http.DefaultClient}, nil
+}
+
+// get fetches the resource at endpoint into v. A 404 is a NotFoundError
+// for the resource named id, and other failed responses are Errors with
+// their status code.
+func (c *client) get(endpoint, resource, id string, v interface{}) []error {
+	req, err := http.NewRequest("GET", c.apiBase+endpoint, nil)
+	if err != nil {
+		return []error{err}
+	}
+	req.Header.Set("Authorization", "Bearer "+c.apiToken)
+	req.Header.Set("Content-type", "application/json; charset=utf-8")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return []error{err}
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return []error{err}
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return []error{&NotFoundError{Resource: resource, Name: id}}
+	case resp.StatusCode != http.StatusOK:
+		e := &Error{
+			StatusCode: resp.StatusCode,
+			Body:       SquashErrors(composeapi.ProcessErrors(resp.StatusCode, string(body))).Error(),
+			Retryable:  retryableStatus(resp.StatusCode),
+		}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			e.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		return []error{e}
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return []error{fmt.Errorf("malformed response from Compose for %s %s: %s", resource, id, err)}
+	}
+	return nil
+}
+
+func (c *client) GetCluster(clusterID string) (*composeapi.Cluster, []error) {
+	cluster := &composeapi.Cluster{}
+	if errs := c.get("clusters/"+clusterID, "cluster", clusterID, cluster); len(errs) > 0 {
+		return nil, errs
+	}
+	return cluster, nil
+}
+
+func (c *client) GetClusterByName(name string) (*composeapi.Cluster, []error) {
+	clusters, errs := c.Client.GetClusters()
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	for _, cluster := range *clusters {
+		if cluster.Name == name {
+			return &cluster, nil
+		}
+	}
+	return nil, []error{&NotFoundError{Resource: "cluster", Name: name}}
+}
+
+func (c *client) GetDeployment(deploymentID string) (*composeapi.Deployment, []error) {
+	deployment := &composeapi.Deployment{}
+	if errs := c.get("deployments/"+deploymentID, "deployment", deploymentID, deployment); len(errs) > 0 {
+		return nil, errs
+	}
+	return deployment, nil
+}
+
+func (c *client) GetDeploymentByName(name string) (*composeapi.Deployment, []error) {
+	deployments, errs := c.Client.GetDeployments()
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	for _, deployment := range *deployments {
+		if deployment.Name == name {
+			return c.GetDeployment(deployment.ID)
+		}
+	}
+	return nil, []error{&NotFoundError{Resource: "deployment", Name: name}}
+}
+
+func (c *client) GetRecipe(recipeID string) (*composeapi.Recipe, []error) {
+	recipe := &composeapi.Recipe{}
+	if errs := c.get("recipes/"+recipeID, "recipe", recipeID, recipe); len(errs) > 0 {
+		return nil, errs
+	}
+	return recipe, nil
+}
+
+func (c *client) GetScalings(deploymentID string) (*composeapi.Scalings, []error) {
+	scalings := &composeapi.Scalings{}
+	if errs := c.get("deployments/"+deploymentID+"/scalings", "deployment", deploymentID, scalings); len(errs) > 0 {
+		return nil, errs
+	}
+	return scalings, nil
+}
+
+func (c *client) GetBackupDetailsForDeployment(deploymentID, backupID string) (*composeapi.Backup, []error) {
+	backup := &composeapi.Backup{}
+	if errs := c.get("deployments/"+deploymentID+"/backups/"+backupID, "backup", backupID, backup); len(errs) > 0 {
+		return nil, errs
+	}
+	return backup, nil
+}
+
+func (c *client) GetAuditEvent(id string) (*composeapi.AuditEvent, []error) {
+	event := &composeapi.AuditEvent{}
+	if errs := c.get("audit_events/"+id, "audit event", id, event); len(errs) > 0 {
+		return nil, errs
+	}
+	return event, nil
+}
+
+func (c *client) GetAlertsForDeployment(deploymentID string) (*composeapi.Alerts, []error) {
+	alerts := &composeapi.Alerts{}
+	if errs := c.get("deployments/"+deploymentID+"/alerts", "deployment", deploymentID, alerts); len(errs) > 0 {
+		return nil, errs
+	}
+	return alerts, nil
 }
 
 func SquashErrors(errs []error) error {
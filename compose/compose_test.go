@@ -2,6 +2,9 @@ package compose
 
 import (
 	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -18,3 +21,77 @@ var _ = Describe("Compose", func() {
 		})
 	})
 })
+
+var _ = Describe("client", func() {
+	var (
+		server *httptest.Server
+		status int
+		header http.Header
+		body   string
+		paths  []string
+		c      *client
+	)
+
+	BeforeEach(func() {
+		status = http.StatusOK
+		header = http.Header{}
+		body = `{}`
+		paths = nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			Expect(req.Header.Get("Authorization")).To(Equal("Bearer token"))
+			paths = append(paths, req.URL.Path)
+			for name, values := range header {
+				w.Header()[name] = values
+			}
+			w.WriteHeader(status)
+			w.Write([]byte(body))
+		}))
+		c = &client{apiToken: "token", apiBase: server.URL + "/", httpClient: http.DefaultClient}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("looks resources up", func() {
+		body = `{"id":"d1","name":"test-one"}`
+
+		deployment, errs := c.GetDeployment("d1")
+		Expect(errs).To(BeEmpty())
+		Expect(deployment.Name).To(Equal("test-one"))
+		Expect(paths).To(Equal([]string{"/deployments/d1"}))
+	})
+
+	It("returns a NotFoundError when the API responds 404", func() {
+		status = http.StatusNotFound
+		body = `{"errors":"Not Found"}`
+
+		_, errs := c.GetRecipe("r1")
+		Expect(errs).To(HaveLen(1))
+		Expect(IsNotFound(errs[0])).To(BeTrue())
+		Expect(errs[0]).To(MatchError("recipe not found: r1"))
+	})
+
+	It("does not take an error which mentions something not found for a missing resource", func() {
+		status = http.StatusUnprocessableEntity
+		body = `{"errors":"recipe not found for field deployment_id"}`
+
+		_, errs := c.GetRecipe("r1")
+		Expect(errs).To(HaveLen(1))
+		Expect(IsNotFound(errs[0])).To(BeFalse())
+		Expect(*AsError(errs[0])).To(Equal(Error{StatusCode: 422, Body: "recipe not found for field deployment_id"}))
+	})
+
+	It("keeps the status code and retry delay of other failures", func() {
+		status = http.StatusServiceUnavailable
+		header.Set("Retry-After", "7")
+		body = `<html>down</html>`
+
+		_, errs := c.GetScalings("d1")
+		Expect(errs).To(HaveLen(1))
+		err := AsError(errs[0])
+		Expect(err.StatusCode).To(Equal(503))
+		Expect(err.Retryable).To(BeTrue())
+		Expect(err.RetryAfter).To(Equal(7 * time.Second))
+	})
+})
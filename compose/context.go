@@ -0,0 +1,360 @@
+package compose
+
+import (
+	"context"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagerctx"
+	composeapi "github.com/compose/gocomposeapi"
+
+	"github.com/alphagov/paas-compose-broker/tracing"
+)
+
+// WithContext binds a Client to ctx: calls fail with ctx.Err() once it is
+// done, and a read in flight when it is done returns immediately.
+// gocomposeapi cannot cancel an HTTP request, so an abandoned read still
+// completes in the background and its result is discarded, but it is not
+// retried. A call which creates or changes a resource is waited for once
+// started, so that the caller learns of what it did, such as the recipe it
+// started or the deployment it created.
+func WithContext(ctx context.Context, client Client) Client {
+	return &contextClient{ctx: ctx, client: bind(ctx, client)}
+}
+
+// binder is implemented by the decorators which wait between calls, so that
+// they stop waiting once the caller's context is done.
+type binder interface {
+	bind(ctx context.Context) Client
+}
+
+func bind(ctx context.Context, client Client) Client {
+	if b, ok := client.(binder); ok {
+		return b.bind(ctx)
+	}
+	return client
+}
+
+type contextClient struct {
+	ctx    context.Context
+	client Client
+}
+
+// mutating lists the client methods which create or change resources.
+var mutating = map[string]bool{
+	"CreateDeployment":          true,
+	"DeprovisionDeployment":     true,
+	"CreateDeploymentWhitelist": true,
+	"SetScalings":               true,
+	"RestoreBackup":             true,
+	"PatchDeployment":           true,
+	"StartBackupForDeployment":  true,
+}
+
+// do returns ctx.Err() if ctx is done before a read completes. Results
+// assigned by call must not be read when errors are returned, as an
+// abandoned call may still be writing them. Each call is logged with the
+// logger in ctx, if there is one, so that it carries the request's data,
+// and traced under the span in ctx.
+func (c *contextClient) do(method string, call func() []error) []error {
+	if err := c.ctx.Err(); err != nil {
+		return []error{err}
+	}
+	_, span := tracing.StartSpan(c.ctx, "compose."+method, tracing.KindClient, map[string]string{
+		"peer.service": "compose",
+	})
+	start := time.Now()
+	var errs []error
+	if mutating[method] {
+		errs = call()
+	} else {
+		done := make(chan []error, 1)
+		go func() {
+			done <- call()
+		}()
+		select {
+		case errs = <-done:
+		case <-c.ctx.Done():
+			errs = []error{c.ctx.Err()}
+		}
+	}
+
+	data := lager.Data{
+		"method":      method,
+		"duration-ms": time.Since(start).Nanoseconds() / int64(time.Millisecond),
+	}
+	if len(errs) > 0 {
+		data["error"] = SquashErrors(errs).Error()
+	}
+	lagerctx.FromContext(c.ctx).Debug("compose-call", data)
+	if len(errs) > 0 {
+		span.Finish(SquashErrors(errs))
+	} else {
+		span.Finish(nil)
+	}
+	return errs
+}
+
+func (c *contextClient) GetAccount() (*composeapi.Account, []error) {
+	var account *composeapi.Account
+	errs := c.do("GetAccount", func() (errs []error) {
+		account, errs = c.client.GetAccount()
+		return errs
+	})
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return account, nil
+}
+
+func (c *contextClient) GetClusters() (*[]composeapi.Cluster, []error) {
+	var clusters *[]composeapi.Cluster
+	errs := c.do("GetClusters", func() (errs []error) {
+		clusters, errs = c.client.GetClusters()
+		return errs
+	})
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return clusters, nil
+}
+
+func (c *contextClient) GetCluster(clusterID string) (*composeapi.Cluster, []error) {
+	var cluster *composeapi.Cluster
+	errs := c.do("GetCluster", func() (errs []error) {
+		cluster, errs = c.client.GetCluster(clusterID)
+		return errs
+	})
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return cluster, nil
+}
+
+func (c *contextClient) GetClusterByName(name string) (*composeapi.Cluster, []error) {
+	var cluster *composeapi.Cluster
+	errs := c.do("GetClusterByName", func() (errs []error) {
+		cluster, errs = c.client.GetClusterByName(name)
+		return errs
+	})
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return cluster, nil
+}
+
+func (c *contextClient) CreateDeployment(params composeapi.DeploymentParams) (*composeapi.Deployment, []error) {
+	var deployment *composeapi.Deployment
+	errs := c.do("CreateDeployment", func() (errs []error) {
+		deployment, errs = c.client.CreateDeployment(params)
+		return errs
+	})
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return deployment, nil
+}
+
+func (c *contextClient) DeprovisionDeployment(deploymentID string) (*composeapi.Recipe, []error) {
+	var recipe *composeapi.Recipe
+	errs := c.do("DeprovisionDeployment", func() (errs []error) {
+		recipe, errs = c.client.DeprovisionDeployment(deploymentID)
+		return errs
+	})
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return recipe, nil
+}
+
+func (c *contextClient) GetDeployment(deploymentID string) (*composeapi.Deployment, []error) {
+	var deployment *composeapi.Deployment
+	errs := c.do("GetDeployment", func() (errs []error) {
+		deployment, errs = c.client.GetDeployment(deploymentID)
+		return errs
+	})
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return deployment, nil
+}
+
+func (c *contextClient) GetDeploymentByName(name string) (*composeapi.Deployment, []error) {
+	var deployment *composeapi.Deployment
+	errs := c.do("GetDeploymentByName", func() (errs []error) {
+		deployment, errs = c.client.GetDeploymentByName(name)
+		return errs
+	})
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return deployment, nil
+}
+
+func (c *contextClient) GetDeployments() (*[]composeapi.Deployment, []error) {
+	var deployments *[]composeapi.Deployment
+	errs := c.do("GetDeployments", func() (errs []error) {
+		deployments, errs = c.client.GetDeployments()
+		return errs
+	})
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return deployments, nil
+}
+
+func (c *contextClient) CreateDeploymentWhitelist(deploymentID string, params composeapi.DeploymentWhitelistParams) (*composeapi.Recipe, []error) {
+	var recipe *composeapi.Recipe
+	errs := c.do("CreateDeploymentWhitelist", func() (errs []error) {
+		recipe, errs = c.client.CreateDeploymentWhitelist(deploymentID, params)
+		return errs
+	})
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return recipe, nil
+}
+
+func (c *contextClient) GetWhitelistForDeployment(deploymentID string) ([]composeapi.DeploymentWhitelist, []error) {
+	var whitelist []composeapi.DeploymentWhitelist
+	errs := c.do("GetWhitelistForDeployment", func() (errs []error) {
+		whitelist, errs = c.client.GetWhitelistForDeployment(deploymentID)
+		return errs
+	})
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return whitelist, nil
+}
+
+func (c *contextClient) GetRecipe(recipeID string) (*composeapi.Recipe, []error) {
+	var recipe *composeapi.Recipe
+	errs := c.do("GetRecipe", func() (errs []error) {
+		recipe, errs = c.client.GetRecipe(recipeID)
+		return errs
+	})
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return recipe, nil
+}
+
+func (c *contextClient) GetScalings(deploymentID string) (*composeapi.Scalings, []error) {
+	var scalings *composeapi.Scalings
+	errs := c.do("GetScalings", func() (errs []error) {
+		scalings, errs = c.client.GetScalings(deploymentID)
+		return errs
+	})
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return scalings, nil
+}
+
+func (c *contextClient) SetScalings(params composeapi.ScalingsParams) (*composeapi.Recipe, []error) {
+	var recipe *composeapi.Recipe
+	errs := c.do("SetScalings", func() (errs []error) {
+		recipe, errs = c.client.SetScalings(params)
+		return errs
+	})
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return recipe, nil
+}
+
+func (c *contextClient) GetBackupsForDeployment(deploymentID string) (*[]composeapi.Backup, []error) {
+	var backups *[]composeapi.Backup
+	errs := c.do("GetBackupsForDeployment", func() (errs []error) {
+		backups, errs = c.client.GetBackupsForDeployment(deploymentID)
+		return errs
+	})
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return backups, nil
+}
+
+func (c *contextClient) RestoreBackup(params composeapi.RestoreBackupParams) (*composeapi.Deployment, []error) {
+	var deployment *composeapi.Deployment
+	errs := c.do("RestoreBackup", func() (errs []error) {
+		deployment, errs = c.client.RestoreBackup(params)
+		return errs
+	})
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return deployment, nil
+}
+
+func (c *contextClient) GetBackupDetailsForDeployment(deploymentID, backupID string) (*composeapi.Backup, []error) {
+	var backup *composeapi.Backup
+	errs := c.do("GetBackupDetailsForDeployment", func() (errs []error) {
+		backup, errs = c.client.GetBackupDetailsForDeployment(deploymentID, backupID)
+		return errs
+	})
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return backup, nil
+}
+
+func (c *contextClient) PatchDeployment(params composeapi.PatchDeploymentParams) (*composeapi.Deployment, []error) {
+	var deployment *composeapi.Deployment
+	errs := c.do("PatchDeployment", func() (errs []error) {
+		deployment, errs = c.client.PatchDeployment(params)
+		return errs
+	})
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return deployment, nil
+}
+
+func (c *contextClient) StartBackupForDeployment(deploymentID string) (*composeapi.Recipe, []error) {
+	var recipe *composeapi.Recipe
+	errs := c.do("StartBackupForDeployment", func() (errs []error) {
+		recipe, errs = c.client.StartBackupForDeployment(deploymentID)
+		return errs
+	})
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return recipe, nil
+}
+
+func (c *contextClient) GetAuditEvents(params composeapi.AuditEventsParams) (*[]composeapi.AuditEvent, []error) {
+	var events *[]composeapi.AuditEvent
+	errs := c.do("GetAuditEvents", func() (errs []error) {
+		events, errs = c.client.GetAuditEvents(params)
+		return errs
+	})
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return events, nil
+}
+
+func (c *contextClient) GetAuditEvent(id string) (*composeapi.AuditEvent, []error) {
+	var event *composeapi.AuditEvent
+	errs := c.do("GetAuditEvent", func() (errs []error) {
+		event, errs = c.client.GetAuditEvent(id)
+		return errs
+	})
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return event, nil
+}
+
+func (c *contextClient) GetAlertsForDeployment(deploymentID string) (*composeapi.Alerts, []error) {
+	var alerts *composeapi.Alerts
+	errs := c.do("GetAlertsForDeployment", func() (errs []error) {
+		alerts, errs = c.client.GetAlertsForDeployment(deploymentID)
+		return errs
+	})
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return alerts, nil
+}
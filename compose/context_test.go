@@ -0,0 +1,115 @@
+package compose_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	composeapi "github.com/compose/gocomposeapi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/paas-compose-broker/compose"
+	"github.com/alphagov/paas-compose-broker/compose/fakes"
+	"github.com/alphagov/paas-compose-broker/tracing"
+)
+
+var _ = Describe("WithContext", func() {
+
+	var fakeComposeClient *fakes.FakeClient
+
+	BeforeEach(func() {
+		fakeComposeClient = &fakes.FakeClient{}
+	})
+
+	It("passes calls through while the context is live", func() {
+		fakeComposeClient.GetRecipeReturns(&composeapi.Recipe{ID: "recipe"}, nil)
+		client := compose.WithContext(context.Background(), fakeComposeClient)
+
+		recipe, errs := client.GetRecipe("recipe")
+		Expect(errs).To(BeEmpty())
+		Expect(recipe.ID).To(Equal("recipe"))
+		Expect(fakeComposeClient.GetRecipeArgsForCall(0)).To(Equal("recipe"))
+	})
+
+	It("returns the errors of a failed call", func() {
+		fakeComposeClient.GetRecipeReturns(nil, []error{errors.New("boom")})
+		client := compose.WithContext(context.Background(), fakeComposeClient)
+
+		_, errs := client.GetRecipe("recipe")
+		Expect(errs).To(Equal([]error{errors.New("boom")}))
+	})
+
+	It("does not call the API once the context is done", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		client := compose.WithContext(ctx, fakeComposeClient)
+
+		recipe, errs := client.GetRecipe("recipe")
+		Expect(recipe).To(BeNil())
+		Expect(errs).To(Equal([]error{context.Canceled}))
+		Expect(fakeComposeClient.GetRecipeCallCount()).To(Equal(0))
+	})
+
+	It("abandons a call in flight when the context is cancelled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		release := make(chan struct{})
+		defer close(release)
+		fakeComposeClient.GetRecipeStub = func(string) (*composeapi.Recipe, []error) {
+			cancel()
+			<-release
+			return &composeapi.Recipe{}, nil
+		}
+		client := compose.WithContext(ctx, fakeComposeClient)
+
+		recipe, errs := client.GetRecipe("recipe")
+		Expect(recipe).To(BeNil())
+		Expect(errs).To(Equal([]error{context.Canceled}))
+	})
+
+	It("waits for a call which changes a resource, even once the context is cancelled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		fakeComposeClient.DeprovisionDeploymentStub = func(string) (*composeapi.Recipe, []error) {
+			cancel()
+			time.Sleep(10 * time.Millisecond)
+			return &composeapi.Recipe{ID: "recipe"}, nil
+		}
+		client := compose.WithContext(ctx, fakeComposeClient)
+
+		recipe, errs := client.DeprovisionDeployment("d1")
+		Expect(errs).To(BeEmpty())
+		Expect(recipe.ID).To(Equal("recipe"))
+	})
+
+	It("traces each call under the request's span", func() {
+		var body []byte
+		collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ = ioutil.ReadAll(r.Body)
+		}))
+		defer collector.Close()
+		tracer := tracing.NewTracer("compose-broker", collector.URL, tracing.FormatZipkin, lagertest.NewTestLogger("tracing"))
+		fakeComposeClient.GetRecipeReturns(nil, []error{errors.New("boom")})
+
+		tracer.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			compose.WithContext(r.Context(), fakeComposeClient).GetRecipe("recipe")
+		})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v2/catalog", nil))
+		Expect(tracer.Flush()).To(Succeed())
+
+		var spans []struct {
+			ID       string            `json:"id"`
+			ParentID string            `json:"parentId"`
+			Name     string            `json:"name"`
+			Tags     map[string]string `json:"tags"`
+		}
+		Expect(json.Unmarshal(body, &spans)).To(Succeed())
+		Expect(spans).To(HaveLen(2))
+		Expect(spans[0].Name).To(Equal("compose.GetRecipe"))
+		Expect(spans[0].ParentID).To(Equal(spans[1].ID))
+		Expect(spans[0].Tags).To(HaveKeyWithValue("error", "boom"))
+	})
+})
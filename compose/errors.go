@@ -0,0 +1,140 @@
+package compose
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error is a failed call to the Compose API. The client's lookups keep the
+// HTTP status, but gocomposeapi discards it for other calls, so there
+// StatusCode is recovered from the error text where it has been included
+// and otherwise inferred from the shape of the Compose error body.
+// It is zero when unknown, e.g. for network failures. RetryAfter is how long
+// the API asked the client to wait, as given in the error, or zero.
+type Error struct {
+	StatusCode int
+	Body       string
+	Retryable  bool
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return e.Body
+}
+
+// NotFoundError is returned by the client when the Compose API has no
+// resource of that name or ID. It is the only way a missing resource is
+// recognised: Compose error text mentioning something "not found" may be
+// about a field of a request.
+type NotFoundError struct {
+	Resource string
+	Name     string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s not found: %s", e.Resource, e.Name)
+}
+
+func IsNotFound(err error) bool {
+	switch err := err.(type) {
+	case *NotFoundError:
+		return true
+	case *Error:
+		return err.StatusCode == 404
+	}
+	return false
+}
+
+var (
+	// gocomposeapi's error when the body was not JSON.
+	unparsedErrorPattern = regexp.MustCompile(`^Unable to parse error - status code (\d{3}) - body (?s:(.*))$`)
+	// gocomposeapi's error when the body held a map of field errors, which
+	// Compose returns for requests it cannot process.
+	fieldErrorsPattern = regexp.MustCompile(`^map\[.*\]$`)
+	// How long a rate limited client should wait, as Compose puts it in
+	// the body of a 429 and a proxy may in a Retry-After header copied into
+	// the error.
+	retryAfterPattern = regexp.MustCompile(`(?i)retry[- _]after\W{0,3}(\d+)`)
+)
+
+func retryableStatus(code int) bool {
+	switch code {
+	case 408, 429, 500, 502, 503, 504:
+		return true
+	}
+	return false
+}
+
+// AsError classifies an error returned by a Client.
+func AsError(err error) *Error {
+	switch e := err.(type) {
+	case *Error:
+		return e
+	case *NotFoundError:
+		return &Error{StatusCode: 404, Body: e.Error()}
+	}
+	if err == ErrCircuitOpen {
+		return &Error{StatusCode: 503, Body: err.Error()}
+	}
+
+	e := &Error{Body: err.Error()}
+	if r, ok := err.(retryAfter); ok {
+		e.RetryAfter = r.RetryAfter()
+	} else if match := retryAfterPattern.FindStringSubmatch(e.Body); match != nil {
+		seconds, _ := strconv.Atoi(match[1])
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	lower := strings.ToLower(e.Body)
+	if match := unparsedErrorPattern.FindStringSubmatch(e.Body); match != nil {
+		e.StatusCode, _ = strconv.Atoi(match[1])
+		e.Body = match[2]
+	} else if strings.Contains(lower, "too many requests") || strings.Contains(lower, "rate limit") {
+		e.StatusCode = 429
+	} else if fieldErrorsPattern.MatchString(e.Body) {
+		e.StatusCode = 422
+	}
+
+	if e.StatusCode != 0 {
+		e.Retryable = retryableStatus(e.StatusCode)
+		return e
+	}
+
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if netErr, ok := err.(net.Error); ok {
+		e.Retryable = netErr.Timeout() || netErr.Temporary() || isConnectionRefused(err)
+	}
+	return e
+}
+
+// NewError combines the errors from a failed call into one Error, taking the
+// status of the first.
+func NewError(errs []error) *Error {
+	if len(errs) == 0 {
+		return nil
+	}
+	e := *AsError(errs[0])
+	for _, err := range errs[1:] {
+		other := AsError(err)
+		e.Body += "; " + other.Body
+		e.Retryable = e.Retryable && other.Retryable
+		if other.RetryAfter > e.RetryAfter {
+			e.RetryAfter = other.RetryAfter
+		}
+	}
+	return &e
+}
+
+func isConnectionRefused(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
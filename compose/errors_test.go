@@ -0,0 +1,76 @@
+package compose_test
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/paas-compose-broker/compose"
+)
+
+var _ = Describe("Error", func() {
+
+	It("recovers the status code of an unparsed body", func() {
+		err := compose.AsError(errors.New("Unable to parse error - status code 503 - body <html>down</html>"))
+		Expect(*err).To(Equal(compose.Error{StatusCode: 503, Body: "<html>down</html>", Retryable: true}))
+
+		err = compose.AsError(errors.New("Unable to parse error - status code 401 - body denied"))
+		Expect(*err).To(Equal(compose.Error{StatusCode: 401, Body: "denied"}))
+	})
+
+	It("infers 422 from field errors", func() {
+		err := compose.AsError(errors.New("map[units:[must be greater than 0]]"))
+		Expect(*err).To(Equal(compose.Error{StatusCode: 422, Body: "map[units:[must be greater than 0]]"}))
+	})
+
+	It("infers 404 from missing resources", func() {
+		err := compose.AsError(&compose.NotFoundError{Resource: "deployment", Name: "test"})
+		Expect(*err).To(Equal(compose.Error{StatusCode: 404, Body: "deployment not found: test"}))
+	})
+
+	It("does not infer 404 from error text", func() {
+		err := compose.AsError(errors.New("recipe not found for field deployment_id"))
+		Expect(*err).To(Equal(compose.Error{Body: "recipe not found for field deployment_id"}))
+	})
+
+	It("infers 429 from rate limiting", func() {
+		err := compose.AsError(errors.New("Rate limit exceeded"))
+		Expect(*err).To(Equal(compose.Error{StatusCode: 429, Body: "Rate limit exceeded", Retryable: true}))
+	})
+
+	It("reads how long to wait from a rate limited response", func() {
+		err := compose.AsError(errors.New(`Unable to parse error - status code 429 - body {"error": "Too many requests, retry after 7 seconds"}`))
+		Expect(err.StatusCode).To(Equal(429))
+		Expect(err.RetryAfter).To(Equal(7 * time.Second))
+	})
+
+	It("retries refused connections", func() {
+		err := compose.AsError(&url.Error{Op: "Get", URL: "https://api.compose.io", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}})
+		Expect(err.StatusCode).To(Equal(0))
+		Expect(err.Retryable).To(BeTrue())
+	})
+
+	It("leaves anything else unclassified", func() {
+		err := compose.AsError(errors.New("computer says no"))
+		Expect(*err).To(Equal(compose.Error{Body: "computer says no"}))
+	})
+
+	It("combines several errors, keeping the status of the first", func() {
+		err := compose.NewError([]error{
+			errors.New("Unable to parse error - status code 502 - body bad gateway"),
+			errors.New("computer says no"),
+		})
+		Expect(err.StatusCode).To(Equal(502))
+		Expect(err.Retryable).To(BeFalse())
+		Expect(err).To(MatchError("bad gateway; computer says no"))
+	})
+
+	It("treats 404s as not found", func() {
+		Expect(compose.IsNotFound(&compose.Error{StatusCode: 404})).To(BeTrue())
+		Expect(compose.IsNotFound(&compose.Error{StatusCode: 410})).To(BeFalse())
+	})
+})
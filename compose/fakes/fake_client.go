@@ -31,6 +31,19 @@ type FakeClient struct {
 		result1 *[]composeapi.Cluster
 		result2 []error
 	}
+	GetClusterStub        func(string) (*composeapi.Cluster, []error)
+	getClusterMutex       sync.RWMutex
+	getClusterArgsForCall []struct {
+		arg1 string
+	}
+	getClusterReturns struct {
+		result1 *composeapi.Cluster
+		result2 []error
+	}
+	getClusterReturnsOnCall map[int]struct {
+		result1 *composeapi.Cluster
+		result2 []error
+	}
 	GetClusterByNameStub        func(string) (*composeapi.Cluster, []error)
 	getClusterByNameMutex       sync.RWMutex
 	getClusterByNameArgsForCall []struct {
@@ -147,6 +160,19 @@ type FakeClient struct {
 		result1 *composeapi.Recipe
 		result2 []error
 	}
+	GetScalingsStub        func(string) (*composeapi.Scalings, []error)
+	getScalingsMutex       sync.RWMutex
+	getScalingsArgsForCall []struct {
+		arg1 string
+	}
+	getScalingsReturns struct {
+		result1 *composeapi.Scalings
+		result2 []error
+	}
+	getScalingsReturnsOnCall map[int]struct {
+		result1 *composeapi.Scalings
+		result2 []error
+	}
 	SetScalingsStub        func(composeapi.ScalingsParams) (*composeapi.Recipe, []error)
 	setScalingsMutex       sync.RWMutex
 	setScalingsArgsForCall []struct {
@@ -173,6 +199,20 @@ type FakeClient struct {
 		result1 *[]composeapi.Backup
 		result2 []error
 	}
+	GetBackupDetailsForDeploymentStub        func(deploymentid string, backupid string) (*composeapi.Backup, []error)
+	getBackupDetailsForDeploymentMutex       sync.RWMutex
+	getBackupDetailsForDeploymentArgsForCall []struct {
+		deploymentid string
+		backupid     string
+	}
+	getBackupDetailsForDeploymentReturns struct {
+		result1 *composeapi.Backup
+		result2 []error
+	}
+	getBackupDetailsForDeploymentReturnsOnCall map[int]struct {
+		result1 *composeapi.Backup
+		result2 []error
+	}
 	RestoreBackupStub        func(composeapi.RestoreBackupParams) (*composeapi.Deployment, []error)
 	restoreBackupMutex       sync.RWMutex
 	restoreBackupArgsForCall []struct {
@@ -212,6 +252,45 @@ type FakeClient struct {
 		result1 *composeapi.Recipe
 		result2 []error
 	}
+	GetAuditEventsStub        func(composeapi.AuditEventsParams) (*[]composeapi.AuditEvent, []error)
+	getAuditEventsMutex       sync.RWMutex
+	getAuditEventsArgsForCall []struct {
+		arg1 composeapi.AuditEventsParams
+	}
+	getAuditEventsReturns struct {
+		result1 *[]composeapi.AuditEvent
+		result2 []error
+	}
+	getAuditEventsReturnsOnCall map[int]struct {
+		result1 *[]composeapi.AuditEvent
+		result2 []error
+	}
+	GetAuditEventStub        func(string) (*composeapi.AuditEvent, []error)
+	getAuditEventMutex       sync.RWMutex
+	getAuditEventArgsForCall []struct {
+		arg1 string
+	}
+	getAuditEventReturns struct {
+		result1 *composeapi.AuditEvent
+		result2 []error
+	}
+	getAuditEventReturnsOnCall map[int]struct {
+		result1 *composeapi.AuditEvent
+		result2 []error
+	}
+	GetAlertsForDeploymentStub        func(string) (*composeapi.Alerts, []error)
+	getAlertsForDeploymentMutex       sync.RWMutex
+	getAlertsForDeploymentArgsForCall []struct {
+		arg1 string
+	}
+	getAlertsForDeploymentReturns struct {
+		result1 *composeapi.Alerts
+		result2 []error
+	}
+	getAlertsForDeploymentReturnsOnCall map[int]struct {
+		result1 *composeapi.Alerts
+		result2 []error
+	}
 	invocations      map[string][][]interface{}
 	invocationsMutex sync.RWMutex
 }
@@ -302,6 +381,57 @@ func (fake *FakeClient) GetClustersReturnsOnCall(i int, result1 *[]composeapi.Cl
 	}{result1, result2}
 }
 
+func (fake *FakeClient) GetCluster(arg1 string) (*composeapi.Cluster, []error) {
+	fake.getClusterMutex.Lock()
+	ret, specificReturn := fake.getClusterReturnsOnCall[len(fake.getClusterArgsForCall)]
+	fake.getClusterArgsForCall = append(fake.getClusterArgsForCall, struct {
+		arg1 string
+	}{arg1})
+	fake.recordInvocation("GetCluster", []interface{}{arg1})
+	fake.getClusterMutex.Unlock()
+	if fake.GetClusterStub != nil {
+		return fake.GetClusterStub(arg1)
+	}
+	if specificReturn {
+		return ret.result1, ret.result2
+	}
+	return fake.getClusterReturns.result1, fake.getClusterReturns.result2
+}
+
+func (fake *FakeClient) GetClusterCallCount() int {
+	fake.getClusterMutex.RLock()
+	defer fake.getClusterMutex.RUnlock()
+	return len(fake.getClusterArgsForCall)
+}
+
+func (fake *FakeClient) GetClusterArgsForCall(i int) string {
+	fake.getClusterMutex.RLock()
+	defer fake.getClusterMutex.RUnlock()
+	return fake.getClusterArgsForCall[i].arg1
+}
+
+func (fake *FakeClient) GetClusterReturns(result1 *composeapi.Cluster, result2 []error) {
+	fake.GetClusterStub = nil
+	fake.getClusterReturns = struct {
+		result1 *composeapi.Cluster
+		result2 []error
+	}{result1, result2}
+}
+
+func (fake *FakeClient) GetClusterReturnsOnCall(i int, result1 *composeapi.Cluster, result2 []error) {
+	fake.GetClusterStub = nil
+	if fake.getClusterReturnsOnCall == nil {
+		fake.getClusterReturnsOnCall = make(map[int]struct {
+			result1 *composeapi.Cluster
+			result2 []error
+		})
+	}
+	fake.getClusterReturnsOnCall[i] = struct {
+		result1 *composeapi.Cluster
+		result2 []error
+	}{result1, result2}
+}
+
 func (fake *FakeClient) GetClusterByName(arg1 string) (*composeapi.Cluster, []error) {
 	fake.getClusterByNameMutex.Lock()
 	ret, specificReturn := fake.getClusterByNameReturnsOnCall[len(fake.getClusterByNameArgsForCall)]
@@ -754,6 +884,57 @@ func (fake *FakeClient) GetRecipeReturnsOnCall(i int, result1 *composeapi.Recipe
 	}{result1, result2}
 }
 
+func (fake *FakeClient) GetScalings(arg1 string) (*composeapi.Scalings, []error) {
+	fake.getScalingsMutex.Lock()
+	ret, specificReturn := fake.getScalingsReturnsOnCall[len(fake.getScalingsArgsForCall)]
+	fake.getScalingsArgsForCall = append(fake.getScalingsArgsForCall, struct {
+		arg1 string
+	}{arg1})
+	fake.recordInvocation("GetScalings", []interface{}{arg1})
+	fake.getScalingsMutex.Unlock()
+	if fake.GetScalingsStub != nil {
+		return fake.GetScalingsStub(arg1)
+	}
+	if specificReturn {
+		return ret.result1, ret.result2
+	}
+	return fake.getScalingsReturns.result1, fake.getScalingsReturns.result2
+}
+
+func (fake *FakeClient) GetScalingsCallCount() int {
+	fake.getScalingsMutex.RLock()
+	defer fake.getScalingsMutex.RUnlock()
+	return len(fake.getScalingsArgsForCall)
+}
+
+func (fake *FakeClient) GetScalingsArgsForCall(i int) string {
+	fake.getScalingsMutex.RLock()
+	defer fake.getScalingsMutex.RUnlock()
+	return fake.getScalingsArgsForCall[i].arg1
+}
+
+func (fake *FakeClient) GetScalingsReturns(result1 *composeapi.Scalings, result2 []error) {
+	fake.GetScalingsStub = nil
+	fake.getScalingsReturns = struct {
+		result1 *composeapi.Scalings
+		result2 []error
+	}{result1, result2}
+}
+
+func (fake *FakeClient) GetScalingsReturnsOnCall(i int, result1 *composeapi.Scalings, result2 []error) {
+	fake.GetScalingsStub = nil
+	if fake.getScalingsReturnsOnCall == nil {
+		fake.getScalingsReturnsOnCall = make(map[int]struct {
+			result1 *composeapi.Scalings
+			result2 []error
+		})
+	}
+	fake.getScalingsReturnsOnCall[i] = struct {
+		result1 *composeapi.Scalings
+		result2 []error
+	}{result1, result2}
+}
+
 func (fake *FakeClient) SetScalings(arg1 composeapi.ScalingsParams) (*composeapi.Recipe, []error) {
 	fake.setScalingsMutex.Lock()
 	ret, specificReturn := fake.setScalingsReturnsOnCall[len(fake.setScalingsArgsForCall)]
@@ -856,6 +1037,58 @@ func (fake *FakeClient) GetBackupsForDeploymentReturnsOnCall(i int, result1 *[]c
 	}{result1, result2}
 }
 
+func (fake *FakeClient) GetBackupDetailsForDeployment(deploymentid string, backupid string) (*composeapi.Backup, []error) {
+	fake.getBackupDetailsForDeploymentMutex.Lock()
+	ret, specificReturn := fake.getBackupDetailsForDeploymentReturnsOnCall[len(fake.getBackupDetailsForDeploymentArgsForCall)]
+	fake.getBackupDetailsForDeploymentArgsForCall = append(fake.getBackupDetailsForDeploymentArgsForCall, struct {
+		deploymentid string
+		backupid     string
+	}{deploymentid, backupid})
+	fake.recordInvocation("GetBackupDetailsForDeployment", []interface{}{deploymentid, backupid})
+	fake.getBackupDetailsForDeploymentMutex.Unlock()
+	if fake.GetBackupDetailsForDeploymentStub != nil {
+		return fake.GetBackupDetailsForDeploymentStub(deploymentid, backupid)
+	}
+	if specificReturn {
+		return ret.result1, ret.result2
+	}
+	return fake.getBackupDetailsForDeploymentReturns.result1, fake.getBackupDetailsForDeploymentReturns.result2
+}
+
+func (fake *FakeClient) GetBackupDetailsForDeploymentCallCount() int {
+	fake.getBackupDetailsForDeploymentMutex.RLock()
+	defer fake.getBackupDetailsForDeploymentMutex.RUnlock()
+	return len(fake.getBackupDetailsForDeploymentArgsForCall)
+}
+
+func (fake *FakeClient) GetBackupDetailsForDeploymentArgsForCall(i int) (string, string) {
+	fake.getBackupDetailsForDeploymentMutex.RLock()
+	defer fake.getBackupDetailsForDeploymentMutex.RUnlock()
+	return fake.getBackupDetailsForDeploymentArgsForCall[i].deploymentid, fake.getBackupDetailsForDeploymentArgsForCall[i].backupid
+}
+
+func (fake *FakeClient) GetBackupDetailsForDeploymentReturns(result1 *composeapi.Backup, result2 []error) {
+	fake.GetBackupDetailsForDeploymentStub = nil
+	fake.getBackupDetailsForDeploymentReturns = struct {
+		result1 *composeapi.Backup
+		result2 []error
+	}{result1, result2}
+}
+
+func (fake *FakeClient) GetBackupDetailsForDeploymentReturnsOnCall(i int, result1 *composeapi.Backup, result2 []error) {
+	fake.GetBackupDetailsForDeploymentStub = nil
+	if fake.getBackupDetailsForDeploymentReturnsOnCall == nil {
+		fake.getBackupDetailsForDeploymentReturnsOnCall = make(map[int]struct {
+			result1 *composeapi.Backup
+			result2 []error
+		})
+	}
+	fake.getBackupDetailsForDeploymentReturnsOnCall[i] = struct {
+		result1 *composeapi.Backup
+		result2 []error
+	}{result1, result2}
+}
+
 func (fake *FakeClient) RestoreBackup(arg1 composeapi.RestoreBackupParams) (*composeapi.Deployment, []error) {
 	fake.restoreBackupMutex.Lock()
 	ret, specificReturn := fake.restoreBackupReturnsOnCall[len(fake.restoreBackupArgsForCall)]
@@ -1009,6 +1242,159 @@ func (fake *FakeClient) StartBackupForDeploymentReturnsOnCall(i int, result1 *co
 	}{result1, result2}
 }
 
+func (fake *FakeClient) GetAuditEvents(arg1 composeapi.AuditEventsParams) (*[]composeapi.AuditEvent, []error) {
+	fake.getAuditEventsMutex.Lock()
+	ret, specificReturn := fake.getAuditEventsReturnsOnCall[len(fake.getAuditEventsArgsForCall)]
+	fake.getAuditEventsArgsForCall = append(fake.getAuditEventsArgsForCall, struct {
+		arg1 composeapi.AuditEventsParams
+	}{arg1})
+	fake.recordInvocation("GetAuditEvents", []interface{}{arg1})
+	fake.getAuditEventsMutex.Unlock()
+	if fake.GetAuditEventsStub != nil {
+		return fake.GetAuditEventsStub(arg1)
+	}
+	if specificReturn {
+		return ret.result1, ret.result2
+	}
+	return fake.getAuditEventsReturns.result1, fake.getAuditEventsReturns.result2
+}
+
+func (fake *FakeClient) GetAuditEventsCallCount() int {
+	fake.getAuditEventsMutex.RLock()
+	defer fake.getAuditEventsMutex.RUnlock()
+	return len(fake.getAuditEventsArgsForCall)
+}
+
+func (fake *FakeClient) GetAuditEventsArgsForCall(i int) composeapi.AuditEventsParams {
+	fake.getAuditEventsMutex.RLock()
+	defer fake.getAuditEventsMutex.RUnlock()
+	return fake.getAuditEventsArgsForCall[i].arg1
+}
+
+func (fake *FakeClient) GetAuditEventsReturns(result1 *[]composeapi.AuditEvent, result2 []error) {
+	fake.GetAuditEventsStub = nil
+	fake.getAuditEventsReturns = struct {
+		result1 *[]composeapi.AuditEvent
+		result2 []error
+	}{result1, result2}
+}
+
+func (fake *FakeClient) GetAuditEventsReturnsOnCall(i int, result1 *[]composeapi.AuditEvent, result2 []error) {
+	fake.GetAuditEventsStub = nil
+	if fake.getAuditEventsReturnsOnCall == nil {
+		fake.getAuditEventsReturnsOnCall = make(map[int]struct {
+			result1 *[]composeapi.AuditEvent
+			result2 []error
+		})
+	}
+	fake.getAuditEventsReturnsOnCall[i] = struct {
+		result1 *[]composeapi.AuditEvent
+		result2 []error
+	}{result1, result2}
+}
+
+func (fake *FakeClient) GetAuditEvent(arg1 string) (*composeapi.AuditEvent, []error) {
+	fake.getAuditEventMutex.Lock()
+	ret, specificReturn := fake.getAuditEventReturnsOnCall[len(fake.getAuditEventArgsForCall)]
+	fake.getAuditEventArgsForCall = append(fake.getAuditEventArgsForCall, struct {
+		arg1 string
+	}{arg1})
+	fake.recordInvocation("GetAuditEvent", []interface{}{arg1})
+	fake.getAuditEventMutex.Unlock()
+	if fake.GetAuditEventStub != nil {
+		return fake.GetAuditEventStub(arg1)
+	}
+	if specificReturn {
+		return ret.result1, ret.result2
+	}
+	return fake.getAuditEventReturns.result1, fake.getAuditEventReturns.result2
+}
+
+func (fake *FakeClient) GetAuditEventCallCount() int {
+	fake.getAuditEventMutex.RLock()
+	defer fake.getAuditEventMutex.RUnlock()
+	return len(fake.getAuditEventArgsForCall)
+}
+
+func (fake *FakeClient) GetAuditEventArgsForCall(i int) string {
+	fake.getAuditEventMutex.RLock()
+	defer fake.getAuditEventMutex.RUnlock()
+	return fake.getAuditEventArgsForCall[i].arg1
+}
+
+func (fake *FakeClient) GetAuditEventReturns(result1 *composeapi.AuditEvent, result2 []error) {
+	fake.GetAuditEventStub = nil
+	fake.getAuditEventReturns = struct {
+		result1 *composeapi.AuditEvent
+		result2 []error
+	}{result1, result2}
+}
+
+func (fake *FakeClient) GetAuditEventReturnsOnCall(i int, result1 *composeapi.AuditEvent, result2 []error) {
+	fake.GetAuditEventStub = nil
+	if fake.getAuditEventReturnsOnCall == nil {
+		fake.getAuditEventReturnsOnCall = make(map[int]struct {
+			result1 *composeapi.AuditEvent
+			result2 []error
+		})
+	}
+	fake.getAuditEventReturnsOnCall[i] = struct {
+		result1 *composeapi.AuditEvent
+		result2 []error
+	}{result1, result2}
+}
+
+func (fake *FakeClient) GetAlertsForDeployment(arg1 string) (*composeapi.Alerts, []error) {
+	fake.getAlertsForDeploymentMutex.Lock()
+	ret, specificReturn := fake.getAlertsForDeploymentReturnsOnCall[len(fake.getAlertsForDeploymentArgsForCall)]
+	fake.getAlertsForDeploymentArgsForCall = append(fake.getAlertsForDeploymentArgsForCall, struct {
+		arg1 string
+	}{arg1})
+	fake.recordInvocation("GetAlertsForDeployment", []interface{}{arg1})
+	fake.getAlertsForDeploymentMutex.Unlock()
+	if fake.GetAlertsForDeploymentStub != nil {
+		return fake.GetAlertsForDeploymentStub(arg1)
+	}
+	if specificReturn {
+		return ret.result1, ret.result2
+	}
+	return fake.getAlertsForDeploymentReturns.result1, fake.getAlertsForDeploymentReturns.result2
+}
+
+func (fake *FakeClient) GetAlertsForDeploymentCallCount() int {
+	fake.getAlertsForDeploymentMutex.RLock()
+	defer fake.getAlertsForDeploymentMutex.RUnlock()
+	return len(fake.getAlertsForDeploymentArgsForCall)
+}
+
+func (fake *FakeClient) GetAlertsForDeploymentArgsForCall(i int) string {
+	fake.getAlertsForDeploymentMutex.RLock()
+	defer fake.getAlertsForDeploymentMutex.RUnlock()
+	return fake.getAlertsForDeploymentArgsForCall[i].arg1
+}
+
+func (fake *FakeClient) GetAlertsForDeploymentReturns(result1 *composeapi.Alerts, result2 []error) {
+	fake.GetAlertsForDeploymentStub = nil
+	fake.getAlertsForDeploymentReturns = struct {
+		result1 *composeapi.Alerts
+		result2 []error
+	}{result1, result2}
+}
+
+func (fake *FakeClient) GetAlertsForDeploymentReturnsOnCall(i int, result1 *composeapi.Alerts, result2 []error) {
+	fake.GetAlertsForDeploymentStub = nil
+	if fake.getAlertsForDeploymentReturnsOnCall == nil {
+		fake.getAlertsForDeploymentReturnsOnCall = make(map[int]struct {
+			result1 *composeapi.Alerts
+			result2 []error
+		})
+	}
+	fake.getAlertsForDeploymentReturnsOnCall[i] = struct {
+		result1 *composeapi.Alerts
+		result2 []error
+	}{result1, result2}
+}
+
 func (fake *FakeClient) Invocations() map[string][][]interface{} {
 	fake.invocationsMutex.RLock()
 	defer fake.invocationsMutex.RUnlock()
@@ -1016,6 +1402,8 @@ func (fake *FakeClient) Invocations() map[string][][]interface{} {
 	defer fake.getAccountMutex.RUnlock()
 	fake.getClustersMutex.RLock()
 	defer fake.getClustersMutex.RUnlock()
+	fake.getClusterMutex.RLock()
+	defer fake.getClusterMutex.RUnlock()
 	fake.getClusterByNameMutex.RLock()
 	defer fake.getClusterByNameMutex.RUnlock()
 	fake.createDeploymentMutex.RLock()
@@ -1034,16 +1422,26 @@ func (fake *FakeClient) Invocations() map[string][][]interface{} {
 	defer fake.getWhitelistForDeploymentMutex.RUnlock()
 	fake.getRecipeMutex.RLock()
 	defer fake.getRecipeMutex.RUnlock()
+	fake.getScalingsMutex.RLock()
+	defer fake.getScalingsMutex.RUnlock()
 	fake.setScalingsMutex.RLock()
 	defer fake.setScalingsMutex.RUnlock()
 	fake.getBackupsForDeploymentMutex.RLock()
 	defer fake.getBackupsForDeploymentMutex.RUnlock()
+	fake.getBackupDetailsForDeploymentMutex.RLock()
+	defer fake.getBackupDetailsForDeploymentMutex.RUnlock()
 	fake.restoreBackupMutex.RLock()
 	defer fake.restoreBackupMutex.RUnlock()
 	fake.patchDeploymentMutex.RLock()
 	defer fake.patchDeploymentMutex.RUnlock()
 	fake.startBackupForDeploymentMutex.RLock()
 	defer fake.startBackupForDeploymentMutex.RUnlock()
+	fake.getAuditEventsMutex.RLock()
+	defer fake.getAuditEventsMutex.RUnlock()
+	fake.getAuditEventMutex.RLock()
+	defer fake.getAuditEventMutex.RUnlock()
+	fake.getAlertsForDeploymentMutex.RLock()
+	defer fake.getAlertsForDeploymentMutex.RUnlock()
 	copiedInvocations := map[string][][]interface{}{}
 	for key, value := range fake.invocations {
 		copiedInvocations[key] = value
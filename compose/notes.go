@@ -0,0 +1,121 @@
+package compose
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	composeapi "github.com/compose/gocomposeapi"
+)
+
+// NotesStore keeps JSON values under keys of a deployment's notes, leaving
+// other keys alone. Each Put reads the notes afresh and writes them back,
+// one at a time, so that writes of different keys through the same store do
+// not undo each other. Compose cannot update notes conditionally, so
+// writers in other processes must coordinate some other way, such as the
+// leader lease.
+type NotesStore struct {
+	Client         Client
+	DeploymentName string
+	// Guard, if set, is called with the key of each Put just before the
+	// notes are written back, and the Put fails with its error instead.
+	Guard func(key string) error
+
+	// putMu serialises Puts.
+	putMu sync.Mutex
+
+	mu           sync.Mutex
+	deploymentID string
+}
+
+func NewNotesStore(client Client, deploymentName string) *NotesStore {
+	return &NotesStore{Client: client, DeploymentName: deploymentName}
+}
+
+// Get decodes the value at key into value, and reports whether there was
+// one.
+func (s *NotesStore) Get(ctx context.Context, key string, value interface{}) (bool, error) {
+	deployment, err := s.deployment(ctx)
+	if err != nil {
+		return false, err
+	}
+	raw, ok := decodeNotes(deployment.Notes)[key]
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(raw, value); err != nil {
+		return false, fmt.Errorf("invalid %s in notes of %s: %s", key, s.DeploymentName, err)
+	}
+	return true, nil
+}
+
+// Put stores value at key.
+func (s *NotesStore) Put(ctx context.Context, key string, value interface{}) error {
+	s.putMu.Lock()
+	defer s.putMu.Unlock()
+
+	deployment, err := s.deployment(ctx)
+	if err != nil {
+		return err
+	}
+	encodedValue, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	notes := decodeNotes(deployment.Notes)
+	notes[key] = encodedValue
+	encodedNotes, err := json.Marshal(notes)
+	if err != nil {
+		return err
+	}
+	if s.Guard != nil {
+		if err := s.Guard(key); err != nil {
+			return err
+		}
+	}
+
+	_, errs := WithContext(ctx, s.Client).PatchDeployment(composeapi.PatchDeploymentParams{
+		DeploymentID: deployment.ID,
+		Notes:        string(encodedNotes),
+	})
+	if len(errs) > 0 {
+		return SquashErrors(errs)
+	}
+	return nil
+}
+
+// deployment fetches the deployment, looking it up by name the first time.
+func (s *NotesStore) deployment(ctx context.Context) (*composeapi.Deployment, error) {
+	client := WithContext(ctx, s.Client)
+
+	s.mu.Lock()
+	id := s.deploymentID
+	s.mu.Unlock()
+
+	if id == "" {
+		deployment, errs := client.GetDeploymentByName(s.DeploymentName)
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("could not find deployment %s: %s", s.DeploymentName, SquashErrors(errs))
+		}
+		s.mu.Lock()
+		s.deploymentID = deployment.ID
+		s.mu.Unlock()
+		id = deployment.ID
+	}
+
+	deployment, errs := client.GetDeployment(id)
+	if len(errs) > 0 {
+		return nil, SquashErrors(errs)
+	}
+	return deployment, nil
+}
+
+// decodeNotes treats notes which are not a JSON object as empty.
+func decodeNotes(notes string) map[string]json.RawMessage {
+	decoded := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(notes), &decoded); err != nil || decoded == nil {
+		return map[string]json.RawMessage{}
+	}
+	return decoded
+}
@@ -0,0 +1,110 @@
+package compose_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	composeapi "github.com/compose/gocomposeapi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/paas-compose-broker/compose"
+	"github.com/alphagov/paas-compose-broker/compose/fakes"
+)
+
+var _ = Describe("NotesStore", func() {
+
+	var (
+		fakeComposeClient *fakes.FakeClient
+		store             *compose.NotesStore
+		notesMutex        sync.Mutex
+		notes             string
+	)
+
+	BeforeEach(func() {
+		notes = `{"other":{"kept":true}}`
+		fakeComposeClient = &fakes.FakeClient{}
+		fakeComposeClient.GetDeploymentByNameReturns(&composeapi.Deployment{ID: "state"}, nil)
+		fakeComposeClient.GetDeploymentStub = func(id string) (*composeapi.Deployment, []error) {
+			notesMutex.Lock()
+			defer notesMutex.Unlock()
+			return &composeapi.Deployment{ID: id, Notes: notes}, nil
+		}
+		fakeComposeClient.PatchDeploymentStub = func(params composeapi.PatchDeploymentParams) (*composeapi.Deployment, []error) {
+			notesMutex.Lock()
+			defer notesMutex.Unlock()
+			notes = params.Notes
+			return &composeapi.Deployment{ID: params.DeploymentID, Notes: notes}, nil
+		}
+		store = compose.NewNotesStore(fakeComposeClient, "broker-state")
+	})
+
+	It("stores values under keys, keeping the others", func() {
+		var value map[string]int
+		found, err := store.Get(context.Background(), "counts", &value)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeFalse())
+
+		Expect(store.Put(context.Background(), "counts", map[string]int{"a": 1})).To(Succeed())
+		Expect(fakeComposeClient.PatchDeploymentArgsForCall(0).DeploymentID).To(Equal("state"))
+		Expect(notes).To(MatchJSON(`{"other":{"kept":true},"counts":{"a":1}}`))
+
+		found, err = store.Get(context.Background(), "counts", &value)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeTrue())
+		Expect(value).To(Equal(map[string]int{"a": 1}))
+		Expect(fakeComposeClient.GetDeploymentByNameCallCount()).To(Equal(1))
+	})
+
+	It("keeps values put at the same time under different keys", func() {
+		patch := fakeComposeClient.PatchDeploymentStub
+		fakeComposeClient.PatchDeploymentStub = func(params composeapi.PatchDeploymentParams) (*composeapi.Deployment, []error) {
+			time.Sleep(10 * time.Millisecond)
+			return patch(params)
+		}
+
+		var wg sync.WaitGroup
+		for _, key := range []string{"a", "b", "c"} {
+			wg.Add(1)
+			go func(key string) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				Expect(store.Put(context.Background(), key, 1)).To(Succeed())
+			}(key)
+		}
+		wg.Wait()
+
+		Expect(notes).To(MatchJSON(`{"other":{"kept":true},"a":1,"b":1,"c":1}`))
+	})
+
+	It("does not write the notes when the guard refuses", func() {
+		store.Guard = func(key string) error {
+			if key == "counts" {
+				return errors.New("not leading")
+			}
+			return nil
+		}
+
+		Expect(store.Put(context.Background(), "counts", 1)).To(MatchError("not leading"))
+		Expect(fakeComposeClient.PatchDeploymentCallCount()).To(Equal(0))
+		Expect(store.Put(context.Background(), "other", 1)).To(Succeed())
+		Expect(notes).To(MatchJSON(`{"other":1}`))
+	})
+
+	It("treats notes which are not a JSON object as empty", func() {
+		notes = "created by hand"
+
+		Expect(store.Put(context.Background(), "counts", 1)).To(Succeed())
+		Expect(notes).To(MatchJSON(`{"counts":1}`))
+	})
+
+	It("fails if the deployment cannot be found", func() {
+		fakeComposeClient.GetDeploymentByNameReturns(nil, []error{errors.New("not found")})
+
+		var value int
+		_, err := store.Get(context.Background(), "counts", &value)
+		Expect(err).To(MatchError("could not find deployment broker-state: not found"))
+	})
+})
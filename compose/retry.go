@@ -0,0 +1,365 @@
+package compose
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	composeapi "github.com/compose/gocomposeapi"
+)
+
+// RetryPolicy configures a RetryingClient.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a call is made before giving up.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry. It doubles on each
+	// subsequent retry, up to MaxDelay, and is jittered.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Idempotent lists the client methods which may be retried after any
+	// transient failure. Other methods are only retried when the Compose API
+	// rate limited the request or the connection was refused, as the request
+	// cannot have been acted on.
+	Idempotent map[string]bool
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+	Idempotent: map[string]bool{
+		"GetAccount":                    true,
+		"GetClusters":                   true,
+		"GetCluster":                    true,
+		"GetClusterByName":              true,
+		"GetDeployment":                 true,
+		"GetDeploymentByName":           true,
+		"GetDeployments":                true,
+		"GetWhitelistForDeployment":     true,
+		"GetRecipe":                     true,
+		"GetScalings":                   true,
+		"GetBackupsForDeployment":       true,
+		"GetBackupDetailsForDeployment": true,
+		"GetAuditEvents":                true,
+		"GetAuditEvent":                 true,
+		"GetAlertsForDeployment":        true,
+	},
+}
+
+// RetryingClient decorates a Client with exponential backoff on transient
+// failures. gocomposeapi discards response headers and often the status
+// code, so failures are classified, and the wait asked for by a rate
+// limited response found, from the error text. Bound to a context by
+// WithContext, it stops waiting to retry once the context is done.
+type RetryingClient struct {
+	client Client
+	policy RetryPolicy
+	logger lager.Logger
+	ctx    context.Context
+
+	// Sleep waits between attempts, returning early with ctx.Err() once ctx
+	// is done. It is replaced in tests.
+	Sleep func(ctx context.Context, d time.Duration) error
+
+	*jitter
+}
+
+type jitter struct {
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// WithOverrides returns a copy of the policy with any non-zero settings
+// replaced, as read from the broker's configuration.
+func (p RetryPolicy) WithOverrides(maxAttempts int, baseDelay, maxDelay time.Duration) RetryPolicy {
+	if maxAttempts > 0 {
+		p.MaxAttempts = maxAttempts
+	}
+	if baseDelay > 0 {
+		p.BaseDelay = baseDelay
+	}
+	if maxDelay > 0 {
+		p.MaxDelay = maxDelay
+	}
+	return p
+}
+
+func NewRetryingClient(client Client, policy RetryPolicy, logger lager.Logger) *RetryingClient {
+	return &RetryingClient{
+		client: client,
+		policy: policy,
+		logger: logger.Session("compose-retry"),
+		ctx:    context.Background(),
+		Sleep:  sleep,
+		jitter: &jitter{rand: rand.New(rand.NewSource(time.Now().UnixNano()))},
+	}
+}
+
+func (c *RetryingClient) bind(ctx context.Context) Client {
+	bound := *c
+	bound.client = bind(ctx, c.client)
+	bound.ctx = ctx
+	return &bound
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type retryAfter interface {
+	RetryAfter() time.Duration
+}
+
+func isTransient(err error) bool {
+	return AsError(err).Retryable
+}
+
+// shouldRetry reports whether a call which failed with errs may be made
+// again, given whether the method is idempotent.
+func shouldRetry(errs []error, idempotent bool) bool {
+	if len(errs) == 0 {
+		return false
+	}
+	for _, err := range errs {
+		if !isTransient(err) {
+			return false
+		}
+		if idempotent {
+			continue
+		}
+		if AsError(err).StatusCode != 429 && !isConnectionRefused(err) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *RetryingClient) backoff(attempt int, errs []error) time.Duration {
+	delay := c.policy.BaseDelay << uint(attempt-1)
+	if delay > c.policy.MaxDelay || delay <= 0 {
+		delay = c.policy.MaxDelay
+	}
+
+	c.mu.Lock()
+	delay = delay/2 + time.Duration(c.rand.Int63n(int64(delay/2)+1))
+	c.mu.Unlock()
+
+	if wait := NewError(errs).RetryAfter; wait > delay {
+		delay = wait
+	}
+	return delay
+}
+
+func (c *RetryingClient) do(method string, call func() []error) []error {
+	idempotent := c.policy.Idempotent[method]
+	for attempt := 1; ; attempt++ {
+		errs := call()
+		if attempt >= c.policy.MaxAttempts || !shouldRetry(errs, idempotent) {
+			return errs
+		}
+
+		delay := c.backoff(attempt, errs)
+		if delay > c.policy.MaxDelay {
+			c.logger.Info("retry-after-too-long", lager.Data{
+				"method": method,
+				"delay":  delay.String(),
+			})
+			return errs
+		}
+
+		c.logger.Info("retry", lager.Data{
+			"method":  method,
+			"attempt": attempt,
+			"delay":   delay.String(),
+			"error":   SquashErrors(errs).Error(),
+		})
+		if err := c.Sleep(c.ctx, delay); err != nil {
+			return errs
+		}
+	}
+}
+
+func (c *RetryingClient) GetAccount() (account *composeapi.Account, errs []error) {
+	errs = c.do("GetAccount", func() []error {
+		account, errs = c.client.GetAccount()
+		return errs
+	})
+	return account, errs
+}
+
+func (c *RetryingClient) GetClusters() (clusters *[]composeapi.Cluster, errs []error) {
+	errs = c.do("GetClusters", func() []error {
+		clusters, errs = c.client.GetClusters()
+		return errs
+	})
+	return clusters, errs
+}
+
+func (c *RetryingClient) GetCluster(clusterID string) (cluster *composeapi.Cluster, errs []error) {
+	errs = c.do("GetCluster", func() []error {
+		cluster, errs = c.client.GetCluster(clusterID)
+		return errs
+	})
+	return cluster, errs
+}
+
+func (c *RetryingClient) GetClusterByName(name string) (cluster *composeapi.Cluster, errs []error) {
+	errs = c.do("GetClusterByName", func() []error {
+		cluster, errs = c.client.GetClusterByName(name)
+		return errs
+	})
+	return cluster, errs
+}
+
+func (c *RetryingClient) CreateDeployment(params composeapi.DeploymentParams) (deployment *composeapi.Deployment, errs []error) {
+	errs = c.do("CreateDeployment", func() []error {
+		deployment, errs = c.client.CreateDeployment(params)
+		return errs
+	})
+	return deployment, errs
+}
+
+func (c *RetryingClient) DeprovisionDeployment(deploymentID string) (recipe *composeapi.Recipe, errs []error) {
+	errs = c.do("DeprovisionDeployment", func() []error {
+		recipe, errs = c.client.DeprovisionDeployment(deploymentID)
+		return errs
+	})
+	return recipe, errs
+}
+
+func (c *RetryingClient) GetDeployment(deploymentID string) (deployment *composeapi.Deployment, errs []error) {
+	errs = c.do("GetDeployment", func() []error {
+		deployment, errs = c.client.GetDeployment(deploymentID)
+		return errs
+	})
+	return deployment, errs
+}
+
+func (c *RetryingClient) GetDeploymentByName(name string) (deployment *composeapi.Deployment, errs []error) {
+	errs = c.do("GetDeploymentByName", func() []error {
+		deployment, errs = c.client.GetDeploymentByName(name)
+		return errs
+	})
+	return deployment, errs
+}
+
+func (c *RetryingClient) GetDeployments() (deployments *[]composeapi.Deployment, errs []error) {
+	errs = c.do("GetDeployments", func() []error {
+		deployments, errs = c.client.GetDeployments()
+		return errs
+	})
+	return deployments, errs
+}
+
+func (c *RetryingClient) CreateDeploymentWhitelist(deploymentID string, params composeapi.DeploymentWhitelistParams) (recipe *composeapi.Recipe, errs []error) {
+	errs = c.do("CreateDeploymentWhitelist", func() []error {
+		recipe, errs = c.client.CreateDeploymentWhitelist(deploymentID, params)
+		return errs
+	})
+	return recipe, errs
+}
+
+func (c *RetryingClient) GetWhitelistForDeployment(deploymentID string) (whitelist []composeapi.DeploymentWhitelist, errs []error) {
+	errs = c.do("GetWhitelistForDeployment", func() []error {
+		whitelist, errs = c.client.GetWhitelistForDeployment(deploymentID)
+		return errs
+	})
+	return whitelist, errs
+}
+
+func (c *RetryingClient) GetRecipe(recipeID string) (recipe *composeapi.Recipe, errs []error) {
+	errs = c.do("GetRecipe", func() []error {
+		recipe, errs = c.client.GetRecipe(recipeID)
+		return errs
+	})
+	return recipe, errs
+}
+
+func (c *RetryingClient) GetScalings(deploymentID string) (scalings *composeapi.Scalings, errs []error) {
+	errs = c.do("GetScalings", func() []error {
+		scalings, errs = c.client.GetScalings(deploymentID)
+		return errs
+	})
+	return scalings, errs
+}
+
+func (c *RetryingClient) SetScalings(params composeapi.ScalingsParams) (recipe *composeapi.Recipe, errs []error) {
+	errs = c.do("SetScalings", func() []error {
+		recipe, errs = c.client.SetScalings(params)
+		return errs
+	})
+	return recipe, errs
+}
+
+func (c *RetryingClient) GetBackupsForDeployment(deploymentID string) (backups *[]composeapi.Backup, errs []error) {
+	errs = c.do("GetBackupsForDeployment", func() []error {
+		backups, errs = c.client.GetBackupsForDeployment(deploymentID)
+		return errs
+	})
+	return backups, errs
+}
+
+func (c *RetryingClient) GetBackupDetailsForDeployment(deploymentID, backupID string) (backup *composeapi.Backup, errs []error) {
+	errs = c.do("GetBackupDetailsForDeployment", func() []error {
+		backup, errs = c.client.GetBackupDetailsForDeployment(deploymentID, backupID)
+		return errs
+	})
+	return backup, errs
+}
+
+func (c *RetryingClient) RestoreBackup(params composeapi.RestoreBackupParams) (deployment *composeapi.Deployment, errs []error) {
+	errs = c.do("RestoreBackup", func() []error {
+		deployment, errs = c.client.RestoreBackup(params)
+		return errs
+	})
+	return deployment, errs
+}
+
+func (c *RetryingClient) PatchDeployment(params composeapi.PatchDeploymentParams) (deployment *composeapi.Deployment, errs []error) {
+	errs = c.do("PatchDeployment", func() []error {
+		deployment, errs = c.client.PatchDeployment(params)
+		return errs
+	})
+	return deployment, errs
+}
+
+func (c *RetryingClient) StartBackupForDeployment(deploymentID string) (recipe *composeapi.Recipe, errs []error) {
+	errs = c.do("StartBackupForDeployment", func() []error {
+		recipe, errs = c.client.StartBackupForDeployment(deploymentID)
+		return errs
+	})
+	return recipe, errs
+}
+
+func (c *RetryingClient) GetAuditEvents(params composeapi.AuditEventsParams) (events *[]composeapi.AuditEvent, errs []error) {
+	errs = c.do("GetAuditEvents", func() []error {
+		events, errs = c.client.GetAuditEvents(params)
+		return errs
+	})
+	return events, errs
+}
+
+func (c *RetryingClient) GetAuditEvent(id string) (event *composeapi.AuditEvent, errs []error) {
+	errs = c.do("GetAuditEvent", func() []error {
+		event, errs = c.client.GetAuditEvent(id)
+		return errs
+	})
+	return event, errs
+}
+
+func (c *RetryingClient) GetAlertsForDeployment(deploymentID string) (alerts *composeapi.Alerts, errs []error) {
+	errs = c.do("GetAlertsForDeployment", func() []error {
+		alerts, errs = c.client.GetAlertsForDeployment(deploymentID)
+		return errs
+	})
+	return alerts, errs
+}
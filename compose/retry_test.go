@@ -0,0 +1,177 @@
+package compose_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	composeapi "github.com/compose/gocomposeapi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/paas-compose-broker/compose"
+	"github.com/alphagov/paas-compose-broker/compose/fakes"
+)
+
+type rateLimitError struct {
+	wait time.Duration
+}
+
+func (e rateLimitError) Error() string {
+	return "Unable to parse error - status code 429 - body slow down"
+}
+
+func (e rateLimitError) RetryAfter() time.Duration {
+	return e.wait
+}
+
+var _ = Describe("RetryingClient", func() {
+
+	var (
+		fakeComposeClient *fakes.FakeClient
+		client            *compose.RetryingClient
+		sleeps            []time.Duration
+		unavailable       = errors.New("Unable to parse error - status code 503 - body <html>Service Unavailable</html>")
+	)
+
+	BeforeEach(func() {
+		fakeComposeClient = &fakes.FakeClient{}
+		client = compose.NewRetryingClient(fakeComposeClient, compose.RetryPolicy{
+			MaxAttempts: 3,
+			BaseDelay:   time.Second,
+			MaxDelay:    4 * time.Second,
+			Idempotent:  compose.DefaultRetryPolicy.Idempotent,
+		}, lager.NewLogger("test"))
+		sleeps = []time.Duration{}
+		client.Sleep = func(_ context.Context, d time.Duration) error {
+			sleeps = append(sleeps, d)
+			return nil
+		}
+	})
+
+	It("retries idempotent calls which fail transiently, backing off each time", func() {
+		fakeComposeClient.GetRecipeReturnsOnCall(0, nil, []error{unavailable})
+		fakeComposeClient.GetRecipeReturnsOnCall(1, nil, []error{unavailable})
+		fakeComposeClient.GetRecipeReturnsOnCall(2, &composeapi.Recipe{ID: "recipe"}, []error{})
+
+		recipe, errs := client.GetRecipe("recipe")
+		Expect(errs).To(BeEmpty())
+		Expect(recipe.ID).To(Equal("recipe"))
+		Expect(fakeComposeClient.GetRecipeCallCount()).To(Equal(3))
+		Expect(fakeComposeClient.GetRecipeArgsForCall(2)).To(Equal("recipe"))
+
+		Expect(sleeps).To(HaveLen(2))
+		Expect(sleeps[0]).To(BeNumerically(">=", 500*time.Millisecond))
+		Expect(sleeps[0]).To(BeNumerically("<=", time.Second))
+		Expect(sleeps[1]).To(BeNumerically(">=", time.Second))
+		Expect(sleeps[1]).To(BeNumerically("<=", 2*time.Second))
+	})
+
+	It("gives up after the maximum number of attempts", func() {
+		fakeComposeClient.GetRecipeReturns(nil, []error{unavailable})
+
+		_, errs := client.GetRecipe("recipe")
+		Expect(errs).To(Equal([]error{unavailable}))
+		Expect(fakeComposeClient.GetRecipeCallCount()).To(Equal(3))
+	})
+
+	It("does not retry errors which are not transient", func() {
+		fakeComposeClient.GetDeploymentByNameReturns(nil, []error{errors.New("deployment not found: test")})
+
+		_, errs := client.GetDeploymentByName("test")
+		Expect(errs).To(HaveLen(1))
+		Expect(fakeComposeClient.GetDeploymentByNameCallCount()).To(Equal(1))
+		Expect(sleeps).To(BeEmpty())
+	})
+
+	It("never retries a non-idempotent call which may have been acted on", func() {
+		fakeComposeClient.CreateDeploymentReturns(nil, []error{unavailable})
+
+		_, errs := client.CreateDeployment(composeapi.DeploymentParams{Name: "test"})
+		Expect(errs).To(HaveLen(1))
+		Expect(fakeComposeClient.CreateDeploymentCallCount()).To(Equal(1))
+	})
+
+	It("retries a non-idempotent call which was rate limited", func() {
+		fakeComposeClient.CreateDeploymentReturnsOnCall(0, nil, []error{errors.New("Too Many Requests")})
+		fakeComposeClient.CreateDeploymentReturnsOnCall(1, &composeapi.Deployment{ID: "d1"}, []error{})
+
+		deployment, errs := client.CreateDeployment(composeapi.DeploymentParams{Name: "test"})
+		Expect(errs).To(BeEmpty())
+		Expect(deployment.ID).To(Equal("d1"))
+		Expect(fakeComposeClient.CreateDeploymentCallCount()).To(Equal(2))
+	})
+
+	It("retries a non-idempotent call whose connection was refused", func() {
+		refused := &url.Error{Op: "Post", URL: "https://api.compose.io", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}
+		fakeComposeClient.DeprovisionDeploymentReturnsOnCall(0, nil, []error{refused})
+		fakeComposeClient.DeprovisionDeploymentReturnsOnCall(1, &composeapi.Recipe{ID: "recipe"}, []error{})
+
+		_, errs := client.DeprovisionDeployment("d1")
+		Expect(errs).To(BeEmpty())
+		Expect(fakeComposeClient.DeprovisionDeploymentCallCount()).To(Equal(2))
+	})
+
+	It("waits as long as the API asks", func() {
+		fakeComposeClient.GetDeploymentsReturnsOnCall(0, nil, []error{rateLimitError{3 * time.Second}})
+		fakeComposeClient.GetDeploymentsReturnsOnCall(1, &[]composeapi.Deployment{}, []error{})
+
+		_, errs := client.GetDeployments()
+		Expect(errs).To(BeEmpty())
+		Expect(sleeps).To(Equal([]time.Duration{3 * time.Second}))
+	})
+
+	It("does not wait longer than the maximum delay", func() {
+		fakeComposeClient.GetDeploymentsReturns(nil, []error{rateLimitError{time.Minute}})
+
+		_, errs := client.GetDeployments()
+		Expect(errs).To(HaveLen(1))
+		Expect(fakeComposeClient.GetDeploymentsCallCount()).To(Equal(1))
+		Expect(sleeps).To(BeEmpty())
+	})
+
+	It("honours a wait given in the text of a rate limited response", func() {
+		fakeComposeClient.GetDeploymentsReturnsOnCall(0, nil, []error{errors.New(`Unable to parse error - status code 429 - body {"error": "Retry after 3 seconds"}`)})
+		fakeComposeClient.GetDeploymentsReturnsOnCall(1, &[]composeapi.Deployment{}, []error{})
+
+		_, errs := client.GetDeployments()
+		Expect(errs).To(BeEmpty())
+		Expect(sleeps).To(Equal([]time.Duration{3 * time.Second}))
+	})
+
+	It("does not retry a patch which may have been applied", func() {
+		fakeComposeClient.PatchDeploymentReturns(nil, []error{unavailable})
+
+		_, errs := client.PatchDeployment(composeapi.PatchDeploymentParams{DeploymentID: "d1"})
+		Expect(errs).To(HaveLen(1))
+		Expect(fakeComposeClient.PatchDeploymentCallCount()).To(Equal(1))
+	})
+
+	It("stops waiting to retry once the caller's context is done", func() {
+		client = compose.NewRetryingClient(fakeComposeClient, compose.RetryPolicy{
+			MaxAttempts: 3,
+			BaseDelay:   100 * time.Millisecond,
+			MaxDelay:    100 * time.Millisecond,
+			Idempotent:  compose.DefaultRetryPolicy.Idempotent,
+		}, lager.NewLogger("test"))
+		ctx, cancel := context.WithCancel(context.Background())
+		fakeComposeClient.GetRecipeStub = func(string) (*composeapi.Recipe, []error) {
+			cancel()
+			return nil, []error{unavailable}
+		}
+
+		_, errs := compose.WithContext(ctx, compose.NewCircuitBreakerClient(client, 10, time.Minute, lager.NewLogger("test"))).GetRecipe("recipe")
+		Expect(errs).To(Equal([]error{context.Canceled}))
+		Consistently(fakeComposeClient.GetRecipeCallCount, 300*time.Millisecond).Should(Equal(1))
+	})
+
+	It("applies overrides from configuration", func() {
+		policy := compose.DefaultRetryPolicy.WithOverrides(1, 0, time.Minute)
+		Expect(policy.MaxAttempts).To(Equal(1))
+		Expect(policy.BaseDelay).To(Equal(compose.DefaultRetryPolicy.BaseDelay))
+		Expect(policy.MaxDelay).To(Equal(time.Minute))
+	})
+})
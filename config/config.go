@@ -2,12 +2,28 @@ package config
 
 import (
 	"fmt"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"code.cloudfoundry.org/lager"
+
+	"github.com/alphagov/paas-compose-broker/leader"
+)
+
+// Restore policies, which say who may restore an instance's backups into a
+// new instance in another space. Restores within a space are always allowed.
+const (
+	RestorePolicySpace = "space"
+	RestorePolicyOrg   = "org"
 )
 
+// CFStopGracePeriod is how long Cloud Foundry waits for an app to exit after
+// asking it to stop, before killing it.
+const CFStopGracePeriod = 10 * time.Second
+
 var (
 	logLevels = map[string]lager.LogLevel{
 		"DEBUG": lager.DEBUG,
@@ -26,6 +42,59 @@ type Config struct {
 	DBPrefix    string
 	ClusterName string
 	IPWhitelist []string
+
+	ClusterCapacityUnits int
+
+	// Zero values leave the compose package's default retry policy in place.
+	ComposeRetryAttempts  int
+	ComposeRetryBaseDelay time.Duration
+	ComposeRetryMaxDelay  time.Duration
+
+	ComposeCircuitFailures int
+	ComposeCircuitCooldown time.Duration
+
+	DeploymentCacheTTL time.Duration
+
+	HTTPReadTimeout  time.Duration
+	HTTPWriteTimeout time.Duration
+	HTTPIdleTimeout  time.Duration
+	ShutdownTimeout  time.Duration
+
+	// PEM-encoded. When both are empty the broker serves plain HTTP.
+	TLSCertificate string
+	TLSPrivateKey  string
+
+	RestorePolicy string
+	// CF user GUIDs allowed to restore across spaces. Empty allows nobody.
+	RestoreUsers []string
+
+	// HTTPS base URLs of the object stores tenants may export backups to,
+	// besides AWS S3's regional endpoints.
+	ExportEndpoints []string
+
+	// The Compose deployment whose notes hold the lease electing the broker
+	// instance which runs background jobs. When empty, the first instance
+	// always runs them.
+	LeaderLockDeployment string
+	LeaderLeaseTTL       time.Duration
+
+	// Where to post Compose audit events as JSON lines. Forwarding keeps its
+	// checkpoint in the leader lock deployment, so needs one.
+	AuditEventsURL string
+
+	// Where to record the audit log of service broker calls: "stdout",
+	// "syslog", "file:<path>" or "none".
+	AuditLog string
+	// The key of the HMACs chaining audit log events.
+	AuditLogKey string
+
+	// Where to post alerts raised by Compose on the broker's deployments.
+	AlertsWebhookURL string
+
+	// Where to export trace spans, and whether as "zipkin" or "otlp" JSON.
+	// Requests are not traced when the endpoint is empty.
+	TracingEndpoint string
+	TracingFormat   string
 }
 
 func New() (*Config, error) {
@@ -69,6 +138,190 @@ func New() (*Config, error) {
 
 	c.ClusterName = os.Getenv("CLUSTER_NAME")
 
+	clusterCapacityFromEnv := os.Getenv("CLUSTER_CAPACITY_UNITS")
+	if clusterCapacityFromEnv != "" {
+		units, err := strconv.Atoi(clusterCapacityFromEnv)
+		if err != nil || units < 0 {
+			return nil, fmt.Errorf("Invalid cluster capacity: %s", clusterCapacityFromEnv)
+		}
+		c.ClusterCapacityUnits = units
+	}
+
+	retryAttemptsFromEnv := os.Getenv("COMPOSE_RETRY_ATTEMPTS")
+	if retryAttemptsFromEnv != "" {
+		attempts, err := strconv.Atoi(retryAttemptsFromEnv)
+		if err != nil || attempts < 1 {
+			return nil, fmt.Errorf("Invalid compose retry attempts: %s", retryAttemptsFromEnv)
+		}
+		c.ComposeRetryAttempts = attempts
+	}
+
+	retryBaseDelayFromEnv := os.Getenv("COMPOSE_RETRY_BASE_DELAY")
+	if retryBaseDelayFromEnv != "" {
+		delay, err := time.ParseDuration(retryBaseDelayFromEnv)
+		if err != nil || delay <= 0 {
+			return nil, fmt.Errorf("Invalid compose retry base delay: %s", retryBaseDelayFromEnv)
+		}
+		c.ComposeRetryBaseDelay = delay
+	}
+
+	retryMaxDelayFromEnv := os.Getenv("COMPOSE_RETRY_MAX_DELAY")
+	if retryMaxDelayFromEnv != "" {
+		delay, err := time.ParseDuration(retryMaxDelayFromEnv)
+		if err != nil || delay <= 0 {
+			return nil, fmt.Errorf("Invalid compose retry max delay: %s", retryMaxDelayFromEnv)
+		}
+		c.ComposeRetryMaxDelay = delay
+	}
+
+	c.ComposeCircuitFailures = 5
+	circuitFailuresFromEnv := os.Getenv("COMPOSE_CIRCUIT_FAILURES")
+	if circuitFailuresFromEnv != "" {
+		failures, err := strconv.Atoi(circuitFailuresFromEnv)
+		if err != nil || failures < 1 {
+			return nil, fmt.Errorf("Invalid compose circuit failures: %s", circuitFailuresFromEnv)
+		}
+		c.ComposeCircuitFailures = failures
+	}
+
+	c.ComposeCircuitCooldown = 30 * time.Second
+	circuitCooldownFromEnv := os.Getenv("COMPOSE_CIRCUIT_COOLDOWN")
+	if circuitCooldownFromEnv != "" {
+		cooldown, err := time.ParseDuration(circuitCooldownFromEnv)
+		if err != nil || cooldown <= 0 {
+			return nil, fmt.Errorf("Invalid compose circuit cooldown: %s", circuitCooldownFromEnv)
+		}
+		c.ComposeCircuitCooldown = cooldown
+	}
+
+	c.DeploymentCacheTTL = time.Minute
+	deploymentCacheTTLFromEnv := os.Getenv("DEPLOYMENT_CACHE_TTL")
+	if deploymentCacheTTLFromEnv != "" {
+		ttl, err := time.ParseDuration(deploymentCacheTTLFromEnv)
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("Invalid deployment cache TTL: %s", deploymentCacheTTLFromEnv)
+		}
+		c.DeploymentCacheTTL = ttl
+	}
+
+	c.HTTPReadTimeout = 30 * time.Second
+	readTimeoutFromEnv := os.Getenv("HTTP_READ_TIMEOUT")
+	if readTimeoutFromEnv != "" {
+		timeout, err := time.ParseDuration(readTimeoutFromEnv)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("Invalid HTTP read timeout: %s", readTimeoutFromEnv)
+		}
+		c.HTTPReadTimeout = timeout
+	}
+
+	c.HTTPWriteTimeout = 2 * time.Minute
+	writeTimeoutFromEnv := os.Getenv("HTTP_WRITE_TIMEOUT")
+	if writeTimeoutFromEnv != "" {
+		timeout, err := time.ParseDuration(writeTimeoutFromEnv)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("Invalid HTTP write timeout: %s", writeTimeoutFromEnv)
+		}
+		c.HTTPWriteTimeout = timeout
+	}
+
+	c.HTTPIdleTimeout = 2 * time.Minute
+	idleTimeoutFromEnv := os.Getenv("HTTP_IDLE_TIMEOUT")
+	if idleTimeoutFromEnv != "" {
+		timeout, err := time.ParseDuration(idleTimeoutFromEnv)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("Invalid HTTP idle timeout: %s", idleTimeoutFromEnv)
+		}
+		c.HTTPIdleTimeout = timeout
+	}
+
+	// The default leaves time within the stop grace period to release the
+	// leader lease and export the last trace spans.
+	c.ShutdownTimeout = 8 * time.Second
+	shutdownTimeoutFromEnv := os.Getenv("SHUTDOWN_TIMEOUT")
+	if shutdownTimeoutFromEnv != "" {
+		timeout, err := time.ParseDuration(shutdownTimeoutFromEnv)
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("Invalid shutdown timeout: %s", shutdownTimeoutFromEnv)
+		}
+		if timeout >= CFStopGracePeriod {
+			return nil, fmt.Errorf("Invalid shutdown timeout: %s is not less than Cloud Foundry's %s stop grace period", shutdownTimeoutFromEnv, CFStopGracePeriod)
+		}
+		c.ShutdownTimeout = timeout
+	}
+
+	c.TLSCertificate = os.Getenv("TLS_CERTIFICATE")
+	c.TLSPrivateKey = os.Getenv("TLS_PRIVATE_KEY")
+	if (c.TLSCertificate == "") != (c.TLSPrivateKey == "") {
+		return nil, fmt.Errorf("TLS_CERTIFICATE and TLS_PRIVATE_KEY must be set together")
+	}
+
+	c.RestorePolicy = RestorePolicySpace
+	restorePolicyFromEnv := os.Getenv("RESTORE_POLICY")
+	if restorePolicyFromEnv != "" {
+		if restorePolicyFromEnv != RestorePolicySpace && restorePolicyFromEnv != RestorePolicyOrg {
+			return nil, fmt.Errorf("Invalid restore policy: %s", restorePolicyFromEnv)
+		}
+		c.RestorePolicy = restorePolicyFromEnv
+	}
+	c.RestoreUsers = ParseList(os.Getenv("RESTORE_USERS"))
+
+	c.ExportEndpoints = []string{}
+	for _, endpoint := range ParseList(os.Getenv("EXPORT_ENDPOINTS")) {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Scheme != "https" || u.Host == "" || u.User != nil {
+			return nil, fmt.Errorf("Invalid export endpoint: %s", endpoint)
+		}
+		c.ExportEndpoints = append(c.ExportEndpoints, strings.TrimSuffix(endpoint, "/"))
+	}
+
+	c.LeaderLockDeployment = os.Getenv("LEADER_LOCK_DEPLOYMENT")
+	// The broker would treat such a deployment as an instance's, and rewrite
+	// its notes.
+	if strings.HasPrefix(c.LeaderLockDeployment, c.DBPrefix+"-") {
+		return nil, fmt.Errorf("Invalid leader lock deployment: %s is named like a service instance", c.LeaderLockDeployment)
+	}
+
+	c.LeaderLeaseTTL = 30 * time.Second
+	leaseTTLFromEnv := os.Getenv("LEADER_LEASE_TTL")
+	if leaseTTLFromEnv != "" {
+		ttl, err := time.ParseDuration(leaseTTLFromEnv)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid leader lease TTL: %s", leaseTTLFromEnv)
+		}
+		if ttl < leader.MinTTL {
+			return nil, fmt.Errorf("Invalid leader lease TTL: %s is less than the minimum of %s", leaseTTLFromEnv, leader.MinTTL)
+		}
+		c.LeaderLeaseTTL = ttl
+	}
+
+	c.AuditEventsURL = os.Getenv("AUDIT_EVENTS_URL")
+	if c.AuditEventsURL != "" && c.LeaderLockDeployment == "" {
+		return nil, fmt.Errorf("AUDIT_EVENTS_URL needs LEADER_LOCK_DEPLOYMENT to be set")
+	}
+
+	c.AuditLog = os.Getenv("AUDIT_LOG")
+	if c.AuditLog == "" {
+		c.AuditLog = "none"
+	}
+	if c.AuditLog != "stdout" && c.AuditLog != "syslog" && c.AuditLog != "none" && (!strings.HasPrefix(c.AuditLog, "file:") || c.AuditLog == "file:") {
+		return nil, fmt.Errorf("Invalid audit log: %s", c.AuditLog)
+	}
+	c.AuditLogKey = os.Getenv("AUDIT_LOG_KEY")
+	if c.AuditLogKey == "" && c.AuditLog != "none" {
+		return nil, fmt.Errorf("Please export $AUDIT_LOG_KEY to record the audit log to %s", c.AuditLog)
+	}
+
+	c.AlertsWebhookURL = os.Getenv("ALERTS_WEBHOOK_URL")
+
+	c.TracingEndpoint = os.Getenv("TRACING_ENDPOINT")
+	c.TracingFormat = os.Getenv("TRACING_FORMAT")
+	if c.TracingFormat == "" {
+		c.TracingFormat = "zipkin"
+	}
+	if c.TracingFormat != "zipkin" && c.TracingFormat != "otlp" {
+		return nil, fmt.Errorf("Invalid tracing format: %s", c.TracingFormat)
+	}
+
 	whitelist, err := ParseIPWhitelist(os.Getenv("IP_WHITELIST"))
 	if err != nil {
 		return nil, err
@@ -91,3 +344,14 @@ func ParseIPWhitelist(ips string) ([]string, error) {
 	}
 	return outIPs, nil
 }
+
+// ParseList splits a comma-separated list, ignoring blank entries.
+func ParseList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
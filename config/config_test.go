@@ -1,7 +1,11 @@
 package config_test
 
 import (
+	"os"
+	"time"
+
 	. "github.com/alphagov/paas-compose-broker/config"
+	"github.com/alphagov/paas-compose-broker/leader"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -28,3 +32,166 @@ var _ = Describe("parsing a whitelist", func() {
 		Expect(err).To(HaveOccurred())
 	})
 })
+
+var _ = Describe("parsing a list", func() {
+	It("parses an empty string as an empty list", func() {
+		Expect(ParseList("")).To(BeEmpty())
+	})
+
+	It("trims spaces and skips blank entries", func() {
+		Expect(ParseList(" a, b,,c ")).To(Equal([]string{"a", "b", "c"}))
+	})
+})
+
+var _ = Describe("reading the environment", func() {
+	var saved map[string]string
+
+	setenv := func(name, value string) {
+		if _, ok := saved[name]; !ok {
+			saved[name] = os.Getenv(name)
+		}
+		os.Setenv(name, value)
+	}
+
+	BeforeEach(func() {
+		saved = map[string]string{}
+		setenv("USERNAME", "username")
+		setenv("PASSWORD", "password")
+		setenv("COMPOSE_API_KEY", "api-key")
+		setenv("AUDIT_LOG_KEY", "audit-key")
+		for _, name := range []string{
+			"COMPOSE_RETRY_ATTEMPTS", "COMPOSE_RETRY_BASE_DELAY", "COMPOSE_RETRY_MAX_DELAY",
+			"COMPOSE_CIRCUIT_FAILURES", "COMPOSE_CIRCUIT_COOLDOWN",
+			"DEPLOYMENT_CACHE_TTL", "SHUTDOWN_TIMEOUT",
+			"LEADER_LOCK_DEPLOYMENT", "LEADER_LEASE_TTL", "DB_PREFIX",
+			"EXPORT_ENDPOINTS", "AUDIT_LOG",
+		} {
+			setenv(name, "")
+		}
+	})
+
+	AfterEach(func() {
+		for name, value := range saved {
+			os.Setenv(name, value)
+		}
+	})
+
+	It("has defaults", func() {
+		cfg, err := New()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.ComposeRetryAttempts).To(Equal(0), "the compose package's default policy applies")
+		Expect(cfg.ComposeCircuitFailures).To(Equal(5))
+		Expect(cfg.ComposeCircuitCooldown).To(Equal(30 * time.Second))
+		Expect(cfg.DeploymentCacheTTL).To(Equal(time.Minute))
+		Expect(cfg.ShutdownTimeout).To(Equal(8 * time.Second))
+		Expect(cfg.LeaderLeaseTTL).To(Equal(30 * time.Second))
+	})
+
+	It("reads the Compose retry policy", func() {
+		setenv("COMPOSE_RETRY_ATTEMPTS", "2")
+		setenv("COMPOSE_RETRY_BASE_DELAY", "100ms")
+		setenv("COMPOSE_RETRY_MAX_DELAY", "5s")
+
+		cfg, err := New()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.ComposeRetryAttempts).To(Equal(2))
+		Expect(cfg.ComposeRetryBaseDelay).To(Equal(100 * time.Millisecond))
+		Expect(cfg.ComposeRetryMaxDelay).To(Equal(5 * time.Second))
+	})
+
+	It("reads the circuit breaker settings", func() {
+		setenv("COMPOSE_CIRCUIT_FAILURES", "3")
+		setenv("COMPOSE_CIRCUIT_COOLDOWN", "1m")
+
+		cfg, err := New()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.ComposeCircuitFailures).To(Equal(3))
+		Expect(cfg.ComposeCircuitCooldown).To(Equal(time.Minute))
+	})
+
+	It("allows the deployment cache to be disabled", func() {
+		setenv("DEPLOYMENT_CACHE_TTL", "0")
+
+		cfg, err := New()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.DeploymentCacheTTL).To(Equal(time.Duration(0)))
+	})
+
+	It("reads a shutdown timeout within Cloud Foundry's stop grace period", func() {
+		setenv("SHUTDOWN_TIMEOUT", "5s")
+
+		cfg, err := New()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.ShutdownTimeout).To(Equal(5 * time.Second))
+	})
+
+	It("reads the leader lease settings", func() {
+		setenv("LEADER_LOCK_DEPLOYMENT", "broker-lock")
+		setenv("LEADER_LEASE_TTL", "1m")
+
+		cfg, err := New()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.LeaderLockDeployment).To(Equal("broker-lock"))
+		Expect(cfg.LeaderLeaseTTL).To(Equal(time.Minute))
+	})
+
+	It("accepts a leader lease TTL which fits a renewal in each third of it", func() {
+		setenv("LEADER_LEASE_TTL", "15s")
+
+		cfg, err := New()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.LeaderLeaseTTL).To(Equal(leader.MinTTL))
+	})
+
+	It("reads the object stores backups may be exported to", func() {
+		setenv("EXPORT_ENDPOINTS", "https://objects.example.com/, https://s3.example.org")
+
+		cfg, err := New()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.ExportEndpoints).To(Equal([]string{"https://objects.example.com", "https://s3.example.org"}))
+	})
+
+	It("records no audit log by default, needing no key", func() {
+		setenv("AUDIT_LOG_KEY", "")
+
+		cfg, err := New()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.AuditLog).To(Equal("none"))
+	})
+
+	It("needs a key to record an audit log", func() {
+		setenv("AUDIT_LOG", "stdout")
+		setenv("AUDIT_LOG_KEY", "")
+
+		_, err := New()
+		Expect(err).To(MatchError("Please export $AUDIT_LOG_KEY to record the audit log to stdout"))
+
+		setenv("AUDIT_LOG_KEY", "audit-key")
+		cfg, err := New()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.AuditLog).To(Equal("stdout"))
+	})
+
+	for _, invalid := range []struct{ description, name, value, message string }{
+		{"no retry attempts", "COMPOSE_RETRY_ATTEMPTS", "0", "Invalid compose retry attempts"},
+		{"a retry base delay which is not a duration", "COMPOSE_RETRY_BASE_DELAY", "soon", "Invalid compose retry base delay"},
+		{"a negative retry max delay", "COMPOSE_RETRY_MAX_DELAY", "-1s", "Invalid compose retry max delay"},
+		{"no circuit failures", "COMPOSE_CIRCUIT_FAILURES", "0", "Invalid compose circuit failures"},
+		{"no circuit cooldown", "COMPOSE_CIRCUIT_COOLDOWN", "0s", "Invalid compose circuit cooldown"},
+		{"a negative deployment cache TTL", "DEPLOYMENT_CACHE_TTL", "-1m", "Invalid deployment cache TTL"},
+		{"a shutdown timeout which is not a duration", "SHUTDOWN_TIMEOUT", "9", "Invalid shutdown timeout"},
+		{"a shutdown timeout as long as the stop grace period", "SHUTDOWN_TIMEOUT", "10s", "not less than Cloud Foundry's 10s stop grace period"},
+		{"a leader lease TTL which is not a duration", "LEADER_LEASE_TTL", "30", "Invalid leader lease TTL"},
+		{"a leader lease TTL below the minimum", "LEADER_LEASE_TTL", "14s", "Invalid leader lease TTL: 14s is less than the minimum of 15s"},
+		{"an export endpoint without HTTPS", "EXPORT_ENDPOINTS", "http://objects.example.com", "Invalid export endpoint"},
+		{"a leader lock deployment named like an instance", "LEADER_LOCK_DEPLOYMENT", "compose-broker-lock", "named like a service instance"},
+	} {
+		invalid := invalid
+		It("rejects "+invalid.description, func() {
+			setenv(invalid.name, invalid.value)
+
+			_, err := New()
+			Expect(err).To(MatchError(ContainSubstring(invalid.message)))
+		})
+	}
+})
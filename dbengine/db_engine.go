@@ -1,6 +1,25 @@
 package dbengine
 
+import "context"
+
+// DBEngine manages the credentials of a deployment. Implementations should
+// give up when ctx is done.
 type DBEngine interface {
-	GenerateCredentials(instanceID, bindingID string) (interface{}, error)
-	RevokeCredentials(instanceID, bindingID string) error
+	GenerateCredentials(ctx context.Context, instanceID, bindingID string) (interface{}, error)
+	RevokeCredentials(ctx context.Context, instanceID, bindingID string) error
+}
+
+// ReadyHook is implemented by engines which set a deployment up once Compose
+// has finished provisioning it. The broker runs OnReady until it succeeds
+// once, but may run it again if it restarts before recording that, so
+// OnReady must be safe to repeat.
+type ReadyHook interface {
+	OnReady(ctx context.Context) error
+}
+
+// StatsReporter is implemented by engines which can report how much of a
+// deployment's database is in use, as statistics by name such as
+// "data_size_bytes".
+type StatsReporter interface {
+	Stats(ctx context.Context) (map[string]float64, error)
 }
@@ -1,12 +1,21 @@
 package dbengine
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"net/url"
 	"regexp"
 	"strings"
 
 	composeapi "github.com/compose/gocomposeapi"
+
+	"github.com/alphagov/paas-compose-broker/client/elastic"
+	"github.com/alphagov/paas-compose-broker/tracing"
 )
 
 // FIXME: this resolves an issue with the hostname returned by Compose
@@ -81,7 +90,11 @@ func NewElasticSearchEngine(deployment *composeapi.Deployment) *ElasticSearchEng
 	return &ElasticSearchEngine{deployment}
 }
 
-func (e *ElasticSearchEngine) GenerateCredentials(instanceID, bindingID string) (interface{}, error) {
+func (e *ElasticSearchEngine) GenerateCredentials(ctx context.Context, instanceID, bindingID string) (interface{}, error) {
+	return e.masterCredentials()
+}
+
+func (e *ElasticSearchEngine) masterCredentials() (*ElasticSearchCredentials, error) {
 	if e.deployment == nil {
 		return nil, fmt.Errorf("no deployment provided: cannot parse the connection string")
 	} else if len(e.deployment.Connection.Direct) < 1 {
@@ -99,6 +112,85 @@ func (e *ElasticSearchEngine) GenerateCredentials(instanceID, bindingID string)
 	return credentials, nil
 }
 
-func (e *ElasticSearchEngine) RevokeCredentials(instanceID, bindingID string) error {
+func (e *ElasticSearchEngine) RevokeCredentials(ctx context.Context, instanceID, bindingID string) error {
 	return nil
 }
+
+// clusterSettings are applied to new deployments. Requiring indices to be
+// named when deleting them stops `DELETE /_all` from wiping a deployment.
+var clusterSettings = map[string]interface{}{
+	"persistent": map[string]interface{}{
+		"action.destructive_requires_name": true,
+	},
+}
+
+func (e *ElasticSearchEngine) OnReady(ctx context.Context) error {
+	credentials, err := e.masterCredentials()
+	if err != nil {
+		return err
+	}
+	httpClient, err := SetupHTTPClient(e.deployment.CACertificateBase64)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(clusterSettings)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", strings.TrimSuffix(credentials.URI, "/")+"/_cluster/settings", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	_, span := tracing.StartSpan(ctx, "elasticsearch.PUT /_cluster/settings", tracing.KindClient, map[string]string{
+		"db.system": "elasticsearch",
+	})
+	err = putClusterSettings(httpClient, req.WithContext(ctx))
+	span.Finish(err)
+	return err
+}
+
+func putClusterSettings(httpClient *http.Client, req *http.Request) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to apply cluster settings: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		detail, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("failed to apply cluster settings: %s: %s", resp.Status, detail)
+	}
+	return nil
+}
+
+// Stats reports the deployment's index statistics from _cluster/stats.
+func (e *ElasticSearchEngine) Stats(ctx context.Context) (map[string]float64, error) {
+	credentials, err := e.masterCredentials()
+	if err != nil {
+		return nil, err
+	}
+	httpClient, err := SetupHTTPClient(e.deployment.CACertificateBase64)
+	if err != nil {
+		return nil, err
+	}
+	client, err := elastic.New(credentials.URI, httpClient)
+	if err != nil {
+		return nil, err
+	}
+
+	_, span := tracing.StartSpan(ctx, "elasticsearch.GET /_cluster/stats", tracing.KindClient, map[string]string{
+		"db.system": "elasticsearch",
+	})
+	stats, err := client.ClusterStats(ctx)
+	span.Finish(err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cluster stats: %s", err)
+	}
+	return map[string]float64{
+		"indices":          float64(stats.Indices.Count),
+		"documents":        float64(stats.Indices.Docs.Count),
+		"store_size_bytes": float64(stats.Indices.Store.SizeInBytes),
+	}, nil
+}
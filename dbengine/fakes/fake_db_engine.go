@@ -1,6 +1,8 @@
 package fakes
 
 import (
+	"context"
+
 	composeapi "github.com/compose/gocomposeapi"
 )
 
@@ -18,7 +20,7 @@ type FakeDBEngine struct {
 	deployment *composeapi.Deployment
 }
 
-func (e *FakeDBEngine) GenerateCredentials(instanceID, bindingID string) (interface{}, error) {
+func (e *FakeDBEngine) GenerateCredentials(ctx context.Context, instanceID, bindingID string) (interface{}, error) {
 	return &FakeCredentials{
 		Host:                "localhost",
 		Port:                "27017",
@@ -30,6 +32,33 @@ func (e *FakeDBEngine) GenerateCredentials(instanceID, bindingID string) (interf
 	}, nil
 }
 
-func (f *FakeDBEngine) RevokeCredentials(instanceID, bindingID string) error {
+func (f *FakeDBEngine) RevokeCredentials(ctx context.Context, instanceID, bindingID string) error {
 	return nil
 }
+
+// FakeReadyDBEngine is a FakeDBEngine with a ready hook.
+type FakeReadyDBEngine struct {
+	FakeDBEngine
+	OnReadyError error
+	onReadyCalls int
+}
+
+func (e *FakeReadyDBEngine) OnReady(ctx context.Context) error {
+	e.onReadyCalls++
+	return e.OnReadyError
+}
+
+func (e *FakeReadyDBEngine) OnReadyCallCount() int {
+	return e.onReadyCalls
+}
+
+// FakeStatsDBEngine is a FakeDBEngine which reports database stats.
+type FakeStatsDBEngine struct {
+	FakeDBEngine
+	StatsResult map[string]float64
+	StatsError  error
+}
+
+func (e *FakeStatsDBEngine) Stats(ctx context.Context) (map[string]float64, error) {
+	return e.StatsResult, e.StatsError
+}
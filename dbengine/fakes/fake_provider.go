@@ -13,6 +13,9 @@ type FakeProvider struct {
 }
 
 func (f FakeProvider) GetDBEngine(deployment *composeapi.Deployment) (dbengine.DBEngine, error) {
+	if f.DBEngine != nil || f.DBEngineError != nil {
+		return f.DBEngine, f.DBEngineError
+	}
 	switch deployment.Type {
 	case "fakedb":
 		return &FakeDBEngine{deployment}, nil
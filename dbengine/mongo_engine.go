@@ -1,6 +1,7 @@
 package dbengine
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
@@ -12,11 +13,21 @@ import (
 
 	composeapi "github.com/compose/gocomposeapi"
 	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/alphagov/paas-compose-broker/tracing"
 )
 
 const (
 	passwordLength      = 32
 	defaultDatabaseName = "default"
+	defaultDialTimeout  = 10 * time.Second
+	// readyCollectionName is the collection created by OnReady, as
+	// MongoDB only creates a database with its first collection.
+	readyCollectionName = "compose_broker"
+	// namespaceExistsCode is MongoDB's error code for creating a
+	// collection which already exists.
+	namespaceExistsCode = 48
 )
 
 // MongoSession is an incomplete interface for mgo.Session
@@ -25,6 +36,17 @@ type MongoSession interface {
 	Run(cmd interface{}, result interface{}) error
 }
 
+// DatabaseStats is the part of the dbStats command's result reported as the
+// engine's stats.
+type DatabaseStats struct {
+	Collections float64 `bson:"collections"`
+	Objects     float64 `bson:"objects"`
+	DataSize    float64 `bson:"dataSize"`
+	StorageSize float64 `bson:"storageSize"`
+	Indexes     float64 `bson:"indexes"`
+	IndexSize   float64 `bson:"indexSize"`
+}
+
 type DatabaseNames struct {
 	Databases []struct {
 		Name  string
@@ -75,21 +97,16 @@ func dialInfoToCredentials(dialInfo *mgo.DialInfo, caCertificateBase64 string) *
 	}
 }
 
-func (e *MongoEngine) GenerateCredentials(instanceID, bindingID string) (interface{}, error) {
-	masterDialInfo, err := e.getMasterDialInfo()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get master dial info: %s", err.Error())
-	}
-
-	session, err := mgo.DialWithInfo(masterDialInfo)
+func (e *MongoEngine) GenerateCredentials(ctx context.Context, instanceID, bindingID string) (interface{}, error) {
+	masterDialInfo, session, err := e.connect(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to MongoDB: %s", err.Error())
+		return nil, err
 	}
 	defer session.Close()
 
-	dbName, err := e.GetDatabaseName(session, defaultDatabaseName)
+	dbName, err := e.getDatabaseName(ctx, session)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list the MongoDB databases: %s", err.Error())
+		return nil, err
 	}
 
 	username := makeUserName(bindingID)
@@ -98,11 +115,13 @@ func (e *MongoEngine) GenerateCredentials(instanceID, bindingID string) (interfa
 		return nil, fmt.Errorf("failed to generate password: %s", err.Error())
 	}
 
+	_, span := startMongoSpan(ctx, "UpsertUser")
 	err = session.DB(dbName).UpsertUser(&mgo.User{
 		Username: username,
 		Password: password,
 		Roles:    []mgo.Role{mgo.RoleReadWrite},
 	})
+	span.Finish(err)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create user in MongoDB: %s", err.Error())
 	}
@@ -115,30 +134,140 @@ func (e *MongoEngine) GenerateCredentials(instanceID, bindingID string) (interfa
 	return dialInfoToCredentials(bindDialInfo, e.deployment.CACertificateBase64), nil
 }
 
-func (e *MongoEngine) RevokeCredentials(instanceID, bindingID string) error {
-	masterDialInfo, err := e.getMasterDialInfo()
+func (e *MongoEngine) RevokeCredentials(ctx context.Context, instanceID, bindingID string) error {
+	_, session, err := e.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	dbName, err := e.getDatabaseName(ctx, session)
 	if err != nil {
-		return fmt.Errorf("failed to get master dial info: %s", err.Error())
+		return err
 	}
 
-	session, err := mgo.DialWithInfo(masterDialInfo)
+	username := makeUserName(bindingID)
+
+	_, span := startMongoSpan(ctx, "RemoveUser")
+	err = session.DB(dbName).RemoveUser(username)
+	span.Finish(err)
+	return err
+}
+
+// OnReady creates the database the broker creates users in, so that it
+// exists, and is reported by Stats, before the instance is first bound.
+func (e *MongoEngine) OnReady(ctx context.Context) error {
+	_, session, err := e.connect(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to connect to MongoDB: %s", err.Error())
+		return err
 	}
 	defer session.Close()
 
-	dbName, err := e.GetDatabaseName(session, defaultDatabaseName)
+	dbName, err := e.getDatabaseName(ctx, session)
 	if err != nil {
-		return fmt.Errorf("failed to list the MongoDB databases: %s", err.Error())
+		return err
 	}
 
-	username := makeUserName(bindingID)
+	_, span := startMongoSpan(ctx, "create")
+	err = e.CreateDatabase(session.DB(dbName))
+	span.Finish(err)
+	if err != nil {
+		return fmt.Errorf("failed to create the MongoDB database: %s", err.Error())
+	}
+	return nil
+}
+
+// CreateDatabase creates db by creating a collection in it. It succeeds if
+// the collection already exists, so that it can be repeated.
+func (e *MongoEngine) CreateDatabase(db MongoSession) error {
+	err := db.Run(bson.D{{Name: "create", Value: readyCollectionName}}, nil)
+	if queryErr, ok := err.(*mgo.QueryError); ok && (queryErr.Code == namespaceExistsCode || strings.Contains(queryErr.Message, "already exists")) {
+		return nil
+	}
+	return err
+}
+
+// Stats reports the dbStats of the database the broker creates users in.
+func (e *MongoEngine) Stats(ctx context.Context) (map[string]float64, error) {
+	_, session, err := e.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	dbName, err := e.getDatabaseName(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+
+	_, span := startMongoSpan(ctx, "dbStats")
+	stats, err := e.GetDatabaseStats(session.DB(dbName))
+	span.Finish(err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the MongoDB database stats: %s", err.Error())
+	}
+	return stats, nil
+}
+
+// GetDatabaseStats runs dbStats on db.
+func (e *MongoEngine) GetDatabaseStats(db MongoSession) (map[string]float64, error) {
+	var result DatabaseStats
+	if err := db.Run("dbStats", &result); err != nil {
+		return nil, err
+	}
+	return map[string]float64{
+		"collections":        result.Collections,
+		"objects":            result.Objects,
+		"data_size_bytes":    result.DataSize,
+		"storage_size_bytes": result.StorageSize,
+		"indexes":            result.Indexes,
+		"index_size_bytes":   result.IndexSize,
+	}, nil
+}
+
+// startMongoSpan starts a span for a MongoDB operation of the request.
+func startMongoSpan(ctx context.Context, operation string) (context.Context, *tracing.Span) {
+	return tracing.StartSpan(ctx, "mongodb."+operation, tracing.KindClient, map[string]string{
+		"db.system": "mongodb",
+	})
+}
+
+// connect dials the deployment as the admin user. The dial, and the TLS
+// dial of each server within it, are traced.
+func (e *MongoEngine) connect(ctx context.Context) (*mgo.DialInfo, *mgo.Session, error) {
+	ctx, span := startMongoSpan(ctx, "connect")
+	masterDialInfo, err := e.getMasterDialInfo(ctx)
+	if err != nil {
+		err = fmt.Errorf("failed to get master dial info: %s", err.Error())
+		span.Finish(err)
+		return nil, nil, err
+	}
+
+	session, err := dialWithContext(ctx, masterDialInfo)
+	if err != nil {
+		err = fmt.Errorf("failed to connect to MongoDB: %s", err.Error())
+		span.Finish(err)
+		return nil, nil, err
+	}
+	span.Finish(nil)
+	return masterDialInfo, session, nil
+}
 
-	return session.DB(dbName).RemoveUser(username)
+// getDatabaseName is GetDatabaseName for the default database, traced.
+func (e *MongoEngine) getDatabaseName(ctx context.Context, session MongoSession) (string, error) {
+	_, span := startMongoSpan(ctx, "listDatabases")
+	dbName, err := e.GetDatabaseName(session, defaultDatabaseName)
+	if err != nil {
+		err = fmt.Errorf("failed to list the MongoDB databases: %s", err.Error())
+	}
+	span.Finish(err)
+	return dbName, err
 }
 
-func (e *MongoEngine) getMasterDialInfo() (*mgo.DialInfo, error) {
-	if e.deployment == nil {
+func (e *MongoEngine) getMasterDialInfo(ctx context.Context) (*mgo.DialInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	} else if e.deployment == nil {
 		return nil, fmt.Errorf("no deployment provided: cannot parse the connection string")
 	} else if len(e.deployment.Connection.Direct) < 1 {
 		return nil, fmt.Errorf("failed to get connection string")
@@ -155,8 +284,8 @@ func (e *MongoEngine) getMasterDialInfo() (*mgo.DialInfo, error) {
 	if err != nil {
 		return nil, err
 	}
-	dialInfo.Timeout = 10 * time.Second
-	dialInfo.DialServer, err = createDialServer(e.deployment.CACertificateBase64)
+	dialInfo.Timeout = dialTimeout(ctx)
+	dialInfo.DialServer, err = createDialServer(ctx, e.deployment.CACertificateBase64)
 	if err != nil {
 		return nil, err
 	}
@@ -175,7 +304,34 @@ func removeSSLOption(uri string) (string, error) {
 	return u.String(), nil
 }
 
-func createDialServer(caCert string) (func(*mgo.ServerAddr) (net.Conn, error), error) {
+// dialTimeout is how long to wait for MongoDB: the default, or less if the
+// context has a sooner deadline.
+func dialTimeout(ctx context.Context) time.Duration {
+	timeout := defaultDialTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := deadline.Sub(time.Now()); remaining < timeout {
+			timeout = remaining
+		}
+	}
+	return timeout
+}
+
+// dialWithContext is mgo.DialWithInfo bounded by ctx. The dial times out by
+// the context's deadline and each server is dialled with ctx, so it returns
+// soon after ctx is done, and is waited for rather than left running with
+// its connections open. A session established after ctx is done is closed.
+func dialWithContext(ctx context.Context, dialInfo *mgo.DialInfo) (*mgo.Session, error) {
+	session, err := mgo.DialWithInfo(dialInfo)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		if session != nil {
+			session.Close()
+		}
+		return nil, ctxErr
+	}
+	return session, err
+}
+
+func createDialServer(ctx context.Context, caCert string) (func(*mgo.ServerAddr) (net.Conn, error), error) {
 	roots := x509.NewCertPool()
 	ca, err := base64.StdEncoding.DecodeString(caCert)
 	if err != nil {
@@ -183,15 +339,54 @@ func createDialServer(caCert string) (func(*mgo.ServerAddr) (net.Conn, error), e
 	}
 	roots.AppendCertsFromPEM(ca)
 
-	tlsConfig := &tls.Config{}
-	tlsConfig.RootCAs = roots
-
 	return func(addr *mgo.ServerAddr) (net.Conn, error) {
-		conn, err := tls.Dial("tcp", addr.String(), tlsConfig)
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return nil, err
+		}
+
+		_, span := startMongoSpan(ctx, "tls-dial")
+		span.SetTag("peer.address", addr.String())
+		conn, err := dialTLS(ctx, addr.String(), &tls.Config{RootCAs: roots, ServerName: host})
+		span.Finish(err)
 		return conn, err
 	}, nil
 }
 
+func dialTLS(ctx context.Context, addr string, config *tls.Config) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if deadline, ok := ctx.Deadline(); ok {
+		tlsConn.SetDeadline(deadline)
+	}
+	// Closing the connection ends a handshake in progress if ctx is
+	// cancelled.
+	handshook := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-handshook:
+		}
+	}()
+	err = tlsConn.Handshake()
+	close(handshook)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
 func (e *MongoEngine) GetDatabaseName(session MongoSession, defaultName string) (string, error) {
 	var result DatabaseNames
 	if err := session.Run("listDatabases", &result); err != nil {
@@ -8,6 +8,8 @@ import (
 	"github.com/alphagov/paas-compose-broker/dbengine/fakes"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 var _ = Describe("MongoDB Engine", func() {
@@ -54,6 +56,73 @@ var _ = Describe("MongoDB Engine", func() {
 
 	})
 
+	Describe("CreateDatabase()", func() {
+		It("should create a collection in the database", func() {
+			mongoEngine := dbengine.MongoEngine{}
+			db := &fakes.FakeMongoSession{}
+
+			Expect(mongoEngine.CreateDatabase(db)).To(Succeed())
+			cmd, _ := db.RunArgsForCall(0)
+			Expect(cmd).To(Equal(bson.D{{Name: "create", Value: "compose_broker"}}))
+		})
+
+		It("should succeed if the collection already exists", func() {
+			mongoEngine := dbengine.MongoEngine{}
+			db := &fakes.FakeMongoSession{}
+			db.RunReturns(&mgo.QueryError{Code: 48, Message: "collection already exists"})
+
+			Expect(mongoEngine.CreateDatabase(db)).To(Succeed())
+		})
+
+		It("should return any other error", func() {
+			mongoEngine := dbengine.MongoEngine{}
+			db := &fakes.FakeMongoSession{}
+			db.RunReturns(&mgo.QueryError{Code: 13, Message: "not authorized"})
+
+			Expect(mongoEngine.CreateDatabase(db)).To(MatchError("not authorized"))
+		})
+	})
+
+	Describe("GetDatabaseStats()", func() {
+		It("should run dbStats and return the stats by name", func() {
+			mongoEngine := dbengine.MongoEngine{}
+			db := &fakes.FakeMongoSession{}
+			db.RunStub = func(cmd interface{}, result interface{}) error {
+				reflect.ValueOf(result).Elem().Set(reflect.ValueOf(dbengine.DatabaseStats{
+					Collections: 2,
+					Objects:     10,
+					DataSize:    2048,
+					StorageSize: 4096,
+					Indexes:     3,
+					IndexSize:   1024,
+				}))
+				return nil
+			}
+
+			stats, err := mongoEngine.GetDatabaseStats(db)
+			Expect(err).NotTo(HaveOccurred())
+			cmd, _ := db.RunArgsForCall(0)
+			Expect(cmd).To(Equal("dbStats"))
+			Expect(stats).To(Equal(map[string]float64{
+				"collections":        2,
+				"objects":            10,
+				"data_size_bytes":    2048,
+				"storage_size_bytes": 4096,
+				"indexes":            3,
+				"index_size_bytes":   1024,
+			}))
+		})
+
+		It("should return the error if dbStats fails", func() {
+			mongoEngine := dbengine.MongoEngine{}
+			db := &fakes.FakeMongoSession{}
+			db.RunReturns(errors.New("not authorized"))
+
+			_, err := mongoEngine.GetDatabaseStats(db)
+			Expect(err).To(MatchError("not authorized"))
+		})
+	})
+
 })
 
 func createMongoSessionRunStub(databaseNames ...string) func(cmd interface{}, result interface{}) error {
@@ -0,0 +1,120 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/alphagov/paas-compose-broker/compose"
+)
+
+// DefaultInterval is how often the Compose API is checked.
+const DefaultInterval = 30 * time.Second
+
+// Compose API statuses.
+const (
+	ComposeOK          = "ok"
+	ComposeUnreachable = "unreachable"
+	ComposeUnknown     = "unknown"
+)
+
+// Status is the body served at /healthz. It says nothing more than whether
+// each part is up, as it is served without authentication.
+type Status struct {
+	Broker  string `json:"broker"`
+	Compose string `json:"compose"`
+}
+
+type circuitBreaker interface {
+	State() compose.CircuitState
+}
+
+// Checker checks the Compose API in the background, so that probes of the
+// health endpoint cost no Compose calls.
+type Checker struct {
+	client compose.Client
+	logger lager.Logger
+
+	mu      sync.Mutex
+	checked bool
+	err     error
+}
+
+func NewChecker(client compose.Client, logger lager.Logger) *Checker {
+	return &Checker{
+		client: client,
+		logger: logger.Session("health"),
+	}
+}
+
+// Run checks the Compose API now and every interval until stop is closed.
+func (c *Checker) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		c.Check(interval)
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check fetches the Compose account, giving up after timeout, and records
+// whether it could.
+func (c *Checker) Check(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var err error
+	if _, errs := compose.WithContext(ctx, c.client).GetAccount(); len(errs) > 0 {
+		err = compose.SquashErrors(errs)
+		c.logger.Error("compose-unreachable", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checked = true
+	c.err = err
+}
+
+// ComposeStatus is the status of the Compose API: unreachable while the
+// circuit breaker is open, otherwise as last checked.
+func (c *Checker) ComposeStatus() string {
+	if breaker, ok := c.client.(circuitBreaker); ok && breaker.State() == compose.CircuitOpen {
+		return ComposeUnreachable
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case !c.checked:
+		return ComposeUnknown
+	case c.err != nil:
+		return ComposeUnreachable
+	}
+	return ComposeOK
+}
+
+// Handler reports that the broker is alive and whether the Compose API is
+// reachable. It responds 200 even when Compose is unreachable, so that it
+// can be used as a CF health check without the broker being restarted
+// during a Compose outage. Alerting should use `?strict=true`, which
+// responds 503 when Compose is unreachable.
+func Handler(checker *Checker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		status := Status{Broker: "ok", Compose: checker.ComposeStatus()}
+
+		w.Header().Set("Content-Type", "application/json")
+		if status.Compose == ComposeUnreachable && req.URL.Query().Get("strict") == "true" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	})
+}
@@ -0,0 +1,97 @@
+package health_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	composeapi "github.com/compose/gocomposeapi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/paas-compose-broker/compose"
+	"github.com/alphagov/paas-compose-broker/compose/fakes"
+	"github.com/alphagov/paas-compose-broker/health"
+)
+
+var _ = Describe("Health", func() {
+
+	var (
+		fakeComposeClient *fakes.FakeClient
+		checker           *health.Checker
+	)
+
+	BeforeEach(func() {
+		fakeComposeClient = &fakes.FakeClient{}
+		checker = health.NewChecker(fakeComposeClient, lager.NewLogger("test"))
+	})
+
+	probe := func(path string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		health.Handler(checker).ServeHTTP(resp, httptest.NewRequest("GET", path, nil))
+		return resp
+	}
+
+	It("reports Compose as reachable", func() {
+		fakeComposeClient.GetAccountReturns(&composeapi.Account{ID: "1"}, []error{})
+		checker.Check(time.Second)
+
+		resp := probe("/healthz?strict=true")
+		Expect(resp.Code).To(Equal(http.StatusOK))
+		Expect(resp.Body.String()).To(MatchJSON(`{"broker": "ok", "compose": "ok"}`))
+	})
+
+	It("does not call Compose when probed", func() {
+		probe("/healthz")
+		probe("/healthz")
+
+		Expect(fakeComposeClient.GetAccountCallCount()).To(Equal(0))
+		Expect(probe("/healthz").Body.String()).To(MatchJSON(`{"broker": "ok", "compose": "unknown"}`))
+	})
+
+	It("stays healthy when Compose is unreachable, without saying why", func() {
+		fakeComposeClient.GetAccountReturns(nil, []error{errors.New("connection refused to 10.0.0.1")})
+		checker.Check(time.Second)
+
+		resp := probe("/healthz")
+		Expect(resp.Code).To(Equal(http.StatusOK))
+		Expect(resp.Body.String()).To(MatchJSON(`{"broker": "ok", "compose": "unreachable"}`))
+	})
+
+	It("responds 503 in strict mode when Compose is unreachable", func() {
+		fakeComposeClient.GetAccountReturns(nil, []error{errors.New("connection refused")})
+		checker.Check(time.Second)
+
+		resp := probe("/healthz?strict=true")
+		Expect(resp.Code).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	It("reports Compose as unreachable while the circuit breaker is open", func() {
+		fakeComposeClient.GetAccountReturns(&composeapi.Account{ID: "1"}, []error{})
+		fakeComposeClient.GetRecipeReturns(nil, []error{errors.New("Unable to parse error - status code 503 - body down")})
+		breaker := compose.NewCircuitBreakerClient(fakeComposeClient, 1, time.Minute, lager.NewLogger("test"))
+		checker = health.NewChecker(breaker, lager.NewLogger("test"))
+		checker.Check(time.Second)
+		Expect(probe("/healthz").Body.String()).To(MatchJSON(`{"broker": "ok", "compose": "ok"}`))
+
+		breaker.GetRecipe("recipe")
+		Expect(probe("/healthz").Body.String()).To(MatchJSON(`{"broker": "ok", "compose": "unreachable"}`))
+	})
+
+	It("checks in the background until stopped", func() {
+		fakeComposeClient.GetAccountReturns(&composeapi.Account{ID: "1"}, []error{})
+		stop := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			checker.Run(10*time.Millisecond, stop)
+			close(stopped)
+		}()
+
+		Eventually(fakeComposeClient.GetAccountCallCount).Should(BeNumerically(">=", 2))
+		close(stop)
+		Eventually(stopped).Should(BeClosed())
+		Expect(probe("/healthz").Body.String()).To(MatchJSON(`{"broker": "ok", "compose": "ok"}`))
+	})
+})
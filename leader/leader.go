@@ -0,0 +1,27 @@
+// Package leader decides which broker instance runs background jobs, so
+// that jobs such as scheduled backups run once however many instances the
+// broker is scaled to.
+package leader
+
+import "os"
+
+type Leader interface {
+	// IsLeader reports whether this instance should run background jobs
+	// now. Jobs should check it each time they run.
+	IsLeader() bool
+}
+
+// Static is a leader decided once, at startup.
+type Static bool
+
+func (s Static) IsLeader() bool {
+	return bool(s)
+}
+
+// FromInstanceIndex makes the first instance of a Cloud Foundry app the
+// leader, or the only instance when not run on Cloud Foundry. It does not
+// fail over, so jobs stop while the first instance is down.
+func FromInstanceIndex() Static {
+	index := os.Getenv("CF_INSTANCE_INDEX")
+	return Static(index == "" || index == "0")
+}
@@ -0,0 +1,29 @@
+package leader_test
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/paas-compose-broker/leader"
+)
+
+var _ = Describe("FromInstanceIndex", func() {
+	AfterEach(func() {
+		os.Unsetenv("CF_INSTANCE_INDEX")
+	})
+
+	It("makes the first instance the leader", func() {
+		os.Setenv("CF_INSTANCE_INDEX", "0")
+		Expect(leader.FromInstanceIndex().IsLeader()).To(BeTrue())
+
+		os.Setenv("CF_INSTANCE_INDEX", "1")
+		Expect(leader.FromInstanceIndex().IsLeader()).To(BeFalse())
+	})
+
+	It("makes an instance not run on Cloud Foundry the leader", func() {
+		os.Unsetenv("CF_INSTANCE_INDEX")
+		Expect(leader.FromInstanceIndex().IsLeader()).To(BeTrue())
+	})
+})
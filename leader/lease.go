@@ -0,0 +1,262 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/alphagov/paas-compose-broker/compose"
+)
+
+// leaseKey is the key of the lease in the lock deployment's notes. Other
+// keys are left alone.
+const leaseKey = "leader"
+
+// ErrNotLeader is returned by the lease's store for writes of other keys
+// while this instance does not lead.
+var ErrNotLeader = errors.New("this broker instance does not hold the leader lease")
+
+const (
+	// DefaultSettleDelay is how long an instance taking the lease waits
+	// before reading it back. Competing writes must reach Compose within
+	// this long of each other.
+	DefaultSettleDelay = 2 * time.Second
+	// RoundTripAllowance is how long a Compose call is allowed to take when
+	// budgeting a renewal.
+	RoundTripAllowance = time.Second
+	// MinTTL is the shortest lease TTL with which a renewal fits in the
+	// third of the TTL between renewals: a read, a write, the settle delay
+	// and another read.
+	MinTTL = 3 * (DefaultSettleDelay + 3*RoundTripAllowance)
+)
+
+type lease struct {
+	Holder    string    `json:"holder"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Lease elects a leader by keeping a lease in the notes of a Compose
+// deployment. The holder renews it every TTL/3; when the holder stops, the
+// lease expires and another instance takes it over.
+//
+// Compose cannot update notes conditionally, so an instance taking over a
+// lease writes it and then reads it back after SettleDelay, and leads only
+// if its write was the last. A leader steps down a third of the TTL before
+// its lease expires if it cannot renew it, so that two instances do not
+// lead at once while clocks agree to within that margin. By then others may
+// see the lease as expired and write their own, so a holder renewing its
+// lease later than that takes it over again like any other instance.
+type Lease struct {
+	// ID identifies this instance in the lease.
+	ID          string
+	TTL         time.Duration
+	SettleDelay time.Duration
+	Logger      lager.Logger
+	// OnChange, if set, is called when this instance gains or loses the
+	// lead.
+	OnChange func(isLeader bool)
+	// Store holds the lease, under the "leader" key.
+	Store *compose.NotesStore
+
+	mu          sync.Mutex
+	leaderUntil time.Time
+	holder      string
+	leading     bool
+}
+
+// NewLease makes a lease kept in store, and guards store so that other keys
+// are only written while this instance leads. Each write puts back the
+// whole of the notes, so a former leader's write could otherwise undo the
+// lease another instance has taken since, and the new leader's lease the
+// former leader's other writes.
+func NewLease(store *compose.NotesStore, id string, ttl time.Duration, logger lager.Logger) *Lease {
+	l := &Lease{
+		ID:          id,
+		TTL:         ttl,
+		SettleDelay: DefaultSettleDelay,
+		Logger:      logger.Session("leader", lager.Data{"id": id}),
+		Store:       store,
+	}
+	store.Guard = l.guard
+	return l
+}
+
+// InstanceID identifies the running broker instance: its Cloud Foundry
+// instance GUID, or its hostname elsewhere.
+func InstanceID() string {
+	if guid := os.Getenv("CF_INSTANCE_GUID"); guid != "" {
+		return guid
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostname
+}
+
+func (l *Lease) IsLeader() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return time.Now().Before(l.leaderUntil)
+}
+
+// Holder is the ID of the instance which held the lease when it was last
+// read, or empty if nobody did.
+func (l *Lease) Holder() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.holder
+}
+
+// Run tries to take or renew the lease every TTL/3 until stop is closed,
+// when it gives the lease up so that another instance can take over
+// straight away.
+func (l *Lease) Run(stop <-chan struct{}) {
+	interval := l.TTL / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		l.Renew(ctx)
+		cancel()
+
+		select {
+		case <-stop:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			l.Release(ctx)
+			cancel()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Renew takes the lease if it is free, or renews it if this instance holds
+// it.
+func (l *Lease) Renew(ctx context.Context) {
+	defer l.notify()
+
+	start := time.Now()
+	current, err := l.read(ctx)
+	if err != nil {
+		l.Logger.Error("read-lease", err)
+		return
+	}
+	l.setHolder(current.Holder)
+
+	// This instance stopped leading a third of the TTL before its lease
+	// expires, so only renews without checking its write won before then.
+	held := current.Holder == l.ID && current.ExpiresAt.After(start.Add(l.TTL/3))
+	if current.Holder != l.ID && current.ExpiresAt.After(start) {
+		l.stepDown()
+		return
+	}
+
+	if err := l.write(ctx, lease{Holder: l.ID, ExpiresAt: start.Add(l.TTL)}); err != nil {
+		l.Logger.Error("write-lease", err)
+		return
+	}
+
+	if !held {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(l.SettleDelay):
+		}
+		current, err = l.read(ctx)
+		if err != nil {
+			l.Logger.Error("read-lease", err)
+			return
+		}
+		l.setHolder(current.Holder)
+		if current.Holder != l.ID {
+			l.stepDown()
+			return
+		}
+	}
+
+	l.mu.Lock()
+	l.leaderUntil = start.Add(l.TTL - l.TTL/3)
+	l.mu.Unlock()
+}
+
+// Release gives up the lease if this instance holds it.
+func (l *Lease) Release(ctx context.Context) {
+	defer l.notify()
+
+	if !l.IsLeader() {
+		return
+	}
+	l.stepDown()
+	current, err := l.read(ctx)
+	if err != nil {
+		l.Logger.Error("read-lease", err)
+		return
+	}
+	if current.Holder != l.ID {
+		return
+	}
+	if err := l.write(ctx, lease{Holder: l.ID, ExpiresAt: time.Now()}); err != nil {
+		l.Logger.Error("release-lease", err)
+	}
+}
+
+// guard allows writes of the lease itself, and of other keys only while
+// this instance leads. It steps down a third of the TTL before its lease
+// expires, leaving that long for the write to land before another instance
+// can take the lease over.
+func (l *Lease) guard(key string) error {
+	if key == leaseKey || l.IsLeader() {
+		return nil
+	}
+	return ErrNotLeader
+}
+
+func (l *Lease) stepDown() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.leaderUntil = time.Time{}
+}
+
+func (l *Lease) setHolder(holder string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.holder = holder
+}
+
+// notify logs and reports changes of leadership since it was last called.
+func (l *Lease) notify() {
+	isLeader := l.IsLeader()
+
+	l.mu.Lock()
+	changed := isLeader != l.leading
+	l.leading = isLeader
+	l.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if isLeader {
+		l.Logger.Info("became-leader")
+	} else {
+		l.Logger.Info("lost-leadership", lager.Data{"holder": l.Holder()})
+	}
+	if l.OnChange != nil {
+		l.OnChange(isLeader)
+	}
+}
+
+func (l *Lease) read(ctx context.Context) (lease, error) {
+	var current lease
+	_, err := l.Store.Get(ctx, leaseKey, &current)
+	return current, err
+}
+
+func (l *Lease) write(ctx context.Context, newLease lease) error {
+	return l.Store.Put(ctx, leaseKey, newLease)
+}
@@ -0,0 +1,225 @@
+package leader_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	composeapi "github.com/compose/gocomposeapi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/paas-compose-broker/compose"
+	"github.com/alphagov/paas-compose-broker/compose/fakes"
+	"github.com/alphagov/paas-compose-broker/leader"
+)
+
+var _ = Describe("Lease", func() {
+	var (
+		fakeComposeClient *fakes.FakeClient
+		notesMutex        sync.Mutex
+		notes             string
+		patchError        error
+		first, second     *leader.Lease
+	)
+
+	setNotes := func(n string) {
+		notesMutex.Lock()
+		defer notesMutex.Unlock()
+		notes = n
+	}
+
+	leaseNotes := func(holder string, expiresAt time.Time) string {
+		encoded, err := json.Marshal(map[string]interface{}{
+			"leader": map[string]interface{}{"holder": holder, "expires_at": expiresAt},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return string(encoded)
+	}
+
+	newLease := func(id string) *leader.Lease {
+		lease := leader.NewLease(compose.NewNotesStore(fakeComposeClient, "broker-lock"), id, 300*time.Millisecond, lager.NewLogger("test"))
+		lease.SettleDelay = time.Millisecond
+		return lease
+	}
+
+	BeforeEach(func() {
+		notes = ""
+		patchError = nil
+		fakeComposeClient = &fakes.FakeClient{}
+		fakeComposeClient.GetDeploymentByNameReturns(&composeapi.Deployment{ID: "lock"}, nil)
+		fakeComposeClient.GetDeploymentStub = func(id string) (*composeapi.Deployment, []error) {
+			notesMutex.Lock()
+			defer notesMutex.Unlock()
+			return &composeapi.Deployment{ID: id, Notes: notes}, nil
+		}
+		fakeComposeClient.PatchDeploymentStub = func(params composeapi.PatchDeploymentParams) (*composeapi.Deployment, []error) {
+			notesMutex.Lock()
+			defer notesMutex.Unlock()
+			if patchError != nil {
+				return nil, []error{patchError}
+			}
+			notes = params.Notes
+			return &composeapi.Deployment{ID: params.DeploymentID, Notes: notes}, nil
+		}
+
+		first = newLease("first")
+		second = newLease("second")
+	})
+
+	It("takes a free lease, keeping the rest of the notes", func() {
+		setNotes(`{"owner":"paas"}`)
+
+		first.Renew(context.Background())
+
+		Expect(first.IsLeader()).To(BeTrue())
+		Expect(first.Holder()).To(Equal("first"))
+		Expect(fakeComposeClient.GetDeploymentByNameArgsForCall(0)).To(Equal("broker-lock"))
+		var written map[string]interface{}
+		Expect(json.Unmarshal([]byte(notes), &written)).To(Succeed())
+		Expect(written).To(HaveKeyWithValue("owner", "paas"))
+		Expect(written).To(HaveKeyWithValue("leader", HaveKeyWithValue("holder", "first")))
+	})
+
+	It("does not lead while another instance holds the lease", func() {
+		first.Renew(context.Background())
+		second.Renew(context.Background())
+
+		Expect(first.IsLeader()).To(BeTrue())
+		Expect(second.IsLeader()).To(BeFalse())
+		Expect(second.Holder()).To(Equal("first"))
+	})
+
+	It("takes over a lease that has expired", func() {
+		setNotes(leaseNotes("first", time.Now().Add(-time.Second)))
+
+		second.Renew(context.Background())
+
+		Expect(second.IsLeader()).To(BeTrue())
+		Expect(second.Holder()).To(Equal("second"))
+	})
+
+	It("does not lead if another instance's write wins", func() {
+		fakeComposeClient.PatchDeploymentStub = func(params composeapi.PatchDeploymentParams) (*composeapi.Deployment, []error) {
+			notesMutex.Lock()
+			defer notesMutex.Unlock()
+			// The other instance writes straight after.
+			notes = leaseNotes("second", time.Now().Add(time.Minute))
+			return &composeapi.Deployment{ID: params.DeploymentID, Notes: notes}, nil
+		}
+
+		first.Renew(context.Background())
+
+		Expect(first.IsLeader()).To(BeFalse())
+		Expect(first.Holder()).To(Equal("second"))
+	})
+
+	It("confirms its claim when renewing a lease it has stopped leading on", func() {
+		setNotes(leaseNotes("first", time.Now().Add(50*time.Millisecond)))
+		fakeComposeClient.PatchDeploymentStub = func(params composeapi.PatchDeploymentParams) (*composeapi.Deployment, []error) {
+			notesMutex.Lock()
+			defer notesMutex.Unlock()
+			// The other instance saw the lease expire, and writes straight
+			// after.
+			notes = leaseNotes("second", time.Now().Add(time.Minute))
+			return &composeapi.Deployment{ID: params.DeploymentID, Notes: notes}, nil
+		}
+
+		first.Renew(context.Background())
+
+		Expect(first.IsLeader()).To(BeFalse())
+		Expect(first.Holder()).To(Equal("second"))
+	})
+
+	It("never lets two instances lead at once", func() {
+		patch := fakeComposeClient.PatchDeploymentStub
+		fakeComposeClient.PatchDeploymentStub = func(params composeapi.PatchDeploymentParams) (*composeapi.Deployment, []error) {
+			time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+			return patch(params)
+		}
+		first.SettleDelay = 10 * time.Millisecond
+		second.SettleDelay = 10 * time.Millisecond
+
+		stopFirst, stopSecond := make(chan struct{}), make(chan struct{})
+		var wg sync.WaitGroup
+		run := func(lease *leader.Lease, stop chan struct{}) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				lease.Run(stop)
+			}()
+		}
+		run(first, stopFirst)
+		run(second, stopSecond)
+
+		leaders := map[string]bool{}
+		watch := func(d time.Duration) {
+			for deadline := time.Now().Add(d); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+				firstLeads, secondLeads := first.IsLeader(), second.IsLeader()
+				Expect(firstLeads && secondLeads).To(BeFalse())
+				leaders["first"] = leaders["first"] || firstLeads
+				leaders["second"] = leaders["second"] || secondLeads
+			}
+		}
+		// Stop the leader, so that the other instance takes over.
+		watch(500 * time.Millisecond)
+		if first.IsLeader() {
+			stopFirst, stopSecond = stopSecond, stopFirst
+		}
+		close(stopSecond)
+		watch(500 * time.Millisecond)
+		close(stopFirst)
+		wg.Wait()
+
+		Expect(leaders).To(Equal(map[string]bool{"first": true, "second": true}))
+	})
+
+	It("steps down before its lease expires when it cannot renew it", func() {
+		first.Renew(context.Background())
+		Expect(first.IsLeader()).To(BeTrue())
+
+		patchError = errors.New("compose is down")
+		first.Renew(context.Background())
+
+		Eventually(first.IsLeader, "250ms", "10ms").Should(BeFalse())
+	})
+
+	It("hands over straight away when released", func() {
+		changes := []bool{}
+		first.OnChange = func(isLeader bool) { changes = append(changes, isLeader) }
+
+		first.Renew(context.Background())
+		first.Release(context.Background())
+		second.Renew(context.Background())
+
+		Expect(first.IsLeader()).To(BeFalse())
+		Expect(second.IsLeader()).To(BeTrue())
+		Expect(changes).To(Equal([]bool{true, false}))
+	})
+
+	It("lets the store write other keys only while leading", func() {
+		first.Renew(context.Background())
+		Expect(first.Store.Put(context.Background(), "checkpoint", 1)).To(Succeed())
+
+		taken := leaseNotes("second", time.Now().Add(time.Minute))
+		setNotes(taken)
+		first.Renew(context.Background())
+		Expect(first.IsLeader()).To(BeFalse())
+
+		Expect(first.Store.Put(context.Background(), "checkpoint", 2)).To(Equal(leader.ErrNotLeader))
+		Expect(notes).To(Equal(taken))
+	})
+
+	It("does not lead if it cannot find the lock deployment", func() {
+		fakeComposeClient.GetDeploymentByNameReturns(nil, []error{errors.New("not found")})
+
+		first.Renew(context.Background())
+
+		Expect(first.IsLeader()).To(BeFalse())
+		Expect(fakeComposeClient.PatchDeploymentCallCount()).To(Equal(0))
+	})
+})
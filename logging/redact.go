@@ -0,0 +1,82 @@
+// Package logging keeps secrets out of the broker's logs.
+package logging
+
+import (
+	"io"
+	"regexp"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// SensitiveKeyPatterns match the names of values which are never logged, at
+// any depth of the log data: passwords, keys, tokens and certificates, and
+// parameters such as `secret_access_key`.
+var SensitiveKeyPatterns = []string{
+	`(?i)pass`,
+	`(?i)pwd`,
+	`(?i)secret`,
+	`(?i)token`,
+	`(?i)credential`,
+	`(?i)private.?key`,
+	`(?i)access.?key`,
+	`(?i)certificate`,
+}
+
+// SensitiveValuePatterns match values which are never logged whatever they
+// are called. The whole value is masked, so an error message with a
+// connection string in it is lost too.
+var SensitiveValuePatterns = []string{
+	// URIs with userinfo, such as connection strings.
+	`[a-zA-Z][a-zA-Z0-9+.-]*://[^/?#@\s"]+@`,
+	// PEM blocks, and base64-encoded PEM blocks as given to apps.
+	`-----BEGIN [A-Z ]+-----`,
+	`LS0tLS1CRUdJT`,
+	// AWS access key IDs.
+	`AKIA[A-Z0-9]{16}`,
+}
+
+var (
+	sensitiveKeys   = compile(SensitiveKeyPatterns)
+	sensitiveValues = compile(SensitiveValuePatterns)
+)
+
+func compile(patterns []string) []*regexp.Regexp {
+	compiled := []*regexp.Regexp{}
+	for _, pattern := range patterns {
+		compiled = append(compiled, regexp.MustCompile(pattern))
+	}
+	return compiled
+}
+
+// IsSensitiveKey reports whether a value called key is never logged.
+func IsSensitiveKey(key string) bool {
+	for _, pattern := range sensitiveKeys {
+		if pattern.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSensitiveValue reports whether value is never logged, whatever it is
+// called.
+func IsSensitiveValue(value string) bool {
+	for _, pattern := range sensitiveValues {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewRedactingSink writes logs at minLogLevel and above to w as JSON lines,
+// like lager.NewWriterSink, with sensitive values replaced with
+// `*REDACTED*`.
+func NewRedactingSink(w io.Writer, minLogLevel lager.LogLevel) lager.Sink {
+	sink, err := lager.NewRedactingWriterSink(w, minLogLevel, SensitiveKeyPatterns, SensitiveValuePatterns)
+	if err != nil {
+		// The patterns are fixed and compiled above.
+		panic(err)
+	}
+	return sink
+}
@@ -1,19 +1,35 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
 
 	"code.cloudfoundry.org/lager"
 
+	"github.com/alphagov/paas-compose-broker/admin"
+	"github.com/alphagov/paas-compose-broker/audit"
+	"github.com/alphagov/paas-compose-broker/auditevents"
 	"github.com/alphagov/paas-compose-broker/broker"
 	"github.com/alphagov/paas-compose-broker/catalog"
 	"github.com/alphagov/paas-compose-broker/compose"
 	"github.com/alphagov/paas-compose-broker/config"
 	"github.com/alphagov/paas-compose-broker/dbengine"
+	"github.com/alphagov/paas-compose-broker/health"
+	"github.com/alphagov/paas-compose-broker/leader"
+	"github.com/alphagov/paas-compose-broker/logging"
+	"github.com/alphagov/paas-compose-broker/metrics"
+	"github.com/alphagov/paas-compose-broker/server"
+	"github.com/alphagov/paas-compose-broker/tracing"
 	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/auth"
 )
 
 var (
@@ -21,6 +37,10 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		os.Exit(admin.Main(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	}
+
 	flag.StringVar(&catalogFilePath, "catalog", "./catalog.json", "Location of the catalog file")
 	flag.Parse()
 	config, err := config.New()
@@ -30,7 +50,7 @@ func main() {
 	}
 
 	logger := lager.NewLogger("compose-broker")
-	logger.RegisterSink(lager.NewWriterSink(os.Stdout, config.LogLevel))
+	logger.RegisterSink(logging.NewRedactingSink(os.Stdout, config.LogLevel))
 
 	catalogFile, err := os.Open(catalogFilePath)
 	if err != nil {
@@ -47,11 +67,19 @@ func main() {
 		os.Exit(1)
 	}
 
+	registry := metrics.NewRegistry()
+
 	composeapi, err := compose.NewClient(config.APIToken)
 	if err != nil {
 		logger.Error("could not create composeapi client", err)
 		os.Exit(1)
 	}
+	composeapi = compose.NewRetryingClient(
+		metrics.NewComposeClient(composeapi, registry),
+		compose.DefaultRetryPolicy.WithOverrides(config.ComposeRetryAttempts, config.ComposeRetryBaseDelay, config.ComposeRetryMaxDelay),
+		logger,
+	)
+	composeapi = compose.NewCircuitBreakerClient(composeapi, config.ComposeCircuitFailures, config.ComposeCircuitCooldown, logger)
 	dbEngineProvider := dbengine.NewProviderService()
 	brokerInstance, err := broker.New(composeapi, dbEngineProvider, config, newCatalog, logger)
 	if err != nil {
@@ -63,9 +91,244 @@ func main() {
 		Username: config.Username,
 		Password: config.Password,
 	}
-	brokerAPI := brokerapi.New(brokerInstance, logger, credentials)
+	var serviceBroker brokerapi.ServiceBroker = brokerInstance
+	auditLog, err := audit.NewLogFromConfig(config.AuditLog, []byte(config.AuditLogKey))
+	if err != nil {
+		logger.Error("could not open audit log", err)
+		os.Exit(1)
+	}
+	if auditLog != nil {
+		serviceBroker = audit.NewServiceBroker(serviceBroker, auditLog, logger)
+	}
+	var brokerAPI http.Handler = broker.WithRequestID(
+		broker.WithOriginatingIdentity(
+			brokerapi.New(metrics.NewServiceBroker(serviceBroker, registry), logger, credentials),
+		),
+		logger,
+	)
+	var tracer *tracing.Tracer
+	if config.TracingEndpoint != "" {
+		tracer = tracing.NewTracer("compose-broker", config.TracingEndpoint, config.TracingFormat, logger.Session("tracing"))
+		brokerAPI = tracer.Middleware(brokerAPI)
+	}
+	operatorAuth := auth.NewWrapper(credentials.Username, credentials.Password)
+
+	adminInstance := &admin.Admin{
+		Compose: composeapi,
+		Config:  config,
+		Catalog: newCatalog,
+	}
+
+	registry.NewGaugeFunc(
+		"compose_broker_instances",
+		"Deployments owned by the broker by catalog service and plan.",
+		[]string{"service", "plan"},
+		metrics.CachedSamples(time.Minute, func() ([]metrics.Sample, error) {
+			counts, err := brokerInstance.PlanInstanceCounts()
+			if err != nil {
+				logger.Error("plan-instance-counts", err)
+				return nil, err
+			}
+			samples := []metrics.Sample{}
+			for _, count := range counts {
+				samples = append(samples, metrics.Sample{
+					LabelValues: []string{count.Service, count.Plan},
+					Value:       float64(count.Instances),
+				})
+			}
+			return samples, nil
+		}),
+	)
+
+	if brokerInstance.ClusterID != "" {
+		clusterCapacity := metrics.CachedSamples(time.Minute, func() ([]metrics.Sample, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			capacity, err := brokerInstance.ClusterCapacity(ctx)
+			if err != nil {
+				logger.Error("cluster-capacity", err)
+				return nil, err
+			}
+			labels := []string{capacity.ClusterName}
+			return []metrics.Sample{
+				{LabelValues: labels, Value: float64(capacity.AllocatedUnits)},
+				{LabelValues: labels, Value: float64(capacity.TotalUnits)},
+				{LabelValues: labels, Value: float64(capacity.HeadroomUnits)},
+			}, nil
+		})
+		gauges := []struct{ name, help string }{
+			{"compose_broker_cluster_allocated_units", "Compose units allocated to deployments in the enterprise cluster."},
+			{"compose_broker_cluster_capacity_units", "Compose units the enterprise cluster has room for, as set by CLUSTER_CAPACITY_UNITS."},
+			{"compose_broker_cluster_headroom_units", "Compose units left in the enterprise cluster for new instances."},
+		}
+		if config.ClusterCapacityUnits == 0 {
+			// Capacity and headroom are unknown.
+			gauges = gauges[:1]
+		}
+		for i, gauge := range gauges {
+			i := i
+			registry.NewGaugeFunc(gauge.name, gauge.help, []string{"cluster"}, func() ([]metrics.Sample, error) {
+				samples, err := clusterCapacity()
+				if err != nil {
+					return nil, err
+				}
+				return samples[i : i+1], nil
+			})
+		}
+	}
+
+	// Usage is labelled with instance and space GUIDs, so it is served to
+	// operators only, from a registry of its own.
+	usageRegistry := metrics.NewRegistry()
+	usageCollector := &broker.UsageCollector{Broker: brokerInstance}
+	usageRegistry.NewGaugeFunc(
+		"compose_broker_instance_usage",
+		"Usage of each instance: Compose units and megabytes allocated and used, and its database engine's stats.",
+		[]string{"instance_id", "space_guid", "service", "plan", "stat"},
+		func() ([]metrics.Sample, error) {
+			usages, ok := usageCollector.Usage()
+			if !ok {
+				return nil, errors.New("usage has not been collected yet")
+			}
+			samples := []metrics.Sample{}
+			for _, usage := range usages {
+				stats := map[string]float64{
+					"allocated_units":     float64(usage.AllocatedUnits),
+					"used_units":          float64(usage.UsedUnits),
+					"allocated_megabytes": float64(usage.AllocatedMB),
+					"used_megabytes":      float64(usage.UsedMB),
+				}
+				for stat, value := range usage.Database {
+					stats["database_"+stat] = value
+				}
+				names := []string{}
+				for stat := range stats {
+					names = append(names, stat)
+				}
+				sort.Strings(names)
+				for _, stat := range names {
+					samples = append(samples, metrics.Sample{
+						LabelValues: []string{usage.InstanceID, usage.SpaceGUID, usage.Service, usage.Plan, stat},
+						Value:       stats[stat],
+					})
+				}
+			}
+			return samples, nil
+		},
+	)
+
+	instanceID := leader.InstanceID()
+	var backgroundLeader leader.Leader = leader.FromInstanceIndex()
+	stopBackground := make(chan struct{})
+	leaseReleased := make(chan struct{})
+	var stateStore *compose.NotesStore
+	if config.LeaderLockDeployment != "" {
+		stateStore = compose.NewNotesStore(composeapi, config.LeaderLockDeployment)
+		lease := leader.NewLease(stateStore, instanceID, config.LeaderLeaseTTL, logger)
+		leaderChanges := registry.NewCounter(
+			"compose_broker_leader_changes_total",
+			"Times this broker instance gained or lost the lead.",
+		)
+		lease.OnChange = func(bool) { leaderChanges.Inc() }
+		registry.NewGaugeFunc(
+			"compose_broker_leader_holder",
+			"The broker instance holding the leader lease, as last seen by this instance.",
+			[]string{"holder"},
+			func() ([]metrics.Sample, error) {
+				holder := lease.Holder()
+				if holder == "" {
+					return []metrics.Sample{}, nil
+				}
+				return []metrics.Sample{{LabelValues: []string{holder}, Value: 1}}, nil
+			},
+		)
+		go func() {
+			lease.Run(stopBackground)
+			close(leaseReleased)
+		}()
+		backgroundLeader = lease
+	} else {
+		close(leaseReleased)
+	}
+	registry.NewGaugeFunc(
+		"compose_broker_leader",
+		"Whether this broker instance runs background jobs.",
+		[]string{"instance"},
+		func() ([]metrics.Sample, error) {
+			value := 0.0
+			if backgroundLeader.IsLeader() {
+				value = 1
+			}
+			return []metrics.Sample{{LabelValues: []string{instanceID}, Value: value}}, nil
+		},
+	)
+
+	if config.AuditEventsURL != "" {
+		forwarder := &auditevents.Forwarder{
+			Compose:  composeapi,
+			Store:    stateStore,
+			Leader:   backgroundLeader,
+			DBPrefix: config.DBPrefix,
+			URL:      config.AuditEventsURL,
+			Logger:   logger.Session("audit-events"),
+		}
+		go forwarder.Run(auditevents.DefaultInterval, stopBackground)
+	}
+
+	backupScheduler := &broker.BackupScheduler{
+		Broker: brokerInstance,
+		Leader: backgroundLeader,
+	}
+	go backupScheduler.Run(stopBackground)
+
+	if config.AlertsWebhookURL != "" {
+		alertNotifier := &broker.AlertNotifier{
+			Broker: brokerInstance,
+			Leader: backgroundLeader,
+			URL:    config.AlertsWebhookURL,
+		}
+		go alertNotifier.Run(stopBackground)
+	}
+
+	go usageCollector.Run(stopBackground)
+
+	healthChecker := health.NewChecker(composeapi, logger)
+	go healthChecker.Run(health.DefaultInterval, stopBackground)
+
+	tracerStopped := make(chan struct{})
+	if tracer != nil {
+		go func() {
+			tracer.Run(tracing.DefaultFlushInterval, stopBackground)
+			close(tracerStopped)
+		}()
+	} else {
+		close(tracerStopped)
+	}
 
-	http.Handle("/", brokerAPI)
-	logger.Info("http-listen", lager.Data{"info": fmt.Sprintf("Service Broker started on " + "0.0.0.0:" + brokerInstance.Config.ListenPort)})
-	logger.Error("http-listen", http.ListenAndServe(":"+brokerInstance.Config.ListenPort, nil))
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry.Handler())
+	mux.Handle("/healthz", health.Handler(healthChecker))
+	mux.Handle("/capacity", operatorAuth.Wrap(broker.CapacityHandler(brokerInstance)))
+	mux.Handle("/billing", operatorAuth.Wrap(admin.BillingHandler(adminInstance)))
+	mux.Handle("/alerts", operatorAuth.Wrap(broker.AlertsHandler(brokerInstance)))
+	mux.Handle("/metrics/usage", operatorAuth.Wrap(usageRegistry.Handler()))
+	mux.Handle("/usage", operatorAuth.Wrap(broker.UsageHandler(brokerInstance)))
+	mux.Handle("/", brokerAPI)
+
+	httpServer, err := server.New(config, mux, logger)
+	if err != nil {
+		logger.Error("could not create server", err)
+		os.Exit(1)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	err = httpServer.ListenAndServe(signals)
+	close(stopBackground)
+	<-leaseReleased
+	<-tracerStopped
+	if err != nil {
+		logger.Error("http-serve", err)
+		os.Exit(1)
+	}
 }
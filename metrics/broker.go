@@ -0,0 +1,211 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// DefaultOperationExpiry is how long an asynchronous operation is counted
+// as in flight after it was accepted or last polled. Cloud Controller stops
+// polling operations it gives up on, and those which end in an error, such
+// as a failed deprovision, are never seen to finish.
+const DefaultOperationExpiry = time.Hour
+
+// asyncOperations are the operations counted by the in flight gauge, which
+// reports each of them even when none are in flight.
+var asyncOperations = []string{"provision", "deprovision", "update"}
+
+type serviceBroker struct {
+	broker           brokerapi.ServiceBroker
+	calls            *Counter
+	duration         *Histogram
+	requestsInFlight *Gauge
+	lastOperations   *Counter
+
+	expiry     time.Duration
+	mu         sync.Mutex
+	operations map[string]trackedOperation
+}
+
+type trackedOperation struct {
+	operation string
+	lastSeen  time.Time
+}
+
+// NewServiceBroker wraps a brokerapi.ServiceBroker so that every call is
+// counted by method and outcome. Asynchronous operations are tracked from
+// the moment they are accepted until Cloud Controller polls a final state,
+// or until they have gone unpolled for DefaultOperationExpiry.
+//
+// Operations are tracked in memory by the broker instance which accepted
+// them, so with more than one instance the in flight gauge is per instance
+// and only approximate: when the final poll goes to another instance, the
+// operation is counted until it expires. Sum it across instances for an
+// upper bound.
+func NewServiceBroker(broker brokerapi.ServiceBroker, registry *Registry) brokerapi.ServiceBroker {
+	return NewServiceBrokerWithExpiry(broker, registry, DefaultOperationExpiry)
+}
+
+// NewServiceBrokerWithExpiry is NewServiceBroker with the time after which
+// an unpolled operation is no longer counted.
+func NewServiceBrokerWithExpiry(broker brokerapi.ServiceBroker, registry *Registry, expiry time.Duration) brokerapi.ServiceBroker {
+	b := &serviceBroker{
+		broker: broker,
+		calls: registry.NewCounter(
+			"compose_broker_requests_total",
+			"Service broker API calls by method and outcome.",
+			"method", "outcome",
+		),
+		duration: registry.NewHistogram(
+			"compose_broker_request_duration_seconds",
+			"Latency of service broker API calls by method.",
+			DefaultBuckets,
+			"method",
+		),
+		requestsInFlight: registry.NewGauge(
+			"compose_broker_requests_in_flight",
+			"Service broker API calls currently being handled by method.",
+			"method",
+		),
+		lastOperations: registry.NewCounter(
+			"compose_broker_last_operation_states_total",
+			"States returned to last_operation polls.",
+			"state",
+		),
+		expiry:     expiry,
+		operations: map[string]trackedOperation{},
+	}
+	registry.NewGaugeFunc(
+		"compose_broker_operations_in_flight",
+		"Asynchronous operations accepted by this broker instance and not yet seen by it to finish. Approximate when there are several instances.",
+		[]string{"operation"},
+		b.operationsInFlight,
+	)
+	return b
+}
+
+func (b *serviceBroker) start(method string) time.Time {
+	b.requestsInFlight.Inc(method)
+	return time.Now()
+}
+
+func (b *serviceBroker) finish(method string, start time.Time, err error) {
+	b.requestsInFlight.Dec(method)
+	b.duration.ObserveSince(start, method)
+	b.calls.Inc(method, outcome(err == nil))
+}
+
+func (b *serviceBroker) operationStarted(instanceID, operation string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.operations[instanceID] = trackedOperation{operation: operation, lastSeen: time.Now()}
+}
+
+func (b *serviceBroker) operationPolled(instanceID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if tracked, ok := b.operations[instanceID]; ok {
+		tracked.lastSeen = time.Now()
+		b.operations[instanceID] = tracked
+	}
+}
+
+func (b *serviceBroker) operationFinished(instanceID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.operations, instanceID)
+}
+
+// operationsInFlight counts the tracked operations when scraped, and forgets
+// those which have expired.
+func (b *serviceBroker) operationsInFlight() ([]Sample, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	counts := map[string]float64{}
+	for instanceID, tracked := range b.operations {
+		if time.Since(tracked.lastSeen) >= b.expiry {
+			delete(b.operations, instanceID)
+			continue
+		}
+		counts[tracked.operation]++
+	}
+
+	samples := []Sample{}
+	for _, operation := range asyncOperations {
+		samples = append(samples, Sample{LabelValues: []string{operation}, Value: counts[operation]})
+	}
+	return samples, nil
+}
+
+func (b *serviceBroker) Services(ctx context.Context) []brokerapi.Service {
+	start := b.start("Services")
+	services := b.broker.Services(ctx)
+	b.finish("Services", start, nil)
+	return services
+}
+
+func (b *serviceBroker) Provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, error) {
+	start := b.start("Provision")
+	spec, err := b.broker.Provision(ctx, instanceID, details, asyncAllowed)
+	b.finish("Provision", start, err)
+	if err == nil && spec.IsAsync {
+		b.operationStarted(instanceID, "provision")
+	}
+	return spec, err
+}
+
+func (b *serviceBroker) Deprovision(ctx context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (brokerapi.DeprovisionServiceSpec, error) {
+	start := b.start("Deprovision")
+	spec, err := b.broker.Deprovision(ctx, instanceID, details, asyncAllowed)
+	b.finish("Deprovision", start, err)
+	if err == nil && spec.IsAsync {
+		b.operationStarted(instanceID, "deprovision")
+	}
+	return spec, err
+}
+
+func (b *serviceBroker) Bind(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
+	start := b.start("Bind")
+	binding, err := b.broker.Bind(ctx, instanceID, bindingID, details)
+	b.finish("Bind", start, err)
+	return binding, err
+}
+
+func (b *serviceBroker) Unbind(ctx context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) error {
+	start := b.start("Unbind")
+	err := b.broker.Unbind(ctx, instanceID, bindingID, details)
+	b.finish("Unbind", start, err)
+	return err
+}
+
+func (b *serviceBroker) Update(ctx context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
+	start := b.start("Update")
+	spec, err := b.broker.Update(ctx, instanceID, details, asyncAllowed)
+	b.finish("Update", start, err)
+	if err == nil && spec.IsAsync {
+		b.operationStarted(instanceID, "update")
+	}
+	return spec, err
+}
+
+func (b *serviceBroker) LastOperation(ctx context.Context, instanceID, operationData string) (brokerapi.LastOperation, error) {
+	start := b.start("LastOperation")
+	lastOperation, err := b.broker.LastOperation(ctx, instanceID, operationData)
+	b.finish("LastOperation", start, err)
+	if err == nil {
+		b.lastOperations.Inc(string(lastOperation.State))
+		if lastOperation.State != brokerapi.InProgress {
+			b.operationFinished(instanceID)
+		} else {
+			b.operationPolled(instanceID)
+		}
+	} else if err == brokerapi.ErrInstanceDoesNotExist {
+		// A finished deprovision.
+		b.operationFinished(instanceID)
+	}
+	return lastOperation, err
+}
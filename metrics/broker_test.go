@@ -0,0 +1,93 @@
+package metrics_test
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/fakes"
+
+	"github.com/alphagov/paas-compose-broker/metrics"
+)
+
+var _ = Describe("Service broker metrics", func() {
+
+	var (
+		registry   *metrics.Registry
+		fakeBroker *fakes.FakeAsyncServiceBroker
+		broker     brokerapi.ServiceBroker
+	)
+
+	BeforeEach(func() {
+		registry = metrics.NewRegistry()
+		fakeBroker = &fakes.FakeAsyncServiceBroker{
+			FakeServiceBroker:    fakes.FakeServiceBroker{InstanceLimit: 10},
+			ShouldProvisionAsync: true,
+		}
+		broker = metrics.NewServiceBroker(fakeBroker, registry)
+	})
+
+	scrape := func() string {
+		out := &bytes.Buffer{}
+		Expect(registry.Write(out)).To(Succeed())
+		return out.String()
+	}
+
+	It("counts calls by method and outcome", func() {
+		ctx := context.Background()
+		_, err := broker.Provision(ctx, "instance", brokerapi.ProvisionDetails{}, true)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = broker.Provision(ctx, "instance", brokerapi.ProvisionDetails{}, true)
+		Expect(err).To(Equal(brokerapi.ErrInstanceAlreadyExists))
+
+		Expect(scrape()).To(ContainSubstring(`compose_broker_requests_total{method="Provision",outcome="success"} 1`))
+		Expect(scrape()).To(ContainSubstring(`compose_broker_requests_total{method="Provision",outcome="error"} 1`))
+		Expect(scrape()).To(ContainSubstring(`compose_broker_requests_in_flight{method="Provision"} 0`))
+	})
+
+	It("tracks asynchronous operations until they finish", func() {
+		ctx := context.Background()
+		_, err := broker.Provision(ctx, "instance", brokerapi.ProvisionDetails{}, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(scrape()).To(ContainSubstring(`compose_broker_operations_in_flight{operation="provision"} 1`))
+
+		fakeBroker.LastOperationState = brokerapi.InProgress
+		broker.LastOperation(ctx, "instance", "")
+		Expect(scrape()).To(ContainSubstring(`compose_broker_operations_in_flight{operation="provision"} 1`))
+
+		fakeBroker.LastOperationState = brokerapi.Succeeded
+		broker.LastOperation(ctx, "instance", "")
+		Expect(scrape()).To(ContainSubstring(`compose_broker_operations_in_flight{operation="provision"} 0`))
+		Expect(scrape()).To(ContainSubstring(`compose_broker_last_operation_states_total{state="in progress"} 1`))
+		Expect(scrape()).To(ContainSubstring(`compose_broker_last_operation_states_total{state="succeeded"} 1`))
+	})
+
+	It("stops counting operations which are no longer polled", func() {
+		registry = metrics.NewRegistry()
+		broker = metrics.NewServiceBrokerWithExpiry(fakeBroker, registry, 50*time.Millisecond)
+		ctx := context.Background()
+		_, err := broker.Provision(ctx, "instance", brokerapi.ProvisionDetails{}, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(scrape()).To(ContainSubstring(`compose_broker_operations_in_flight{operation="provision"} 1`))
+
+		Eventually(scrape).Should(ContainSubstring(`compose_broker_operations_in_flight{operation="provision"} 0`))
+	})
+
+	It("stops counting a deprovision once the instance is gone", func() {
+		ctx := context.Background()
+		fakeBroker.ShouldProvisionAsync = false
+		_, err := broker.Provision(ctx, "instance", brokerapi.ProvisionDetails{}, true)
+		Expect(err).NotTo(HaveOccurred())
+		fakeBroker.ShouldProvisionAsync = true
+		_, err = broker.Deprovision(ctx, "instance", brokerapi.DeprovisionDetails{}, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(scrape()).To(ContainSubstring(`compose_broker_operations_in_flight{operation="deprovision"} 1`))
+
+		fakeBroker.LastOperationError = brokerapi.ErrInstanceDoesNotExist
+		broker.LastOperation(ctx, "instance", "")
+		Expect(scrape()).To(ContainSubstring(`compose_broker_operations_in_flight{operation="deprovision"} 0`))
+	})
+})
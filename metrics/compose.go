@@ -0,0 +1,199 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/alphagov/paas-compose-broker/compose"
+	composeapi "github.com/compose/gocomposeapi"
+)
+
+type composeClient struct {
+	client   compose.Client
+	calls    *Counter
+	duration *Histogram
+}
+
+// NewComposeClient wraps a compose.Client so that every call is counted by
+// method and outcome, and its latency recorded.
+func NewComposeClient(client compose.Client, registry *Registry) compose.Client {
+	return &composeClient{
+		client: client,
+		calls: registry.NewCounter(
+			"compose_api_requests_total",
+			"Calls to the Compose API by client method and outcome.",
+			"method", "outcome",
+		),
+		duration: registry.NewHistogram(
+			"compose_api_request_duration_seconds",
+			"Latency of calls to the Compose API by client method.",
+			DefaultBuckets,
+			"method",
+		),
+	}
+}
+
+func (c *composeClient) observe(method string, start time.Time, errs []error) {
+	c.duration.ObserveSince(start, method)
+	c.calls.Inc(method, outcome(len(errs) == 0))
+}
+
+func outcome(ok bool) string {
+	if ok {
+		return "success"
+	}
+	return "error"
+}
+
+func (c *composeClient) GetAccount() (*composeapi.Account, []error) {
+	start := time.Now()
+	account, errs := c.client.GetAccount()
+	c.observe("GetAccount", start, errs)
+	return account, errs
+}
+
+func (c *composeClient) GetClusters() (*[]composeapi.Cluster, []error) {
+	start := time.Now()
+	clusters, errs := c.client.GetClusters()
+	c.observe("GetClusters", start, errs)
+	return clusters, errs
+}
+
+func (c *composeClient) GetCluster(clusterID string) (*composeapi.Cluster, []error) {
+	start := time.Now()
+	cluster, errs := c.client.GetCluster(clusterID)
+	c.observe("GetCluster", start, errs)
+	return cluster, errs
+}
+
+func (c *composeClient) GetClusterByName(name string) (*composeapi.Cluster, []error) {
+	start := time.Now()
+	cluster, errs := c.client.GetClusterByName(name)
+	c.observe("GetClusterByName", start, errs)
+	return cluster, errs
+}
+
+func (c *composeClient) CreateDeployment(params composeapi.DeploymentParams) (*composeapi.Deployment, []error) {
+	start := time.Now()
+	deployment, errs := c.client.CreateDeployment(params)
+	c.observe("CreateDeployment", start, errs)
+	return deployment, errs
+}
+
+func (c *composeClient) DeprovisionDeployment(deploymentID string) (*composeapi.Recipe, []error) {
+	start := time.Now()
+	recipe, errs := c.client.DeprovisionDeployment(deploymentID)
+	c.observe("DeprovisionDeployment", start, errs)
+	return recipe, errs
+}
+
+func (c *composeClient) GetDeployment(deploymentID string) (*composeapi.Deployment, []error) {
+	start := time.Now()
+	deployment, errs := c.client.GetDeployment(deploymentID)
+	c.observe("GetDeployment", start, errs)
+	return deployment, errs
+}
+
+func (c *composeClient) GetDeploymentByName(name string) (*composeapi.Deployment, []error) {
+	start := time.Now()
+	deployment, errs := c.client.GetDeploymentByName(name)
+	c.observe("GetDeploymentByName", start, errs)
+	return deployment, errs
+}
+
+func (c *composeClient) GetDeployments() (*[]composeapi.Deployment, []error) {
+	start := time.Now()
+	deployments, errs := c.client.GetDeployments()
+	c.observe("GetDeployments", start, errs)
+	return deployments, errs
+}
+
+func (c *composeClient) CreateDeploymentWhitelist(deploymentID string, params composeapi.DeploymentWhitelistParams) (*composeapi.Recipe, []error) {
+	start := time.Now()
+	recipe, errs := c.client.CreateDeploymentWhitelist(deploymentID, params)
+	c.observe("CreateDeploymentWhitelist", start, errs)
+	return recipe, errs
+}
+
+func (c *composeClient) GetWhitelistForDeployment(deploymentID string) ([]composeapi.DeploymentWhitelist, []error) {
+	start := time.Now()
+	whitelist, errs := c.client.GetWhitelistForDeployment(deploymentID)
+	c.observe("GetWhitelistForDeployment", start, errs)
+	return whitelist, errs
+}
+
+func (c *composeClient) GetRecipe(recipeID string) (*composeapi.Recipe, []error) {
+	start := time.Now()
+	recipe, errs := c.client.GetRecipe(recipeID)
+	c.observe("GetRecipe", start, errs)
+	return recipe, errs
+}
+
+func (c *composeClient) GetScalings(deploymentID string) (*composeapi.Scalings, []error) {
+	start := time.Now()
+	scalings, errs := c.client.GetScalings(deploymentID)
+	c.observe("GetScalings", start, errs)
+	return scalings, errs
+}
+
+func (c *composeClient) SetScalings(params composeapi.ScalingsParams) (*composeapi.Recipe, []error) {
+	start := time.Now()
+	recipe, errs := c.client.SetScalings(params)
+	c.observe("SetScalings", start, errs)
+	return recipe, errs
+}
+
+func (c *composeClient) GetBackupsForDeployment(deploymentID string) (*[]composeapi.Backup, []error) {
+	start := time.Now()
+	backups, errs := c.client.GetBackupsForDeployment(deploymentID)
+	c.observe("GetBackupsForDeployment", start, errs)
+	return backups, errs
+}
+
+func (c *composeClient) GetBackupDetailsForDeployment(deploymentID, backupID string) (*composeapi.Backup, []error) {
+	start := time.Now()
+	backup, errs := c.client.GetBackupDetailsForDeployment(deploymentID, backupID)
+	c.observe("GetBackupDetailsForDeployment", start, errs)
+	return backup, errs
+}
+
+func (c *composeClient) RestoreBackup(params composeapi.RestoreBackupParams) (*composeapi.Deployment, []error) {
+	start := time.Now()
+	deployment, errs := c.client.RestoreBackup(params)
+	c.observe("RestoreBackup", start, errs)
+	return deployment, errs
+}
+
+func (c *composeClient) PatchDeployment(params composeapi.PatchDeploymentParams) (*composeapi.Deployment, []error) {
+	start := time.Now()
+	deployment, errs := c.client.PatchDeployment(params)
+	c.observe("PatchDeployment", start, errs)
+	return deployment, errs
+}
+
+func (c *composeClient) StartBackupForDeployment(deploymentID string) (*composeapi.Recipe, []error) {
+	start := time.Now()
+	recipe, errs := c.client.StartBackupForDeployment(deploymentID)
+	c.observe("StartBackupForDeployment", start, errs)
+	return recipe, errs
+}
+
+func (c *composeClient) GetAuditEvents(params composeapi.AuditEventsParams) (*[]composeapi.AuditEvent, []error) {
+	start := time.Now()
+	events, errs := c.client.GetAuditEvents(params)
+	c.observe("GetAuditEvents", start, errs)
+	return events, errs
+}
+
+func (c *composeClient) GetAuditEvent(id string) (*composeapi.AuditEvent, []error) {
+	start := time.Now()
+	event, errs := c.client.GetAuditEvent(id)
+	c.observe("GetAuditEvent", start, errs)
+	return event, errs
+}
+
+func (c *composeClient) GetAlertsForDeployment(deploymentID string) (*composeapi.Alerts, []error) {
+	start := time.Now()
+	alerts, errs := c.client.GetAlertsForDeployment(deploymentID)
+	c.observe("GetAlertsForDeployment", start, errs)
+	return alerts, errs
+}
@@ -0,0 +1,40 @@
+package metrics_test
+
+import (
+	"bytes"
+	"errors"
+
+	composeapi "github.com/compose/gocomposeapi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/paas-compose-broker/compose/fakes"
+	"github.com/alphagov/paas-compose-broker/metrics"
+)
+
+var _ = Describe("Compose client metrics", func() {
+
+	It("counts calls by method and outcome and records their latency", func() {
+		registry := metrics.NewRegistry()
+		fakeComposeClient := &fakes.FakeClient{}
+		fakeComposeClient.GetRecipeReturns(&composeapi.Recipe{ID: "recipe"}, []error{})
+		fakeComposeClient.CreateDeploymentReturns(nil, []error{errors.New("computer says no")})
+
+		client := metrics.NewComposeClient(fakeComposeClient, registry)
+
+		recipe, errs := client.GetRecipe("recipe")
+		Expect(errs).To(BeEmpty())
+		Expect(recipe.ID).To(Equal("recipe"))
+		Expect(fakeComposeClient.GetRecipeArgsForCall(0)).To(Equal("recipe"))
+		client.GetRecipe("recipe")
+
+		_, errs = client.CreateDeployment(composeapi.DeploymentParams{Name: "db"})
+		Expect(errs).To(HaveLen(1))
+
+		out := &bytes.Buffer{}
+		Expect(registry.Write(out)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring(`compose_api_requests_total{method="GetRecipe",outcome="success"} 2`))
+		Expect(out.String()).To(ContainSubstring(`compose_api_requests_total{method="CreateDeployment",outcome="error"} 1`))
+		Expect(out.String()).To(ContainSubstring(`compose_api_request_duration_seconds_count{method="GetRecipe"} 2`))
+	})
+})
@@ -0,0 +1,378 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the histogram buckets, in seconds, used for request
+// latencies. Compose recipes are slow but individual API calls should not be.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Registry holds metrics and renders them in the Prometheus text exposition
+// format. There is no Prometheus client library in the vendor tree, so this
+// implements just the counters, gauges and histograms the broker needs.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	name() string
+	write(w io.Writer) error
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.metrics {
+		if existing.name() == m.name() {
+			panic(fmt.Sprintf("metric %s registered twice", m.name()))
+		}
+	}
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes every registered metric, sorted by name.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	metrics := make([]metric, len(r.metrics))
+	copy(metrics, r.metrics)
+	r.mu.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].name() < metrics[j].name()
+	})
+
+	buf := bufio.NewWriter(w)
+	for _, m := range metrics {
+		if err := m.write(buf); err != nil {
+			return err
+		}
+	}
+	return buf.Flush()
+}
+
+// Handler serves the registry for Prometheus to scrape. It does not need to
+// be authenticated as no metric carries credentials or instance names.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.Write(w)
+	})
+}
+
+type desc struct {
+	metricName string
+	help       string
+	labels     []string
+}
+
+func (d *desc) name() string {
+	return d.metricName
+}
+
+func (d *desc) writeHeader(w io.Writer, metricType string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.metricName, d.help, d.metricName, metricType)
+	return err
+}
+
+func (d *desc) key(labelValues []string) string {
+	if len(labelValues) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", d.metricName, len(d.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+escapeLabelValue(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabelValue(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+}
+
+type seriesSet struct {
+	desc
+	mu     sync.Mutex
+	values map[string]*series
+}
+
+func (s *seriesSet) get(labelValues []string) *series {
+	key := s.key(labelValues)
+	v, ok := s.values[key]
+	if !ok {
+		v = &series{labelValues: append([]string{}, labelValues...)}
+		s.values[key] = v
+	}
+	return v
+}
+
+func (s *seriesSet) writeSeries(w io.Writer, metricType string) error {
+	if err := s.writeHeader(w, metricType); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := []string{}
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := s.values[key]
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", s.metricName, formatLabels(s.labels, v.labelValues), formatValue(v.value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Counter is a monotonically increasing value per combination of labels.
+type Counter struct {
+	seriesSet
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{seriesSet{desc: desc{name, help, labels}, values: map[string]*series{}}}
+	r.register(c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("counter %s cannot decrease", c.metricName))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.get(labelValues).value += delta
+}
+
+func (c *Counter) write(w io.Writer) error {
+	return c.writeSeries(w, "counter")
+}
+
+// Gauge is a value per combination of labels which can go up and down.
+type Gauge struct {
+	seriesSet
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{seriesSet{desc: desc{name, help, labels}, values: map[string]*series{}}}
+	r.register(g)
+	return g
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.get(labelValues).value = value
+}
+
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.get(labelValues).value += delta
+}
+
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+func (g *Gauge) write(w io.Writer) error {
+	return g.writeSeries(w, "gauge")
+}
+
+// Sample is a single value of a GaugeFunc.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// SampleFunc computes the current samples of a GaugeFunc.
+type SampleFunc func() ([]Sample, error)
+
+type gaugeFunc struct {
+	desc
+	collect SampleFunc
+}
+
+// NewGaugeFunc registers a gauge whose samples are computed when the
+// registry is scraped. If collect fails, the gauge is left out of the scrape.
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect SampleFunc) {
+	r.register(&gaugeFunc{desc{name, help, labels}, collect})
+}
+
+func (g *gaugeFunc) write(w io.Writer) error {
+	samples, err := g.collect()
+	if err != nil {
+		return nil
+	}
+
+	if err := g.writeHeader(w, "gauge"); err != nil {
+		return err
+	}
+	for _, sample := range samples {
+		g.key(sample.LabelValues)
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", g.metricName, formatLabels(g.labels, sample.LabelValues), formatValue(sample.Value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CachedSamples wraps collect so that it is called at most once every ttl.
+// Use it for samples which are expensive to compute from the Compose API.
+func CachedSamples(ttl time.Duration, collect SampleFunc) SampleFunc {
+	var (
+		mu        sync.Mutex
+		samples   []Sample
+		err       error
+		collected time.Time
+	)
+	return func() ([]Sample, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if collected.IsZero() || time.Since(collected) >= ttl {
+			samples, err = collect()
+			collected = time.Now()
+		}
+		return samples, err
+	}
+}
+
+// Histogram counts observations into cumulative buckets per combination of
+// labels.
+type Histogram struct {
+	desc
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		desc:    desc{name, help, labels},
+		buckets: append([]float64{}, buckets...),
+		values:  map[string]*histogramSeries{},
+	}
+	sort.Float64s(h.buckets)
+	r.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	key := h.key(labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.values[key]
+	if !ok {
+		s = &histogramSeries{
+			labelValues: append([]string{}, labelValues...),
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+// ObserveSince records the seconds elapsed since start.
+func (h *Histogram) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	if err := h.writeHeader(w, "histogram"); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := []string{}
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.values[key]
+		for i, bound := range h.buckets {
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, formatLabels(h.labels, s.labelValues, "le", formatValue(bound)), s.counts[i]); err != nil {
+				return err
+			}
+		}
+		labels := formatLabels(h.labels, s.labelValues)
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			h.metricName, formatLabels(h.labels, s.labelValues, "le", "+Inf"), s.count,
+			h.metricName, labels, formatValue(s.sum),
+			h.metricName, labels, s.count,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package metrics_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/paas-compose-broker/metrics"
+)
+
+var _ = Describe("Registry", func() {
+
+	var registry *metrics.Registry
+
+	BeforeEach(func() {
+		registry = metrics.NewRegistry()
+	})
+
+	scrape := func() string {
+		out := &bytes.Buffer{}
+		Expect(registry.Write(out)).To(Succeed())
+		return out.String()
+	}
+
+	It("renders counters and gauges in the text exposition format", func() {
+		counter := registry.NewCounter("test_total", "A counter.", "method")
+		counter.Inc("Get")
+		counter.Add(2, "Get")
+		counter.Inc(`a "quoted" value`)
+
+		gauge := registry.NewGauge("test_in_flight", "A gauge.")
+		gauge.Inc()
+		gauge.Inc()
+		gauge.Dec()
+
+		Expect(scrape()).To(Equal(`# HELP test_in_flight A gauge.
+# TYPE test_in_flight gauge
+test_in_flight 1
+# HELP test_total A counter.
+# TYPE test_total counter
+test_total{method="Get"} 3
+test_total{method="a \"quoted\" value"} 1
+`))
+	})
+
+	It("renders histograms with cumulative buckets", func() {
+		histogram := registry.NewHistogram("test_seconds", "A histogram.", []float64{1, 0.1}, "method")
+		histogram.Observe(0.05, "Get")
+		histogram.Observe(0.5, "Get")
+		histogram.Observe(5, "Get")
+
+		Expect(scrape()).To(Equal(`# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{method="Get",le="0.1"} 1
+test_seconds_bucket{method="Get",le="1"} 2
+test_seconds_bucket{method="Get",le="+Inf"} 3
+test_seconds_sum{method="Get"} 5.55
+test_seconds_count{method="Get"} 3
+`))
+	})
+
+	It("computes gauge functions when scraped", func() {
+		value := 1.0
+		registry.NewGaugeFunc("test_func", "A gauge func.", []string{"plan"}, func() ([]metrics.Sample, error) {
+			return []metrics.Sample{{LabelValues: []string{"small"}, Value: value}}, nil
+		})
+
+		Expect(scrape()).To(ContainSubstring(`test_func{plan="small"} 1`))
+		value = 2
+		Expect(scrape()).To(ContainSubstring(`test_func{plan="small"} 2`))
+	})
+
+	It("leaves out gauge functions which fail", func() {
+		registry.NewGaugeFunc("test_func", "A gauge func.", nil, func() ([]metrics.Sample, error) {
+			return nil, errors.New("compose is down")
+		})
+		registry.NewCounter("test_total", "A counter.").Inc()
+
+		Expect(scrape()).NotTo(ContainSubstring("test_func"))
+		Expect(scrape()).To(ContainSubstring("test_total 1"))
+	})
+
+	It("caches expensive samples", func() {
+		calls := 0
+		collect := metrics.CachedSamples(time.Hour, func() ([]metrics.Sample, error) {
+			calls++
+			return []metrics.Sample{{Value: float64(calls)}}, nil
+		})
+
+		collect()
+		samples, err := collect()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(samples[0].Value).To(Equal(1.0))
+		Expect(calls).To(Equal(1))
+	})
+
+	It("refuses to register a metric twice", func() {
+		registry.NewCounter("test_total", "A counter.")
+		Expect(func() { registry.NewGauge("test_total", "A gauge.") }).To(Panic())
+	})
+
+	It("serves the metrics over HTTP", func() {
+		registry.NewCounter("test_total", "A counter.").Inc()
+
+		resp := httptest.NewRecorder()
+		registry.Handler().ServeHTTP(resp, httptest.NewRequest("GET", "/metrics", nil))
+
+		Expect(resp.Code).To(Equal(200))
+		Expect(resp.Header().Get("Content-Type")).To(Equal("text/plain; version=0.0.4"))
+		Expect(resp.Body.String()).To(ContainSubstring("test_total 1"))
+	})
+})
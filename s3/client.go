@@ -0,0 +1,221 @@
+// Package s3 uploads objects to S3-compatible object storage.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPartSize is the size of the parts objects are uploaded in. S3
+// needs every part but the last to be at least 5 MiB.
+const DefaultPartSize = 8 * 1024 * 1024
+
+type Client struct {
+	// Endpoint is the base URL of the object store. Buckets are addressed
+	// by path, e.g. https://s3.eu-west-1.amazonaws.com/bucket/key.
+	Endpoint        string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+
+	PartSize   int
+	HTTPClient *http.Client
+}
+
+// Error is an error response from the object store.
+type Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("S3 responded %d", e.StatusCode)
+	}
+	return fmt.Sprintf("S3 responded %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Upload streams body to bucket/key as a multipart upload, calling progress
+// with the number of bytes stored after each part. The upload is aborted if
+// it fails part way.
+func (c *Client) Upload(ctx context.Context, bucket, key string, body io.Reader, progress func(uploaded int64)) error {
+	uploadID, err := c.createMultipartUpload(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+
+	err = c.uploadParts(ctx, bucket, key, uploadID, body, progress)
+	if err != nil {
+		c.abortMultipartUpload(bucket, key, uploadID)
+	}
+	return err
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (c *Client) uploadParts(ctx context.Context, bucket, key, uploadID string, body io.Reader, progress func(int64)) error {
+	partSize := c.PartSize
+	if partSize <= 0 {
+		partSize = DefaultPartSize
+	}
+
+	var (
+		parts    []completedPart
+		uploaded int64
+		buf      = make([]byte, partSize)
+	)
+	for partNumber := 1; ; partNumber++ {
+		n, readErr := io.ReadFull(body, buf)
+		if readErr == io.EOF && partNumber > 1 {
+			break
+		}
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return readErr
+		}
+
+		etag, err := c.uploadPart(ctx, bucket, key, uploadID, partNumber, buf[:n])
+		if err != nil {
+			return err
+		}
+		parts = append(parts, completedPart{PartNumber: partNumber, ETag: etag})
+		uploaded += int64(n)
+		if progress != nil {
+			progress(uploaded)
+		}
+
+		if readErr != nil {
+			break
+		}
+	}
+
+	return c.completeMultipartUpload(ctx, bucket, key, uploadID, parts)
+}
+
+func (c *Client) createMultipartUpload(ctx context.Context, bucket, key string) (string, error) {
+	resp, err := c.do(ctx, "POST", bucket, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(resp, &result); err != nil {
+		return "", err
+	}
+	if result.UploadID == "" {
+		return "", fmt.Errorf("S3 returned no upload ID")
+	}
+	return result.UploadID, nil
+}
+
+func (c *Client) uploadPart(ctx context.Context, bucket, key, uploadID string, partNumber int, data []byte) (string, error) {
+	query := url.Values{
+		"partNumber": {strconv.Itoa(partNumber)},
+		"uploadId":   {uploadID},
+	}
+	req, err := c.newRequest(ctx, "PUT", bucket, key, query, data)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+func (c *Client) completeMultipartUpload(ctx context.Context, bucket, key, uploadID string, parts []completedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(ctx, "POST", bucket, key, url.Values{"uploadId": {uploadID}}, body)
+	if err != nil {
+		return err
+	}
+	// S3 can report a failure to complete in a 200 response.
+	if bytes.Contains(resp, []byte("<Error>")) {
+		s3Err := &Error{StatusCode: http.StatusOK}
+		xml.Unmarshal(resp, s3Err)
+		return s3Err
+	}
+	return nil
+}
+
+// abortMultipartUpload frees the parts of a failed upload. It is not bound
+// to the upload's context, which may be why it failed.
+func (c *Client) abortMultipartUpload(bucket, key, uploadID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	c.do(ctx, "DELETE", bucket, key, url.Values{"uploadId": {uploadID}}, nil)
+}
+
+// do sends a request and returns the body of a successful response.
+func (c *Client) do(ctx context.Context, method, bucket, key string, query url.Values, body []byte) ([]byte, error) {
+	req, err := c.newRequest(ctx, method, bucket, key, query, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (c *Client) newRequest(ctx context.Context, method, bucket, key string, query url.Values, body []byte) (*http.Request, error) {
+	endpoint, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + "/" + bucket + "/" + key
+	endpoint.RawPath = uriEncode(endpoint.Path, false)
+	endpoint.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	sign(req, hashHex(body), c.AccessKeyID, c.SecretAccessKey, c.Region, time.Now())
+	return req, nil
+}
+
+// send sends a signed request, turning error responses into Errors.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		s3Err := &Error{StatusCode: resp.StatusCode}
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		xml.Unmarshal(body, s3Err)
+		return nil, s3Err
+	}
+	return resp, nil
+}
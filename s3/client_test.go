@@ -0,0 +1,94 @@
+package s3_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/paas-compose-broker/s3"
+	"github.com/alphagov/paas-compose-broker/s3/s3test"
+)
+
+var _ = Describe("Client", func() {
+	var (
+		server *s3test.Server
+		client *s3.Client
+	)
+
+	BeforeEach(func() {
+		server = s3test.NewServer("access-key-id")
+		client = &s3.Client{
+			Endpoint:        server.URL,
+			Region:          "eu-west-1",
+			AccessKeyID:     "access-key-id",
+			SecretAccessKey: "secret",
+			PartSize:        4,
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("uploads an object in parts, reporting progress", func() {
+		var progress []int64
+		err := client.Upload(context.Background(), "bucket", "backups/a b.tar", bytes.NewBufferString("0123456789"), func(uploaded int64) {
+			progress = append(progress, uploaded)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		object, ok := server.Object("bucket", "backups/a b.tar")
+		Expect(ok).To(BeTrue())
+		Expect(string(object)).To(Equal("0123456789"))
+		Expect(progress).To(Equal([]int64{4, 8, 10}))
+	})
+
+	It("uploads an empty object", func() {
+		err := client.Upload(context.Background(), "bucket", "empty", &bytes.Buffer{}, nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		object, ok := server.Object("bucket", "empty")
+		Expect(ok).To(BeTrue())
+		Expect(object).To(BeEmpty())
+	})
+
+	It("aborts the upload when a part fails", func() {
+		server.FailPart(2)
+
+		err := client.Upload(context.Background(), "bucket", "key", bytes.NewBufferString("0123456789"), nil)
+		Expect(err).To(MatchError("S3 responded 500: InternalError: We encountered an internal error. Please try again."))
+		Expect(server.PendingUploads()).To(Equal(0))
+		_, ok := server.Object("bucket", "key")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("aborts the upload when reading the object fails", func() {
+		body := io.MultiReader(bytes.NewBufferString("01234"), &failingReader{errors.New("connection reset")})
+
+		err := client.Upload(context.Background(), "bucket", "key", body, nil)
+		Expect(err).To(MatchError("connection reset"))
+		Expect(server.PendingUploads()).To(Equal(0))
+	})
+
+	It("returns the object store's errors", func() {
+		client.AccessKeyID = "wrong"
+
+		err := client.Upload(context.Background(), "bucket", "key", bytes.NewBufferString("data"), nil)
+		s3Err, ok := err.(*s3.Error)
+		Expect(ok).To(BeTrue())
+		Expect(s3Err.StatusCode).To(Equal(403))
+		Expect(s3Err.Code).To(Equal("InvalidAccessKeyId"))
+	})
+})
+
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,170 @@
+// Package s3test provides an in-memory S3 stand-in for tests. It supports
+// just what the s3 package uses, addressing buckets by path, and checks
+// requests' credentials and payload hashes but not their signatures.
+package s3test
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type Server struct {
+	*httptest.Server
+	AccessKeyID string
+
+	mu       sync.Mutex
+	objects  map[string][]byte
+	uploads  map[string]map[int][]byte
+	nextID   int
+	failPart int
+}
+
+func NewServer(accessKeyID string) *Server {
+	s := newServer(accessKeyID)
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// NewTLSServer is NewServer serving HTTPS, with a certificate only clients
+// which skip verification accept.
+func NewTLSServer(accessKeyID string) *Server {
+	s := newServer(accessKeyID)
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func newServer(accessKeyID string) *Server {
+	return &Server{
+		AccessKeyID: accessKeyID,
+		objects:     map[string][]byte{},
+		uploads:     map[string]map[int][]byte{},
+	}
+}
+
+// Object returns the object stored at bucket/key.
+func (s *Server) Object(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object, ok := s.objects[bucket+"/"+key]
+	return object, ok
+}
+
+// PendingUploads is the number of multipart uploads neither completed nor
+// aborted.
+func (s *Server) PendingUploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+// FailPart makes uploads of the given part number fail with a 500.
+func (s *Server) FailPart(partNumber int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failPart = partNumber
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="+s.AccessKeyID+"/") {
+		writeError(w, http.StatusForbidden, "InvalidAccessKeyId", "The AWS Access Key Id you provided does not exist in our records.")
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	sum := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		writeError(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed.")
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == "POST" && query["uploads"] != nil:
+		s.nextID++
+		id := strconv.Itoa(s.nextID)
+		s.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, path, id)
+
+	case r.Method == "PUT" && uploadID != "":
+		parts, ok := s.uploads[uploadID]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+			return
+		}
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		if partNumber == s.failPart {
+			writeError(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.")
+			return
+		}
+		parts[partNumber] = body
+		w.Header().Set("ETag", etag(body))
+
+	case r.Method == "POST" && uploadID != "":
+		parts, ok := s.uploads[uploadID]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+			return
+		}
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+			return
+		}
+		sort.Slice(complete.Parts, func(i, j int) bool {
+			return complete.Parts[i].PartNumber < complete.Parts[j].PartNumber
+		})
+		var object []byte
+		for _, part := range complete.Parts {
+			data, ok := parts[part.PartNumber]
+			if !ok || etag(data) != part.ETag {
+				writeError(w, http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found.")
+				return
+			}
+			object = append(object, data...)
+		}
+		s.objects[path] = object
+		delete(s.uploads, uploadID)
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Key>%s</Key></CompleteMultipartUploadResult>`, path)
+
+	case r.Method == "DELETE" && uploadID != "":
+		delete(s.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "A header you provided implies functionality that is not implemented.")
+	}
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<Error><Code>%s</Code><Message>%s</Message></Error>`, code, message)
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/alphagov/paas-compose-broker/config"
+)
+
+// Server serves the broker over HTTP, or HTTPS when a certificate is
+// configured. When it receives a signal it stops accepting connections and
+// waits up to the shutdown timeout for requests in flight to complete, so
+// that a restart does not cut a Provision off half way through. Requests
+// still in flight after the timeout have their connections closed, which
+// cancels their contexts and so their Compose calls, other than those which
+// change something and have started.
+type Server struct {
+	server          *http.Server
+	tlsConfig       *tls.Config
+	shutdownTimeout time.Duration
+	logger          lager.Logger
+
+	inFlight  int64
+	completed int64
+}
+
+func New(cfg *config.Config, handler http.Handler, logger lager.Logger) (*Server, error) {
+	s := &Server{
+		shutdownTimeout: cfg.ShutdownTimeout,
+		logger:          logger.Session("http-server"),
+	}
+	s.server = &http.Server{
+		Addr:         ":" + cfg.ListenPort,
+		Handler:      s.track(handler),
+		ReadTimeout:  cfg.HTTPReadTimeout,
+		WriteTimeout: cfg.HTTPWriteTimeout,
+		IdleTimeout:  cfg.HTTPIdleTimeout,
+	}
+
+	if cfg.TLSCertificate != "" {
+		certificate, err := tls.X509KeyPair([]byte(cfg.TLSCertificate), []byte(cfg.TLSPrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("could not load TLS certificate: %s", err)
+		}
+		s.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
+	return s, nil
+}
+
+func (s *Server) track(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&s.inFlight, 1)
+		defer func() {
+			atomic.AddInt64(&s.inFlight, -1)
+			atomic.AddInt64(&s.completed, 1)
+		}()
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// ListenAndServe listens on the configured port and serves until a signal is
+// received or the server fails.
+func (s *Server) ListenAndServe(signals <-chan os.Signal) error {
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener, signals)
+}
+
+func (s *Server) Serve(listener net.Listener, signals <-chan os.Signal) error {
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+	s.logger.Info("listening", lager.Data{"address": listener.Addr().String(), "tls": s.tlsConfig != nil})
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.server.Serve(listener)
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case signal := <-signals:
+		return s.shutdown(signal)
+	}
+}
+
+func (s *Server) shutdown(signal os.Signal) error {
+	start := time.Now()
+	inFlight := atomic.LoadInt64(&s.inFlight)
+	completed := atomic.LoadInt64(&s.completed)
+	s.logger.Info("shutting-down", lager.Data{
+		"signal":    signal.String(),
+		"in-flight": inFlight,
+		"timeout":   s.shutdownTimeout.String(),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+	err := s.server.Shutdown(ctx)
+	if err != nil {
+		// Closing the connections cancels the contexts of the requests
+		// left, which abandons their Compose calls.
+		s.server.Close()
+	}
+
+	summary := lager.Data{
+		"duration":  time.Since(start).String(),
+		"drained":   atomic.LoadInt64(&s.completed) - completed,
+		"abandoned": atomic.LoadInt64(&s.inFlight),
+	}
+	if err != nil {
+		s.logger.Error("shutdown-incomplete", err, summary)
+		return fmt.Errorf("abandoned requests in flight after %s", s.shutdownTimeout)
+	}
+	s.logger.Info("shutdown-complete", summary)
+	return nil
+}
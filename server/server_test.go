@@ -0,0 +1,171 @@
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/paas-compose-broker/config"
+	"github.com/alphagov/paas-compose-broker/server"
+)
+
+var _ = Describe("Server", func() {
+
+	var (
+		cfg      *config.Config
+		handler  http.HandlerFunc
+		listener net.Listener
+		signals  chan os.Signal
+		served   chan error
+		started  chan struct{}
+		release  chan struct{}
+	)
+
+	BeforeEach(func() {
+		cfg = &config.Config{
+			HTTPReadTimeout:  time.Second,
+			HTTPWriteTimeout: time.Second,
+			HTTPIdleTimeout:  time.Second,
+			ShutdownTimeout:  time.Second,
+		}
+		started = make(chan struct{}, 1)
+		release = make(chan struct{})
+		startedCh, releaseCh := started, release
+		handler = func(w http.ResponseWriter, req *http.Request) {
+			startedCh <- struct{}{}
+			select {
+			case <-releaseCh:
+				w.WriteHeader(http.StatusCreated)
+			case <-req.Context().Done():
+			}
+		}
+		signals = make(chan os.Signal, 1)
+		served = make(chan error, 1)
+
+		var err error
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		listener.Close()
+	})
+
+	serve := func() {
+		s, err := server.New(cfg, handler, lager.NewLogger("test"))
+		Expect(err).NotTo(HaveOccurred())
+		go func() {
+			served <- s.Serve(listener, signals)
+		}()
+	}
+
+	getPath := func(client *http.Client, scheme, path string) <-chan *http.Response {
+		responses := make(chan *http.Response, 1)
+		go func() {
+			defer GinkgoRecover()
+			resp, err := client.Get(scheme + "://" + listener.Addr().String() + path)
+			if err != nil {
+				responses <- nil
+				return
+			}
+			resp.Body.Close()
+			responses <- resp
+		}()
+		return responses
+	}
+
+	get := func(client *http.Client, scheme string) <-chan *http.Response {
+		return getPath(client, scheme, "/")
+	}
+
+	It("drains requests in flight when signalled", func() {
+		serve()
+		responses := get(http.DefaultClient, "http")
+		Eventually(started).Should(Receive())
+
+		signals <- syscall.SIGTERM
+		Eventually(func() error {
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}).Should(HaveOccurred())
+		Consistently(served, 100*time.Millisecond).ShouldNot(Receive())
+
+		close(release)
+		var resp *http.Response
+		Eventually(responses).Should(Receive(&resp))
+		Expect(resp).NotTo(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		Eventually(served).Should(Receive(BeNil()))
+	})
+
+	It("abandons requests still in flight after the shutdown timeout", func() {
+		cfg.ShutdownTimeout = 50 * time.Millisecond
+		serve()
+		responses := getPath(http.DefaultClient, "http", "/v2/service_instances/instance")
+		Eventually(started).Should(Receive())
+
+		signals <- syscall.SIGTERM
+		Eventually(served).Should(Receive(MatchError("abandoned requests in flight after 50ms")))
+		Eventually(responses).Should(Receive(BeNil()))
+	})
+
+	It("serves HTTPS when a certificate is configured", func() {
+		cfg.TLSCertificate, cfg.TLSPrivateKey = generateCertificate()
+		close(release)
+		serve()
+
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+		var resp *http.Response
+		Eventually(get(client, "https")).Should(Receive(&resp))
+		Expect(resp).NotTo(BeNil())
+		Expect(resp.TLS).NotTo(BeNil())
+
+		signals <- syscall.SIGTERM
+		Eventually(served).Should(Receive(BeNil()))
+	})
+
+	It("refuses an invalid certificate", func() {
+		cfg.TLSCertificate, cfg.TLSPrivateKey = "not a certificate", "not a key"
+		_, err := server.New(cfg, handler, lager.NewLogger("test"))
+		Expect(err).To(MatchError(ContainSubstring("could not load TLS certificate")))
+	})
+})
+
+func generateCertificate() (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return string(certificate), string(privateKey)
+}
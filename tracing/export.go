@@ -0,0 +1,145 @@
+package tracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+type zipkinEndpoint struct {
+	ServiceName string `json:"serviceName"`
+}
+
+type zipkinSpan struct {
+	TraceID       string            `json:"traceId"`
+	ID            string            `json:"id"`
+	ParentID      string            `json:"parentId,omitempty"`
+	Name          string            `json:"name"`
+	Kind          string            `json:"kind,omitempty"`
+	Timestamp     int64             `json:"timestamp"`
+	Duration      int64             `json:"duration"`
+	LocalEndpoint zipkinEndpoint    `json:"localEndpoint"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+// encodeZipkin encodes spans as a Zipkin v2 JSON list.
+func encodeZipkin(service string, spans []*Span) ([]byte, error) {
+	encoded := []zipkinSpan{}
+	for _, span := range spans {
+		tags := span.tags()
+		if span.Error != "" {
+			tags["error"] = span.Error
+		}
+		encoded = append(encoded, zipkinSpan{
+			TraceID:       span.TraceID,
+			ID:            span.ID,
+			ParentID:      span.ParentID,
+			Name:          span.Name,
+			Kind:          span.Kind,
+			Timestamp:     span.Start.UnixNano() / 1000,
+			Duration:      int64(span.Duration) / 1000,
+			LocalEndpoint: zipkinEndpoint{ServiceName: service},
+			Tags:          tags,
+		})
+	}
+	return json.Marshal(encoded)
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// OTLP span kinds and status codes.
+var otlpKinds = map[string]int{KindInternal: 1, KindServer: 2, KindClient: 3}
+
+const otlpStatusError = 2
+
+// encodeOTLP encodes spans as an OTLP/HTTP JSON export request.
+func encodeOTLP(service string, spans []*Span) ([]byte, error) {
+	encoded := []otlpSpan{}
+	for _, span := range spans {
+		tags := span.tags()
+		keys := []string{}
+		for key := range tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		attributes := []otlpAttribute{}
+		for _, key := range keys {
+			attributes = append(attributes, otlpAttribute{Key: key, Value: otlpValue{StringValue: tags[key]}})
+		}
+
+		status := otlpStatus{}
+		if span.Error != "" {
+			status = otlpStatus{Code: otlpStatusError, Message: span.Error}
+		}
+		start := span.Start.UnixNano()
+		encoded = append(encoded, otlpSpan{
+			TraceID:           span.TraceID,
+			SpanID:            span.ID,
+			ParentSpanID:      span.ParentID,
+			Name:              span.Name,
+			Kind:              otlpKinds[span.Kind],
+			StartTimeUnixNano: fmt.Sprint(start),
+			EndTimeUnixNano:   fmt.Sprint(start + int64(span.Duration)),
+			Attributes:        attributes,
+			Status:            status,
+		})
+	}
+
+	return json.Marshal(otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: []otlpAttribute{
+				{Key: "service.name", Value: otlpValue{StringValue: service}},
+			}},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/alphagov/paas-compose-broker/tracing"},
+				Spans: encoded,
+			}},
+		}},
+	})
+}
@@ -0,0 +1,236 @@
+package tracing
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// Export formats.
+const (
+	FormatZipkin = "zipkin"
+	FormatOTLP   = "otlp"
+)
+
+const (
+	// DefaultFlushInterval is how often finished spans are exported.
+	DefaultFlushInterval = 5 * time.Second
+	maxQueuedSpans       = 1000
+	batchSize            = 100
+)
+
+// Tracer starts request spans and exports finished spans to URL in Format.
+// Spans are exported in batches by Run; when the collector cannot keep up,
+// spans are dropped rather than held.
+type Tracer struct {
+	Service    string
+	URL        string
+	Format     string
+	HTTPClient *http.Client
+	Logger     lager.Logger
+
+	mu      sync.Mutex
+	spans   []*Span
+	dropped int
+}
+
+// NewTracer returns a tracer exporting spans for service to url.
+func NewTracer(service, url, format string, logger lager.Logger) *Tracer {
+	return &Tracer{
+		Service: service,
+		URL:     url,
+		Format:  format,
+		Logger:  logger,
+	}
+}
+
+func (t *Tracer) newSpan(traceID, parentID, name, kind string, tags map[string]string) *Span {
+	span := &Span{
+		tracer:   t,
+		TraceID:  traceID,
+		ID:       randomID(8),
+		ParentID: parentID,
+		Name:     name,
+		Kind:     kind,
+		Start:    time.Now(),
+		Tags:     map[string]string{},
+	}
+	for key, value := range tags {
+		span.Tags[key] = value
+	}
+	return span
+}
+
+func (t *Tracer) queue(span *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.spans) >= maxQueuedSpans {
+		t.dropped++
+		return
+	}
+	t.spans = append(t.spans, span)
+}
+
+// Run exports finished spans every interval until stop is closed, then
+// exports the rest.
+func (t *Tracer) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			t.flushLogged()
+			return
+		case <-ticker.C:
+			t.flushLogged()
+		}
+	}
+}
+
+func (t *Tracer) flushLogged() {
+	if err := t.Flush(); err != nil {
+		t.Logger.Error("export-spans", err)
+	}
+}
+
+// Flush exports the finished spans. Spans which cannot be exported are
+// dropped.
+func (t *Tracer) Flush() error {
+	t.mu.Lock()
+	spans := t.spans
+	dropped := t.dropped
+	t.spans = nil
+	t.dropped = 0
+	t.mu.Unlock()
+
+	if dropped > 0 {
+		t.Logger.Info("spans-dropped", lager.Data{"spans": dropped})
+	}
+	for len(spans) > 0 {
+		n := batchSize
+		if n > len(spans) {
+			n = len(spans)
+		}
+		if err := t.post(spans[:n]); err != nil {
+			return fmt.Errorf("%s (dropped %d spans)", err, len(spans))
+		}
+		spans = spans[n:]
+	}
+	return nil
+}
+
+func (t *Tracer) post(spans []*Span) error {
+	var body []byte
+	var err error
+	if t.Format == FormatOTLP {
+		body, err = encodeOTLP(t.Service, spans)
+	} else {
+		body, err = encodeZipkin(t.Service, spans)
+	}
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", t.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	httpClient := t.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if urlErr, ok := err.(*url.Error); ok {
+		// The URL may have credentials in it.
+		err = urlErr.Err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to export spans: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("failed to export spans: %s", resp.Status)
+	}
+	return nil
+}
+
+// Middleware wraps each request in a server span, continuing the trace
+// given in the request's W3C traceparent or B3 headers if there is one.
+func (t *Tracer) Middleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		traceID, parentID := incomingTrace(req.Header)
+		if traceID == "" {
+			traceID = randomID(16)
+		}
+		span := t.newSpan(traceID, parentID, req.Method+" "+Route(req.URL.Path), KindServer, map[string]string{
+			"http.method": req.Method,
+			"http.path":   req.URL.Path,
+		})
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(recorder, req.WithContext(NewContext(req.Context(), span)))
+
+		span.SetTag("http.status_code", fmt.Sprint(recorder.status))
+		var err error
+		if recorder.status >= 500 {
+			err = fmt.Errorf("%d %s", recorder.status, http.StatusText(recorder.status))
+		}
+		span.Finish(err)
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+var (
+	traceparentPattern = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+	b3TraceIDPattern   = regexp.MustCompile(`^([0-9a-f]{16}|[0-9a-f]{32})$`)
+	b3SpanIDPattern    = regexp.MustCompile(`^[0-9a-f]{16}$`)
+)
+
+func incomingTrace(header http.Header) (traceID, parentID string) {
+	if match := traceparentPattern.FindStringSubmatch(strings.ToLower(header.Get("Traceparent"))); match != nil {
+		return match[1], match[2]
+	}
+	traceID = strings.ToLower(header.Get("X-B3-Traceid"))
+	parentID = strings.ToLower(header.Get("X-B3-Spanid"))
+	if b3TraceIDPattern.MatchString(traceID) && b3SpanIDPattern.MatchString(parentID) {
+		// OTLP needs 128-bit trace IDs.
+		if len(traceID) == 16 {
+			traceID = strings.Repeat("0", 16) + traceID
+		}
+		return traceID, parentID
+	}
+	return "", ""
+}
+
+var guidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// Route names a service broker API path without its GUIDs, such as
+// /v2/service_instances/:id/service_bindings/:id, so that spans of the same
+// operation share a name.
+func Route(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if guidPattern.MatchString(segment) || (i > 0 && (segments[i-1] == "service_instances" || segments[i-1] == "service_bindings")) {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,170 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/paas-compose-broker/tracing"
+)
+
+var _ = Describe("Tracer", func() {
+	var (
+		collector *httptest.Server
+		posted    []string
+		status    int
+	)
+
+	// serve handles a request to the broker with tracer, making a Compose
+	// call and a database call within it.
+	serve := func(tracer *tracing.Tracer, req *http.Request) {
+		handler := tracer.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, span := tracing.StartSpan(r.Context(), "compose.GetDeploymentByName", tracing.KindClient, nil)
+			span.Finish(nil)
+			ctx, span := tracing.StartSpan(r.Context(), "mongodb.connect", tracing.KindClient, map[string]string{"db.system": "mongodb"})
+			_, child := tracing.StartSpan(ctx, "mongodb.tls-dial", tracing.KindClient, nil)
+			child.Finish(errors.New("handshake failed"))
+			span.Finish(nil)
+			w.WriteHeader(http.StatusCreated)
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	BeforeEach(func() {
+		posted = nil
+		status = http.StatusAccepted
+		collector = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.Header.Get("Content-Type")).To(Equal("application/json"))
+			body, _ := ioutil.ReadAll(r.Body)
+			posted = append(posted, string(body))
+			w.WriteHeader(status)
+		}))
+	})
+
+	AfterEach(func() {
+		collector.Close()
+	})
+
+	It("does nothing outside a traced request", func() {
+		ctx, span := tracing.StartSpan(context.Background(), "compose.GetAccount", tracing.KindClient, nil)
+		Expect(span).To(BeNil())
+		Expect(tracing.FromContext(ctx)).To(BeNil())
+		span.SetTag("key", "value")
+		span.Finish(errors.New("ignored"))
+	})
+
+	It("exports a request's spans, nested, as Zipkin JSON", func() {
+		tracer := tracing.NewTracer("compose-broker", collector.URL, tracing.FormatZipkin, lagertest.NewTestLogger("tracing"))
+		serve(tracer, httptest.NewRequest("PUT", "/v2/service_instances/instance-1/service_bindings/binding-1", nil))
+		Expect(tracer.Flush()).To(Succeed())
+
+		Expect(posted).To(HaveLen(1))
+		var spans []struct {
+			TraceID       string            `json:"traceId"`
+			ID            string            `json:"id"`
+			ParentID      string            `json:"parentId"`
+			Name          string            `json:"name"`
+			Kind          string            `json:"kind"`
+			LocalEndpoint map[string]string `json:"localEndpoint"`
+			Tags          map[string]string `json:"tags"`
+		}
+		Expect(json.Unmarshal([]byte(posted[0]), &spans)).To(Succeed())
+		Expect(spans).To(HaveLen(4))
+		getDeployment, tlsDial, connect, request := spans[0], spans[1], spans[2], spans[3]
+
+		Expect(request.Name).To(Equal("PUT /v2/service_instances/:id/service_bindings/:id"))
+		Expect(request.Kind).To(Equal("SERVER"))
+		Expect(request.ParentID).To(BeEmpty())
+		Expect(request.TraceID).To(HaveLen(32))
+		Expect(request.Tags).To(HaveKeyWithValue("http.status_code", "201"))
+		Expect(request.LocalEndpoint).To(HaveKeyWithValue("serviceName", "compose-broker"))
+
+		Expect(getDeployment.Name).To(Equal("compose.GetDeploymentByName"))
+		Expect(getDeployment.Kind).To(Equal("CLIENT"))
+		Expect(getDeployment.ParentID).To(Equal(request.ID))
+		Expect(connect.ParentID).To(Equal(request.ID))
+		Expect(connect.Tags).To(HaveKeyWithValue("db.system", "mongodb"))
+		Expect(tlsDial.ParentID).To(Equal(connect.ID))
+		Expect(tlsDial.Tags).To(HaveKeyWithValue("error", "handshake failed"))
+		for _, span := range spans {
+			Expect(span.TraceID).To(Equal(request.TraceID))
+		}
+
+		Expect(tracer.Flush()).To(Succeed())
+		Expect(posted).To(HaveLen(1))
+	})
+
+	It("exports spans as OTLP JSON", func() {
+		tracer := tracing.NewTracer("compose-broker", collector.URL, tracing.FormatOTLP, lagertest.NewTestLogger("tracing"))
+		serve(tracer, httptest.NewRequest("GET", "/v2/catalog", nil))
+		Expect(tracer.Flush()).To(Succeed())
+
+		Expect(posted).To(HaveLen(1))
+		var request struct {
+			ResourceSpans []struct {
+				Resource struct {
+					Attributes []map[string]interface{} `json:"attributes"`
+				} `json:"resource"`
+				ScopeSpans []struct {
+					Spans []struct {
+						Name              string `json:"name"`
+						Kind              int    `json:"kind"`
+						StartTimeUnixNano string `json:"startTimeUnixNano"`
+						Status            struct {
+							Code    int    `json:"code"`
+							Message string `json:"message"`
+						} `json:"status"`
+					} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		Expect(json.Unmarshal([]byte(posted[0]), &request)).To(Succeed())
+		Expect(request.ResourceSpans[0].Resource.Attributes[0]).To(HaveKeyWithValue("key", "service.name"))
+		spans := request.ResourceSpans[0].ScopeSpans[0].Spans
+		Expect(spans).To(HaveLen(4))
+		Expect(spans[1].Name).To(Equal("mongodb.tls-dial"))
+		Expect(spans[1].Kind).To(Equal(3))
+		Expect(spans[1].Status.Code).To(Equal(2))
+		Expect(spans[1].Status.Message).To(Equal("handshake failed"))
+		Expect(spans[3].Name).To(Equal("GET /v2/catalog"))
+		Expect(spans[3].Kind).To(Equal(2))
+		Expect(spans[3].StartTimeUnixNano).To(MatchRegexp(`^\d+$`))
+	})
+
+	It("continues a trace from W3C or B3 headers", func() {
+		tracer := tracing.NewTracer("compose-broker", collector.URL, tracing.FormatZipkin, lagertest.NewTestLogger("tracing"))
+
+		req := httptest.NewRequest("GET", "/v2/catalog", nil)
+		req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		serve(tracer, req)
+		req = httptest.NewRequest("GET", "/v2/catalog", nil)
+		req.Header.Set("X-B3-TraceId", "463ac35c9f6413ad")
+		req.Header.Set("X-B3-SpanId", "a2fb4a1d1a96d312")
+		serve(tracer, req)
+		Expect(tracer.Flush()).To(Succeed())
+
+		var spans []map[string]interface{}
+		Expect(json.Unmarshal([]byte(posted[0]), &spans)).To(Succeed())
+		Expect(spans[3]).To(HaveKeyWithValue("traceId", "4bf92f3577b34da6a3ce929d0e0e4736"))
+		Expect(spans[3]).To(HaveKeyWithValue("parentId", "00f067aa0ba902b7"))
+		Expect(spans[7]).To(HaveKeyWithValue("traceId", "0000000000000000463ac35c9f6413ad"))
+		Expect(spans[7]).To(HaveKeyWithValue("parentId", "a2fb4a1d1a96d312"))
+	})
+
+	It("drops spans the collector rejects", func() {
+		status = http.StatusServiceUnavailable
+		tracer := tracing.NewTracer("compose-broker", collector.URL, tracing.FormatZipkin, lagertest.NewTestLogger("tracing"))
+		serve(tracer, httptest.NewRequest("GET", "/v2/catalog", nil))
+
+		Expect(tracer.Flush()).To(MatchError("failed to export spans: 503 Service Unavailable (dropped 4 spans)"))
+		Expect(tracer.Flush()).To(Succeed())
+		Expect(posted).To(HaveLen(1))
+	})
+})
@@ -0,0 +1,107 @@
+// Package tracing records spans for service broker API requests and the
+// Compose and database calls made while handling them, and exports them to
+// a collector as Zipkin or OTLP JSON.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Span kinds.
+const (
+	KindServer   = "SERVER"
+	KindClient   = "CLIENT"
+	KindInternal = ""
+)
+
+// Span is a timed step of a request. Methods on a nil span do nothing, so
+// code can trace whether or not the request is being traced.
+type Span struct {
+	tracer *Tracer
+
+	TraceID  string
+	ID       string
+	ParentID string
+	Name     string
+	Kind     string
+	Start    time.Time
+	Duration time.Duration
+	Error    string
+
+	mu   sync.Mutex
+	Tags map[string]string
+}
+
+type spanKey struct{}
+
+// FromContext returns the span of ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// NewContext returns a context carrying span, which later spans are started
+// under.
+func NewContext(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// StartSpan starts a span under the span of ctx, and returns a context
+// carrying it. If ctx has no span, as outside a traced request, it returns
+// ctx and a nil span.
+func StartSpan(ctx context.Context, name, kind string, tags map[string]string) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := parent.tracer.newSpan(parent.TraceID, parent.ID, name, kind, tags)
+	return NewContext(ctx, span), span
+}
+
+// SetTag sets a tag on the span.
+func (s *Span) SetTag(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Tags[key] = value
+}
+
+// Finish ends the span, marking it as failed if err is not nil, and queues
+// it for export.
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Duration = time.Since(s.Start)
+	if err != nil {
+		s.Error = err.Error()
+	}
+	s.mu.Unlock()
+	s.tracer.queue(s)
+}
+
+// tags returns a copy of the span's tags.
+func (s *Span) tags() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tags := map[string]string{}
+	for key, value := range s.Tags {
+		tags[key] = value
+	}
+	return tags
+}
+
+func randomID(bytes int) string {
+	id := make([]byte, bytes)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}